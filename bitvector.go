@@ -10,6 +10,13 @@
 
 package chd
 
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
 // bitVector represents a bit vector in an efficient manner
 type bitVector struct {
 	v []uint64
@@ -74,3 +81,132 @@ func (b *bitVector) Merge(x *bitVector) *bitVector {
 	}
 	return b
 }
+
+// Count returns the number of set bits
+func (b *bitVector) Count() uint64 {
+	var n int
+	for _, w := range b.v {
+		n += bits.OnesCount64(w)
+	}
+	return uint64(n)
+}
+
+// NextSet returns the first set bit at or after bit 'i'; it returns false if
+// there are none.
+func (b *bitVector) NextSet(i uint64) (uint64, bool) {
+	j := i / 64
+	if j >= uint64(len(b.v)) {
+		return 0, false
+	}
+
+	// ignore the bits before 'i' in the first word
+	w := b.v[j] >> (i % 64) << (i % 64)
+	for {
+		if w != 0 {
+			return j*64 + uint64(bits.TrailingZeros64(w)), true
+		}
+
+		j++
+		if j >= uint64(len(b.v)) {
+			return 0, false
+		}
+		w = b.v[j]
+	}
+}
+
+// MarshalBinary writes the bitvector to 'w' as a little-endian uint64 word
+// count followed by the little-endian words. It returns the number of bytes
+// written.
+func (b *bitVector) MarshalBinary(w io.Writer) (int, error) {
+	buf := make([]byte, 8*(len(b.v)+1))
+	le := binary.LittleEndian
+
+	le.PutUint64(buf, uint64(len(b.v)))
+	for i, x := range b.v {
+		le.PutUint64(buf[8*(i+1):], x)
+	}
+	return writeAll(w, buf)
+}
+
+// UnmarshalBinary reads a bitvector written by MarshalBinary() from 'buf'
+// and returns the number of bytes consumed.
+func (b *bitVector) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8 {
+		return 0, fmt.Errorf("bitvector: buffer too small")
+	}
+
+	le := binary.LittleEndian
+	n := le.Uint64(buf)
+	if n > uint64(len(buf)-8)/8 {
+		return 0, fmt.Errorf("bitvector: buffer too small for %d words", n)
+	}
+
+	v := make([]uint64, n)
+	for i := range v {
+		v[i] = le.Uint64(buf[8*(i+1):])
+	}
+	b.v = v
+	return int(8 * (n + 1)), nil
+}
+
+// BitVector is a fixed size set of bits; it is the public face of the
+// bitvector used internally for occupancy maps.
+type BitVector struct {
+	bv bitVector
+}
+
+// NewBitVector returns a bitvector that holds at least 'size' bits
+func NewBitVector(size uint64) *BitVector {
+	return &BitVector{*newBitVector(size)}
+}
+
+// Size returns the number of bits in the bitvector (a multiple of 64)
+func (b *BitVector) Size() uint64 {
+	return b.bv.Size()
+}
+
+// Set sets bit 'i'
+func (b *BitVector) Set(i uint64) {
+	b.bv.Set(i)
+}
+
+// Clear clears bit 'i'
+func (b *BitVector) Clear(i uint64) {
+	b.bv.Clear(i)
+}
+
+// IsSet returns true if bit 'i' is set
+func (b *BitVector) IsSet(i uint64) bool {
+	return b.bv.IsSet(i)
+}
+
+// Reset clears all the bits
+func (b *BitVector) Reset() {
+	b.bv.Reset()
+}
+
+// Count returns the number of set bits
+func (b *BitVector) Count() uint64 {
+	return b.bv.Count()
+}
+
+// NextSet returns the first set bit at or after bit 'i'; it returns false if
+// there are none. All the set bits can be visited with:
+//
+//	for i, ok := b.NextSet(0); ok; i, ok = b.NextSet(i + 1) {
+//		...
+//	}
+func (b *BitVector) NextSet(i uint64) (uint64, bool) {
+	return b.bv.NextSet(i)
+}
+
+// MarshalBinary writes the bitvector to 'w'; see UnmarshalBinary()
+func (b *BitVector) MarshalBinary(w io.Writer) (int, error) {
+	return b.bv.MarshalBinary(w)
+}
+
+// UnmarshalBinary restores a bitvector written by MarshalBinary() from
+// 'buf' and returns the number of bytes consumed.
+func (b *BitVector) UnmarshalBinary(buf []byte) (int, error) {
+	return b.bv.UnmarshalBinary(buf)
+}
@@ -11,6 +11,7 @@
 package chd
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -57,3 +58,60 @@ func TestBitVectorMerge(t *testing.T) {
 	}
 
 }
+
+func TestBitVectorCount(t *testing.T) {
+	assert := newAsserter(t)
+
+	bv := newBitVector(1000)
+	assert(bv.Count() == 0, "empty bitvector has %d bits", bv.Count())
+
+	set := []uint64{0, 1, 63, 64, 200, 511, 512, 999}
+	for _, i := range set {
+		bv.Set(i)
+	}
+	assert(bv.Count() == uint64(len(set)), "exp %d bits, saw %d", len(set), bv.Count())
+
+	var seen []uint64
+	for i, ok := bv.NextSet(0); ok; i, ok = bv.NextSet(i + 1) {
+		seen = append(seen, i)
+	}
+	assert(len(seen) == len(set), "nextset: exp %v, saw %v", set, seen)
+	for i := range set {
+		assert(seen[i] == set[i], "nextset: exp %v, saw %v", set, seen)
+	}
+
+	j, ok := bv.NextSet(65)
+	assert(ok && j == 200, "nextset(65): exp 200, saw %d", j)
+	_, ok = bv.NextSet(1000)
+	assert(!ok, "nextset past the last bit")
+	_, ok = bv.NextSet(1 << 20)
+	assert(!ok, "nextset past the end")
+}
+
+func TestBitVectorMarshal(t *testing.T) {
+	assert := newAsserter(t)
+
+	bv := NewBitVector(300)
+	for i := uint64(0); i < 300; i += 7 {
+		bv.Set(i)
+	}
+
+	var buf bytes.Buffer
+	n, err := bv.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(n == buf.Len(), "marshal: exp %d bytes, saw %d", buf.Len(), n)
+
+	var b2 BitVector
+	m, err := b2.UnmarshalBinary(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(m == n, "unmarshal: consumed %d of %d bytes", m, n)
+	assert(b2.Size() == bv.Size(), "size mismatch: exp %d, saw %d", bv.Size(), b2.Size())
+	assert(b2.Count() == bv.Count(), "count mismatch: exp %d, saw %d", bv.Count(), b2.Count())
+
+	for i := uint64(0); i < bv.Size(); i++ {
+		assert(b2.IsSet(i) == bv.IsSet(i), "bit %d mismatch", i)
+	}
+
+	_, err = b2.UnmarshalBinary(buf.Bytes()[:n-1])
+	assert(err != nil, "truncated buffer accepted")
+}
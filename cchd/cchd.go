@@ -0,0 +1,133 @@
+// cchd.go -- C ABI for reading CHD DBs from non-Go programs
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// cchd exports a minimal C ABI to open, query and close DBs built by
+// chdb.DBWriter. Build it as a shared library:
+//
+//	go build -buildmode=c-shared -o libchd.so ./cchd
+//
+// This generates libchd.so and libchd.h; the latter has the prototypes of:
+//
+//	int64_t chd_open(char *fn, int cache);
+//	int     chd_lookup(int64_t db, uint64_t key, void *buf, size_t bufsz, size_t *vlen);
+//	int     chd_len(int64_t db);
+//	void    chd_close(int64_t db);
+//
+// chd_open returns a positive handle or -1 on failure. chd_lookup returns
+// CHD_OK and copies the value into 'buf'; if 'buf' is too small, it returns
+// CHD_ESMALL - in both cases '*vlen' is the size of the value. It returns
+// CHD_ENOKEY if the key is absent and CHD_EIO on all other errors.
+package main
+
+/*
+#include <stdint.h>
+#include <stddef.h>
+#include <string.h>
+
+enum {
+	CHD_OK     = 0,
+	CHD_ENOKEY = 1,
+	CHD_ESMALL = 2,
+	CHD_EIO    = -1,
+};
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// Go pointers can't be handed to C; so, we hand out integer handles.
+var dbs = struct {
+	sync.Mutex
+	m    map[int64]*chdb.DBReader
+	next int64
+}{
+	m: make(map[int64]*chdb.DBReader),
+}
+
+func getDB(h C.int64_t) *chdb.DBReader {
+	dbs.Lock()
+	defer dbs.Unlock()
+	return dbs.m[int64(h)]
+}
+
+//export chd_open
+func chd_open(fn *C.char, cache C.int) C.int64_t {
+	rd, err := chdb.NewDBReader(C.GoString(fn), int(cache))
+	if err != nil {
+		return -1
+	}
+
+	dbs.Lock()
+	dbs.next++
+	h := dbs.next
+	dbs.m[h] = rd
+	dbs.Unlock()
+
+	return C.int64_t(h)
+}
+
+//export chd_lookup
+func chd_lookup(h C.int64_t, key C.uint64_t, buf unsafe.Pointer, bufsz C.size_t, vlen *C.size_t) C.int {
+	rd := getDB(h)
+	if rd == nil {
+		return C.CHD_EIO
+	}
+
+	v, err := rd.Find(uint64(key))
+	switch err {
+	case nil:
+	case chdb.ErrNoKey:
+		return C.CHD_ENOKEY
+	default:
+		return C.CHD_EIO
+	}
+
+	if vlen != nil {
+		*vlen = C.size_t(len(v))
+	}
+
+	if len(v) > int(bufsz) {
+		return C.CHD_ESMALL
+	}
+
+	if len(v) > 0 {
+		C.memcpy(buf, unsafe.Pointer(&v[0]), C.size_t(len(v)))
+	}
+	return C.CHD_OK
+}
+
+//export chd_len
+func chd_len(h C.int64_t) C.int {
+	rd := getDB(h)
+	if rd == nil {
+		return -1
+	}
+	return C.int(rd.Len())
+}
+
+//export chd_close
+func chd_close(h C.int64_t) {
+	dbs.Lock()
+	rd := dbs.m[int64(h)]
+	delete(dbs.m, int64(h))
+	dbs.Unlock()
+
+	if rd != nil {
+		rd.Close()
+	}
+}
+
+// required by -buildmode=c-shared
+func main() {}
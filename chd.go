@@ -11,21 +11,19 @@
 // a given set of keys. This is an implementation of CHD in
 // http://cmph.sourceforge.net/papers/esa09.pdf -
 //
-// Additionally, DBWriter enables creating a fast, constant-time DB for read-only workloads.
-// It serializes the key,value pairs and builds a CHD minimal perfect hash function over the
-// given keys. The serialized DB can be read back via DBReader for constant time lookups
-// of the MPH DB.
+// Package chd only depends on the standard library. The constant-time DB built
+// on top of it (DBWriter, DBReader) is in package github.com/opencoff/go-chd/chdb.
 package chd
 
 import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"sort"
+	"math/bits"
 )
 
 const (
-	// number of times we will try to build the table
+	// default largest seed tried for each bucket
 	_MaxSeed uint32 = 65536 * 2
 )
 
@@ -33,6 +31,31 @@ const (
 type ChdBuilder struct {
 	data map[uint64]bool
 	salt uint64
+
+	// number of duplicate keys seen so far
+	dups uint64
+
+	// optional callback for each duplicate key
+	dupfp func(key uint64)
+
+	// forced and maximum size of the seeds in bytes; 0 if unconstrained
+	seedsz byte
+	maxsz  byte
+
+	// largest seed tried for each bucket; 0 for the default
+	maxseed uint32
+
+	// size of the key fingerprints in bits; 0 if disabled
+	fpbits int
+
+	// max number of keys in a shard of a multi-level table; 0 if disabled
+	shardsz uint64
+
+	// set once Freeze() succeeds; the key set can't change after that
+	frozen bool
+
+	// scratch space reused when Freeze() is retried
+	arena freezeArena
 }
 
 // New enables creation of a minimal perfect hash function via the
@@ -52,107 +75,427 @@ func New() (*ChdBuilder, error) {
 	return c, nil
 }
 
-// Add a new key to the MPH builder
+// Add a new key to the MPH builder. It returns ErrFrozen if the builder is
+// already frozen.
 func (c *ChdBuilder) Add(key uint64) error {
-	if _, ok := c.data[key]; ok {
+	if c.frozen {
+		return ErrFrozen
+	}
+	if !c.AddUnique(key) {
 		return fmt.Errorf("chd: duplicate key %x", key)
 	}
+	return nil
+}
+
+// AddUnique adds a new key to the MPH builder and returns true; duplicate keys
+// are counted, reported to the duplicate callback (if any) and otherwise
+// ignored - in which case it returns false. It also returns false if the
+// builder is already frozen.
+func (c *ChdBuilder) AddUnique(key uint64) bool {
+	if c.frozen {
+		return false
+	}
+
+	if _, ok := c.data[key]; ok {
+		c.dups++
+		if c.dupfp != nil {
+			c.dupfp(key)
+		}
+		return false
+	}
 
 	c.data[key] = true
+	return true
+}
+
+// Duplicates returns the number of duplicate keys seen so far
+func (c *ChdBuilder) Duplicates() uint64 {
+	return c.dups
+}
+
+// OnDuplicate registers a callback that is invoked with every duplicate key
+// passed to Add() or AddUnique(); a nil 'fp' removes the callback.
+func (c *ChdBuilder) OnDuplicate(fp func(key uint64)) {
+	c.dupfp = fp
+}
+
+// SetSeedSize forces every seed of the table to be 'n' bytes wide (1, 2 or
+// 4) - e.g., for readers that only support one width; 0 restores the default
+// of using the smallest width that holds the largest seed. Freeze() fails if
+// the seeds don't fit in 'n' bytes.
+func (c *ChdBuilder) SetSeedSize(n int) error {
+	if !validSeedSize(n) {
+		return fmt.Errorf("chd: invalid seed size %d", n)
+	}
+	c.seedsz = byte(n)
+	return nil
+}
+
+// SetMaxSeedSize makes Freeze() fail if the seeds need more than 'n' bytes
+// (1, 2 or 4); 0 removes the limit.
+func (c *ChdBuilder) SetMaxSeedSize(n int) error {
+	if !validSeedSize(n) {
+		return fmt.Errorf("chd: invalid seed size %d", n)
+	}
+	c.maxsz = byte(n)
 	return nil
 }
 
-type bucket struct {
-	slot uint64
-	keys []uint64
+// SetMaxSeed sets the largest seed Freeze() tries when displacing the keys of
+// a bucket; 0 restores the default of 131072. A smaller limit makes Freeze()
+// fail fast with a *SeedError instead of searching for a long time - the
+// caller can then retry with a lower load factor. The limit also bounds the
+// seed width recorded in the marshaled table: a limit below 256 guarantees 1
+// byte seeds and below 65536, 2 byte seeds.
+func (c *ChdBuilder) SetMaxSeed(n uint32) error {
+	if n >= _RouteSeed {
+		return fmt.Errorf("chd: max seed %#x is reserved", n)
+	}
+	c.maxseed = n
+	return nil
 }
-type buckets []bucket
 
-func (b buckets) Len() int {
-	return len(b)
+// MaxSeed returns the largest seed Freeze() tries for each bucket
+func (c *ChdBuilder) MaxSeed() uint32 {
+	if c.maxseed > 0 {
+		return c.maxseed
+	}
+	return _MaxSeed
 }
 
-func (b buckets) Less(i, j int) bool {
-	return len(b[i].keys) > len(b[j].keys)
+// SetSalt replaces the random salt of the hash table with 'salt'; the same
+// keys with the same salt always produce the same table. This is meant for
+// reproducible builds and test fixtures.
+func (c *ChdBuilder) SetSalt(salt uint64) {
+	c.salt = salt
 }
 
-func (b buckets) Swap(i, j int) {
-	b[i], b[j] = b[j], b[i]
+func validSeedSize(n int) bool {
+	switch n {
+	case 0, 1, 2, 4:
+		return true
+	}
+	return false
+}
+
+// Reset discards all the keys and unfreezes the builder so it can build a
+// table for a new set of keys; the builder picks a new salt. The duplicate
+// callback, the seed size constraints, the fingerprint size and the shard
+// size are retained.
+func (c *ChdBuilder) Reset() {
+	for k := range c.data {
+		delete(c.data, k)
+	}
+	c.salt = rand64()
+	c.dups = 0
+	c.frozen = false
 }
 
 // Freeze builds a constant-time lookup table using the CMD algorithm and
 // the given load factor. Lower load factors speeds up the construction
 // of the MPHF. Suggested value for load is between 0.75-0.9
+// A failed Freeze can be retried (e.g., with a lower load); once it succeeds,
+// the builder is frozen and further calls to Add() or Freeze() return
+// ErrFrozen until Reset().
 func (c *ChdBuilder) Freeze(load float64) (*Chd, error) {
+	if c.frozen {
+		return nil, ErrFrozen
+	}
 	if load < 0 || load > 1 {
 		return nil, fmt.Errorf("chd: invalid load factor %f", load)
 	}
 
-	m := uint64(float64(len(c.data)) / load)
+	var chd *Chd
+	var err error
+
+	n := uint64(len(c.data))
+	if c.shardsz > 0 && n > c.shardsz {
+		chd, err = c.freezeShards(load)
+	} else {
+		chd, err = c.build(&c.arena, n, load, func(fp func(k uint64)) {
+			for key := range c.data {
+				fp(key)
+			}
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the seeds may now belong to the table; a frozen builder has no
+	// further use for the scratch space.
+	c.arena = freezeArena{}
+	c.frozen = true
+	return chd, nil
+}
+
+// build a single level table of the 'n' keys enumerated by 'each' using the
+// scratch space in 'a'; 'each' is called once for every pass over the keys.
+func (c *ChdBuilder) build(a *freezeArena, n uint64, load float64, each func(fp func(k uint64))) (*Chd, error) {
+	m := uint64(float64(n) / load)
 	m = nextpow2(m)
-	buckets := make(buckets, m)
-	seeds := make([]uint32, m)
 
-	for i := range buckets {
-		b := &buckets[i]
-		b.slot = uint64(i)
+	seeds := a.u32s(&a.seeds, m)
+
+	// The keys are laid out bucket by bucket in one array (a counting
+	// sort): the keys of bucket 'j' are keys[start[j]:start[j+1]]. This
+	// avoids a separate allocation for each of the 'm' buckets.
+	start := a.u64s(&a.start, m+1)
+	each(func(key uint64) {
+		start[rhash(0, key, m, c.salt)]++
+	})
+
+	// histogram of bucket sizes
+	var bhist []uint64
+	if m > 0 {
+		var max uint64
+		for _, z := range start[:m] {
+			if z > max {
+				max = z
+			}
+		}
+
+		bhist = make([]uint64, max+1)
+		for _, z := range start[:m] {
+			bhist[z]++
+		}
 	}
 
-	for key, _ := range c.data {
-		j := rhash(0, key, m, c.salt)
-		b := &buckets[j]
-		b.keys = append(b.keys, key)
+	// start[j] is now the end of bucket 'j'; placing the keys moves it
+	// back to the beginning.
+	for j := uint64(1); j < m; j++ {
+		start[j] += start[j-1]
 	}
+	start[m] = n
 
-	occ := newBitVector(m)
-	bOcc := newBitVector(m)
+	keys := a.u64s(&a.keys, n)
+	each(func(key uint64) {
+		j := rhash(0, key, m, c.salt)
+		start[j]--
+		keys[start[j]] = key
+	})
 
-	// sort buckets in decreasing order of occupancy-size
-	sort.Sort(buckets)
+	order := bucketOrder(a, start, bhist)
+	occ := &bitVector{a.u64s(&a.occ, (m+63)/64)}
 
 	tries := 0
+	limit := c.MaxSeed()
 	var maxseed uint32
-	for i := range buckets {
-		b := &buckets[i]
-		for s := uint32(1); s < _MaxSeed; s++ {
-			bOcc.Reset()
-			for _, key := range b.keys {
-				h := rhash(s, key, m, c.salt)
-				if occ.IsSet(h) || bOcc.IsSet(h) {
-					goto nextSeed // try next seed
-				}
-				bOcc.Set(h)
-			}
-			occ.Merge(bOcc)
-			seeds[b.slot] = s
-			if s > maxseed {
-				maxseed = s
-			}
-			goto nextBucket
+	for _, j := range order {
+		bkt := keys[start[j]:start[j+1]]
+		s, n, ok := displace(bkt, m, c.salt, limit, occ, &a.hs)
+		tries += n
+		if !ok {
+			return nil, &SeedError{Bucket: j, Keys: len(bkt), MaxSeed: limit}
+		}
 
-		nextSeed:
-			tries++
+		seeds[j] = s
+		if s > maxseed {
+			maxseed = s
 		}
+	}
 
-		return nil, fmt.Errorf("chd: No MPH after %d tries", _MaxSeed)
-	nextBucket:
+	// empty buckets trivially succeed with the first seed
+	for j := uint64(0); j < m; j++ {
+		if start[j] == start[j+1] {
+			seeds[j] = 1
+		}
+	}
+
+	sz := seedSize(maxseed)
+	if c.maxsz > 0 && sz > c.maxsz {
+		return nil, fmt.Errorf("chd: seeds need %d bytes; limit is %d", sz, c.maxsz)
+	}
+	if c.seedsz > 0 {
+		if sz > c.seedsz {
+			return nil, fmt.Errorf("chd: seeds need %d bytes; can't force %d", sz, c.seedsz)
+		}
+		sz = c.seedsz
 	}
 
 	chd := &Chd{
-		seed:  makeSeeds(seeds, maxseed),
+		seed:  newSeeder(seeds, sz),
 		salt:  c.salt,
 		tries: tries,
+		nkeys: n,
+		bhist: bhist,
+	}
+
+	// 4 byte seeds are used in place; don't reuse them for another table
+	if sz == 4 {
+		a.seeds = nil
 	}
 
+	if c.fpbits > 0 {
+		chd.fp = newFingerprints(c.fpbits, m)
+		each(func(key uint64) {
+			chd.fp.set(chd.Find(key), fphash(key, c.salt))
+		})
+	}
 	return chd, nil
 }
 
+// freezeArena holds the scratch space of Freeze(); a failed Freeze() leaves
+// it behind so that a retry (e.g., with a lower load) doesn't have to
+// allocate it all over again.
+type freezeArena struct {
+	seeds []uint32
+	start []uint64
+	keys  []uint64
+	order []uint64
+	pos   []uint64
+	occ   []uint64
+	hs    []uint64
+}
+
+// return a zeroed slice of 'n' elements - reusing '*p' if it is big enough
+func (a *freezeArena) u64s(p *[]uint64, n uint64) []uint64 {
+	if uint64(cap(*p)) < n {
+		*p = make([]uint64, n)
+		return *p
+	}
+
+	v := (*p)[:n]
+	for i := range v {
+		v[i] = 0
+	}
+	*p = v
+	return v
+}
+
+func (a *freezeArena) u32s(p *[]uint32, n uint64) []uint32 {
+	if uint64(cap(*p)) < n {
+		*p = make([]uint32, n)
+		return *p
+	}
+
+	v := (*p)[:n]
+	for i := range v {
+		v[i] = 0
+	}
+	*p = v
+	return v
+}
+
+// EstimateMemory returns the approximate number of bytes Freeze(load) will
+// allocate for the keys added so far: the scratch space of the construction
+// and the finished table (assuming 2 byte seeds) including any fingerprints.
+// It doesn't include the memory already used to hold the keys in the builder.
+func (c *ChdBuilder) EstimateMemory(load float64) uint64 {
+	if load <= 0 || load > 1 {
+		return 0
+	}
+
+	n := uint64(len(c.data))
+	m := nextpow2(uint64(float64(n) / load))
+
+	// buckets that can hold keys
+	nb := m
+	if n < nb {
+		nb = n
+	}
+
+	sz := 4 * m             // seeds
+	sz += 8 * (m + 1)       // bucket layout
+	sz += 8 * n             // keys in bucket order
+	sz += 8 * nb            // bucket order
+	sz += (m + 63) / 64 * 8 // occupied slots
+	sz += 2 * m             // finished seed table
+	sz += uint64(c.fpbits/8) * m
+	return sz
+}
+
+// bucketOrder returns the non-empty buckets in the order they are
+// displaced: decreasing size and then increasing bucket number - the same
+// order as FreezeFromFile(). 'start' is the bucket layout and 'bhist' the
+// histogram of bucket sizes.
+func bucketOrder(a *freezeArena, start, bhist []uint64) []uint64 {
+	if len(bhist) == 0 {
+		return nil
+	}
+
+	// pos[z] is the next position of a bucket of size 'z'; the
+	// largest buckets come first.
+	pos := a.u64s(&a.pos, uint64(len(bhist)))
+	var n uint64
+	for z := len(bhist) - 1; z > 0; z-- {
+		pos[z] = n
+		n += bhist[z]
+	}
+
+	order := a.u64s(&a.order, n)
+	m := uint64(len(start) - 1)
+	for j := uint64(0); j < m; j++ {
+		if z := start[j+1] - start[j]; z > 0 {
+			order[pos[z]] = j
+			pos[z]++
+		}
+	}
+	return order
+}
+
+// find the first seed that maps all the keys of a bucket to distinct, free
+// slots of the table; mark those slots as occupied. Returns the seed and the
+// number of seeds that didn't work. Seeds up to 'max' are tried; 'hs' is
+// scratch space for the slots.
+func displace(keys []uint64, m, salt uint64, max uint32, occ *bitVector, hs *[]uint64) (uint32, int, bool) {
+	tries := 0
+	for s := uint32(1); s <= max; s++ {
+		h := (*hs)[:0]
+		for _, key := range keys {
+			x := rhash(s, key, m, salt)
+			if occ.IsSet(x) {
+				goto nextSeed
+			}
+
+			// buckets are tiny; a linear scan is the fastest
+			for _, y := range h {
+				if x == y {
+					goto nextSeed
+				}
+			}
+			h = append(h, x)
+		}
+
+		for _, x := range h {
+			occ.Set(x)
+		}
+		*hs = h
+		return s, tries, true
+
+	nextSeed:
+		*hs = h
+		tries++
+	}
+
+	return 0, tries, false
+}
+
 func makeSeeds(s []uint32, max uint32) seeder {
+	return newSeeder(s, seedSize(max))
+}
+
+// smallest size of a seed (in bytes) that can hold 'max'
+func seedSize(max uint32) byte {
 	switch {
 	case max < 256:
-		return newU8(s)
+		return 1
 
 	case max < 65536:
+		return 2
+
+	default:
+		return 4
+	}
+}
+
+// make a seed table with seeds of 'sz' bytes
+func newSeeder(s []uint32, sz byte) seeder {
+	switch sz {
+	case 1:
+		return newU8(s)
+
+	case 2:
 		return newU16(s)
 
 	default:
@@ -165,14 +508,155 @@ type Chd struct {
 	seed  seeder
 	salt  uint64
 	tries int
+
+	// number of keys in the table; zero if unknown
+	nkeys uint64
+
+	// histogram of bucket sizes; only known at construction time
+	bhist []uint64
+
+	// optional per-slot key fingerprints
+	fp *fingerprints
+
+	// multi-level tables: the shards and the first slot of each shard
+	// (with the total number of slots at the end); 'seed' and 'fp' are
+	// unused.
+	shards []*Chd
+	base   []uint64
+}
+
+// ChdStats describes the shape of a frozen CHD table. Some of the fields are
+// only known for tables that were constructed or marshaled by this version of
+// the library; they are zero otherwise.
+type ChdStats struct {
+	// Size of each seed in bytes (1, 2, 4)
+	SeedSize int
+
+	// Size of the lookup table
+	Slots uint64
+
+	// Number of keys in the table (if known)
+	Keys uint64
+
+	// Number of unused slots in the table (if known)
+	Empty uint64
+
+	// Effective load factor: Keys/Slots (if known)
+	Load float64
+
+	// Largest seed in the table
+	MaxSeed uint32
+
+	// Size of the key fingerprints in bits; 0 if the table has none
+	FingerprintBits int
+
+	// Number of shards of a multi-level table; 0 for single level tables.
+	// SeedSize and MaxSeed are the largest of all the shards.
+	Shards int
+
+	// Number of seeds that failed during construction (if known)
+	Tries int
+
+	// SeedHist[i] is the number of buckets whose seed is in the interval
+	// [2^i, 2^(i+1))
+	SeedHist []uint64
+
+	// BucketHist[i] is the number of buckets with 'i' keys; this is nil
+	// for tables that are unmarshaled.
+	BucketHist []uint64
+}
+
+// MaxSeed returns the largest seed in the table
+func (c *Chd) MaxSeed() uint32 {
+	var max uint32
+
+	for _, s := range c.shards {
+		if x := s.MaxSeed(); x > max {
+			max = x
+		}
+	}
+	if c.shards != nil {
+		return max
+	}
+
+	n := uint64(c.seed.length())
+	for i := uint64(0); i < n; i++ {
+		if s := c.seed.seed(i); s > max {
+			max = s
+		}
+	}
+	return max
 }
 
+// Stats returns the statistics of the CHD table
+func (c *Chd) Stats() *ChdStats {
+	if c.shards != nil {
+		st := &ChdStats{}
+		c.shardStats(st)
+		return st
+	}
+
+	n := uint64(c.seed.length())
+	st := &ChdStats{
+		SeedSize: int(c.seed.seedsize()),
+		Slots:    n,
+		Keys:     c.nkeys,
+		Tries:    c.tries,
+		SeedHist: make([]uint64, 33),
+
+		FingerprintBits: c.FingerprintBits(),
+	}
+
+	if c.nkeys > 0 && n > 0 {
+		st.Empty = n - c.nkeys
+		st.Load = float64(c.nkeys) / float64(n)
+	}
+
+	var top int
+	for i := uint64(0); i < n; i++ {
+		s := c.seed.seed(i)
+		if s > st.MaxSeed {
+			st.MaxSeed = s
+		}
+
+		j := bits.Len32(s) - 1
+		if j < 0 {
+			continue
+		}
+		if j > top {
+			top = j
+		}
+		st.SeedHist[j]++
+	}
+	st.SeedHist = st.SeedHist[:top+1]
+
+	if c.bhist != nil {
+		st.BucketHist = make([]uint64, len(c.bhist))
+		copy(st.BucketHist, c.bhist)
+	}
+	return st
+}
+
+// SeedSize returns the size of the seeds of the table in bytes; for
+// multi-level tables, it is the largest of all the shards.
 func (c *Chd) SeedSize() byte {
+	if c.shards != nil {
+		var sz byte
+		for _, s := range c.shards {
+			if x := s.SeedSize(); x > sz {
+				sz = x
+			}
+		}
+		return sz
+	}
 	return c.seed.seedsize()
 }
 
 // Len returns the actual length of the PHF lookup table
 func (c *Chd) Len() int {
+	if c.shards != nil {
+		return int(c.base[len(c.shards)])
+	}
 	return c.seed.length()
 }
 
@@ -181,6 +665,11 @@ func (c *Chd) Len() int {
 // at the time of construction of the minimal-hash).
 // Callers should verify that the key at the returned index == k.
 func (c *Chd) Find(k uint64) uint64 {
+	if c.shards != nil {
+		s, base := c.findShard(k)
+		return base + s.Find(k)
+	}
+
 	m := uint64(c.seed.length())
 	h := rhash(0, k, m, c.salt)
 	return rhash(c.seed.seed(h), k, m, c.salt)
@@ -253,7 +742,8 @@ func (u *u8Seeder) unmarshal(b []byte) error {
 	return nil
 }
 
-// 16 bit seed
+// 16 bit seed; the seeds are kept little-endian so they can be marshaled and
+// mmap'd as is.
 type u16Seeder struct {
 	seeds []uint16
 }
@@ -261,7 +751,7 @@ type u16Seeder struct {
 func newU16(v []uint32) seeder {
 	us := make([]uint16, len(v))
 	for i, a := range v {
-		us[i] = uint16(a & 0xffff)
+		us[i] = toLittleEndianUint16(uint16(a & 0xffff))
 	}
 
 	s := &u16Seeder{
@@ -271,7 +761,7 @@ func newU16(v []uint32) seeder {
 }
 
 func (u *u16Seeder) seed(v uint64) uint32 {
-	return uint32(u.seeds[v])
+	return uint32(toLittleEndianUint16(u.seeds[v]))
 }
 
 func (u *u16Seeder) length() int {
@@ -291,12 +781,16 @@ func (u *u16Seeder) unmarshal(b []byte) error {
 	return nil
 }
 
-// 32 bit seed
+// 32 bit seed; the seeds are kept little-endian (see u16Seeder)
 type u32Seeder struct {
 	seeds []uint32
 }
 
+// NB: the seeds in 'v' are converted in place
 func newU32(v []uint32) seeder {
+	for i, a := range v {
+		v[i] = toLittleEndianUint32(a)
+	}
 	s := &u32Seeder{
 		seeds: v,
 	}
@@ -304,7 +798,7 @@ func newU32(v []uint32) seeder {
 }
 
 func (u *u32Seeder) seed(v uint64) uint32 {
-	return uint32(u.seeds[v])
+	return toLittleEndianUint32(u.seeds[v])
 }
 
 func (u *u32Seeder) length() int {
@@ -329,18 +823,34 @@ func (u *u32Seeder) unmarshal(b []byte) error {
 // A subsequent call to UnmarshalBinary() will reconstruct the CHD instance.
 func (c *Chd) MarshalBinary(w io.Writer) (int, error) {
 	// Header: 2 64-bit words:
-	//   o version byte
-	//   o CHD_Seed_Size byte
-	//   o resv [6]byte
+	//   o version byte: 1, or 2 if the table has fingerprints
+	//   o CHD_Seed_Size byte; the upper nibble is the size of the
+	//     fingerprints in bytes (version 2)
+	//   o nkeys [6]byte: 48-bit little-endian number of keys (0 if unknown)
 	//   o salt 8 bytes
 	//
 	// Body:
 	//   o <n> seeds laid out sequentially
+	//   o version 2: zero padding to align the fingerprints, followed
+	//     by <n> fingerprints
+	//
+	// Multi-level tables are version 3; see multilevel.go.
+
+	if c.shards != nil {
+		return c.marshalShards(w)
+	}
 
 	var x [_ChdHeaderSize]byte // 4 x 64-bit words
 
 	x[0] = 1
 	x[1] = c.SeedSize()
+	if c.fp != nil {
+		x[0] = 2
+		x[1] |= c.fp.size() << 4
+	}
+	if c.nkeys < (1 << 48) {
+		putUint48(x[2:8], c.nkeys)
+	}
 	binary.LittleEndian.PutUint64(x[8:], c.salt)
 	nw, err := writeAll(w, x[:])
 	if err != nil {
@@ -348,11 +858,39 @@ func (c *Chd) MarshalBinary(w io.Writer) (int, error) {
 	}
 
 	m, err := c.seed.marshal(w)
+	nw += m
+	if err != nil || c.fp == nil {
+		return nw, err
+	}
+
+	var z [8]byte
+	pad := fpPad(uint64(c.seed.length()), c.SeedSize(), c.fp.size())
+	if m, err = writeAll(w, z[:pad]); err != nil {
+		return nw + m, err
+	}
+	nw += m
+
+	m, err = c.fp.marshal(w)
 	return nw + m, err
 }
 
+// number of zero bytes between 'm' seeds of size 'ss' and the fingerprints of
+// size 'fs' that follow them
+func fpPad(m uint64, ss, fs byte) uint64 {
+	n := m * uint64(ss)
+	return (uint64(fs) - n%uint64(fs)) % uint64(fs)
+}
+
 // Dump CHD meta-data to io.Writer 'w'
 func (c *Chd) DumpMeta(w io.Writer) {
+	if c.shards != nil {
+		fmt.Fprintf(w, "  CHD with %d shards <salt %#x>\n", len(c.shards), c.salt)
+		for i, s := range c.shards {
+			fmt.Fprintf(w, "  shard %d: %d slots at %d\n", i, s.Len(), c.base[i])
+		}
+		return
+	}
+
 	switch c.seed.(type) {
 	case *u8Seeder:
 		fmt.Fprintf(w, "  CHD with 8-bit seeds <salt %#x>\n", c.salt)
@@ -364,28 +902,62 @@ func (c *Chd) DumpMeta(w io.Writer) {
 	default:
 		panic("Unknown seed type!")
 	}
+
+	if c.fp != nil {
+		fmt.Fprintf(w, "  %d-bit key fingerprints\n", c.FingerprintBits())
+	}
 }
 
 // UnmarshalBinaryMmap reads a previously marshalled Chd instance and returns
 // a lookup table. It assumes that buf is memory-mapped and aligned at the
 // right boundaries.
 func (c *Chd) UnmarshalBinaryMmap(buf []byte) error {
+	if len(buf) < _ChdHeaderSize {
+		return fmt.Errorf("chd: header too small (%d bytes)", len(buf))
+	}
+
 	hdr := buf[:_ChdHeaderSize]
-	if hdr[0] != 1 {
+	switch hdr[0] {
+	case 1, 2:
+	case 3:
+		return c.unmarshalShards(buf)
+	default:
 		return fmt.Errorf("chd: no support to un-marshal version %d", hdr[0])
 	}
 
 	var seed seeder
+	var fp *fingerprints
 
 	size := hdr[1]
+	nkeys := uint48(hdr[2:8])
 	salt := binary.LittleEndian.Uint64(hdr[8:])
 	vals := buf[_ChdHeaderSize:]
 
+	if hdr[0] == 2 {
+		fs := size >> 4
+		size &= 0xf
+		if fs == 0 || size == 0 {
+			return fmt.Errorf("chd: bad seed/fingerprint size %#x", hdr[1])
+		}
+
+		m := uint64(len(vals)) / uint64(size+fs)
+		pad := fpPad(m, size, fs)
+		if m*uint64(size+fs)+pad != uint64(len(vals)) {
+			return fmt.Errorf("chd: partial fingerprints (%d bytes of seeds and fingerprints)", len(vals))
+		}
+
+		var err error
+		if fp, err = unmarshalFingerprints(fs, vals[m*uint64(size)+pad:]); err != nil {
+			return err
+		}
+		vals = vals[:m*uint64(size)]
+	}
+
 	switch size {
 	case 1:
 		u8 := &u8Seeder{}
 		if err := u8.unmarshal(vals); err != nil {
-			return nil
+			return err
 		}
 		seed = u8
 	case 2:
@@ -415,11 +987,33 @@ func (c *Chd) UnmarshalBinaryMmap(buf []byte) error {
 		return fmt.Errorf("chd: unknown seed-size %d", size)
 	}
 
-	c.seed = seed
-	c.salt = salt
+	*c = Chd{
+		seed:  seed,
+		salt:  salt,
+		nkeys: nkeys,
+		fp:    fp,
+	}
 	return nil
 }
 
+// encode the lower 48 bits of 'v' in little-endian order into 'b'
+func putUint48(b []byte, v uint64) {
+	_ = b[5]
+	for i := 0; i < 6; i++ {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+}
+
+// decode a 48-bit little-endian integer from 'b'
+func uint48(b []byte) uint64 {
+	_ = b[5]
+	var v uint64
+	for i := 0; i < 6; i++ {
+		v |= uint64(b[i]) << (8 * uint(i))
+	}
+	return v
+}
+
 // compression function for fasthash
 // borrowed from Zi Long Tan's superfast hash
 func mix(h uint64) uint64 {
@@ -12,7 +12,17 @@ package chd
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/opencoff/go-fasthash"
 )
@@ -104,3 +114,1000 @@ func TestCHDMarshal(t *testing.T) {
 		assert(x == y, "b and b2 mapped key %d <%#x>: %d vs. %d", i, k, x, y)
 	}
 }
+
+func TestCHDStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	for i := 0; i < 1000; i++ {
+		b.Add(rand64())
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st := c.Stats()
+	assert(st.Keys == 1000, "exp 1000 keys, saw %d", st.Keys)
+	assert(st.Slots == uint64(c.Len()), "exp %d slots, saw %d", c.Len(), st.Slots)
+	assert(st.Empty == st.Slots-st.Keys, "empty slots mismatch: %d", st.Empty)
+	assert(st.SeedSize == int(c.SeedSize()), "seed size mismatch: %d", st.SeedSize)
+	assert(st.MaxSeed == c.MaxSeed(), "max seed mismatch: %d vs %d", st.MaxSeed, c.MaxSeed())
+
+	var nb, nk uint64
+	for i, n := range st.BucketHist {
+		nb += n
+		nk += uint64(i) * n
+	}
+	assert(nb == st.Slots, "bucket hist: exp %d buckets, saw %d", st.Slots, nb)
+	assert(nk == st.Keys, "bucket hist: exp %d keys, saw %d", st.Keys, nk)
+
+	nb = 0
+	for _, n := range st.SeedHist {
+		nb += n
+	}
+	assert(nb == st.Slots, "seed hist: exp %d buckets, saw %d", st.Slots, nb)
+
+	// key count must survive marshaling
+	var buf bytes.Buffer
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+
+	st2 := c2.Stats()
+	assert(st2.Keys == st.Keys, "unmarshal: exp %d keys, saw %d", st.Keys, st2.Keys)
+	assert(st2.MaxSeed == st.MaxSeed, "unmarshal: exp maxseed %d, saw %d", st.MaxSeed, st2.MaxSeed)
+	assert(st2.BucketHist == nil, "unmarshal: bucket hist is not nil")
+}
+
+func TestCHDCheckpoint(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	keys := make([]uint64, 1000)
+	for i := range keys {
+		keys[i] = rand64()
+		b.Add(keys[i])
+	}
+
+	var buf bytes.Buffer
+	n, err := b.WriteTo(&buf)
+	assert(err == nil, "checkpoint failed: %s", err)
+	assert(n == int64(buf.Len()), "checkpoint: exp %d bytes, saw %d", buf.Len(), n)
+
+	b2, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	m, err := b2.ReadFrom(bytes.NewReader(buf.Bytes()))
+	assert(err == nil, "restore failed: %s", err)
+	assert(m == n, "restore: exp %d bytes, saw %d", n, m)
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	c2, err := b2.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for i, k := range keys {
+		x := c.Find(k)
+		y := c2.Find(k)
+		assert(x == y, "key %d <%#x>: %d vs. %d", i, k, x, y)
+	}
+
+	// corrupt a key and make sure we notice
+	bs := buf.Bytes()
+	bs[_CheckpointHeaderSize] ^= 0xff
+	_, err = b2.ReadFrom(bytes.NewReader(bs))
+	assert(err != nil, "corrupt checkpoint restored")
+}
+
+func TestCHDDuplicates(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	var seen []uint64
+	b.OnDuplicate(func(k uint64) {
+		seen = append(seen, k)
+	})
+
+	for i := uint64(0); i < 100; i++ {
+		assert(b.AddUnique(i), "key %d not added", i)
+	}
+
+	assert(!b.AddUnique(5), "duplicate key 5 added")
+	err = b.Add(7)
+	assert(err != nil, "duplicate key 7 added")
+
+	assert(b.Duplicates() == 2, "exp 2 duplicates, saw %d", b.Duplicates())
+	assert(len(seen) == 2 && seen[0] == 5 && seen[1] == 7, "callback saw %v", seen)
+}
+
+func TestCHDSeedSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a full table with a fixed salt needs wide seeds
+	build := func(sz, max int) (*Chd, error) {
+		b, err := New()
+		assert(err == nil, "construction failed: %s", err)
+
+		b.salt = 0x5eed5eed5eed5eed
+		assert(b.SetSeedSize(sz) == nil, "can't set seed size %d", sz)
+		assert(b.SetMaxSeedSize(max) == nil, "can't set max seed size %d", max)
+		for i := uint64(0); i < 1<<14; i++ {
+			b.Add(i)
+		}
+		return b.Freeze(1.0)
+	}
+
+	c, err := build(0, 0)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.SeedSize() > 1, "seed size %d; test needs wider seeds", c.SeedSize())
+
+	_, err = build(0, 1)
+	assert(err != nil, "max seed size 1 not enforced")
+
+	_, err = build(1, 0)
+	assert(err != nil, "forced 1 byte seeds for wide seeds")
+
+	c4, err := build(4, 4)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c4.SeedSize() == 4, "exp 4 byte seeds, saw %d", c4.SeedSize())
+
+	var buf bytes.Buffer
+	_, err = c4.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(c2.SeedSize() == 4, "exp 4 byte seeds, saw %d", c2.SeedSize())
+
+	for i := uint64(0); i < 1<<14; i++ {
+		x, y := c.Find(i), c2.Find(i)
+		assert(x == y, "key %d: mapped to %d and %d", i, x, y)
+	}
+
+	b, _ := New()
+	assert(b.SetSeedSize(3) != nil, "seed size 3 accepted")
+	assert(b.SetMaxSeedSize(8) != nil, "max seed size 8 accepted")
+}
+
+func TestCHDFrozen(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	for i := uint64(0); i < 100; i++ {
+		assert(b.Add(i) == nil, "can't add key %d", i)
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = b.Add(1000)
+	assert(err == ErrFrozen, "add after freeze: exp ErrFrozen, saw %v", err)
+	assert(!b.AddUnique(1001), "addunique after freeze succeeded")
+	assert(b.Duplicates() == 0, "frozen adds counted as duplicates")
+
+	_, err = b.Freeze(0.9)
+	assert(err == ErrFrozen, "refreeze: exp ErrFrozen, saw %v", err)
+
+	// the table is unaffected by the rejected adds
+	seen := make(map[uint64]bool)
+	for i := uint64(0); i < 100; i++ {
+		j := c.Find(i)
+		assert(!seen[j], "key %d: slot %d reused", i, j)
+		seen[j] = true
+	}
+
+	b.Reset()
+	for i := uint64(500); i < 550; i++ {
+		assert(b.Add(i) == nil, "can't add key %d after reset", i)
+	}
+
+	c, err = b.Freeze(0.9)
+	assert(err == nil, "freeze after reset failed: %s", err)
+	assert(c.Stats().Keys == 50, "exp 50 keys after reset, saw %d", c.Stats().Keys)
+}
+
+func TestCHDRetry(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	b.salt = 0x5eed5eed5eed5eed
+	for i := uint64(0); i < 1<<14; i++ {
+		b.Add(i)
+	}
+
+	est := b.EstimateMemory(1.0)
+	assert(est > 0, "no memory estimate")
+	assert(b.EstimateMemory(0.5) > est, "lower load doesn't need more memory")
+	assert(b.EstimateMemory(0) == 0, "estimate for invalid load")
+
+	// a full table needs wide seeds; the failed attempt leaves its
+	// scratch space behind for the retry.
+	assert(b.SetMaxSeedSize(1) == nil, "can't set max seed size")
+	_, err = b.Freeze(1.0)
+	assert(err != nil, "max seed size not enforced")
+
+	keys := &b.arena.keys[0]
+	assert(len(b.arena.keys) == 1<<14, "exp 16384 scratch keys, saw %d", len(b.arena.keys))
+
+	v := b.arena.u64s(&b.arena.keys, 100)
+	assert(&v[0] == keys && v[0] == 0, "scratch keys not reused")
+
+	assert(b.SetMaxSeedSize(0) == nil, "can't clear max seed size")
+
+	c, err := b.Freeze(1.0)
+	assert(err == nil, "retry failed: %s", err)
+	assert(b.arena.keys == nil, "scratch space retained after freeze")
+
+	seen := make(map[uint64]bool)
+	for i := uint64(0); i < 1<<14; i++ {
+		j := c.Find(i)
+		assert(!seen[j], "key %d: slot %d reused", i, j)
+		seen[j] = true
+	}
+}
+
+func TestCHDFreezeFromFile(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "chdkeys")
+	assert(err == nil, "tempdir: %s", err)
+	defer os.RemoveAll(dir)
+
+	// force several sorted runs
+	old := freezeRunKeys
+	freezeRunKeys = 1000
+	defer func() {
+		freezeRunKeys = old
+	}()
+
+	keys := make([]uint64, 10000)
+	bin := make([]byte, 8*len(keys), 8*len(keys)+8)
+	var txt strings.Builder
+	for i := range keys {
+		keys[i] = rand64()
+		binary.LittleEndian.PutUint64(bin[i*8:], keys[i])
+		fmt.Fprintf(&txt, "%#x\n", keys[i])
+	}
+
+	bfn := filepath.Join(dir, "keys.bin")
+	tfn := filepath.Join(dir, "keys.txt")
+	err = ioutil.WriteFile(bfn, bin, 0600)
+	assert(err == nil, "write: %s", err)
+	err = ioutil.WriteFile(tfn, []byte(txt.String()), 0600)
+	assert(err == nil, "write: %s", err)
+
+	for _, fn := range []string{bfn, tfn} {
+		c, err := FreezeFromFile(fn, 0.9)
+		assert(err == nil, "%s: freeze failed: %s", fn, err)
+		assert(c.Stats().Keys == uint64(len(keys)), "%s: key count mismatch", fn)
+
+		seen := make(map[uint64]uint64)
+		for _, k := range keys {
+			j := c.Find(k)
+			assert(j < uint64(c.Len()), "%s: key %#x mapped out of range %d", fn, k, j)
+
+			x, ok := seen[j]
+			assert(!ok, "%s: index %d already mapped to key %#x", fn, j, x)
+			seen[j] = k
+		}
+	}
+
+	// duplicates must be caught
+	bin = bin[:len(bin)+8]
+	binary.LittleEndian.PutUint64(bin[len(bin)-8:], keys[17])
+	err = ioutil.WriteFile(bfn, bin, 0600)
+	assert(err == nil, "write: %s", err)
+
+	_, err = FreezeFromFile(bfn, 0.9)
+	assert(err != nil, "duplicate key not detected")
+
+	// even when there are more copies than a bucket holds
+	for i := 0; i < 300; i++ {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], keys[23])
+		bin = append(bin, b[:]...)
+	}
+	err = ioutil.WriteFile(bfn, bin, 0600)
+	assert(err == nil, "write: %s", err)
+
+	_, err = FreezeFromFile(bfn, 0.9)
+	assert(err != nil && strings.Contains(err.Error(), "duplicate key"), "exp duplicate key error, saw %v", err)
+}
+
+func TestCHDText(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	keys := make([]uint64, 500)
+	for i := range keys {
+		keys[i] = rand64()
+		b.Add(keys[i])
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	txt, err := c.MarshalText()
+	assert(err == nil, "marshal text: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalText(txt)
+	assert(err == nil, "unmarshal text: %s", err)
+
+	txt2, err := c2.MarshalText()
+	assert(err == nil, "marshal text: %s", err)
+	assert(bytes.Equal(txt, txt2), "text encoding is not stable")
+
+	for i, k := range keys {
+		x := c.Find(k)
+		y := c2.Find(k)
+		assert(x == y, "key %d <%#x>: %d vs. %d", i, k, x, y)
+	}
+
+	js, err := json.Marshal(c)
+	assert(err == nil, "json: %s", err)
+
+	var v struct {
+		Keys  uint64   `json:"keys"`
+		Seeds []uint32 `json:"seeds"`
+	}
+	err = json.Unmarshal(js, &v)
+	assert(err == nil, "json decode: %s", err)
+	assert(v.Keys == uint64(len(keys)), "json: exp %d keys, saw %d", len(keys), v.Keys)
+	assert(len(v.Seeds) == c.Len(), "json: exp %d seeds, saw %d", c.Len(), len(v.Seeds))
+}
+
+func BenchmarkCHDFreeze(b *testing.B) {
+	keys := make([]uint64, 1<<20)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := New()
+		if err != nil {
+			b.Fatalf("construction failed: %s", err)
+		}
+		for _, k := range keys {
+			c.Add(k)
+		}
+		if _, err := c.Freeze(0.9); err != nil {
+			b.Fatalf("freeze failed: %s", err)
+		}
+	}
+}
+
+func TestCHDFingerprint(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+	assert(b.SetFingerprintBits(7) != nil, "accepted 7 bit fingerprints")
+	assert(b.SetFingerprintBits(8) == nil, "rejected 8 bit fingerprints")
+
+	keys := make(map[uint64]bool)
+	for len(keys) < 2000 {
+		k := rand64()
+		keys[k] = true
+		b.Add(k)
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.FingerprintBits() == 8, "exp 8 bit fingerprints, saw %d", c.FingerprintBits())
+
+	var buf bytes.Buffer
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(c2.FingerprintBits() == 8, "unmarshal: exp 8 bit fingerprints, saw %d", c2.FingerprintBits())
+
+	for k := range keys {
+		i, ok := c.FindWithFingerprint(k)
+		assert(ok, "member key %#x rejected", k)
+		assert(i == c.Find(k), "key %#x: slot mismatch", k)
+
+		j, ok := c2.FindWithFingerprint(k)
+		assert(ok && j == i, "unmarshaled: member key %#x: %d, %v", k, j, ok)
+	}
+
+	// the false positive rate should be close to 1/256
+	const n = 100000
+	fp := 0
+	for i := 0; i < n; i++ {
+		k := rand64()
+		if keys[k] {
+			continue
+		}
+		if _, ok := c2.FindWithFingerprint(k); ok {
+			fp++
+		}
+	}
+	assert(fp < 2*n/256, "too many false positives: %d of %d", fp, n)
+
+	// tables without fingerprints can't reject keys
+	b, err = New()
+	assert(err == nil, "construction failed: %s", err)
+	for k := range keys {
+		b.Add(k)
+	}
+	c, err = b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.FingerprintBits() == 0, "unexpected fingerprints")
+
+	_, ok := c.FindWithFingerprint(rand64())
+	assert(ok, "table without fingerprints rejected a key")
+
+	// empty tables reject everything
+	b, err = New()
+	assert(err == nil, "construction failed: %s", err)
+	c, err = b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	_, ok = c.FindWithFingerprint(1)
+	assert(!ok, "empty table found a key")
+}
+
+func TestCHDFingerprintSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	rates := []struct {
+		p    float64
+		bits int
+	}{
+		{1, 0},
+		{0.01, 8},
+		{1.0 / 256, 8},
+		{0.001, 16},
+		{1.0 / 65536, 16},
+	}
+	for _, r := range rates {
+		err = b.SetFalsePositiveRate(r.p)
+		assert(err == nil, "rate %g: %s", r.p, err)
+		assert(b.fpbits == r.bits, "rate %g: exp %d bits, saw %d", r.p, r.bits, b.fpbits)
+	}
+	assert(b.SetFalsePositiveRate(1e-6) != nil, "accepted rate 1e-6")
+	assert(b.SetFalsePositiveRate(0) != nil, "accepted rate 0")
+	assert(b.SetFalsePositiveRate(-1) != nil, "accepted rate -1")
+
+	est := b.EstimateMemory(0.9)
+	err = b.SetFingerprintBits(16)
+	assert(err == nil, "rejected 16 bit fingerprints: %s", err)
+
+	keys := make(map[uint64]bool)
+	for len(keys) < 2000 {
+		k := rand64()
+		keys[k] = true
+		b.Add(k)
+	}
+	assert(b.EstimateMemory(0.9) > est, "fingerprints don't need memory")
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Stats().FingerprintBits == 16, "stats: exp 16 bit fingerprints, saw %d", c.Stats().FingerprintBits)
+
+	var buf bytes.Buffer
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+
+	txt, err := c.MarshalText()
+	assert(err == nil, "marshal text: %s", err)
+	assert(bytes.HasPrefix(txt, []byte("chd 2\n")), "text: exp version 2")
+
+	var c3 Chd
+	err = c3.UnmarshalText(txt)
+	assert(err == nil, "unmarshal text: %s", err)
+	assert(c3.FingerprintBits() == 16, "text: exp 16 bit fingerprints, saw %d", c3.FingerprintBits())
+
+	txt2, err := c3.MarshalText()
+	assert(err == nil, "marshal text: %s", err)
+	assert(bytes.Equal(txt, txt2), "text encoding is not stable")
+
+	for k := range keys {
+		assert(c.Contains(k), "member key %#x rejected", k)
+		assert(c2.Contains(k), "unmarshaled: member key %#x rejected", k)
+		assert(c3.Contains(k), "text: member key %#x rejected", k)
+	}
+
+	// the false positive rate should be close to 1/65536
+	const n = 200000
+	fp := 0
+	for i := 0; i < n; i++ {
+		k := rand64()
+		if !keys[k] && c2.Contains(k) {
+			fp++
+		}
+	}
+	assert(fp < 20, "too many false positives: %d of %d", fp, n)
+
+	js, err := json.Marshal(c)
+	assert(err == nil, "json: %s", err)
+
+	var v struct {
+		FPBits       int      `json:"fpbits"`
+		Fingerprints []uint16 `json:"fingerprints"`
+	}
+	err = json.Unmarshal(js, &v)
+	assert(err == nil, "json decode: %s", err)
+	assert(v.FPBits == 16, "json: exp 16 bit fingerprints, saw %d", v.FPBits)
+	assert(len(v.Fingerprints) == c.Len(), "json: exp %d fingerprints, saw %d", c.Len(), len(v.Fingerprints))
+
+	// a single slot of 1 byte seeds needs padding before the fingerprint
+	b, err = New()
+	assert(err == nil, "construction failed: %s", err)
+	b.SetFingerprintBits(16)
+	b.Add(42)
+	c, err = b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Len() == 1 && c.SeedSize() == 1, "exp 1 slot of 1 byte seeds, saw %d of %d", c.Len(), c.SeedSize())
+
+	buf.Reset()
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(buf.Len() == _ChdHeaderSize+4, "exp %d bytes, saw %d", _ChdHeaderSize+4, buf.Len())
+
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(c2.Contains(42), "single key rejected")
+}
+
+func TestCHDFreezePartitions(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "chdparts")
+	assert(err == nil, "tempdir: %s", err)
+	defer os.RemoveAll(dir)
+
+	_, err = PartitionKeys(nil, 3, 1)
+	assert(err != nil, "accepted 3 partitions")
+
+	keys := make([]uint64, 10000)
+	for i := range keys {
+		keys[i] = rand64()
+	}
+
+	const nparts = 8
+	salt := rand64()
+
+	// two "mappers" with half the keys each
+	var parts [nparts][]uint64
+	for _, half := range [][]uint64{keys[:5000], keys[5000:]} {
+		p, err := PartitionKeys(half, nparts, salt)
+		assert(err == nil, "partition failed: %s", err)
+		for i := range p {
+			parts[i] = append(parts[i], p[i]...)
+		}
+	}
+
+	write := func(i int, keys []uint64) string {
+		fn := filepath.Join(dir, fmt.Sprintf("part.%d", i))
+		fd, err := os.Create(fn)
+		assert(err == nil, "create: %s", err)
+		_, err = WritePartition(fd, i, nparts, salt, keys)
+		assert(err == nil, "partition %d: write failed: %s", i, err)
+		assert(fd.Close() == nil, "close failed")
+		return fn
+	}
+
+	files := make([]string, nparts)
+	for i := range parts {
+		files[i] = write(i, parts[i])
+	}
+
+	c, err := FreezePartitions(files, 0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Stats().Keys == uint64(len(keys)), "key count mismatch")
+	assert(c.salt == salt, "table doesn't use the partition salt")
+
+	seen := make(map[uint64]uint64)
+	for _, k := range keys {
+		j := c.Find(k)
+		assert(j < uint64(c.Len()), "key %#x mapped out of range %d", k, j)
+
+		x, ok := seen[j]
+		assert(!ok, "index %d already mapped to key %#x", j, x)
+		seen[j] = k
+	}
+
+	// a key can't be written to the wrong partition
+	_, err = WritePartition(ioutil.Discard, 1, nparts, salt, parts[0])
+	assert(err != nil, "wrote keys of partition 0 as partition 1")
+
+	// missing and repeated partitions
+	_, err = FreezePartitions(files[1:], 0.9)
+	assert(err != nil, "missing partition not detected")
+	_, err = FreezePartitions(append(files[1:], files[1]), 0.9)
+	assert(err != nil, "duplicate partition not detected")
+
+	// duplicate keys within a partition
+	files[0] = write(0, append(parts[0], parts[0][0]))
+	_, err = FreezePartitions(files, 0.9)
+	assert(err != nil, "duplicate key not detected")
+
+	// corrupt partition
+	files[0] = write(0, parts[0])
+	b, err := ioutil.ReadFile(files[0])
+	assert(err == nil, "read: %s", err)
+	b[_PartitionHeaderSize] ^= 0xff
+	err = ioutil.WriteFile(files[0], b, 0600)
+	assert(err == nil, "write: %s", err)
+	_, err = FreezePartitions(files, 0.9)
+	assert(err != nil, "corrupt partition not detected")
+}
+
+func TestCHDMultiLevel(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+	assert(b.SetShardSize(-1) != nil, "accepted negative shard size")
+	assert(b.SetShardSize(1000) == nil, "rejected shard size")
+	assert(b.SetFingerprintBits(8) == nil, "rejected 8 bit fingerprints")
+
+	keys := make([]uint64, 10000)
+	for i := range keys {
+		keys[i] = rand64()
+		b.Add(keys[i])
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Shards() == 16, "exp 16 shards, saw %d", c.Shards())
+
+	st := c.Stats()
+	assert(st.Shards == 16, "stats: exp 16 shards, saw %d", st.Shards)
+	assert(st.Keys == uint64(len(keys)), "stats: exp %d keys, saw %d", len(keys), st.Keys)
+	assert(st.Slots == uint64(c.Len()), "stats: exp %d slots, saw %d", c.Len(), st.Slots)
+	assert(st.FingerprintBits == 8, "stats: exp 8 bit fingerprints, saw %d", st.FingerprintBits)
+
+	var buf bytes.Buffer
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(c2.Shards() == c.Shards() && c2.Len() == c.Len(), "unmarshal: shape mismatch")
+
+	seen := make(map[uint64]uint64)
+	for _, k := range keys {
+		j := c.Find(k)
+		assert(j < uint64(c.Len()), "key %#x mapped out of range %d", k, j)
+		assert(c2.Find(k) == j, "key %#x: unmarshaled table disagrees", k)
+		assert(c2.Contains(k), "member key %#x rejected", k)
+
+		x, ok := seen[j]
+		assert(!ok, "index %d already mapped to key %#x", j, x)
+		seen[j] = k
+	}
+
+	_, err = c.MarshalText()
+	assert(err != nil, "text encoded a multi-level table")
+
+	// small key sets stay single level
+	b, err = New()
+	assert(err == nil, "construction failed: %s", err)
+	b.SetShardSize(DefaultShardSize)
+	for _, k := range keys {
+		b.Add(k)
+	}
+	c, err = b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Shards() == 0, "exp a single level table, saw %d shards", c.Shards())
+}
+
+func TestCHDMultiLevelEmptyShard(t *testing.T) {
+	assert := newAsserter(t)
+
+	// with 1 key per shard, some of the shards are bound to be empty
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+	b.SetShardSize(1)
+
+	keys := make(map[uint64]bool)
+	for len(keys) < 20 {
+		k := rand64()
+		keys[k] = true
+		b.Add(k)
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.Shards() == 32, "exp 32 shards, saw %d", c.Shards())
+
+	for k := range keys {
+		j := c.Find(k)
+		assert(j < uint64(c.Len()), "key %#x mapped out of range %d", k, j)
+	}
+
+	for i := 0; i < 1000; i++ {
+		j := c.Find(rand64())
+		assert(j < uint64(c.Len()), "unknown key mapped out of range %d", j)
+	}
+}
+
+func TestCHDMaxSeed(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+	assert(b.MaxSeed() == _MaxSeed, "exp default max seed, saw %d", b.MaxSeed())
+	assert(b.SetMaxSeed(_RouteSeed) != nil, "router seed accepted as max seed")
+
+	for i := uint64(0); i < 1<<14; i++ {
+		b.Add(i)
+	}
+
+	// a full table can't be built with a handful of seeds
+	assert(b.SetMaxSeed(3) == nil, "can't set max seed")
+	_, err = b.Freeze(1.0)
+
+	var se *SeedError
+	assert(errors.As(err, &se), "exp seed error, saw %v", err)
+	assert(se.MaxSeed == 3, "exp max seed 3, saw %d", se.MaxSeed)
+	assert(se.Keys > 0, "failing bucket has no keys")
+
+	// a small limit keeps the seeds narrow
+	assert(b.SetMaxSeed(255) == nil, "can't set max seed")
+	c, err := b.Freeze(0.5)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(c.SeedSize() == 1, "exp 1 byte seeds, saw %d", c.SeedSize())
+	assert(c.MaxSeed() <= 255, "seed %d exceeds limit", c.MaxSeed())
+
+	var buf bytes.Buffer
+	_, err = c.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var c2 Chd
+	err = c2.UnmarshalBinaryMmap(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(c2.SeedSize() == 1, "exp 1 byte seeds after unmarshal, saw %d", c2.SeedSize())
+
+	for i := uint64(0); i < 1<<14; i++ {
+		assert(c2.Find(i) == c.Find(i), "key %d: mismatched slot", i)
+	}
+}
+
+func TestCHDRecommendLoad(t *testing.T) {
+	assert := newAsserter(t)
+
+	// no limit and small key sets get the most compact table
+	assert(RecommendLoad(1<<20, 0) == 0.99, "no limit: exp 0.99, saw %f", RecommendLoad(1<<20, 0))
+	assert(RecommendLoad(1000, time.Second) == 0.99, "exp 0.99 for 1000 keys")
+
+	// an impossible target gets the fastest build: 1M keys fill a
+	// table of 1<<20 slots up to 0.95 - a bigger table builds faster.
+	load := RecommendLoad(1000000, time.Microsecond)
+	assert(load == 0.95, "exp 0.95 for tiny target, saw %f", load)
+
+	// a tighter budget never recommends a fuller table
+	n := 1000000
+	prev := 0.0
+	for _, d := range []time.Duration{time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, time.Second, time.Minute} {
+		load = RecommendLoad(n, d)
+		assert(load > 0 && load <= 1, "target %s: invalid load %f", d, load)
+		assert(load >= prev, "target %s: load %f less than %f", d, load, prev)
+		prev = load
+	}
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+	for i := uint64(0); i < 10000; i++ {
+		b.Add(i)
+	}
+	_, err = b.Freeze(RecommendLoad(10000, time.Second))
+	assert(err == nil, "freeze at recommended load failed: %s", err)
+}
+
+func TestCHDFile(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	for i := uint64(1); i <= 5000; i++ {
+		b.Add(i * 7919)
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	fn := filepath.Join(t.TempDir(), "keys.mph")
+	err = c.WriteFile(fn)
+	assert(err == nil, "write failed: %s", err)
+
+	c2, err := LoadChdFile(fn)
+	assert(err == nil, "load failed: %s", err)
+	assert(c2.Len() == c.Len(), "exp %d slots, saw %d", c.Len(), c2.Len())
+
+	for i := uint64(1); i <= 5000; i++ {
+		k := i * 7919
+		assert(c2.Find(k) == c.Find(k), "key %d: mismatched slot", k)
+	}
+
+	buf, err := ioutil.ReadFile(fn)
+	assert(err == nil, "read failed: %s", err)
+
+	// a flipped bit in the table fails the checksum
+	bad := append([]byte(nil), buf...)
+	bad[_ChdFileHeaderSize+20] ^= 1
+	err = ioutil.WriteFile(fn, bad, 0600)
+	assert(err == nil, "write failed: %s", err)
+	_, err = LoadChdFile(fn)
+	assert(err != nil, "corrupt file loaded")
+
+	err = ioutil.WriteFile(fn, buf[:len(buf)-1], 0600)
+	assert(err == nil, "write failed: %s", err)
+	_, err = LoadChdFile(fn)
+	assert(err != nil, "truncated file loaded")
+}
+
+func TestCHDEncoding(t *testing.T) {
+	assert := newAsserter(t)
+
+	build := func(shard int) *Chd {
+		b, err := New()
+		assert(err == nil, "construction failed: %s", err)
+		if shard > 0 {
+			assert(b.SetShardSize(shard) == nil, "can't set shard size")
+		}
+
+		for i := uint64(1); i <= 2000; i++ {
+			b.Add(i * 31)
+		}
+
+		c, err := b.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+		return c
+	}
+
+	// a composite index that embeds tables
+	type index struct {
+		Name   string
+		Table  *Chd
+		Shards *Chd
+		Empty  Chd
+	}
+
+	in := &index{Name: "gob", Table: build(0), Shards: build(500)}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(in)
+	assert(err == nil, "gob encode failed: %s", err)
+
+	var out index
+	err = gob.NewDecoder(&buf).Decode(&out)
+	assert(err == nil, "gob decode failed: %s", err)
+	assert(out.Name == "gob", "exp name gob, saw %s", out.Name)
+
+	for _, x := range []struct{ exp, d *Chd }{{in.Table, out.Table}, {in.Shards, out.Shards}} {
+		c, d := x.exp, x.d
+		assert(d != nil, "table not decoded")
+		assert(d.Len() == c.Len(), "exp %d slots, saw %d", c.Len(), d.Len())
+		for i := uint64(1); i <= 2000; i++ {
+			assert(d.Find(i*31) == c.Find(i*31), "key %d: mismatched slot", i*31)
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	assert := newAsserter(t)
+
+	b, err := New()
+	assert(err == nil, "construction failed: %s", err)
+
+	for i := uint64(1); i <= 3000; i++ {
+		b.Add(i * 104729)
+	}
+
+	c, err := b.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	du := NewDictU64(c)
+	db := NewDictBytes(c)
+	for i := uint64(1); i <= 3000; i++ {
+		k := i * 104729
+		if i%3 == 0 {
+			continue
+		}
+
+		j, err := du.Set(k, i)
+		assert(err == nil, "key %d: set failed: %s", k, err)
+		assert(j == c.Find(k), "key %d: exp slot %d, saw %d", k, c.Find(k), j)
+
+		var v []byte
+		if i%5 != 0 {
+			v = []byte(fmt.Sprintf("val-%d", i))
+		}
+		_, err = db.Set(k, v)
+		assert(err == nil, "key %d: set failed: %s", k, err)
+	}
+	assert(du.Len() == 2000, "exp 2000 keys, saw %d", du.Len())
+	assert(du.Slots() == c.Len(), "exp %d slots, saw %d", c.Len(), du.Slots())
+	assert(len(du.Values()) == c.Len(), "exp %d values, saw %d", c.Len(), len(du.Values()))
+
+	var buf bytes.Buffer
+	_, err = du.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+	du2, err := UnmarshalDictU64(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+
+	buf.Reset()
+	n, err := db.MarshalBinary(&buf)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(n == buf.Len(), "exp %d bytes written, saw %d", buf.Len(), n)
+	db2, err := UnmarshalDictBytes(buf.Bytes())
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(db2.Len() == 2000, "exp 2000 keys, saw %d", db2.Len())
+
+	for i := uint64(1); i <= 3000; i++ {
+		k := i * 104729
+		for _, d := range []*DictU64{du, du2} {
+			v, ok := d.Get(k)
+			if i%3 == 0 {
+				assert(!ok, "key %d: unset key found", k)
+				continue
+			}
+			assert(ok && v == i, "key %d: exp %d, saw %d", k, i, v)
+		}
+
+		for _, d := range []*DictBytes{db, db2} {
+			v, ok := d.Get(k)
+			if i%3 == 0 {
+				assert(!ok, "key %d: unset key found", k)
+				continue
+			}
+
+			exp := ""
+			if i%5 != 0 {
+				exp = fmt.Sprintf("val-%d", i)
+			}
+			assert(ok && string(v) == exp, "key %d: exp %q, saw %q", k, exp, v)
+		}
+	}
+
+	// a key that isn't in the table can't take the slot of another key
+	k := uint64(7)
+	for {
+		if _, ok := du.Key(c.Find(k)); ok {
+			break
+		}
+		k++
+	}
+	_, ok := du.Get(k)
+	assert(!ok, "unknown key %d found", k)
+	_, err = du.Set(k, 1)
+	assert(err != nil, "unknown key %d stole a slot", k)
+
+	_, err = UnmarshalDictBytes(buf.Bytes()[:buf.Len()/2])
+	assert(err != nil, "truncated dict unmarshaled")
+	_, err = UnmarshalDictU64(buf.Bytes())
+	assert(err != nil, "bytes dict unmarshaled as u64 dict")
+}
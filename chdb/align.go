@@ -0,0 +1,47 @@
+// align.go -- record alignment
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// largest supported record alignment
+const _MaxAlign = 1 << 20
+
+// WithRecordAlign makes the DBWriter start every record (the checksum
+// followed by the value) at a multiple of 'n' bytes - e.g., 512 or 4096 - so
+// that records can be read with O_DIRECT or accessed in place from an mmap
+// without bounce buffers. 'n' must be a power of 2 no larger than 1MB; 0
+// disables alignment. Large gaps between records are left as holes in the
+// file. The alignment is recorded in the header; see DBReader.RecordAlign().
+func WithRecordAlign(n int) WriterOption {
+	return func(o *writerOpts) {
+		o.align = n
+	}
+}
+
+// RecordAlign returns the alignment of the records in the DB file; 0 if the
+// records aren't aligned.
+func (rd *DBReader) RecordAlign() int {
+	return int(rd.align)
+}
+
+// return true if 'n' is a valid record alignment
+func validAlign(n uint64) bool {
+	return n <= _MaxAlign && (n&(n-1)) == 0
+}
+
+// skip to the next record boundary
+func (w *DBWriter) alignRecord() error {
+	a := uint64(w.opt.align)
+	if a <= 1 {
+		return nil
+	}
+
+	return w.padTo((w.off + a - 1) &^ (a - 1))
+}
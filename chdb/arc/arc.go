@@ -0,0 +1,71 @@
+// arc.go -- ARC record cache for DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package arc adapts the Adaptive Replacement Cache (ARC) of
+// github.com/opencoff/golang-lru to a chdb.Cache. ARC resists scans better
+// than an LRU; use it with chdb.WithCache():
+//
+//	c, err := arc.New(4096)
+//	...
+//	rd, err := chdb.NewDBReader(fn, 0, chdb.WithCache(c))
+package arc
+
+import (
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/golang-lru"
+)
+
+// Cache is an ARC cache of DB records
+type Cache struct {
+	c *lru.ARCCache
+}
+
+var (
+	_ chdb.Cache     = &Cache{}
+	_ chdb.CacheKeys = &Cache{}
+)
+
+// New returns an ARC cache that holds up to 'size' records
+func New(size int) (*Cache, error) {
+	c, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{c}, nil
+}
+
+// Get returns the cached value of 'key'
+func (c *Cache) Get(key uint64) ([]byte, bool) {
+	v, ok := c.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+// Add caches 'val' as the value of 'key'
+func (c *Cache) Add(key uint64, val []byte) {
+	c.c.Add(key, val)
+}
+
+// Purge removes all the entries
+func (c *Cache) Purge() {
+	c.c.Purge()
+}
+
+// Keys returns the cached keys; the least recently used first
+func (c *Cache) Keys() []uint64 {
+	ks := c.c.Keys()
+	keys := make([]uint64, 0, len(ks))
+	for _, k := range ks {
+		keys = append(keys, k.(uint64))
+	}
+	return keys
+}
@@ -0,0 +1,188 @@
+// batch.go -- batched record lookups
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"os"
+	"time"
+)
+
+// max number of record reads issued together
+const _BatchSize = 64
+
+// a single positional read in a batch
+type readReq struct {
+	off  uint64
+	slot uint64
+	buf  []byte
+	err  error
+}
+
+// FindMany looks up all the keys in 'keys' and returns their values in the
+// same order. Keys that are not in the DB have a nil value; in a keys-only
+// DB, keys that are present have an empty (non-nil) value. Records that
+// aren't in the cache are read from disk in batches - on Linux builds with
+// the "iouring" tag, each batch is issued with a single io_uring submission.
+// It returns an error if disk i/o or a record checksum failed. A Tracer sees
+// every key of the batch; each with the duration of the whole call.
+func (rd *DBReader) FindMany(keys []uint64) ([][]byte, error) {
+	if rd.tracer == nil {
+		return rd.findMany(keys)
+	}
+
+	for _, key := range keys {
+		rd.tracer.OnLookupStart(key)
+	}
+
+	t0 := time.Now()
+	vals, err := rd.findMany(keys)
+	dur := time.Since(t0)
+	for k, key := range keys {
+		hit := err == nil && vals[k] != nil
+		rd.tracer.OnLookupEnd(key, hit, dur, err)
+	}
+	return vals, err
+}
+
+// look up 'keys' in batches
+func (rd *DBReader) findMany(keys []uint64) (_ [][]byte, err error) {
+	defer catchTableRead(&err)
+
+	if rd.xform != nil {
+		xk := make([]uint64, len(keys))
+		for i, k := range keys {
+			xk[i] = rd.xform.Transform(k)
+		}
+		keys = xk
+	}
+	return rd.findStored(keys)
+}
+
+// look up the stored keys 'keys' in batches
+func (rd *DBReader) findStored(keys []uint64) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+
+	var reqs []readReq
+	var idx []int
+
+	flush := func() error {
+		rd.readBatch(reqs)
+		for i := range reqs {
+			r := &reqs[i]
+			if r.err == nil {
+				r.err = rd.checkRecord(r.buf, r.off, r.slot)
+			}
+			if r.err != nil {
+				return r.err
+			}
+
+			k := idx[i]
+			val := r.buf[8:]
+			if rd.codec != nil && len(val) > 0 {
+				v, err := rd.decode(nil, val)
+				if err != nil {
+					return err
+				}
+				val = v
+			}
+			vals[k] = val
+			rd.stats.hit()
+			rd.cache.Add(rd.ckey(keys[k]), val)
+			rd.touch(keys[k])
+		}
+
+		reqs = reqs[:0]
+		idx = idx[:0]
+		return nil
+	}
+
+	for k, key := range keys {
+		rd.stats.lookup()
+		ck := rd.ckey(key)
+		if v, ok := rd.cache.Get(ck); ok {
+			if vals[k] = v; vals[k] == nil {
+				vals[k] = []byte{}
+			}
+			rd.stats.cacheHit()
+			rd.touch(key)
+			continue
+		}
+
+		i := rd.chd.Find(key)
+		if !rd.has(i, key) {
+			rd.stats.miss()
+			continue
+		}
+
+		if keysOnly {
+			vals[k] = []byte{}
+			rd.stats.hit()
+			rd.cache.Add(ck, nil)
+			rd.touch(key)
+			continue
+		}
+
+		vlen := rd.vlenAt(i)
+		if vlen == 0 {
+			// empty values have no record on disk
+			vals[k] = []byte{}
+			rd.stats.hit()
+			rd.cache.Add(ck, vals[k])
+			rd.touch(key)
+			continue
+		}
+		if err := rd.checkExtent(rd.offAt(i), vlen, i); err != nil {
+			return nil, err
+		}
+
+		reqs = append(reqs, readReq{
+			off:  rd.offAt(i),
+			slot: i,
+			buf:  make([]byte, int(vlen)+8),
+		})
+		idx = append(idx, k)
+
+		if len(reqs) == _BatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(reqs) > 0 {
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// issue the reads in 'reqs' as a batch and account for the bytes read
+func (rd *DBReader) readBatch(reqs []readReq) {
+	rd.bio.read(rd.fd, reqs)
+
+	var n int
+	for i := range reqs {
+		if reqs[i].err == nil {
+			n += len(reqs[i].buf)
+		}
+	}
+	rd.stats.read(n)
+}
+
+// issue the reads in 'reqs' one at a time
+func preadBatch(fd *os.File, reqs []readReq) {
+	for i := range reqs {
+		r := &reqs[i]
+		_, r.err = fd.ReadAt(r.buf, int64(r.off))
+	}
+}
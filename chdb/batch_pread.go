@@ -0,0 +1,28 @@
+// batch_pread.go -- batched record reads using pread(2)
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux || !iouring
+// +build !linux !iouring
+
+package chdb
+
+import (
+	"os"
+)
+
+// batchIO issues the reads of a batch one at a time
+type batchIO struct{}
+
+func (b *batchIO) read(fd *os.File, reqs []readReq) {
+	preadBatch(fd, reqs)
+}
+
+func (b *batchIO) close() {
+}
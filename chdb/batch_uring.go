@@ -0,0 +1,350 @@
+// batch_uring.go -- batched record reads using io_uring(7)
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux && iouring
+// +build linux,iouring
+
+package chdb
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// batchIO issues the reads of a batch with a single io_uring submission. It
+// keeps a free list of rings so concurrent batches don't contend. If io_uring
+// is unavailable (old kernel, seccomp etc.), it falls back to pread(2).
+type batchIO struct {
+	mu   sync.Mutex
+	free []*uring
+
+	// set when we fail to set up a ring
+	disabled bool
+
+	// rings that may still write into the buffers they pin; see read()
+	stuck []*uring
+}
+
+func (b *batchIO) read(fd *os.File, reqs []readReq) {
+	u := b.get()
+	if u == nil {
+		preadBatch(fd, reqs)
+		return
+	}
+
+	// the ring is in an unknown state after a failed submission; reads
+	// are idempotent - so we redo the whole batch. If the ring couldn't
+	// wait for the reads in flight, the kernel may still write into their
+	// old buffers; so we never close or free it.
+	if err := u.read(fd, reqs); err != nil {
+		if u.pinned != nil {
+			b.mu.Lock()
+			b.stuck = append(b.stuck, u)
+			b.mu.Unlock()
+		} else {
+			u.close()
+		}
+		preadBatch(fd, reqs)
+		return
+	}
+
+	b.mu.Lock()
+	b.free = append(b.free, u)
+	b.mu.Unlock()
+}
+
+func (b *batchIO) get() *uring {
+	b.mu.Lock()
+	if n := len(b.free); n > 0 {
+		u := b.free[n-1]
+		b.free = b.free[:n-1]
+		b.mu.Unlock()
+		return u
+	}
+
+	if b.disabled {
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	u, err := newUring(_BatchSize)
+	if err != nil {
+		b.mu.Lock()
+		b.disabled = true
+		b.mu.Unlock()
+		return nil
+	}
+	return u
+}
+
+func (b *batchIO) close() {
+	b.mu.Lock()
+	for _, u := range b.free {
+		u.close()
+	}
+	b.free = nil
+	b.mu.Unlock()
+}
+
+const (
+	_SYS_IO_URING_SETUP = 425
+	_SYS_IO_URING_ENTER = 426
+
+	_IORING_OFF_SQ_RING = 0
+	_IORING_OFF_CQ_RING = 0x8000000
+	_IORING_OFF_SQES    = 0x10000000
+
+	_IORING_ENTER_GETEVENTS = 1
+
+	_IORING_OP_READ = 22
+)
+
+// struct io_sqring_offsets
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	flags, dropped, array, resv1      uint32
+	resv2                             uint64
+}
+
+// struct io_cqring_offsets
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries uint32
+	overflow, cqes, flags, resv1      uint32
+	resv2                             uint64
+}
+
+// struct io_uring_params
+type uringParams struct {
+	sqEntries, cqEntries, flags uint32
+	sqThreadCPU, sqThreadIdle   uint32
+	features, wqFd              uint32
+	resv                        [3]uint32
+	sqOff                       sqringOffsets
+	cqOff                       cqringOffsets
+}
+
+// struct io_uring_sqe
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	pad         [2]uint64
+}
+
+// struct io_uring_cqe
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// an io_uring instance with its mapped submission and completion rings
+type uring struct {
+	fd      int
+	entries uint32
+
+	sqMem, cqMem, sqeMem []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSqe
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCqe
+
+	// buffers of reads that may still be in flight
+	pinned [][]byte
+}
+
+func newUring(entries uint32) (*uring, error) {
+	var p uringParams
+
+	fd, _, e := syscall.Syscall(_SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, e
+	}
+
+	u := &uring{
+		fd:      int(fd),
+		entries: p.sqEntries,
+	}
+
+	mmap := func(off int64, sz uint32) ([]byte, error) {
+		return syscall.Mmap(u.fd, off, int(sz), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	}
+
+	var err error
+	if u.sqMem, err = mmap(_IORING_OFF_SQ_RING, p.sqOff.array+p.sqEntries*4); err != nil {
+		u.close()
+		return nil, err
+	}
+	if u.cqMem, err = mmap(_IORING_OFF_CQ_RING, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCqe{}))); err != nil {
+		u.close()
+		return nil, err
+	}
+	if u.sqeMem, err = mmap(_IORING_OFF_SQES, p.sqEntries*uint32(unsafe.Sizeof(uringSqe{}))); err != nil {
+		u.close()
+		return nil, err
+	}
+
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.tail]))
+	u.sqMask = *(*uint32)(unsafe.Pointer(&u.sqMem[p.sqOff.ringMask]))
+	u.sqArray = bsToUint32Slice(u.sqMem[p.sqOff.array:])[:p.sqEntries]
+	u.sqes = (*[1 << 16]uringSqe)(unsafe.Pointer(&u.sqeMem[0]))[:p.sqEntries:p.sqEntries]
+
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.head]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.tail]))
+	u.cqMask = *(*uint32)(unsafe.Pointer(&u.cqMem[p.cqOff.ringMask]))
+	u.cqes = (*[1 << 16]uringCqe)(unsafe.Pointer(&u.cqMem[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+	return u, nil
+}
+
+// read all the requests in 'reqs' from 'fd'. Errors of individual reads are
+// recorded in the request; the returned error is for the ring itself.
+func (u *uring) read(fd *os.File, reqs []readReq) error {
+	ifd := int32(fd.Fd())
+
+	for len(reqs) > 0 {
+		n := len(reqs)
+		if n > int(u.entries) {
+			n = int(u.entries)
+		}
+
+		batch := reqs[:n]
+
+		// we are the only producer of this ring
+		tail := *u.sqTail
+		for i := range batch {
+			r := &batch[i]
+			idx := tail & u.sqMask
+			u.sqes[idx] = uringSqe{
+				opcode:   _IORING_OP_READ,
+				fd:       ifd,
+				off:      r.off,
+				addr:     uint64(uintptr(unsafe.Pointer(&r.buf[0]))),
+				len:      uint32(len(r.buf)),
+				userData: uint64(i),
+			}
+			u.sqArray[idx] = idx
+			tail++
+		}
+		atomic.StoreUint32(u.sqTail, tail)
+
+		submit, done := n, 0
+		for done < n {
+			nsub, _, e := syscall.Syscall6(_SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(submit), 1, _IORING_ENTER_GETEVENTS, 0, 0)
+			if e != 0 {
+				if e == syscall.EINTR {
+					continue
+				}
+
+				// the reads we submitted may still be in flight and
+				// write into 'batch'; wait for them. If we can't, the
+				// ring keeps the old buffers and the batch gets new ones.
+				if err := u.wait(n - submit - done); err != nil {
+					for i := range batch {
+						r := &batch[i]
+						u.pinned = append(u.pinned, r.buf)
+						r.buf = make([]byte, len(r.buf))
+					}
+				}
+				return e
+			}
+			submit -= int(nsub)
+
+			done += u.reap(func(cqe *uringCqe) {
+				complete(fd, &batch[cqe.userData], cqe.res)
+			})
+		}
+
+		// the kernel wrote into these buffers behind the GC's back
+		runtime.KeepAlive(batch)
+		reqs = reqs[n:]
+	}
+	return nil
+}
+
+// wait for 'pending' submitted reads to complete and discard their results
+func (u *uring) wait(pending int) error {
+	for pending > 0 {
+		_, _, e := syscall.Syscall6(_SYS_IO_URING_ENTER, uintptr(u.fd), 0, 1, _IORING_ENTER_GETEVENTS, 0, 0)
+		if e != 0 && e != syscall.EINTR {
+			return e
+		}
+		pending -= u.reap(func(*uringCqe) {})
+	}
+	return nil
+}
+
+// call 'fp' for each available completion and return their number
+func (u *uring) reap(fp func(cqe *uringCqe)) int {
+	var n int
+
+	head := atomic.LoadUint32(u.cqHead)
+	tail := atomic.LoadUint32(u.cqTail)
+	for ; head != tail; head++ {
+		fp(&u.cqes[head&u.cqMask])
+		n++
+	}
+	atomic.StoreUint32(u.cqHead, head)
+	return n
+}
+
+// finish request 'r' given the result 'res' of its completion
+func complete(fd *os.File, r *readReq, res int32) {
+	switch {
+	case res < 0:
+		e := syscall.Errno(-res)
+		if e != syscall.EINVAL && e != syscall.EOPNOTSUPP {
+			r.err = e
+			return
+		}
+
+		// IORING_OP_READ is unsupported on this kernel
+		_, r.err = fd.ReadAt(r.buf, int64(r.off))
+
+	case int(res) < len(r.buf):
+		// short read; the rest comes from pread (which reports EOF)
+		_, r.err = fd.ReadAt(r.buf[res:], int64(r.off)+int64(res))
+
+	default:
+		r.err = nil
+	}
+}
+
+func (u *uring) close() {
+	if u.sqeMem != nil {
+		syscall.Munmap(u.sqeMem)
+	}
+	if u.cqMem != nil {
+		syscall.Munmap(u.cqMem)
+	}
+	if u.sqMem != nil {
+		syscall.Munmap(u.sqMem)
+	}
+	syscall.Close(u.fd)
+}
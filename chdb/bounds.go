@@ -0,0 +1,49 @@
+// bounds.go -- limits on the records a DBReader reads from untrusted files
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+)
+
+// The offset and vlen tables of a DB say where each record is and how big it
+// is; the reader allocates a buffer of that size before it reads the record
+// and verifies its checksum. A damaged or hostile DB can claim records of
+// upto 4GB. So every record must lie within the records of the file -
+// between the header and the offset table - and its value can't be larger
+// than the limit set by WithMaxValueSize(). Records that break these bounds
+// fail with ErrCorrupt before anything is allocated.
+
+// WithMaxValueSize makes lookups of values larger than 'n' bytes fail with
+// ErrCorrupt; so a corrupt DB can't make a lookup allocate more than 'n'
+// bytes. For DBs written with a ValueCodec, the limit applies to the
+// encoded and the decoded value; the built-in codecs (e.g., Flate) stop
+// decoding at the limit. Zero (the default) limits values only by
+// the size of the file.
+func WithMaxValueSize(n uint32) ReaderOption {
+	return func(o *readerOpts) {
+		o.maxValue = n
+	}
+}
+
+// return an error if the record of 'vlen' bytes at offset 'off' of slot 'i'
+// is out of bounds
+func (rd *DBReader) checkExtent(off uint64, vlen uint32, i uint64) error {
+	end := off + 8 + uint64(vlen)
+	if off < 64 || off > rd.offtbl || end > rd.offtbl {
+		return fmt.Errorf("%s: %w: slot %d: record of %d bytes at off %d is outside the records",
+			rd.fn, ErrCorrupt, i, vlen, off)
+	}
+	if max := rd.maxValue; max > 0 && vlen > max {
+		return fmt.Errorf("%s: %w: slot %d: %d byte value; limit is %d", rd.fn, ErrCorrupt, i, vlen, max)
+	}
+	return nil
+}
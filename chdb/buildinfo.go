@@ -0,0 +1,160 @@
+// buildinfo.go -- build provenance of a DB
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// BuildInfo describes how and when a DB was built. The DBWriter stores it as
+// an extra record after the key/value records; the header holds its offset
+// and length. The record value is (big-endian):
+//
+//	magic   [4]byte "CHDI"
+//	time    int64   build time in nanoseconds since the Unix epoch
+//	toollen uint16  length of the tool string
+//	tool    []byte  name and version of the builder
+//	srclen  uint16  length of the source digest
+//	src     []byte  caller supplied digest of the source data
+type BuildInfo struct {
+	Time   time.Time `json:"time"`
+	Tool   string    `json:"tool"`
+	Source []byte    `json:"source,omitempty"`
+}
+
+// WithBuildTime records 't' as the build time of the DB instead of the time
+// of Freeze(); this is useful for reproducible builds.
+func WithBuildTime(t time.Time) WriterOption {
+	return func(o *writerOpts) {
+		o.buildTime = t
+	}
+}
+
+// WithSourceDigest records 'd' (e.g., a hash of the input data) in the build
+// info of the DB. 'd' is at most 65535 bytes.
+func WithSourceDigest(d []byte) WriterOption {
+	return func(o *writerOpts) {
+		o.srcDigest = append([]byte(nil), d...)
+	}
+}
+
+// name and version of this package as a builder
+func toolVersion() string {
+	const path = "github.com/opencoff/go-chd"
+
+	ver := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == path && len(bi.Main.Version) > 0 {
+			ver = bi.Main.Version
+		}
+		for _, m := range bi.Deps {
+			if m.Path == path {
+				ver = m.Version
+				break
+			}
+		}
+	}
+	return fmt.Sprintf("go-chd %s (%s)", ver, runtime.Version())
+}
+
+func (b *BuildInfo) marshal() []byte {
+	n := 4 + 8 + 2 + len(b.Tool) + 2 + len(b.Source)
+	buf := make([]byte, n)
+
+	be := binary.BigEndian
+	copy(buf[:4], []byte{'C', 'H', 'D', 'I'})
+	be.PutUint64(buf[4:], uint64(b.Time.UnixNano()))
+
+	i := 12
+	be.PutUint16(buf[i:], uint16(len(b.Tool)))
+	i += 2
+	i += copy(buf[i:], b.Tool)
+	be.PutUint16(buf[i:], uint16(len(b.Source)))
+	i += 2
+	copy(buf[i:], b.Source)
+	return buf
+}
+
+func (b *BuildInfo) unmarshal(buf []byte) error {
+	if len(buf) < 16 || string(buf[:4]) != "CHDI" {
+		return fmt.Errorf("bad build info")
+	}
+
+	be := binary.BigEndian
+	b.Time = time.Unix(0, int64(be.Uint64(buf[4:]))).UTC()
+
+	buf = buf[12:]
+	n := int(be.Uint16(buf))
+	if len(buf) < 2+n+2 {
+		return fmt.Errorf("build info too short")
+	}
+	b.Tool = string(buf[2 : 2+n])
+
+	buf = buf[2+n:]
+	n = int(be.Uint16(buf))
+	if len(buf) != 2+n {
+		return fmt.Errorf("build info size mismatch")
+	}
+	if n > 0 {
+		b.Source = append([]byte(nil), buf[2:]...)
+	}
+	return nil
+}
+
+// write the build info record at the current offset and return its offset
+// and length
+func (w *DBWriter) writeBuildInfo() (uint64, uint32, error) {
+	b := BuildInfo{
+		Time:   w.opt.buildTime,
+		Tool:   toolVersion(),
+		Source: w.opt.srcDigest,
+	}
+	if b.Time.IsZero() {
+		b.Time = time.Now()
+	}
+
+	val := b.marshal()
+	if err := w.alignRecord(); err != nil {
+		return 0, 0, err
+	}
+
+	off := w.off
+	if err := w.writeRecord(val, off); err != nil {
+		return 0, 0, err
+	}
+	return off, uint32(len(val)), nil
+}
+
+// BuildInfo returns the build provenance of the DB; it returns nil if the
+// DB was built without it (i.e., by an older version).
+func (rd *DBReader) BuildInfo() (*BuildInfo, error) {
+	if rd.binfoOff == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, 8+int(rd.binfoLen))
+	if _, err := rd.fd.ReadAt(data, int64(rd.binfoOff)); err != nil {
+		return nil, fmt.Errorf("%s: can't read build info: %s", rd.fn, err)
+	}
+	if err := rd.verifyRecord(data, rd.binfoOff); err != nil {
+		return nil, err
+	}
+
+	var b BuildInfo
+	if err := b.unmarshal(data[8:]); err != nil {
+		return nil, fmt.Errorf("%s: %s", rd.fn, err)
+	}
+	return &b, nil
+}
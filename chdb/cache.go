@@ -0,0 +1,318 @@
+// cache.go -- record cache of the DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+// Cache holds records that a DBReader has read from disk. The DBReader uses
+// a ShardedCache of LRUCaches by default; WithCache() plugs in a different implementation
+// (e.g., the ARC cache in package chdb/arc). A Cache must be safe for
+// concurrent use and must not be shared between readers of different DBs.
+// Caches that also have a Keys() method (see CacheKeys) can be saved with
+// DBReader.SaveHotSet().
+type Cache interface {
+	// Get returns the cached value of 'key'
+	Get(key uint64) ([]byte, bool)
+
+	// Add caches 'val' as the value of 'key'; a nil 'val' is cached too
+	Add(key uint64, val []byte)
+
+	// Purge removes all the entries
+	Purge()
+}
+
+// CacheKeys is implemented by caches that can list the keys they hold
+type CacheKeys interface {
+	// Keys returns the cached keys; the least recently used first if
+	// the cache tracks recency - so that adding them in this order
+	// restores it.
+	Keys() []uint64
+}
+
+// LRUCache is a least-recently-used cache of records bounded by the number of
+// entries and optionally by the total size of the values.
+type LRUCache struct {
+	mu sync.Mutex
+
+	m    map[uint64]*lruEntry
+	head lruEntry // sentinel; head.next is the most recently used
+
+	max      int
+	maxBytes uint64
+	bytes    uint64
+}
+
+type lruEntry struct {
+	key        uint64
+	val        []byte
+	prev, next *lruEntry
+}
+
+var (
+	_ Cache     = &LRUCache{}
+	_ CacheKeys = &LRUCache{}
+)
+
+// NewLRUCache returns a cache that holds up to 'entries' records (at least
+// 1) whose values total up to 'maxBytes' bytes; a zero 'maxBytes' doesn't
+// limit the size. Values larger than 'maxBytes' are never cached.
+func NewLRUCache(entries int, maxBytes uint64) *LRUCache {
+	if entries <= 0 {
+		entries = 1
+	}
+
+	c := &LRUCache{
+		m:        make(map[uint64]*lruEntry, entries),
+		max:      entries,
+		maxBytes: maxBytes,
+	}
+	c.head.prev = &c.head
+	c.head.next = &c.head
+	return c
+}
+
+// Get returns the cached value of 'key' and marks it as recently used
+func (c *LRUCache) Get(key uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.unlink(e)
+	c.push(e)
+	return e.val, true
+}
+
+// Add caches 'val' as the value of 'key' and evicts the least recently used
+// entries to stay within the limits.
+func (c *LRUCache) Add(key uint64, val []byte) {
+	n := uint64(len(val))
+	if c.maxBytes > 0 && n > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.m[key]; ok {
+		c.bytes += n - uint64(len(e.val))
+		e.val = val
+		c.unlink(e)
+		c.push(e)
+	} else {
+		e = &lruEntry{key: key, val: val}
+		c.m[key] = e
+		c.bytes += n
+		c.push(e)
+	}
+
+	for len(c.m) > c.max || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		e := c.head.prev
+		c.unlink(e)
+		delete(c.m, e.key)
+		c.bytes -= uint64(len(e.val))
+	}
+}
+
+// Purge removes all the entries
+func (c *LRUCache) Purge() {
+	c.mu.Lock()
+	c.m = make(map[uint64]*lruEntry)
+	c.head.prev = &c.head
+	c.head.next = &c.head
+	c.bytes = 0
+	c.mu.Unlock()
+}
+
+// Keys returns the cached keys; the least recently used first
+func (c *LRUCache) Keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]uint64, 0, len(c.m))
+	for e := c.head.prev; e != &c.head; e = e.prev {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// Len returns the number of cached records
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+// Bytes returns the total size of the cached values
+func (c *LRUCache) Bytes() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *LRUCache) unlink(e *lruEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+}
+
+// make 'e' the most recently used entry
+func (c *LRUCache) push(e *lruEntry) {
+	e.prev = &c.head
+	e.next = c.head.next
+	c.head.next.prev = e
+	c.head.next = e
+}
+
+// ShardedCache spreads records over several LRUCaches by key hash so that
+// concurrent lookups of different keys rarely contend for the same lock.
+// Each shard evicts independently; the cache as a whole is only
+// approximately LRU.
+type ShardedCache struct {
+	shards []*LRUCache
+	shift  uint
+}
+
+var (
+	_ Cache     = &ShardedCache{}
+	_ CacheKeys = &ShardedCache{}
+)
+
+// NewShardedLRUCache returns a cache with 'shards' shards (rounded up to a
+// power of two) that together hold up to 'entries' records whose values
+// total up to 'maxBytes' bytes; a zero 'maxBytes' doesn't limit the size.
+// The limits are split evenly between the shards.
+func NewShardedLRUCache(shards, entries int, maxBytes uint64) *ShardedCache {
+	if shards <= 0 {
+		shards = 1
+	}
+	if entries <= 0 {
+		entries = 1
+	}
+
+	lg := uint(bits.Len(uint(shards - 1)))
+	n := 1 << lg
+	c := &ShardedCache{
+		shards: make([]*LRUCache, n),
+		shift:  64 - lg,
+	}
+
+	per := (entries + n - 1) / n
+	perBytes := (maxBytes + uint64(n) - 1) / uint64(n)
+	for i := range c.shards {
+		c.shards[i] = NewLRUCache(per, perBytes)
+	}
+	return c
+}
+
+// Get returns the cached value of 'key'
+func (c *ShardedCache) Get(key uint64) ([]byte, bool) {
+	return c.shard(key).Get(key)
+}
+
+// Add caches 'val' as the value of 'key'
+func (c *ShardedCache) Add(key uint64, val []byte) {
+	c.shard(key).Add(key, val)
+}
+
+// Purge removes all the entries
+func (c *ShardedCache) Purge() {
+	for _, s := range c.shards {
+		s.Purge()
+	}
+}
+
+// Shards returns the number of shards
+func (c *ShardedCache) Shards() int {
+	return len(c.shards)
+}
+
+// Keys returns the cached keys; the least recently used first within each
+// shard.
+func (c *ShardedCache) Keys() []uint64 {
+	var keys []uint64
+	for _, s := range c.shards {
+		keys = append(keys, s.Keys()...)
+	}
+	return keys
+}
+
+// Len returns the number of cached records
+func (c *ShardedCache) Len() int {
+	var n int
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Bytes returns the total size of the cached values
+func (c *ShardedCache) Bytes() uint64 {
+	var n uint64
+	for _, s := range c.shards {
+		n += s.Bytes()
+	}
+	return n
+}
+
+// keys need not be well distributed (e.g., small integers); mix them with
+// a fibonacci hash and use the top bits to pick the shard.
+func (c *ShardedCache) shard(key uint64) *LRUCache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[(key*0x9e3779b97f4a7c15)>>c.shift]
+}
+
+// default number of cache shards: one per CPU, but keep at least 16
+// records in each shard.
+func cacheShards(entries int) int {
+	n := runtime.GOMAXPROCS(0)
+	if m := entries / 16; m < n {
+		n = m
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// WithCache makes the DBReader cache records in 'c' instead of its own
+// LRUCache; the 'cache' argument of NewDBReader() is then ignored.
+func WithCache(c Cache) ReaderOption {
+	return func(o *readerOpts) {
+		o.cache = c
+	}
+}
+
+// WithCacheBytes limits the total size of the values in the default record
+// cache to 'n' bytes - in addition to the limit on the number of records.
+func WithCacheBytes(n uint64) ReaderOption {
+	return func(o *readerOpts) {
+		o.cacheBytes = n
+	}
+}
+
+// WithCacheShards splits the default record cache into 'n' shards (rounded
+// up to a power of two) to reduce lock contention between concurrent
+// lookups. The default is one shard per CPU but no fewer than 16 records per
+// shard.
+func WithCacheShards(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.cacheShards = n
+	}
+}
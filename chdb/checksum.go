@@ -0,0 +1,72 @@
+// checksum.go -- selectable metadata checksum
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"crypto/sha512"
+	"hash"
+	"hash/crc32"
+)
+
+// Checksum identifies the algorithm of the checksum over the DB header, the
+// offset table and the hash table. The checksum is always stored in the 32
+// byte trailer of the DB; shorter checksums are zero padded. The algorithm
+// is recorded in the header flags (see FlagChecksumMask).
+type Checksum int
+
+const (
+	// ChecksumSHA512_256 is a strong cryptographic checksum (the default)
+	ChecksumSHA512_256 Checksum = iota
+
+	// ChecksumCRC32C is a fast, hardware accelerated checksum that only
+	// detects accidental corruption.
+	ChecksumCRC32C
+)
+
+const flagChecksumShift = 2
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WithChecksum selects the algorithm of the metadata checksum
+func WithChecksum(c Checksum) WriterOption {
+	return func(o *writerOpts) {
+		o.checksum = c
+	}
+}
+
+// String returns the name of the checksum algorithm
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumSHA512_256:
+		return "sha512-256"
+	case ChecksumCRC32C:
+		return "crc32c"
+	}
+	return "unknown"
+}
+
+// return a new hash for algorithm 'c'; nil if 'c' is unknown
+func (c Checksum) hash() hash.Hash {
+	switch c {
+	case ChecksumSHA512_256:
+		return sha512.New512_256()
+	case ChecksumCRC32C:
+		return crc32.New(castagnoli)
+	}
+	return nil
+}
+
+// return the checksum in 'h' as a 32 byte trailer
+func trailer(h hash.Hash) []byte {
+	var t [32]byte
+	copy(t[:], h.Sum(nil))
+	return t[:]
+}
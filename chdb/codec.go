@@ -0,0 +1,238 @@
+// codec.go -- transparent transformation of values
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ValueCodec transforms values on their way into and out of a DB; e.g., to
+// compress or encrypt them. The DBWriter encodes every non-empty value before
+// writing it and records the codec ID in the file header. DBReaders decode
+// values with the codec of the same ID; a DB written with a codec can't be
+// opened without it.
+type ValueCodec interface {
+	// ID identifies the codec in the file header; it must be non-zero. IDs
+	// with the high bit set are reserved for the codecs of this package.
+	ID() uint32
+
+	// Encode appends the encoded form of 'src' to 'dst' and returns the
+	// extended slice
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode appends the decoded form of 'src' to 'dst' and returns the
+	// extended slice
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// NewValueCodec returns a ValueCodec with the given ID built from a pair of
+// encode and decode functions.
+func NewValueCodec(id uint32, enc, dec func(v []byte) ([]byte, error)) ValueCodec {
+	return &funcCodec{id, enc, dec}
+}
+
+type funcCodec struct {
+	id  uint32
+	enc func(v []byte) ([]byte, error)
+	dec func(v []byte) ([]byte, error)
+}
+
+func (c *funcCodec) ID() uint32 {
+	return c.id
+}
+
+func (c *funcCodec) Encode(dst, src []byte) ([]byte, error) {
+	v, err := c.enc(src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, v...), nil
+}
+
+func (c *funcCodec) Decode(dst, src []byte) ([]byte, error) {
+	v, err := c.dec(src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, v...), nil
+}
+
+// CodecFlate is the ID of the Flate codec
+const CodecFlate uint32 = 0x80000001
+
+// Flate is a ValueCodec that compresses values with DEFLATE. Like all the
+// codecs of this package, DBReaders know it without WithValueCodecs().
+var Flate ValueCodec = &flateCodec{funcCodec{CodecFlate, flateEncode, flateDecode}}
+
+// CodecZstd is the ID of the Zstd codec
+const CodecZstd uint32 = 0x80000002
+
+// Zstd is a ValueCodec that compresses values with zstd; it compresses
+// better than Flate and decodes faster.
+var Zstd ValueCodec = &zstdCodec{}
+
+// codecs every DBReader knows
+var builtinCodecs = []ValueCodec{Flate, Zstd}
+
+func flateEncode(v []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(v); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func flateDecode(v []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(v))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// a ValueCodec that can stop decoding a value once it is larger than a
+// limit; a small hostile value can't then inflate to gigabytes.
+type limitDecoder interface {
+	// decodeLimit is like Decode() - except that it decodes at most
+	// 'max'+1 bytes of 'src'
+	decodeLimit(dst, src []byte, max uint32) ([]byte, error)
+}
+
+type flateCodec struct {
+	funcCodec
+}
+
+func (c *flateCodec) decodeLimit(dst, src []byte, max uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	v, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, v...), nil
+}
+
+// WithValueCodec makes the DBWriter encode every value with 'c'
+func WithValueCodec(c ValueCodec) WriterOption {
+	return func(o *writerOpts) {
+		o.codec = c
+	}
+}
+
+// WithValueCodecs registers the codecs the DBReader may need to decode
+// values. The codec whose ID matches the one in the file header is used;
+// DBs written without a codec ignore them.
+func WithValueCodecs(cs ...ValueCodec) ReaderOption {
+	return func(o *readerOpts) {
+		o.codecs = append(o.codecs, cs...)
+	}
+}
+
+// decode value 'v' read from disk into 'dst' (appending to it)
+func (rd *DBReader) decode(dst, v []byte) ([]byte, error) {
+	if rd.codec == nil || len(v) == 0 {
+		return append(dst, v...), nil
+	}
+
+	var d []byte
+	var err error
+
+	n := len(dst)
+	max := rd.maxValue
+	if ld, ok := rd.codec.(limitDecoder); ok && max > 0 {
+		d, err = ld.decodeLimit(dst, v, max)
+	} else {
+		d, err = rd.codec.Decode(dst, v)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't decode value: %w", rd.fn, err)
+	}
+	if max > 0 && uint64(len(d)-n) > uint64(max) {
+		return nil, fmt.Errorf("%s: %w: decoded value of %d bytes; limit is %d", rd.fn, ErrCorrupt, len(d)-n, max)
+	}
+	return d, nil
+}
+
+// the zstd encoder and decoder are safe for concurrent use by EncodeAll()
+// and DecodeAll(); so all the DBs share one of each - created on first use.
+type zstdCodec struct {
+	sync.Once
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+	err error
+}
+
+func (c *zstdCodec) init() error {
+	c.Do(func() {
+		if c.enc, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCodec) ID() uint32 {
+	return CodecZstd
+}
+
+func (c *zstdCodec) Encode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(src, dst), nil
+}
+
+func (c *zstdCodec) Decode(dst, src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(src, dst)
+}
+
+func (c *zstdCodec) decodeLimit(dst, src []byte, max uint32) ([]byte, error) {
+	// the decoder allocates a window as large as the frame header says;
+	// so cap it too
+	mem := uint64(max) + 1
+	if mem < zstd.MinWindowSize {
+		mem = zstd.MinWindowSize
+	}
+
+	r, err := zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(mem))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	v, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	switch {
+	case errors.Is(err, zstd.ErrWindowSizeExceeded), errors.Is(err, zstd.ErrDecoderSizeExceeded):
+		return nil, fmt.Errorf("%w: value is larger than %d bytes", ErrCorrupt, max)
+	case err != nil:
+		return nil, err
+	}
+	return append(dst, v...), nil
+}
@@ -0,0 +1,76 @@
+// content.go -- content addressed values
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+
+	"github.com/dchest/siphash"
+)
+
+// WithContentAddressed turns the value region of the DB into a content
+// addressed arena: every distinct value is stored once and all the keys
+// with that value refer to the same record. This shrinks DBs with many
+// repeated values; and, when used with Convert() or DBSet.Compact(), values
+// shared across the source DBs are stored only once. Such DBs are marked
+// with FlagSharedValues. Keys of different groups (see AddGroup()) never
+// share a record.
+func WithContentAddressed() WriterOption {
+	return func(o *writerOpts) {
+		o.shared = true
+	}
+}
+
+// arena of the distinct values written so far: keyed by the hash of the
+// (encoded) value
+type valueArena struct {
+	recs map[uint64]*value
+
+	// number of values that reused an existing record
+	hits int
+}
+
+func newValueArena() *valueArena {
+	return &valueArena{
+		recs: make(map[uint64]*value),
+	}
+}
+
+// return the existing record of group 'g' holding 'val'; nil if there is
+// none
+func (w *DBWriter) findValue(val []byte, g uint32) (*value, uint64, error) {
+	h := siphash.New(w.salt)
+	h.Write(val)
+	sum := h.Sum64()
+
+	v, ok := w.arena.recs[sum]
+	if !ok || v.vlen != uint32(len(val)) || v.group != g {
+		return nil, sum, nil
+	}
+
+	// a hash match is only a hint; compare the stored value
+	buf := make([]byte, len(val))
+	if _, err := w.fd.ReadAt(buf, int64(v.off+8)); err != nil {
+		return nil, sum, err
+	}
+	if !bytes.Equal(buf, val) {
+		return nil, sum, nil
+	}
+
+	w.arena.hits++
+	return v, sum, nil
+}
+
+// SharedValues returns true if the records of the DB are content
+// addressed; i.e., keys with identical values share a record.
+func (rd *DBReader) SharedValues() bool {
+	return (rd.flags & FlagSharedValues) > 0
+}
@@ -0,0 +1,103 @@
+// convert.go -- rewrite a DB with new build options
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+)
+
+// WithLoad sets the load factor of the DB built by Convert(); the default
+// is the load factor of the source DB. Freeze() ignores it.
+func WithLoad(load float64) WriterOption {
+	return func(o *writerOpts) {
+		o.load = load
+	}
+}
+
+// Convert reads every record of the DB 'src' and writes them to a new DB
+// 'dst' in the current format with the writer options 'opts'. 'dst' may be
+// the same file as 'src'; it is replaced atomically. The application flags,
+// key transform ID and the source digest of 'src' are preserved unless 'opts'
+// override them.
+// The records of a DB built with AddGroup() keep their groups. 'src' must not
+// need a ValueCodec other than the built-in ones.
+func Convert(src, dst string, opts ...WriterOption) error {
+	rd, err := NewDBReader(src, 1, withoutTransform())
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	in, err := rd.Info()
+	if err != nil {
+		return err
+	}
+
+	// the caller's options override the ones from 'src'
+	wopts := []WriterOption{WithAppFlags(rd.AppFlags()), WithLoad(in.Load), withStoredKeys(rd.xformID), WithSalt(rd.Salt())}
+	if in.Build != nil && len(in.Build.Source) > 0 {
+		wopts = append(wopts, WithSourceDigest(in.Build.Source))
+	}
+	wopts = append(wopts, opts...)
+
+	// the extents of a keys-only DB don't tell us the group of a key
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+	ext := rd.Extents()
+	if keysOnly && ext != nil {
+		return fmt.Errorf("%s: can't convert: keys-only DB doesn't record the groups of its keys", src)
+	}
+
+	wr, err := NewDBWriter(dst, wopts...)
+	if err != nil {
+		return err
+	}
+
+	// Scan() returns nil when we stop it early; so keep the error of Add()
+	// on its own.
+	var addErr error
+	add := func(g uint32) func(k uint64, v []byte) bool {
+		return func(k uint64, v []byte) bool {
+			switch {
+			case keysOnly:
+				addErr = wr.Add(k, nil)
+			case ext != nil:
+				addErr = wr.AddGroup(g, k, v)
+			default:
+				addErr = wr.Add(k, v)
+			}
+			return addErr == nil
+		}
+	}
+
+	if ext == nil {
+		err = rd.Scan(add(0))
+	} else {
+		for i := range ext {
+			g := ext[i].Group
+			if err = rd.ScanGroup(g, add(g)); err != nil || addErr != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		wr.Abort()
+		return fmt.Errorf("%s: can't convert: %w", src, err)
+	}
+
+	load := wr.opt.load
+	if load <= 0 || load > 1 {
+		load = 0.85
+	}
+	return wr.Freeze(load)
+}
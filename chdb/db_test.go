@@ -0,0 +1,4160 @@
+// db_test.go -- test suite for dbreader/dbwriter
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/dchest/siphash"
+	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-fasthash"
+)
+
+var keep bool
+
+func init() {
+	flag.BoolVar(&keep, "keep", false, "Keep test DB")
+}
+
+func TestDB(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer func() {
+		if keep {
+			t.Logf("DB in %s retained after test\n", fn)
+		} else {
+			os.Remove(fn)
+		}
+	}()
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	//rd.DumpMeta(os.Stdout)
+	for h, v := range kvmap {
+		s, err := rd.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+
+		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+	}
+
+	// now look for keys not in the DB
+	for i := 0; i < 10; i++ {
+		v, err := rd.Find(uint64(i))
+		assert(err != nil, "whoa: found key %d => %s", i, string(v))
+	}
+}
+
+func TestDBKeysOnly(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer func() {
+		if keep {
+			t.Logf("DB in %s retained after test\n", fn)
+		} else {
+			os.Remove(fn)
+		}
+	}()
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, nil)
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	//rd.DumpMeta(os.Stdout)
+
+	for h := range kvmap {
+		s, err := rd.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+
+		assert(s == nil, "key %x: value mismatch; exp nil, saw '%s'", h, string(s))
+	}
+
+	// now look for keys not in the DB
+	for i := 0; i < 10; i++ {
+		j := rand64()
+		v, err := rd.Find(j)
+		assert(err != nil, "whoa: found key %d => %s", j, string(v))
+	}
+}
+
+func TestDBFindInto(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer os.Remove(fn)
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	buf := make([]byte, 0, 64)
+	for h, v := range kvmap {
+		s, err := rd.FindInto(h, buf)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+	}
+
+	// steady state lookups must not allocate
+	var k uint64
+	for h := range kvmap {
+		k = h
+		break
+	}
+	n := testing.AllocsPerRun(100, func() {
+		buf, err = rd.FindInto(k, buf)
+	})
+	assert(err == nil, "can't find key %#x: %s", k, err)
+	assert(n == 0, "FindInto: %v allocs per lookup", n)
+
+	for i := 0; i < 10; i++ {
+		v, err := rd.FindInto(uint64(i), buf)
+		assert(err != nil, "whoa: found key %d => %s", i, string(v))
+	}
+}
+
+func TestDBSnapshot(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer os.Remove(fn)
+
+	hseed := rand64()
+	kvmap := make(map[uint64]string)
+	for _, s := range keyw {
+		h := fasthash.Hash64(hseed, []byte(s))
+		err = wr.Add(h, []byte(s))
+		assert(err == nil, "can't add key %x: %s", h, err)
+		kvmap[h] = s
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	snap, err := rd.Snapshot()
+	assert(err == nil, "snapshot failed: %s", err)
+
+	// the snapshot must outlive the reader
+	rd.Close()
+
+	_, err = rd.Snapshot()
+	assert(err == ErrClosed, "snapshot of closed reader: %v", err)
+
+	seen := make(map[uint64]bool)
+	err = snap.Iter(func(k uint64, v []byte) error {
+		s, ok := kvmap[k]
+		assert(ok, "iter: unknown key %#x", k)
+		assert(s == string(v), "iter: key %#x: exp '%s', saw '%s'", k, s, string(v))
+		assert(!seen[k], "iter: key %#x seen twice", k)
+		seen[k] = true
+		return nil
+	})
+	assert(err == nil, "iter failed: %s", err)
+	assert(len(seen) == len(kvmap), "iter: exp %d keys, saw %d", len(kvmap), len(seen))
+
+	for h, v := range kvmap {
+		s, err := snap.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+	}
+
+	snap.Close()
+	snap.Close()
+}
+
+func TestDBLocking(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer os.Remove(fn)
+
+	// a second writer for the same DB must fail
+	_, err = NewDBWriter(fn)
+	assert(errors.Is(err, ErrLocked), "concurrent writer: exp ErrLocked, saw %v", err)
+
+	for i, s := range keyw {
+		err = wr.Add(uint64(i+1), []byte(s))
+		assert(err == nil, "can't add key %d: %s", i, err)
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = os.Stat(fn + ".lock")
+	assert(os.IsNotExist(err), "lock file not removed: %v", err)
+
+	busy, err := InUse(fn)
+	assert(err == nil, "inuse: %s", err)
+	assert(!busy, "unused DB reported in-use")
+
+	rd, err := NewDBReader(fn, 10, WithSharedLock())
+	assert(err == nil, "read failed: %s", err)
+
+	busy, err = InUse(fn)
+	assert(err == nil, "inuse: %s", err)
+	assert(busy, "locked DB not reported in-use")
+
+	rd.Close()
+
+	busy, err = InUse(fn)
+	assert(err == nil, "inuse: %s", err)
+	assert(!busy, "closed DB reported in-use")
+}
+
+func TestDBTempDir(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmpdir, err := ioutil.TempDir("", "chdtmp")
+	assert(err == nil, "mkdirtemp: %s", err)
+	defer os.RemoveAll(tmpdir)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn, WithTempDir(tmpdir), WithTempSuffix(".partial"))
+	assert(err == nil, "can't create db: %s", err)
+
+	defer os.Remove(fn)
+
+	ents, err := ioutil.ReadDir(tmpdir)
+	assert(err == nil, "readdir: %s", err)
+	assert(len(ents) == 1, "exp 1 temp file, saw %d", len(ents))
+
+	tmp := ents[0].Name()
+	pref := filepath.Base(fn) + ".partial."
+	assert(strings.HasPrefix(tmp, pref), "temp file %s doesn't start with %s", tmp, pref)
+
+	for i, s := range keyw {
+		err = wr.Add(uint64(i+1), []byte(s))
+		assert(err == nil, "can't add key %d: %s", i, err)
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	ents, err = ioutil.ReadDir(tmpdir)
+	assert(err == nil, "readdir: %s", err)
+	assert(len(ents) == 0, "temp file not removed: %d entries", len(ents))
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	for i, s := range keyw {
+		v, err := rd.Find(uint64(i + 1))
+		assert(err == nil, "can't find key %d: %s", i, err)
+		assert(string(v) == s, "key %d: exp '%s', saw '%s'", i, s, string(v))
+	}
+	rd.Close()
+}
+
+func TestDBWriterClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmpdir, err := ioutil.TempDir("", "chdtmp")
+	assert(err == nil, "mkdirtemp: %s", err)
+	defer os.RemoveAll(tmpdir)
+
+	fn := filepath.Join(tmpdir, "a.db")
+
+	// Close without Freeze must abort
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	err = wr.Add(1, []byte("one"))
+	assert(err == nil, "can't add: %s", err)
+
+	err = wr.Close()
+	assert(err == nil, "close: %s", err)
+	err = wr.Close()
+	assert(err == nil, "2nd close: %s", err)
+
+	ents, err := ioutil.ReadDir(tmpdir)
+	assert(err == nil, "readdir: %s", err)
+	assert(len(ents) == 0, "aborted writer left %d files behind", len(ents))
+
+	// Close after Freeze must keep the DB
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	err = wr.Add(1, []byte("one"))
+	assert(err == nil, "can't add: %s", err)
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = wr.Close()
+	assert(err == nil, "close: %s", err)
+
+	_, err = os.Stat(fn)
+	assert(err == nil, "frozen DB removed by close: %v", err)
+}
+
+func TestDBAddBulk(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	defer os.Remove(fn)
+
+	kvmap := make(map[uint64]string)
+	keys := make([]uint64, 0, len(keyw))
+	vals := make([][]byte, 0, len(keyw))
+	for i, s := range keyw {
+		k := uint64(i + 1)
+		keys = append(keys, k)
+		vals = append(vals, []byte(s))
+		kvmap[k] = s
+	}
+
+	// duplicates within the batch are skipped
+	n, err := wr.AddKeyVals(append(keys[:5:5], keys[0]), vals[:6])
+	assert(err == nil, "addkeyvals: %s", err)
+	assert(n == 5, "addkeyvals: exp 5, saw %d", n)
+
+	// duplicates of earlier keys are skipped
+	m := make(map[uint64][]byte)
+	for i := 3; i < 10; i++ {
+		m[keys[i]] = vals[i]
+	}
+	n, err = wr.AddMap(m)
+	assert(err == nil, "addmap: %s", err)
+	assert(n == 5, "addmap: exp 5, saw %d", n)
+
+	i := 8
+	n, err = wr.AddPairs(func() (uint64, []byte, bool) {
+		if i >= len(keys) {
+			return 0, nil, false
+		}
+		i++
+		return keys[i-1], vals[i-1], true
+	})
+	assert(err == nil, "addpairs: %s", err)
+	assert(n == len(keys)-10, "addpairs: exp %d, saw %d", len(keys)-10, n)
+	assert(wr.Len() == len(keys), "exp %d keys, saw %d", len(keys), wr.Len())
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	for h, v := range kvmap {
+		s, err := rd.Find(h)
+		assert(err == nil, "can't find key %#x: %s", h, err)
+		assert(string(s) == v, "key %x: value mismatch; exp '%s', saw '%s'", h, v, string(s))
+	}
+	rd.Close()
+}
+
+func TestDBHeatMap(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "chdheat")
+	assert(err == nil, "tempdir: %s", err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "a.db")
+	hfn := filepath.Join(dir, "a.heat")
+	keywDB(t, fn)
+
+	// two sessions; counts must accumulate across them
+	for n := 0; n < 2; n++ {
+		rd, err := NewDBReader(fn, 10, WithHeatMap(hfn, 1))
+		assert(err == nil, "read failed: %s", err)
+
+		for i := uint64(1); i <= 3; i++ {
+			for j := uint64(0); j < i; j++ {
+				_, err := rd.Find(i)
+				assert(err == nil, "can't find key %d: %s", i, err)
+			}
+		}
+
+		_, err = rd.Find(5000)
+		assert(err != nil, "found non-existent key")
+		rd.Close()
+	}
+
+	hm, err := ReadHeatMap(hfn)
+	assert(err == nil, "heatmap: %s", err)
+	assert(len(hm) == 3, "exp 3 hot keys, saw %d", len(hm))
+	for i := uint64(1); i <= 3; i++ {
+		assert(hm.Count(i) == 2*i, "key %d: exp %d hits, saw %d", i, 2*i, hm.Count(i))
+	}
+
+	keys := []uint64{1, 7, 2, 3}
+	hm.Sort(keys)
+	assert(keys[0] == 3 && keys[1] == 2 && keys[2] == 1 && keys[3] == 7, "bad heat order %v", keys)
+}
+
+func TestDBWithoutMmap(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10, WithoutMmap())
+	assert(err == nil, "read failed: %s", err)
+
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: exp '%s', saw '%s'", k, v, string(s))
+	}
+
+	for i := len(kv) + 1; i < len(kv)+10; i++ {
+		v, err := rd.Find(uint64(i))
+		assert(err != nil, "whoa: found key %d => %s", i, string(v))
+	}
+	rd.Close()
+}
+
+func TestDBHugePages(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	for _, opts := range [][]ReaderOption{
+		{WithHugePages()},
+		{WithHugePages(), WithoutMmap()},
+	} {
+		rd, err := NewDBReader(fn, 10, opts...)
+		assert(err == nil, "read failed: %s", err)
+
+		for k, v := range kv {
+			s, err := rd.Find(k)
+			assert(err == nil, "can't find key %d: %s", k, err)
+			assert(string(s) == v, "key %d: exp '%s', saw '%s'", k, v, string(s))
+		}
+		rd.Close()
+	}
+}
+
+// readers that copy the metadata into huge pages must release all of it
+func TestDBHugePagesClose(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	keywDB(t, fn)
+
+	// return true if 'addr' is in a mapping of this process; /proc is
+	// linux only and we assume nothing is mapped elsewhere.
+	mapped := func(addr uintptr) bool {
+		b, err := ioutil.ReadFile("/proc/self/maps")
+		if err != nil {
+			return false
+		}
+		for _, s := range strings.Split(string(b), "\n") {
+			var lo, hi uintptr
+			if _, err := fmt.Sscanf(s, "%x-%x", &lo, &hi); err == nil && addr >= lo && addr < hi {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 16; i++ {
+		rd, err := NewDBReader(fn, 10, WithHugePages(), WithoutMmap())
+		assert(err == nil, "read failed: %s", err)
+
+		if rd.inmem {
+			rd.Close()
+			t.Skipf("no anonymous memory for the metadata")
+		}
+
+		bs := rd.mmap[:cap(rd.mmap)]
+		end := uintptr(unsafe.Pointer(&bs[len(bs)-1]))
+		if i%2 == 0 {
+			err = rd.unmapMeta()
+			assert(err == nil, "unmap failed: %s", err)
+		}
+		rd.Close()
+		assert(!mapped(end), "metadata at %#x still mapped after close", end)
+	}
+}
+
+func TestDBReaderPool(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	p, err := NewReaderPool(fn, 10)
+	assert(err == nil, "pool failed: %s", err)
+	assert(p.Replicas() >= 1, "no replicas")
+
+	// a reader pinned to node 0 exists on every system
+	rd, err := NewDBReader(fn, 10, WithNUMANode(0))
+	assert(err == nil, "read failed: %s", err)
+
+	for k, v := range kv {
+		s, err := p.Find(k)
+		assert(err == nil, "pool: can't find key %d: %s", k, err)
+		assert(string(s) == v, "pool: key %d: exp '%s', saw '%s'", k, v, string(s))
+
+		s, err = rd.Find(k)
+		assert(err == nil, "node0: can't find key %d: %s", k, err)
+		assert(string(s) == v, "node0: key %d: exp '%s', saw '%s'", k, v, string(s))
+	}
+
+	v, ok := p.Lookup(uint64(len(kv) + 1))
+	assert(!ok, "whoa: found missing key => %s", string(v))
+
+	rd.Close()
+	p.Close()
+}
+
+func TestDBFindMany(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// every key twice - so later lookups hit the cache; and a few missing keys
+	var keys []uint64
+	for i := 0; i < 2; i++ {
+		for k := range kv {
+			keys = append(keys, k)
+		}
+	}
+	for i := len(kv) + 1; i < len(kv)+10; i++ {
+		keys = append(keys, uint64(i))
+	}
+
+	vals, err := rd.FindMany(keys)
+	assert(err == nil, "findmany failed: %s", err)
+	assert(len(vals) == len(keys), "exp %d vals, saw %d", len(keys), len(vals))
+
+	for i, k := range keys {
+		v, ok := kv[k]
+		if !ok {
+			assert(vals[i] == nil, "whoa: found key %d => %s", k, string(vals[i]))
+			continue
+		}
+		assert(string(vals[i]) == v, "key %d: exp '%s', saw '%s'", k, v, string(vals[i]))
+	}
+}
+
+func TestDBScan(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	seen := make(map[uint64]bool)
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		exp, ok := kv[k]
+		assert(ok, "unknown key %d", k)
+		assert(string(v) == exp, "key %d: exp '%s', saw '%s'", k, exp, string(v))
+		assert(!seen[k], "key %d seen twice", k)
+		seen[k] = true
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(len(seen) == len(kv), "exp %d keys, saw %d", len(kv), len(seen))
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		n++
+		return n < 3
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == 3, "scan didn't stop; saw %d", n)
+}
+
+func TestDBValueCodec(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	// reverse the value and append a marker byte
+	enc := func(v []byte) ([]byte, error) {
+		r := make([]byte, 0, len(v)+1)
+		for i := len(v) - 1; i >= 0; i-- {
+			r = append(r, v[i])
+		}
+		return append(r, '!'), nil
+	}
+	dec := func(v []byte) ([]byte, error) {
+		if len(v) == 0 || v[len(v)-1] != '!' {
+			return nil, fmt.Errorf("bad value")
+		}
+		v = v[:len(v)-1]
+		r := make([]byte, 0, len(v))
+		for i := len(v) - 1; i >= 0; i-- {
+			r = append(r, v[i])
+		}
+		return r, nil
+	}
+	codec := NewValueCodec(7, enc, dec)
+
+	kv := keywDB(t, fn, WithValueCodec(codec))
+
+	_, err := NewDBReader(fn, 10)
+	assert(err != nil, "opened db without its codec")
+
+	_, err = NewDBReader(fn, 10, WithValueCodecs(NewValueCodec(8, enc, dec)))
+	assert(err != nil, "opened db with the wrong codec")
+
+	rd, err := NewDBReader(fn, 10, WithValueCodecs(codec))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+	assert(rd.Flags()&FlagValueCodec != 0, "codec flag not set: %#x", rd.Flags())
+
+	var buf []byte
+	var keys []uint64
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: exp '%s', saw '%s'", k, v, string(s))
+
+		buf, err = rd.FindInto(k, buf)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(buf) == v, "key %d: exp '%s', saw '%s'", k, v, string(buf))
+		keys = append(keys, k)
+	}
+
+	vals, err := rd.FindMany(keys)
+	assert(err == nil, "findmany failed: %s", err)
+	for i, k := range keys {
+		assert(string(vals[i]) == kv[k], "key %d: exp '%s', saw '%s'", k, kv[k], string(vals[i]))
+	}
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		assert(string(v) == kv[k], "key %d: exp '%s', saw '%s'", k, kv[k], string(v))
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv), "exp %d keys, saw %d", len(kv), n)
+
+	snap, err := rd.Snapshot()
+	assert(err == nil, "snapshot failed: %s", err)
+	defer snap.Close()
+
+	n = 0
+	err = snap.Iter(func(k uint64, v []byte) error {
+		assert(string(v) == kv[k], "key %d: exp '%s', saw '%s'", k, kv[k], string(v))
+		n++
+		return nil
+	})
+	assert(err == nil, "iter failed: %s", err)
+	assert(n == len(kv), "exp %d keys, saw %d", len(kv), n)
+}
+
+type testRecord struct {
+	Name  string
+	Age   int
+	Score float64
+	Tags  []string
+	Attrs map[string]int
+	Blob  []byte
+	Next  *testRecord
+}
+
+func TestDBFlate(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn, WithValueCodec(Flate))
+	assert(err == nil, "can't create db: %s", err)
+
+	kv := make(map[uint64]string)
+	for i, s := range keyw {
+		kv[uint64(i+1)] = strings.Repeat(s, i+1)
+		err = wr.Add(uint64(i+1), []byte(kv[uint64(i+1)]))
+		assert(err == nil, "can't add key %d: %s", i+1, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// built-in codecs need not be registered
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: exp '%s', saw '%s'", k, v, s)
+	}
+}
+
+func TestDBConvert(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	dst := filepath.Join(dir, "dst.db")
+
+	kv := keywDB(t, src, WithAppFlags(0x42), WithSourceDigest([]byte("abc")))
+
+	check := func(fn string, c Checksum, codec uint32) {
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read %s failed: %s", fn, err)
+		defer rd.Close()
+
+		assert(rd.AppFlags() == 0x42, "%s: app flags lost: %#x", fn, rd.AppFlags())
+		assert(rd.Checksum() == c, "%s: exp checksum %s, saw %s", fn, c, rd.Checksum())
+		assert(rd.codecID == codec, "%s: exp codec %#x, saw %#x", fn, codec, rd.codecID)
+
+		b, err := rd.BuildInfo()
+		assert(err == nil && b != nil, "%s: no build info: %v", fn, err)
+		assert(string(b.Source) == "abc", "%s: source digest lost: %q", fn, b.Source)
+
+		n := 0
+		err = rd.Scan(func(k uint64, v []byte) bool {
+			n++
+			assert(string(v) == kv[k], "%s: key %d: exp %s, saw %s", fn, k, kv[k], v)
+			return true
+		})
+		assert(err == nil, "%s: scan failed: %s", fn, err)
+		assert(n == len(kv), "%s: exp %d keys, saw %d", fn, len(kv), n)
+	}
+
+	err := Convert(src, dst, WithValueCodec(Flate), WithChecksum(ChecksumCRC32C), WithLoad(0.5))
+	assert(err == nil, "convert failed: %s", err)
+	check(dst, ChecksumCRC32C, CodecFlate)
+
+	rd, err := NewDBReader(dst, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.Len() >= 2*len(kv), "load not applied: %d slots", rd.Len())
+	rd.Close()
+
+	err = Convert(dst, dst, WithValueCodec(Zstd))
+	assert(err == nil, "convert to zstd failed: %s", err)
+	check(dst, ChecksumSHA512_256, CodecZstd)
+
+	// in place
+	err = Convert(dst, dst)
+	assert(err == nil, "convert in place failed: %s", err)
+	check(dst, ChecksumSHA512_256, 0)
+
+	// a limit that rejects records must fail the conversion and leave
+	// the source alone
+	err = Convert(dst, dst, WithMaxKeys(10))
+	assert(errors.Is(err, ErrTooManyKeys), "exp ErrTooManyKeys, saw %v", err)
+	check(dst, ChecksumSHA512_256, 0)
+}
+
+func TestDBFindAs(t *testing.T) {
+	assert := newAsserter(t)
+
+	recs := []testRecord{
+		{Name: "alpha", Age: 42, Score: 3.5, Tags: []string{"a", "b"}},
+		{Name: "beta", Age: -7, Attrs: map[string]int{"x": 1, "y": 300}},
+		{Name: "gamma", Blob: []byte{0, 1, 2, 255}, Next: &testRecord{Name: "delta", Age: 1 << 30}},
+	}
+
+	codecs := map[string]Codec{
+		"json":    JSON,
+		"gob":     Gob,
+		"msgpack": Msgpack,
+	}
+
+	for nm, c := range codecs {
+		fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+		defer os.Remove(fn)
+
+		wr, err := NewDBWriter(fn)
+		assert(err == nil, "%s: can't create db: %s", nm, err)
+		for i := range recs {
+			err = wr.AddValue(uint64(i+1), &recs[i], c)
+			assert(err == nil, "%s: can't add key %d: %s", nm, i+1, err)
+		}
+		err = wr.Freeze(0.9)
+		assert(err == nil, "%s: freeze failed: %s", nm, err)
+
+		rd, err := NewDBReader(fn, 10, WithCodec(c))
+		assert(err == nil, "%s: read failed: %s", nm, err)
+
+		for i := range recs {
+			var r testRecord
+
+			err = rd.FindAs(uint64(i+1), &r)
+			assert(err == nil, "%s: can't find key %d: %s", nm, i+1, err)
+			assert(reflect.DeepEqual(r, recs[i]), "%s: key %d: exp %+v, saw %+v", nm, i+1, recs[i], r)
+		}
+
+		var r testRecord
+		err = rd.FindAs(uint64(len(recs)+1), &r)
+		assert(err == ErrNoKey, "%s: found missing key", nm)
+		rd.Close()
+	}
+}
+
+func TestGetter(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+	mv := make(map[uint64][]byte)
+	for k, v := range kv {
+		mv[k] = []byte(v)
+	}
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	set, err := NewDBSet(fn, nil, 10)
+	assert(err == nil, "dbset failed: %s", err)
+	defer set.Close()
+
+	m, err := chd.NewMap(mv, 0.9)
+	assert(err == nil, "map failed: %s", err)
+	assert(m.Len() == len(mv), "map: exp %d keys, saw %d", len(mv), m.Len())
+
+	empty, err := chd.NewMap(nil, 0.9)
+	assert(err == nil, "empty map failed: %s", err)
+	_, ok := empty.Lookup(0)
+	assert(!ok, "empty map: found key 0")
+
+	getters := map[string]chd.Getter{
+		"dbreader": rd,
+		"dbset":    set,
+		"map":      m,
+		"gomap":    chd.MapGetter(mv),
+	}
+
+	for nm, g := range getters {
+		for k, v := range kv {
+			s, ok := g.Lookup(k)
+			assert(ok, "%s: can't find key %d", nm, k)
+			assert(string(s) == v, "%s: key %d: exp '%s', saw '%s'", nm, k, v, string(s))
+		}
+
+		for k := uint64(len(kv) + 1); k < uint64(len(kv)+50); k++ {
+			_, ok := g.Lookup(k)
+			assert(!ok, "%s: found missing key %d", nm, k)
+		}
+		_, ok := g.Lookup(0)
+		assert(!ok, "%s: found missing key 0", nm)
+	}
+}
+
+func TestDBVerifyAll(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+
+	r, err := rd.VerifyAll(context.Background(), 4)
+	assert(err == nil, "verify failed: %s", err)
+	assert(r.OK(), "verify: unexpected failures: %v", r.Failures())
+	assert(r.Records == uint64(len(kv)), "exp %d records, saw %d", len(kv), r.Records)
+	assert(len(r.Ranges) == 4, "exp 4 ranges, saw %d", len(r.Ranges))
+
+	// corrupt the last byte of the value of key 1; the records aren't covered
+	// by the metadata checksum - so the DB still opens.
+	i := rd.chd.Find(1)
+	off := rd.offAt(i)
+	vlen := rd.vlenAt(i)
+	rd.Close()
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{'~'}, int64(off+8+uint64(vlen)-1))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	r, err = rd.VerifyAll(context.Background(), 0)
+	assert(err == nil, "verify failed: %s", err)
+	assert(!r.OK(), "verify: corruption not detected")
+	assert(r.Records == uint64(len(kv)), "exp %d records, saw %d", len(kv), r.Records)
+
+	f := r.Failures()
+	assert(len(f) == 1, "exp 1 failed range, saw %d", len(f))
+	assert(len(f[0].Corrupt) == 1 && f[0].Corrupt[0] == 1, "exp key 1 corrupt, saw %v", f[0].Corrupt)
+	assert(off >= f[0].Start && off < f[0].End, "off %d outside range %d-%d", off, f[0].Start, f[0].End)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rd.VerifyAll(ctx, 2)
+	assert(err == context.Canceled, "exp cancellation; saw %v", err)
+}
+
+func TestDBVerifyPolicy(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	once, err := NewDBReader(fn, 10, WithVerify(VerifyOnce))
+	assert(err == nil, "read failed: %s", err)
+	defer once.Close()
+
+	r, err := once.VerifyAll(context.Background(), 2)
+	assert(err == nil && r.OK(), "verify failed: %v", err)
+
+	// corrupt the last byte of the value of key 1
+	i := once.chd.Find(1)
+	off := once.offAt(i)
+	vlen := once.vlenAt(i)
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{'~'}, int64(off+8+uint64(vlen)-1))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	// VerifyAll() marked the record as good; so it isn't checked again
+	v, err := once.FindInto(1, nil)
+	assert(err == nil, "verify once: unexpected err %s", err)
+	assert(v[len(v)-1] == '~', "verify once: exp corrupted value, saw %s", v)
+
+	always, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer always.Close()
+
+	_, err = always.FindInto(1, nil)
+	assert(err != nil, "verify always: corruption not detected")
+
+	never, err := NewDBReader(fn, 10, WithVerify(VerifyNever))
+	assert(err == nil, "read failed: %s", err)
+	defer never.Close()
+
+	_, err = never.FindInto(1, nil)
+	assert(err == nil, "verify never: unexpected err %s", err)
+
+	// a fresh reader verifies on first access
+	once2, err := NewDBReader(fn, 10, WithVerify(VerifyOnce))
+	assert(err == nil, "read failed: %s", err)
+	defer once2.Close()
+
+	_, err = once2.Find(1)
+	assert(err != nil, "verify once: corruption not detected")
+
+	v, err = once2.Find(2)
+	assert(err == nil, "find 2: %s", err)
+	assert(string(v) == kv[2], "key 2: exp %s, saw %s", kv[2], v)
+
+	j := once2.chd.Find(2)
+	assert(once2.verified[j/64]&(1<<(j%64)) != 0, "key 2 not marked verified")
+	k := once2.chd.Find(1)
+	assert(once2.verified[k/64]&(1<<(k%64)) == 0, "corrupt key 1 marked verified")
+}
+
+func TestDBSizeBreakdown(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+	var vsz uint64
+	for _, v := range kv {
+		vsz += uint64(len(v))
+	}
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "stat failed: %s", err)
+
+	s, err := rd.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	assert(s.Total() == uint64(st.Size()), "exp total %d, saw %d", st.Size(), s.Total())
+	assert(s.Records == vsz+8*uint64(len(kv)), "exp %d bytes of records, saw %d", vsz+8*uint64(len(kv)), s.Records)
+	assert(s.Offsets == 16*uint64(rd.Len()), "wrong offset table size %d", s.Offsets)
+	assert(s.Vlens == 4*uint64(rd.Len()), "wrong vlen table size %d", s.Vlens)
+	assert(s.Chd > 0, "empty chd")
+}
+
+func TestDBInfo(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	in, err := rd.Info()
+	assert(err == nil, "info failed: %s", err)
+	assert(in.Keys == uint64(len(kv)), "exp %d keys, saw %d", len(kv), in.Keys)
+
+	occ, err := rd.Occupancy()
+	assert(err == nil, "occupancy failed: %s", err)
+	assert(occ.Count() == in.Keys, "occupancy: exp %d keys, saw %d", in.Keys, occ.Count())
+	assert(in.Slots == uint64(rd.Len()), "exp %d slots, saw %d", rd.Len(), in.Slots)
+	assert(!in.KeysOnly, "kv db marked keys-only")
+	assert(in.Size == in.Sizes.Total(), "size mismatch: %d vs %d", in.Size, in.Sizes.Total())
+	assert(in.Load > 0 && in.Load <= 1, "invalid load %f", in.Load)
+}
+
+func TestLRUCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := NewLRUCache(3, 10)
+	c.Add(1, []byte("aaa"))
+	c.Add(2, []byte("bbb"))
+	c.Add(3, []byte("ccc"))
+	assert(c.Len() == 3, "exp 3 entries, saw %d", c.Len())
+
+	// 1 is now the most recently used; 2 is evicted next
+	_, ok := c.Get(1)
+	assert(ok, "missing key 1")
+	c.Add(4, []byte("d"))
+	_, ok = c.Get(2)
+	assert(!ok, "key 2 not evicted")
+	assert(c.Len() == 3, "exp 3 entries, saw %d", c.Len())
+
+	// 7 + 3 + 1 bytes exceeds the byte limit; evicts 3
+	c.Add(5, []byte("eeeeeee"))
+	_, ok = c.Get(3)
+	assert(!ok, "key 3 not evicted")
+	assert(c.Bytes() <= 10, "cache too big: %d bytes", c.Bytes())
+
+	c.Add(6, []byte("this value is too big"))
+	_, ok = c.Get(6)
+	assert(!ok, "oversized value cached")
+
+	v, ok := c.Get(5)
+	assert(ok && string(v) == "eeeeeee", "key 5: exp eeeeeee, saw %q", v)
+
+	c.Purge()
+	assert(c.Len() == 0 && c.Bytes() == 0, "purge: %d entries, %d bytes", c.Len(), c.Bytes())
+}
+
+func TestDBWithCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	c := NewLRUCache(len(kv), 0)
+	rd, err := NewDBReader(fn, 0, WithCache(c))
+	assert(err == nil, "read failed: %s", err)
+
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(s) == v, "key %x: value mismatch; exp %s, saw %s", k, v, s)
+	}
+	assert(c.Len() == len(kv), "exp %d cached, saw %d", len(kv), c.Len())
+
+	// cached values are returned without reading the DB
+	for k, v := range kv {
+		s, ok := c.Get(k)
+		assert(ok && string(s) == v, "key %x: not cached", k)
+	}
+	rd.Close()
+	assert(c.Len() == 0, "close didn't purge the cache")
+
+	// byte limited default cache
+	rd, err = NewDBReader(fn, len(kv), WithCacheBytes(16))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(s) == v, "key %x: value mismatch; exp %s, saw %s", k, v, s)
+	}
+	sc := rd.cache.(*ShardedCache)
+	assert(sc.Bytes() <= 16, "cache too big: %d bytes", sc.Bytes())
+}
+
+func TestShardedCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := NewShardedLRUCache(3, 64, 0)
+	assert(c.Shards() == 4, "exp 4 shards, saw %d", c.Shards())
+
+	for i := uint64(0); i < 64; i++ {
+		c.Add(i, []byte(fmt.Sprintf("%d", i)))
+	}
+	for i := uint64(0); i < 64; i++ {
+		v, ok := c.Get(i)
+		if ok {
+			assert(string(v) == fmt.Sprintf("%d", i), "key %d: wrong value %s", i, v)
+		}
+	}
+	assert(c.Len() <= 64 && c.Len() > 0, "exp at most 64 entries, saw %d", c.Len())
+
+	// every shard must see some of the keys
+	for i, s := range c.shards {
+		assert(s.Len() > 0, "shard %d is empty", i)
+	}
+
+	c.Purge()
+	assert(c.Len() == 0, "purge left %d entries", c.Len())
+
+	// concurrent use; run with -race
+	var wg sync.WaitGroup
+	c = NewShardedLRUCache(16, 64, 0)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := uint64(0); j < 1000; j++ {
+				k := j * uint64(i+1)
+				c.Add(k, []byte{byte(i)})
+				c.Get(k)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert(c.Len() <= 64, "exp at most 64 entries, saw %d", c.Len())
+}
+
+func TestFlightGroup(t *testing.T) {
+	assert := newAsserter(t)
+
+	var g flightGroup
+	var calls int32
+	var wg sync.WaitGroup
+
+	start := make(chan struct{})
+	release := make(chan struct{})
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	const n = 16
+	vals := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			vals[i], _ = g.do(42, fn)
+		}(i)
+	}
+
+	close(start)
+
+	// wait for the first caller to get in flight before releasing it
+	for atomic.LoadInt32(&calls) == 0 {
+		runtime.Gosched()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert(atomic.LoadInt32(&calls) < n, "exp shared reads, saw %d calls", calls)
+	for i, v := range vals {
+		assert(string(v) == "value", "caller %d: wrong value %q", i, v)
+	}
+
+	// a new call after the flight landed must run fn again
+	calls = 0
+	release = make(chan struct{})
+	close(release)
+	_, err := g.do(42, fn)
+	assert(err == nil, "err %s", err)
+	assert(calls == 1, "exp 1 call, saw %d", calls)
+	assert(len(g.m) == 0, "flight map not empty: %d", len(g.m))
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, n := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			c := NewShardedLRUCache(n, 4096, 0)
+			val := []byte("value")
+			b.RunParallel(func(pb *testing.PB) {
+				k := rand64()
+				for pb.Next() {
+					k++
+					if _, ok := c.Get(k % 8192); !ok {
+						c.Add(k%8192, val)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestDBIntegrity(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	for _, l := range []Integrity{HeaderOnly, MetadataVerify, FullVerify} {
+		rd, err := NewDBReader(fn, 10, WithIntegrity(l))
+		assert(err == nil, "integrity %d: read failed: %s", l, err)
+		rd.Close()
+	}
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	i := rd.chd.Find(1)
+	off := rd.offAt(i)
+	vlen := rd.vlenAt(i)
+	rd.Close()
+
+	// corrupt a record: only a full verification notices
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{'~'}, int64(off+8+uint64(vlen)-1))
+	assert(err == nil, "write failed: %s", err)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	rd.Close()
+
+	_, err = NewDBReader(fn, 10, WithIntegrity(FullVerify))
+	assert(err != nil, "full verify: corrupt record not detected")
+
+	// corrupt the metadata checksum: only HeaderOnly opens the DB
+	st, err := fd.Stat()
+	assert(err == nil, "stat failed: %s", err)
+	var b [1]byte
+	_, err = fd.ReadAt(b[:], st.Size()-1)
+	assert(err == nil, "read failed: %s", err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b[:], st.Size()-1)
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	_, err = NewDBReader(fn, 10)
+	assert(err != nil, "metadata verify: corruption not detected")
+
+	rd, err = NewDBReader(fn, 10, WithIntegrity(HeaderOnly))
+	assert(err == nil, "header only: read failed: %s", err)
+	defer rd.Close()
+
+	v, err := rd.Find(2)
+	assert(err == nil, "find failed: %s", err)
+	assert(string(v) == kv[2], "key 2: exp %s, saw %s", kv[2], v)
+}
+
+func TestDBVerifyCache(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "test.db")
+
+	keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10, WithVerifyCache(""))
+	assert(err == nil, "read failed: %s", err)
+	off := rd.offtbl
+	rd.Close()
+
+	side := fn + ".verified"
+	_, err = os.Stat(side)
+	assert(err == nil, "no sidecar: %s", err)
+
+	// corrupt the metadata behind the cache's back: keep the size and mtime
+	st, err := os.Stat(fn)
+	assert(err == nil, "stat failed: %s", err)
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	var b [1]byte
+	_, err = fd.ReadAt(b[:], int64(off))
+	assert(err == nil, "read failed: %s", err)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b[:], int64(off))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	err = os.Chtimes(fn, st.ModTime(), st.ModTime())
+	assert(err == nil, "chtimes failed: %s", err)
+
+	rd, err = NewDBReader(fn, 10, WithVerifyCache(""))
+	assert(err == nil, "cached verification: read failed: %s", err)
+	rd.Close()
+
+	_, err = NewDBReader(fn, 10)
+	assert(err != nil, "uncached open: corruption not detected")
+
+	_, err = NewDBReader(fn, 10, WithVerifyCache(""), WithForceVerify())
+	assert(err != nil, "forced verification: corruption not detected")
+
+	// a changed mtime invalidates the cache
+	err = os.Chtimes(fn, st.ModTime(), st.ModTime().Add(time.Second))
+	assert(err == nil, "chtimes failed: %s", err)
+
+	_, err = NewDBReader(fn, 10, WithVerifyCache(""))
+	assert(err != nil, "stale cache: corruption not detected")
+}
+
+func TestDBChecksum(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	for _, c := range []Checksum{ChecksumSHA512_256, ChecksumCRC32C} {
+		keywDB(t, fn, WithChecksum(c))
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "%s: read failed: %s", c, err)
+		assert(rd.Checksum() == c, "exp checksum %s, saw %s", c, rd.Checksum())
+
+		in, err := rd.Info()
+		assert(err == nil, "info failed: %s", err)
+		assert(in.Checksum == c.String(), "info: exp %s, saw %s", c, in.Checksum)
+
+		v, err := rd.Find(1)
+		assert(err == nil, "%s: find failed: %s", c, err)
+		assert(string(v) == keyw[0], "%s: exp %s, saw %s", c, keyw[0], v)
+		off := rd.offtbl
+		rd.Close()
+
+		// corrupt the offset table
+		fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+		assert(err == nil, "open failed: %s", err)
+		var b [1]byte
+		_, err = fd.ReadAt(b[:], int64(off))
+		assert(err == nil, "read failed: %s", err)
+		b[0] ^= 0x01
+		_, err = fd.WriteAt(b[:], int64(off))
+		assert(err == nil, "write failed: %s", err)
+		fd.Close()
+
+		_, err = NewDBReader(fn, 10)
+		assert(err != nil, "%s: corruption not detected", c)
+	}
+
+	_, err := NewDBWriter(fn, WithChecksum(Checksum(3)))
+	assert(err != nil, "unknown checksum accepted")
+}
+
+func TestDBBuildInfo(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	when := time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)
+	digest := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	for _, keysOnly := range []bool{false, true} {
+		wr, err := NewDBWriter(fn, WithBuildTime(when), WithSourceDigest(digest))
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for i, s := range keyw {
+			var v []byte
+			if !keysOnly {
+				v = []byte(s)
+			}
+			err = wr.Add(uint64(i+1), v)
+			assert(err == nil, "can't add key %d: %s", i+1, err)
+		}
+		err = wr.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read failed: %s", err)
+
+		in, err := rd.Info()
+		assert(err == nil, "info failed: %s", err)
+		assert(in.Build != nil, "no build info")
+		assert(in.Build.Time.Equal(when), "exp build time %s, saw %s", when, in.Build.Time)
+		assert(strings.HasPrefix(in.Build.Tool, "go-chd "), "unexpected tool %s", in.Build.Tool)
+		assert(bytes.Equal(in.Build.Source, digest), "exp digest %x, saw %x", digest, in.Build.Source)
+		assert(in.Size == in.Sizes.Total(), "size mismatch: %d vs %d", in.Size, in.Sizes.Total())
+
+		// the build info isn't a key
+		if !keysOnly {
+			n := 0
+			err = rd.Scan(func(k uint64, v []byte) bool {
+				n++
+				return true
+			})
+			assert(err == nil, "scan failed: %s", err)
+			assert(n == len(keyw), "exp %d keys, saw %d", len(keyw), n)
+		}
+		rd.Close()
+	}
+
+	_, err := NewDBWriter(fn, WithSourceDigest(make([]byte, 65536)))
+	assert(err != nil, "oversized source digest accepted")
+}
+
+func TestDBFlags(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	keywDB(t, fn, WithAppFlags(0xbeef))
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.AppFlags() == 0xbeef, "exp app flags 0xbeef, saw %#x", rd.AppFlags())
+	assert(rd.Flags()&FlagFormatMask == 0, "unexpected format flags %#x", rd.Flags())
+	rd.Close()
+
+	// a keys-only DB
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	for i := range keyw {
+		err = wr.Add(uint64(i+1), nil)
+		assert(err == nil, "can't add key %d: %s", i+1, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	assert(rd.Flags() == FlagKeysOnly, "exp keys-only flag, saw %#x", rd.Flags())
+	assert(rd.AppFlags() == 0, "exp no app flags, saw %#x", rd.AppFlags())
+	rd.Close()
+
+	// unknown format flags are rejected
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{0, 0, 0x80, 0x01}, 4)
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	_, err = NewDBReader(fn, 10)
+	assert(err != nil && strings.Contains(err.Error(), "format flags"), "exp format flags error, saw %v", err)
+}
+
+// build a DB with 'n' keys for benchmarks
+func benchDB(b *testing.B, n int) (string, []uint64) {
+	fn := fmt.Sprintf("%s/mphbench%d.db", os.TempDir(), rand.Int())
+	wr, err := NewDBWriter(fn)
+	if err != nil {
+		b.Fatalf("can't create db: %s", err)
+	}
+
+	keys := make([]uint64, n)
+	val := []byte("benchmark value")
+	for i := range keys {
+		keys[i] = rand64()
+		if err := wr.Add(keys[i], val); err != nil {
+			b.Fatalf("can't add key: %s", err)
+		}
+	}
+
+	if err := wr.Freeze(0.85); err != nil {
+		b.Fatalf("freeze failed: %s", err)
+	}
+	return fn, keys
+}
+
+func benchFind(b *testing.B, opts ...ReaderOption) {
+	fn, keys := benchDB(b, 1<<18)
+	defer os.Remove(fn)
+
+	rd, err := NewDBReader(fn, 1, opts...)
+	if err != nil {
+		b.Fatalf("read failed: %s", err)
+	}
+	defer rd.Close()
+
+	var buf []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err = rd.FindInto(keys[i%len(keys)], buf)
+		if err != nil {
+			b.Fatalf("find failed: %s", err)
+		}
+	}
+}
+
+func BenchmarkDBFind(b *testing.B) {
+	benchFind(b)
+}
+
+func BenchmarkDBFindHugePages(b *testing.B) {
+	benchFind(b, WithHugePages(), WithoutMmap())
+}
+
+func BenchmarkDBFindTrusted(b *testing.B) {
+	fn, keys := benchDB(b, 1<<18)
+	defer os.Remove(fn)
+
+	rd, err := NewDBReader(fn, 1)
+	if err != nil {
+		b.Fatalf("read failed: %s", err)
+	}
+	defer rd.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rd.FindTrusted(keys[i%len(keys)]); err != nil {
+			b.Fatalf("find failed: %s", err)
+		}
+	}
+}
+
+func BenchmarkDBFindMany(b *testing.B) {
+	fn, keys := benchDB(b, 1<<18)
+	defer os.Remove(fn)
+
+	rd, err := NewDBReader(fn, 1)
+	if err != nil {
+		b.Fatalf("read failed: %s", err)
+	}
+	defer rd.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += _BatchSize {
+		j := i % (len(keys) - _BatchSize)
+		if _, err := rd.FindMany(keys[j : j+_BatchSize]); err != nil {
+			b.Fatalf("findmany failed: %s", err)
+		}
+	}
+}
+
+func TestDBMemUsage(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "stat failed: %s", err)
+
+	rd, err := NewDBReader(fn, len(kv), WithVerify(VerifyOnce))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.FileSize() == uint64(st.Size()), "exp file size %d, saw %d", st.Size(), rd.FileSize())
+
+	s, err := rd.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	m := rd.MemUsage()
+	assert(m.Mapped == s.Offsets+s.Vlens+s.Chd, "exp %d mapped bytes, saw %d", s.Offsets+s.Vlens+s.Chd, m.Mapped)
+	assert(m.Heap == 0, "exp no heap, saw %d", m.Heap)
+	assert(m.Seeds > 0 && m.Seeds <= s.Chd, "invalid seed bytes %d", m.Seeds)
+	assert(m.Cache == 0, "exp empty cache, saw %d", m.Cache)
+	assert(m.Aux == 8*uint64((rd.Len()+63)/64), "wrong aux bytes %d", m.Aux)
+
+	var vsz uint64
+	for k, v := range kv {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		vsz += uint64(len(v))
+	}
+
+	m = rd.MemUsage()
+	assert(m.Cache == vsz, "exp %d cached bytes, saw %d", vsz, m.Cache)
+	assert(m.Total() == m.Mapped+vsz+m.Aux, "wrong total %d", m.Total())
+
+	rd2, err := NewDBReader(fn, 10, WithoutMmap())
+	assert(err == nil, "read failed: %s", err)
+	defer rd2.Close()
+
+	m2 := rd2.MemUsage()
+	assert(m2.Mapped == 0, "exp nothing mapped, saw %d", m2.Mapped)
+	assert(m2.Heap == m.Mapped, "exp %d heap bytes, saw %d", m.Mapped, m2.Heap)
+	assert(m2.Seeds == m.Seeds, "seed bytes mismatch: %d vs %d", m.Seeds, m2.Seeds)
+	assert(m2.Aux == 0, "exp no aux, saw %d", m2.Aux)
+}
+
+func TestDBStats(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+	var vsz uint64
+	for _, v := range kv {
+		vsz += uint64(len(v))
+	}
+
+	rd, err := NewDBReader(fn, len(kv))
+	assert(err == nil, "read failed: %s", err)
+
+	for k := range kv {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+	}
+
+	n := uint64(len(kv))
+	s := rd.Stats()
+	assert(s.Lookups == n && s.Hits == n, "exp %d hits, saw %+v", n, s)
+	assert(s.CacheHits == 0 && s.Misses == 0, "unexpected cache hits or misses: %+v", s)
+	assert(s.BytesRead == vsz+8*n, "exp %d bytes read, saw %d", vsz+8*n, s.BytesRead)
+
+	// every key is now cached
+	vals, err := rd.FindMany([]uint64{1, 2, 0xdeadbeef})
+	assert(err == nil, "findmany failed: %s", err)
+	assert(vals[2] == nil, "found missing key")
+
+	s = rd.Stats()
+	assert(s.Lookups == n+3 && s.Hits == n+2, "wrong lookups: %+v", s)
+	assert(s.CacheHits == 2 && s.Misses == 1, "wrong cache hits or misses: %+v", s)
+	assert(s.BytesRead == vsz+8*n, "cache hits read %d bytes", s.BytesRead-vsz-8*n)
+
+	// corrupt the value of key 1
+	i := rd.chd.Find(1)
+	off := rd.offAt(i)
+	vlen := rd.vlenAt(i)
+	rd.Close()
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{'~'}, int64(off+8+uint64(vlen)-1))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.FindInto(1, nil)
+	assert(err != nil, "corruption not detected")
+
+	s = rd.Stats()
+	assert(s.Lookups == 1 && s.Hits == 0, "wrong lookups: %+v", s)
+	assert(s.ChecksumFailures == 1, "exp 1 checksum failure, saw %d", s.ChecksumFailures)
+}
+
+// records the lookups seen by a Tracer
+type testTracer struct {
+	sync.Mutex
+	started []uint64
+	hits    map[uint64]bool
+	errs    int
+}
+
+func (t *testTracer) OnLookupStart(key uint64) {
+	t.Lock()
+	t.started = append(t.started, key)
+	t.Unlock()
+}
+
+func (t *testTracer) OnLookupEnd(key uint64, hit bool, dur time.Duration, err error) {
+	t.Lock()
+	t.hits[key] = hit
+	if err != nil {
+		t.errs++
+	}
+	t.Unlock()
+}
+
+func TestDBTracer(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	tr := &testTracer{hits: make(map[uint64]bool)}
+	rd, err := NewDBReader(fn, 10, WithTracer(tr))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find(1)
+	assert(err == nil, "can't find key 1: %s", err)
+	_, err = rd.FindInto(2, nil)
+	assert(err == nil, "can't find key 2: %s", err)
+	_, ok := rd.Lookup(0xdeadbeef)
+	assert(!ok, "found missing key")
+
+	_, err = rd.FindMany([]uint64{3, 0xfeedface})
+	assert(err == nil, "findmany failed: %s", err)
+
+	exp := []uint64{1, 2, 0xdeadbeef, 3, 0xfeedface}
+	assert(len(tr.started) == len(exp), "exp %d lookups, saw %d", len(exp), len(tr.started))
+	for i, k := range exp {
+		assert(tr.started[i] == k, "lookup %d: exp key %#x, saw %#x", i, k, tr.started[i])
+	}
+
+	assert(len(tr.hits) == len(exp), "exp %d ends, saw %d", len(exp), len(tr.hits))
+	for _, k := range exp {
+		_, want := kv[k]
+		assert(tr.hits[k] == want, "key %#x: exp hit %v", k, want)
+	}
+	assert(tr.errs == 0, "exp no errors, saw %d", tr.errs)
+}
+
+// collects the messages logged via a Logger
+type testLogger struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+// return true if some logged message contains 's'
+func (l *testLogger) saw(s string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDBLogger(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	wl := &testLogger{}
+	keywDB(t, fn, WithWriterLogger(wl))
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "stat failed: %s", err)
+
+	assert(wl.saw("building in"), "no build start: %v", wl.msgs)
+	assert(wl.saw(fmt.Sprintf("MPH of %d keys", len(keyw))), "no MPH build: %v", wl.msgs)
+	assert(wl.saw("seed retries"), "no MPH stats: %v", wl.msgs)
+	assert(wl.saw(fmt.Sprintf("wrote %d bytes", st.Size())), "no write summary: %v", wl.msgs)
+
+	// an aborted build
+	wl = &testLogger{}
+	wr, err := NewDBWriter(fn, WithWriterLogger(wl))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	wr.Abort()
+	assert(wl.saw("aborted"), "no abort: %v", wl.msgs)
+
+	rl := &testLogger{}
+	rd, err := NewDBReader(fn, 10, WithLogger(rl), WithoutMmap())
+	assert(err == nil, "read failed: %s", err)
+	assert(rl.saw("opened") && rl.saw("read into the heap"), "no open: %v", rl.msgs)
+
+	i := rd.chd.Find(1)
+	off := rd.offAt(i)
+	rd.Close()
+	assert(rl.saw("closed"), "no close: %v", rl.msgs)
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	_, err = fd.WriteAt([]byte{'~'}, int64(off+8))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	rl = &testLogger{}
+	rd, err = NewDBReader(fn, 10, WithLogger(rl))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+	assert(rl.saw("mmap'd"), "no mmap: %v", rl.msgs)
+
+	_, err = rd.Find(1)
+	assert(err != nil, "corruption not detected")
+	assert(rl.saw(fmt.Sprintf("checksum failed for record at off %d", off)), "no checksum failure: %v", rl.msgs)
+
+	_, err = NewDBReader(fn+".missing", 10, WithLogger(rl))
+	assert(err != nil, "opened missing db")
+	assert(rl.saw("open failed"), "no open failure: %v", rl.msgs)
+}
+
+func TestDBShardSize(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn, WithShardSize(100))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kv := make(map[uint64]string)
+	for i := 0; i < 1000; i++ {
+		k := uint64(i + 1)
+		kv[k] = fmt.Sprintf("value-%d", i)
+		err = wr.Add(k, []byte(kv[k]))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.chd.Shards() == 16, "exp 16 shards, saw %d", rd.chd.Shards())
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: exp %s, saw %s", k, v, s)
+	}
+
+	_, err = rd.Find(5000)
+	assert(err == ErrNoKey, "found missing key: %v", err)
+}
+
+func TestDBMaxSeed(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn, WithMaxSeed(2))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+	defer wr.Abort()
+
+	for i := 0; i < 4096; i++ {
+		err = wr.Add(uint64(i+1), []byte("x"))
+		assert(err == nil, "can't add key %d: %s", i+1, err)
+	}
+
+	err = wr.Freeze(1.0)
+	assert(errors.Is(err, ErrMPHFail), "exp MPH failure, saw %v", err)
+
+	var se *chd.SeedError
+	assert(errors.As(err, &se), "exp seed error, saw %v", err)
+	assert(se.MaxSeed == 2, "exp max seed 2, saw %d", se.MaxSeed)
+}
+
+func TestDBAddKeyValsFunc(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	// values starting with '!' can't be encoded
+	enc := func(v []byte) ([]byte, error) {
+		if v[0] == '!' {
+			return nil, fmt.Errorf("bad value %s", v)
+		}
+		return v, nil
+	}
+	dec := func(v []byte) ([]byte, error) {
+		return v, nil
+	}
+
+	wr, err := NewDBWriter(fn, WithValueCodec(NewValueCodec(7, enc, dec)))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	keys := []uint64{1, 2, 3, 2, 4, 1}
+	vals := [][]byte{[]byte("a"), []byte("b"), []byte("!c"), []byte("d"), []byte("e"), []byte("f")}
+	exp := []AddStatus{AddOK, AddOK, AddEncodeFailed, AddDuplicate, AddOK, AddDuplicate}
+
+	var saw []AddStatus
+	n, err := wr.AddKeyValsFunc(keys, vals, func(i int, st AddStatus) {
+		assert(i == len(saw), "exp index %d, saw %d", len(saw), i)
+		saw = append(saw, st)
+	})
+	assert(err == nil, "addkeyvalsfunc: %s", err)
+	assert(n == 3, "exp 3 records, saw %d", n)
+	assert(reflect.DeepEqual(saw, exp), "exp %v, saw %v", exp, saw)
+	assert(AddTooLarge.String() == "too-large", "bad string %s", AddTooLarge)
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10, WithValueCodecs(NewValueCodec(7, enc, dec)))
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range map[uint64]string{1: "a", 2: "b", 4: "e"} {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: exp %s, saw %s", k, v, s)
+	}
+	_, err = rd.Find(3)
+	assert(err == ErrNoKey, "found rejected key 3: %v", err)
+}
+
+func TestDBRecordAlign(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	_, err := NewDBWriter(fn, WithRecordAlign(100))
+	assert(err != nil, "alignment 100 accepted")
+
+	wr, err := NewDBWriter(fn, WithRecordAlign(512), WithBuildTime(time.Now()))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kv := make(map[uint64]string)
+	for i := 0; i < 100; i++ {
+		k := uint64(i + 1)
+		kv[k] = strings.Repeat("x", i*13+1)
+		err = wr.Add(k, []byte(kv[k]))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.RecordAlign() == 512, "exp alignment 512, saw %d", rd.RecordAlign())
+	assert(rd.binfoOff%512 == 0, "build info at unaligned offset %d", rd.binfoOff)
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.used(i) && rd.vlenAt(i) > 0 {
+			assert(rd.offAt(i)%512 == 0, "slot %d: unaligned offset %d", i, rd.offAt(i))
+		}
+	}
+
+	for k, v := range kv {
+		s, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(s) == v, "key %d: value mismatch", k)
+	}
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		assert(string(v) == kv[k], "scan: key %d: value mismatch", k)
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv), "scan: exp %d keys, saw %d", len(kv), n)
+
+	info, err := rd.Info()
+	assert(err == nil, "info failed: %s", err)
+	assert(info.Align == 512, "info: exp alignment 512, saw %d", info.Align)
+	assert(info.Sizes.Total() == info.Size, "size breakdown %d != file size %d", info.Sizes.Total(), info.Size)
+}
+
+func TestDBSparsePadding(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	// every record is followed by a large hole
+	wr, err := NewDBWriter(fn, WithRecordAlign(1<<16))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kv := make(map[uint64]string)
+	for i := 0; i < 50; i++ {
+		k := uint64(i + 1)
+		kv[k] = fmt.Sprintf("value-%d", i)
+		err = wr.Add(k, []byte(kv[k]))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	r, err := rd.VerifyAll(context.Background(), 4)
+	assert(err == nil, "verify failed: %s", err)
+	assert(r.Records == uint64(len(kv)), "exp %d records, saw %d", len(kv), r.Records)
+	assert(len(r.Failures()) == 0, "verify: %d failed ranges", len(r.Failures()))
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		assert(string(v) == kv[k], "scan: key %d: value mismatch", k)
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv), "scan: exp %d keys, saw %d", len(kv), n)
+
+	// a copy preserves the content - holes included
+	copyfn := fn + ".copy"
+	defer os.Remove(copyfn)
+
+	s, err := os.Open(fn)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	defer s.Close()
+
+	d, err := os.Create(copyfn)
+	assert(err == nil, "can't create %s: %s", copyfn, err)
+	err = copySparse(d, s)
+	assert(err == nil, "copy failed: %s", err)
+	d.Close()
+
+	a, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read %s: %s", fn, err)
+	b, err := ioutil.ReadFile(copyfn)
+	assert(err == nil, "can't read %s: %s", copyfn, err)
+	assert(bytes.Equal(a, b), "copy differs from the original")
+}
+
+func TestDBContentAddressed(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	dst := filepath.Join(dir, "dst.db")
+
+	// 200 keys with 10 distinct values
+	kv := make(map[uint64]string)
+	build := func(fn string, opts ...WriterOption) {
+		wr, err := NewDBWriter(fn, opts...)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for i := 0; i < 200; i++ {
+			k := uint64(i + 1)
+			kv[k] = strings.Repeat(fmt.Sprintf("value-%d;", i%10), 20)
+			err = wr.Add(k, []byte(kv[k]))
+			assert(err == nil, "can't add key %d: %s", k, err)
+		}
+		err = wr.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+	}
+
+	check := func(fn string, shared bool) *DBInfo {
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read %s failed: %s", fn, err)
+		defer rd.Close()
+
+		assert(rd.SharedValues() == shared, "%s: exp shared %v", fn, shared)
+		for k, v := range kv {
+			s, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %d: %s", fn, k, err)
+			assert(string(s) == v, "%s: key %d: value mismatch", fn, k)
+		}
+
+		n := 0
+		err = rd.Scan(func(k uint64, v []byte) bool {
+			assert(string(v) == kv[k], "%s: scan: key %d: value mismatch", fn, k)
+			n++
+			return true
+		})
+		assert(err == nil, "%s: scan failed: %s", fn, err)
+		assert(n == len(kv), "%s: scan: exp %d keys, saw %d", fn, len(kv), n)
+
+		r, err := rd.VerifyAll(context.Background(), 3)
+		assert(err == nil, "%s: verify failed: %s", fn, err)
+		assert(r.Records == uint64(len(kv)), "%s: exp %d records, saw %d", fn, len(kv), r.Records)
+		assert(len(r.Failures()) == 0, "%s: verify: %d failed ranges", fn, len(r.Failures()))
+
+		info, err := rd.Info()
+		assert(err == nil, "%s: info failed: %s", fn, err)
+		assert(info.Sizes.Total() == info.Size, "%s: size breakdown %d != file size %d", fn, info.Sizes.Total(), info.Size)
+		return info
+	}
+
+	build(src)
+	plain := check(src, false)
+
+	// converting dedups the values of the source DB
+	err := Convert(src, dst, WithContentAddressed())
+	assert(err == nil, "convert failed: %s", err)
+	ca := check(dst, true)
+	assert(ca.Sizes.Records*10 < plain.Sizes.Records, "records not shared: %d vs %d", ca.Sizes.Records, plain.Sizes.Records)
+
+	// distinct values don't need the format flag
+	kv = map[uint64]string{1: "a", 2: "b"}
+	wr, err := NewDBWriter(src, WithContentAddressed())
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kv {
+		err = wr.Add(k, []byte(v))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	check(src, false)
+}
+
+func TestDBKeyTransform(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "xform.db")
+	dst := filepath.Join(dir, "dst.db")
+
+	// strip the tenant bits
+	xf := NewKeyTransform(5, func(k uint64) uint64 {
+		return k &^ (uint64(0xff) << 56)
+	})
+	tenant := uint64(7) << 56
+
+	_, err := NewDBWriter(fn, WithWriterKeyTransform(NewKeyTransform(0, nil)))
+	assert(err != nil, "transform ID 0 accepted")
+
+	wr, err := NewDBWriter(fn, WithWriterKeyTransform(xf))
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	kv := make(map[uint64]string)
+	for i := 0; i < 100; i++ {
+		k := uint64(i+1) | tenant
+		kv[k] = fmt.Sprintf("value-%d", i)
+		err = wr.Add(k, []byte(kv[k]))
+		assert(err == nil, "can't add key %#x: %s", k, err)
+	}
+	err = wr.Add(1|(uint64(9)<<56), []byte("dup"))
+	assert(err == ErrExists, "transformed duplicate accepted: %v", err)
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = NewDBReader(fn, 10)
+	assert(err != nil, "opened without the key transform")
+
+	_, err = NewDBReader(fn, 10, WithKeyTransform(NewKeyTransform(6, xf.Transform)))
+	assert(err != nil, "opened with the wrong key transform")
+
+	check := func(fn string) {
+		rd, err := NewDBReader(fn, 10, WithKeyTransform(xf))
+		assert(err == nil, "read %s failed: %s", fn, err)
+		defer rd.Close()
+
+		assert(rd.KeyTransform() == 5, "%s: exp transform 5, saw %d", fn, rd.KeyTransform())
+		keys := make([]uint64, 0, len(kv))
+		for k, v := range kv {
+			s, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %#x: %s", fn, k, err)
+			assert(string(s) == v, "%s: key %#x: value mismatch", fn, k)
+			keys = append(keys, k)
+		}
+
+		vals, err := rd.FindMany(keys)
+		assert(err == nil, "%s: findmany failed: %s", fn, err)
+		for j, k := range keys {
+			assert(string(vals[j]) == kv[k], "%s: findmany: key %#x: value mismatch", fn, k)
+		}
+
+		// iteration returns the stored keys
+		err = rd.Scan(func(k uint64, v []byte) bool {
+			assert(string(v) == kv[k|tenant], "%s: scan: key %#x: value mismatch", fn, k)
+			return true
+		})
+		assert(err == nil, "%s: scan failed: %s", fn, err)
+	}
+
+	check(fn)
+
+	// copies keep the transform without applying it again
+	err = Convert(fn, dst)
+	assert(err == nil, "convert failed: %s", err)
+	check(dst)
+}
+
+func TestDBTenants(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	// both tenants use the same keys
+	tenants := []uint64{0, 42}
+	keys := make([]uint64, 50)
+	for i := range keys {
+		keys[i] = uint64(i + 1)
+	}
+
+	val := func(tenant, k uint64) string {
+		return fmt.Sprintf("tenant-%d-key-%d", tenant, k)
+	}
+	for _, tn := range tenants {
+		tw := TenantWriter(wr, tn)
+		assert(tw.Tenant() == tn, "exp tenant %d, saw %d", tn, tw.Tenant())
+
+		vals := make([][]byte, len(keys))
+		for i, k := range keys {
+			vals[i] = []byte(val(tn, k))
+		}
+		n, err := tw.AddKeyVals(keys, vals)
+		assert(err == nil, "tenant %d: add failed: %s", tn, err)
+		assert(n == len(keys), "tenant %d: exp %d records, saw %d", tn, len(keys), n)
+	}
+	assert(wr.Len() == len(tenants)*len(keys), "exp %d keys, saw %d", len(tenants)*len(keys), wr.Len())
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	for _, tn := range tenants {
+		tr := TenantReader(rd, tn)
+		for _, k := range keys {
+			v, err := tr.Find(k)
+			assert(err == nil, "tenant %d: can't find key %d: %s", tn, k, err)
+			assert(string(v) == val(tn, k), "tenant %d: key %d: exp %s, saw %s", tn, k, val(tn, k), v)
+		}
+
+		vals, err := tr.FindMany(keys)
+		assert(err == nil, "tenant %d: findmany failed: %s", tn, err)
+		for i, k := range keys {
+			assert(string(vals[i]) == val(tn, k), "tenant %d: findmany: key %d: value mismatch", tn, k)
+		}
+
+		_, ok := tr.Lookup(1000)
+		assert(!ok, "tenant %d: found missing key", tn)
+	}
+
+	// other tenants see nothing
+	_, err = TenantReader(rd, 7).Find(keys[0])
+	assert(err == ErrNoKey, "tenant 7 found a key: %v", err)
+}
+
+func TestDBFindTrusted(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := fmt.Sprintf("%s/mph%d.db", os.TempDir(), rand.Int())
+	defer os.Remove(fn)
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	// keys from iterating the DB are members
+	var keys []uint64
+	err = rd.Scan(func(k uint64, _ []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(len(keys) == len(kv), "exp %d keys, saw %d", len(kv), len(keys))
+
+	for _, k := range keys {
+		v, err := rd.FindTrusted(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(v) == kv[k], "key %d: exp %s, saw %s", k, kv[k], v)
+	}
+
+	st := rd.Stats()
+	assert(st.Hits == uint64(len(kv)), "exp %d hits, saw %d", len(kv), st.Hits)
+	assert(st.CacheHits == 0, "trusted lookups used the cache")
+}
+
+func TestDBJoin(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fa := filepath.Join(dir, "a.db")
+	fb := filepath.Join(dir, "b.db")
+
+	// 'a' is small; 'b' is large and overlaps keys 50..99 of 'a'
+	ka := make(map[uint64]string)
+	for i := 0; i < 100; i++ {
+		ka[uint64(i)] = fmt.Sprintf("a-%d", i)
+	}
+	kb := make(map[uint64]string)
+	for i := 50; i < 2000; i++ {
+		kb[uint64(i)] = fmt.Sprintf("b-%d", i)
+	}
+
+	// empty values on both sides
+	ka[60], kb[70] = "", ""
+	makeDB(t, fa, ka)
+	makeDB(t, fb, kb)
+
+	a, err := NewDBReader(fa, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer a.Close()
+
+	b, err := NewDBReader(fb, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer b.Close()
+
+	// key 0 isn't in 'b'; it mustn't match an empty slot
+	_, err = b.Find(0)
+	assert(err == ErrNoKey, "found missing key 0: %v", err)
+
+	// the argument order decides the order of the values - not the sizes
+	for _, swap := range []bool{false, true} {
+		x, y := a, b
+		if swap {
+			x, y = b, a
+		}
+
+		seen := make(map[uint64]bool)
+		err = Join(x, y, func(k uint64, vx, vy []byte) error {
+			va, vb := vx, vy
+			if swap {
+				va, vb = vy, vx
+			}
+			assert(!seen[k], "key %d joined twice", k)
+			assert(va != nil && vb != nil, "key %d: empty value joined as nil", k)
+			assert(string(va) == ka[k], "key %d: exp %s, saw %s", k, ka[k], va)
+			assert(string(vb) == kb[k], "key %d: exp %s, saw %s", k, kb[k], vb)
+			seen[k] = true
+			return nil
+		})
+		assert(err == nil, "join failed: %s", err)
+		assert(len(seen) == 50, "exp 50 joined keys, saw %d", len(seen))
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = Join(a, b, func(k uint64, va, vb []byte) error {
+		n++
+		return stop
+	})
+	assert(err == stop, "exp stop error, saw %v", err)
+	assert(n == 1, "join continued after an error")
+}
+
+func TestDBSetOps(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	keysDB := func(name string, lo, hi uint64) *DBReader {
+		fn := filepath.Join(dir, name)
+		wr, err := NewDBWriter(fn)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for k := lo; k < hi; k++ {
+			err = wr.Add(k, nil)
+			assert(err == nil, "can't add key %d: %s", k, err)
+		}
+		err = wr.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read %s failed: %s", fn, err)
+		return rd
+	}
+
+	a := keysDB("a.db", 0, 1000)
+	defer a.Close()
+	b := keysDB("b.db", 500, 1500)
+	defer b.Close()
+
+	check := func(name string, lo, hi uint64) {
+		fn := filepath.Join(dir, name)
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read %s failed: %s", fn, err)
+		defer rd.Close()
+
+		n := uint64(0)
+		err = rd.Scan(func(k uint64, _ []byte) bool {
+			assert(k >= lo && k < hi, "%s: unexpected key %d", name, k)
+			n++
+			return true
+		})
+		assert(err == nil, "%s: scan failed: %s", name, err)
+		assert(n == hi-lo, "%s: exp %d keys, saw %d", name, hi-lo, n)
+
+		for k := lo; k < hi; k++ {
+			_, err := rd.Find(k)
+			assert(err == nil, "%s: can't find key %d: %s", name, k, err)
+		}
+		_, err = rd.Find(hi)
+		assert(err == ErrNoKey, "%s: found key %d: %v", name, hi, err)
+	}
+
+	err := Union(filepath.Join(dir, "union.db"), a, b, 0.9)
+	assert(err == nil, "union failed: %s", err)
+	check("union.db", 0, 1500)
+
+	err = Intersect(filepath.Join(dir, "isect.db"), a, b, 0.9)
+	assert(err == nil, "intersect failed: %s", err)
+	check("isect.db", 500, 1000)
+
+	err = Difference(filepath.Join(dir, "diff.db"), a, b, 0.9)
+	assert(err == nil, "difference failed: %s", err)
+	check("diff.db", 0, 500)
+
+	// only keys-only DBs have set semantics
+	fn := filepath.Join(dir, "vals.db")
+	makeDB(t, fn, map[uint64]string{1: "one", 2: "two", 3: "three"})
+	v, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer v.Close()
+
+	err = Union(filepath.Join(dir, "bad.db"), a, v, 0.9)
+	assert(err != nil, "union with a values DB")
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.keys.*"))
+	assert(len(matches) == 0, "temp key files left behind: %v", matches)
+}
+
+func TestDBReaderLazy(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "lazy.db")
+
+	kv := keywDB(t, fn)
+
+	_, err := NewDBReaderLazy(filepath.Join(dir, "missing.db"), 10)
+	assert(err != nil, "opened a missing DB")
+
+	l, err := NewDBReaderLazy(fn, 10)
+	assert(err == nil, "lazy open failed: %s", err)
+	assert(!l.Opened(), "DB opened before the first lookup")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, v := range kv {
+				val, err := l.Find(k)
+				assert(err == nil, "can't find key %d: %s", k, err)
+				assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert(l.Opened(), "DB not opened after lookups")
+	assert(l.Len() >= len(kv), "exp at least %d slots, saw %d", len(kv), l.Len())
+
+	l.Close()
+	_, err = l.Find(1)
+	assert(err == ErrClosed, "exp ErrClosed, saw %v", err)
+
+	// open errors surface on the first lookup
+	bad := filepath.Join(dir, "bad.db")
+	err = ioutil.WriteFile(bad, []byte("not a DB"), 0600)
+	assert(err == nil, "write failed: %s", err)
+
+	l, err = NewDBReaderLazy(bad, 10)
+	assert(err == nil, "lazy open failed: %s", err)
+	_, err = l.Find(1)
+	assert(err != nil, "found a key in a corrupt DB")
+	_, ok := l.Lookup(1)
+	assert(!ok, "found a key in a corrupt DB")
+	l.Close()
+}
+
+func TestDBManager(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	var fns []string
+	for i := 0; i < 6; i++ {
+		fn := filepath.Join(dir, fmt.Sprintf("shard%d.db", i))
+		makeDB(t, fn, map[uint64]string{
+			1: fmt.Sprintf("one-%d", i),
+			2: fmt.Sprintf("two-%d", i),
+			3: fmt.Sprintf("three-%d", i),
+		})
+		fns = append(fns, fn)
+	}
+
+	m := NewManager(2, 10)
+	defer m.Close()
+
+	// a snapshot stays usable after its DB is closed to make room
+	s, err := m.Acquire(fns[0])
+	assert(err == nil, "acquire failed: %s", err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 3; n++ {
+				for i, fn := range fns {
+					v, err := m.Find(fn, 2)
+					assert(err == nil, "%s: can't find key: %s", fn, err)
+					assert(string(v) == fmt.Sprintf("two-%d", i), "%s: wrong value %s", fn, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert(m.Len() <= 2, "exp at most 2 open DBs, saw %d", m.Len())
+
+	v, err := s.Find(3)
+	assert(err == nil, "snapshot find failed: %s", err)
+	assert(string(v) == "three-0", "snapshot: wrong value %s", v)
+	s.Close()
+
+	_, err = m.Find(filepath.Join(dir, "missing.db"), 1)
+	assert(err != nil, "found key in a missing DB")
+
+	// per-DB options
+	xf := NewKeyTransform(7, func(k uint64) uint64 {
+		return k ^ 0xff
+	})
+
+	xfn := filepath.Join(dir, "xform.db")
+	wr, err := NewDBWriter(xfn, WithWriterKeyTransform(xf))
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 3; k++ {
+		err = wr.Add(k, []byte("xform"))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = m.Find(xfn, 1)
+	assert(err != nil, "opened a DB without its key transform")
+
+	m.SetOptions(xfn, WithKeyTransform(xf))
+	v, err = m.Find(xfn, 1)
+	assert(err == nil, "can't find key: %s", err)
+	assert(string(v) == "xform", "wrong value %s", v)
+
+	m.Evict(xfn)
+	assert(m.Len() <= 1, "exp at most 1 open DB, saw %d", m.Len())
+
+	m.Close()
+	_, err = m.Find(fns[0], 1)
+	assert(err == ErrClosed, "exp ErrClosed, saw %v", err)
+}
+
+func TestDBWriterPoison(t *testing.T) {
+	assert := newAsserter(t)
+
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("no /dev/full: %s", err)
+	}
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "full.db")
+
+	wr, err := NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	err = wr.Add(1, []byte("one"))
+	assert(err == nil, "can't add key: %s", err)
+
+	// every write now fails with ENOSPC
+	tmp := wr.fd
+	wr.fd = full
+	defer tmp.Close()
+
+	err = wr.Add(2, []byte("two"))
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+
+	// the writer is unusable after the first failure
+	wr.fd = tmp
+	err = wr.Add(3, []byte("three"))
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+	_, err = wr.AddKeyVals([]uint64{4}, [][]byte{[]byte("four")})
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+
+	err = wr.Freeze(0.9)
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+
+	_, err = os.Stat(fn)
+	assert(os.IsNotExist(err), "partial DB renamed into place: %v", err)
+
+	// a failure while freezing never leaves a DB behind
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 10; k++ {
+		err = wr.Add(k, []byte("val"))
+		assert(err == nil, "can't add key: %s", err)
+	}
+
+	tmp = wr.fd
+	wr.fd = full
+	defer tmp.Close()
+
+	err = wr.Freeze(0.9)
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+	err = wr.Freeze(0.9)
+	assert(errors.Is(err, syscall.ENOSPC), "exp ENOSPC, saw %v", err)
+
+	_, err = os.Stat(fn)
+	assert(os.IsNotExist(err), "partial DB renamed into place: %v", err)
+
+	m, _ := filepath.Glob(filepath.Join(dir, "full.db.tmp*"))
+	assert(len(m) == 0, "temp files left behind: %v", m)
+}
+
+func TestDBVlenLittleEndian(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "vlen.db")
+
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	defer rd.Close()
+
+	b, err := ioutil.ReadFile(fn)
+	assert(err == nil, "read failed: %s", err)
+
+	// the vlen table follows the offset table; it is little-endian on
+	// every host
+	off := rd.offtbl + rd.nkeys*16
+	vlen := b[off : off+rd.nkeys*4]
+	for k, v := range kv {
+		i := rd.chd.Find(k)
+		n := binary.LittleEndian.Uint32(vlen[i*4:])
+		assert(n == uint32(len(v)), "key %d: exp vlen %d, saw %d", k, len(v), n)
+	}
+}
+
+func TestDBMapWindow(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	// values DB: both tables span many 64KB windows
+	fn := filepath.Join(dir, "win.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 20000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	rd, err := NewDBReader(fn, 10, WithMapWindow(64*1024))
+	assert(err == nil, "windowed open failed: %s", err)
+	defer rd.Close()
+
+	assert(len(rd.windows) > 2, "exp many windows, saw %d", len(rd.windows))
+
+	whole, err := NewDBReader(fn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer whole.Close()
+
+	assert(len(whole.windows) == 0, "small DB mapped in windows")
+	s1, err := rd.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	s2, err := whole.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	assert(s1 == s2, "size breakdowns differ")
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+	}
+	_, err = rd.Find(20001)
+	assert(err == ErrNoKey, "found missing key: %v", err)
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv), "exp %d keys, saw %d", len(kv), n)
+
+	// a hash table larger than the window can't be mapped
+	kfn := filepath.Join(dir, "keys.db")
+	wr, err := NewDBWriter(kfn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 70000; k++ {
+		err = wr.Add(k, nil)
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	_, err = NewDBReader(kfn, 10, WithMapWindow(64*1024))
+	assert(errors.Is(err, ErrMapLimit), "exp ErrMapLimit, saw %v", err)
+
+	krd, err := NewDBReader(kfn, 10, WithMapWindow(256*1024))
+	assert(err == nil, "windowed open failed: %s", err)
+	defer krd.Close()
+
+	for k := uint64(1); k <= 70000; k++ {
+		_, err := krd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+	}
+
+	// a single slot table isn't 8 byte aligned after the vlen table
+	one := filepath.Join(dir, "one.db")
+	makeDB(t, one, map[uint64]string{7: "seven"})
+
+	ord, err := NewDBReader(one, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer ord.Close()
+
+	v, err := ord.Find(7)
+	assert(err == nil, "can't find key: %s", err)
+	assert(string(v) == "seven", "exp seven, saw %s", v)
+}
+
+func TestDBWindowedReads(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	fn := filepath.Join(dir, "paged.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 20000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	// 4096 slots per window; at most 2 of them in memory
+	rd, err := NewDBReader(fn, 0, WithWindowedReads(2), WithMapWindow(64*1024))
+	assert(err == nil, "windowed open failed: %s", err)
+	defer rd.Close()
+
+	assert(rd.paged != nil, "tables not read in windows")
+	assert(len(rd.paged.wins) > 2, "exp many windows, saw %d", len(rd.paged.wins))
+
+	whole, err := NewDBReader(fn, 0, WithoutMmap())
+	assert(err == nil, "open failed: %s", err)
+	defer whole.Close()
+
+	s1, err := rd.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	s2, err := whole.SizeBreakdown()
+	assert(err == nil, "size breakdown failed: %s", err)
+	assert(s1 == s2, "size breakdowns differ")
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+	}
+	_, err = rd.Find(20001)
+	assert(err == ErrNoKey, "found missing key: %v", err)
+
+	assert(len(rd.paged.fifo) == 2, "exp 2 resident windows, saw %d", len(rd.paged.fifo))
+	m := rd.MemUsage()
+	assert(m.Heap < whole.MemUsage().Heap, "windowed reader uses %d bytes; exp less than %d",
+		m.Heap, whole.MemUsage().Heap)
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		assert(kv[k] == string(v), "key %d: exp %s, saw %s", k, kv[k], v)
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv), "exp %d keys, saw %d", len(kv), n)
+
+	// concurrent lookups evict windows from under each other
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := uint64(1 + g); k <= 20000; k += 4 {
+				if _, err := rd.Find(k); err != nil {
+					t.Errorf("can't find key %d: %s", k, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// keys only DB
+	kfn := filepath.Join(dir, "keys.db")
+	wr, err := NewDBWriter(kfn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 10000; k++ {
+		err = wr.Add(k, nil)
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	krd, err := NewDBReader(kfn, 0, WithWindowedReads(1), WithMapWindow(64*1024))
+	assert(err == nil, "windowed open failed: %s", err)
+	defer krd.Close()
+
+	for k := uint64(1); k <= 10000; k++ {
+		_, err := krd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+	}
+	_, err = krd.Find(10001)
+	assert(err == ErrNoKey, "found missing key: %v", err)
+}
+
+// a table window that can't be read fails the lookup; the key isn't missing
+func TestDBWindowedReadError(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	fn := filepath.Join(dir, "paged.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 20000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	rd, err := NewDBReader(fn, 0, WithWindowedReads(1), WithMapWindow(64*1024))
+	assert(err == nil, "windowed open failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find(1)
+	assert(err == nil, "can't find key 1: %s", err)
+
+	// a key in a window that isn't resident
+	win := func(k uint64) uint64 {
+		return rd.chd.Find(k) >> rd.wshift
+	}
+	var key uint64
+	for k := uint64(2); k <= 20000; k++ {
+		if win(k) != win(1) {
+			key = k
+			break
+		}
+	}
+	assert(key > 0, "all keys in one window")
+
+	bad, err := os.Open(fn)
+	assert(err == nil, "can't open %s: %s", fn, err)
+	bad.Close()
+
+	fd := rd.fd
+	rd.fd = bad
+
+	_, err = rd.Find(key)
+	assert(err != nil && err != ErrNoKey, "key %d: exp read error, saw %v", key, err)
+	_, _, err = rd.Get(key)
+	assert(err != nil, "key %d: get hid the read error", key)
+	_, err = rd.Info()
+	assert(err != nil, "info hid the read error")
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		return true
+	})
+	assert(err != nil, "scan hid the read error")
+	_, err = rd.VerifyAll(context.Background(), 2)
+	assert(err != nil, "verify hid the read error")
+	_, _, err = rd.IndexOf(key)
+	assert(err != nil, "key %d: index hid the read error", key)
+	_, err = rd.Occupancy()
+	assert(err != nil, "occupancy hid the read error")
+	_, err = rd.SizeBreakdown()
+	assert(err != nil, "size breakdown hid the read error")
+
+	var b bytes.Buffer
+	rd.DumpMeta(&b)
+	assert(strings.Contains(b.String(), "can't read table window"), "dump hid the read error")
+
+	// the failed window is read again by the next lookup
+	rd.fd = fd
+	val, err := rd.Find(key)
+	assert(err == nil, "can't find key %d: %s", key, err)
+	assert(string(val) == kv[key], "key %d: exp %s, saw %s", key, kv[key], val)
+}
+
+func TestDBHotSet(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "hot.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 1000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	rd, err := NewDBReader(fn, 0, WithCache(NewLRUCache(4, 0)))
+	assert(err == nil, "open failed: %s", err)
+
+	for _, k := range []uint64{10, 20, 30, 40, 50, 20} {
+		_, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+	}
+
+	var b bytes.Buffer
+	err = rd.SaveHotSet(&b)
+	assert(err == nil, "can't save hot set: %s", err)
+	rd.Close()
+
+	// the recency order survives the restore
+	c := NewLRUCache(4, 0)
+	rd, err = NewDBReader(fn, 0, WithCache(c), WithHotSet(bytes.NewReader(b.Bytes())))
+	assert(err == nil, "open with hot set failed: %s", err)
+	defer rd.Close()
+
+	keys := c.Keys()
+	exp := []uint64{30, 40, 50, 20}
+	assert(len(keys) == len(exp), "exp %d cached keys, saw %v", len(exp), keys)
+	for i := range exp {
+		assert(keys[i] == exp[i], "cached keys: exp %v, saw %v", exp, keys)
+	}
+
+	s := rd.Stats()
+	assert(s.Lookups == 0 && s.BytesRead == 0, "warming counted: %+v", s)
+
+	for _, k := range exp {
+		v, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(v) == kv[k], "key %d: exp %s, saw %s", k, kv[k], v)
+	}
+	s = rd.Stats()
+	assert(s.CacheHits == uint64(len(exp)), "exp %d cache hits, saw %+v", len(exp), s)
+
+	// a bad hot set doesn't fail the open
+	tl := &testLogger{}
+	bad, err := NewDBReader(fn, 10, WithLogger(tl), WithHotSet(strings.NewReader("garbage")))
+	assert(err == nil, "open with bad hot set failed: %s", err)
+	defer bad.Close()
+	assert(tl.saw("can't warm the cache"), "bad hot set not logged: %v", tl.msgs)
+
+	// caches that can't list their keys can't be saved
+	nc, err := NewDBReader(fn, 0, WithCache(noKeysCache{}))
+	assert(err == nil, "open failed: %s", err)
+	defer nc.Close()
+
+	err = nc.SaveHotSet(&b)
+	assert(err != nil, "saved hot set of a cache without keys")
+}
+
+// a Cache that caches nothing
+type noKeysCache struct{}
+
+func (noKeysCache) Get(key uint64) ([]byte, bool) { return nil, false }
+func (noKeysCache) Add(key uint64, val []byte)    {}
+func (noKeysCache) Purge()                        {}
+
+func TestDBTombstones(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "tomb.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 1000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	tfn := filepath.Join(dir, "tomb.db.dead")
+	ts := NewTombstones()
+	ts.Add(7, 500, 2000)
+	err := ts.WriteFile(tfn)
+	assert(err == nil, "can't write tombstones: %s", err)
+
+	// add to an existing file
+	ts, err = ReadTombstones(tfn)
+	assert(err == nil, "can't read tombstones: %s", err)
+	assert(ts.Len() == 3 && ts.Has(500), "tombstones: exp 3 keys, saw %v", ts.Keys())
+	ts.Add(999)
+	err = ts.WriteFile(tfn)
+	assert(err == nil, "can't write tombstones: %s", err)
+
+	rd, err := NewDBReader(fn, 10, WithTombstones(tfn), WithIntegrity(FullVerify))
+	assert(err == nil, "open with tombstones failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		if ts.Has(k) {
+			assert(err == ErrNoKey, "found deleted key %d: %v", k, err)
+			continue
+		}
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+	}
+
+	vals, err := rd.FindMany([]uint64{6, 7, 8})
+	assert(err == nil, "findmany failed: %s", err)
+	assert(vals[0] != nil && vals[1] == nil && vals[2] != nil, "findmany saw deleted key 7")
+
+	n := 0
+	err = rd.Scan(func(k uint64, v []byte) bool {
+		assert(!ts.Has(k), "scan saw deleted key %d", k)
+		n++
+		return true
+	})
+	assert(err == nil, "scan failed: %s", err)
+	assert(n == len(kv)-3, "scan: exp %d keys, saw %d", len(kv)-3, n)
+
+	n = 0
+	err = rd.iter(func(k uint64, v []byte) error {
+		assert(!ts.Has(k), "iter saw deleted key %d", k)
+		n++
+		return nil
+	})
+	assert(err == nil, "iter failed: %s", err)
+	assert(n == len(kv)-3, "iter: exp %d keys, saw %d", len(kv)-3, n)
+
+	// a bad tombstone file fails the open
+	err = ioutil.WriteFile(tfn, []byte("garbage"), 0600)
+	assert(err == nil, "can't write: %s", err)
+	_, err = NewDBReader(fn, 10, WithTombstones(tfn))
+	assert(err != nil, "opened with bad tombstones")
+}
+
+func TestDBEmptyValues(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	kv := map[uint64]string{
+		1: "one",
+		2: "",
+		3: "three",
+		4: "",
+		5: "five",
+	}
+
+	for _, opts := range [][]WriterOption{nil, {WithContentAddressed()}, {WithRecordAlign(512)}} {
+		fn := filepath.Join(dir, fmt.Sprintf("empty%d.db", len(opts)))
+		wr, err := NewDBWriter(fn, opts...)
+		assert(err == nil, "can't create db: %s", err)
+		for k := uint64(1); k <= 5; k++ {
+			var v []byte
+			if k != 4 {
+				v = []byte(kv[k])
+			}
+			err = wr.Add(k, v)
+			assert(err == nil, "can't add key %d: %s", k, err)
+		}
+		err = wr.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10, WithIntegrity(FullVerify))
+		assert(err == nil, "open failed: %s", err)
+		defer rd.Close()
+
+		for k, v := range kv {
+			val, err := rd.Find(k)
+			assert(err == nil, "can't find key %d: %s", k, err)
+			assert(val != nil && string(val) == v, "key %d: exp %q, saw %q", k, v, val)
+
+			val, ok, err := rd.Get(k)
+			assert(err == nil && ok, "get key %d: %v %s", k, ok, err)
+			assert(val != nil && string(val) == v, "get key %d: exp %q, saw %q", k, v, val)
+
+			val, err = rd.FindInto(k, make([]byte, 4))
+			assert(err == nil, "findinto key %d: %s", k, err)
+			assert(string(val) == v, "findinto key %d: exp %q, saw %q", k, v, val)
+
+			val, err = rd.FindTrusted(k)
+			assert(err == nil, "findtrusted key %d: %s", k, err)
+			assert(string(val) == v, "findtrusted key %d: exp %q, saw %q", k, v, val)
+		}
+
+		val, ok, err := rd.Get(6)
+		assert(err == nil && !ok && val == nil, "get missing key: %q %v %v", val, ok, err)
+
+		vals, err := rd.FindMany([]uint64{1, 2, 4, 6})
+		assert(err == nil, "findmany failed: %s", err)
+		assert(vals[1] != nil && len(vals[1]) == 0 && vals[2] != nil, "findmany: empty values are nil")
+		assert(vals[3] == nil, "findmany found missing key")
+
+		seen := make(map[uint64]string)
+		err = rd.Scan(func(k uint64, v []byte) bool {
+			assert(v != nil, "scan: nil value for key %d", k)
+			seen[k] = string(v)
+			return true
+		})
+		assert(err == nil, "scan failed: %s", err)
+		assert(len(seen) == len(kv), "scan: exp %d keys, saw %d", len(kv), len(seen))
+
+		seen = make(map[uint64]string)
+		err = rd.iter(func(k uint64, v []byte) error {
+			seen[k] = string(v)
+			return nil
+		})
+		assert(err == nil, "iter failed: %s", err)
+		for k, v := range kv {
+			assert(seen[k] == v, "iter key %d: exp %q, saw %q", k, v, seen[k])
+		}
+
+		r, err := rd.VerifyAll(context.Background(), 2)
+		assert(err == nil && r.OK(), "verify failed: %s %+v", err, r)
+		assert(r.Records == 3 || len(opts) > 0, "verify: exp 3 records, saw %d", r.Records)
+	}
+
+	// keys-only DBs have a non-nil empty value via Get
+	kfn := filepath.Join(dir, "keys.db")
+	wr, err := NewDBWriter(kfn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 5; k++ {
+		err = wr.Add(k, nil)
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	krd, err := NewDBReader(kfn, 10)
+	assert(err == nil, "open failed: %s", err)
+
+	v, err := krd.Find(3)
+	assert(err == nil && v == nil, "keys-only find: %q %v", v, err)
+	v, ok, err := krd.Get(3)
+	assert(err == nil && ok && v != nil && len(v) == 0, "keys-only get: %q %v %v", v, ok, err)
+	v, ok, err = krd.Get(9)
+	assert(err == nil && !ok && v == nil, "keys-only get missing key: %q %v %v", v, ok, err)
+
+	krd.Close()
+
+	// a DB whose values are all empty isn't keys-only
+	efn := filepath.Join(dir, "allempty.db")
+	wr, err = NewDBWriter(efn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 5; k++ {
+		err = wr.Add(k, []byte{})
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	erd, err := NewDBReader(efn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer erd.Close()
+
+	assert((erd.Flags()&FlagKeysOnly) == 0, "all empty values: DB is keys-only")
+	for k := uint64(1); k <= 5; k++ {
+		v, err := erd.Find(k)
+		assert(err == nil && v != nil && len(v) == 0, "all empty values: key %d: %q %v", k, v, err)
+	}
+	_, err = erd.Find(9)
+	assert(err == ErrNoKey, "all empty values: found missing key: %v", err)
+
+	n := 0
+	err = erd.Scan(func(k uint64, v []byte) bool {
+		assert(v != nil, "all empty values: scan: nil value for key %d", k)
+		n++
+		return true
+	})
+	assert(err == nil && n == 5, "all empty values: scan saw %d keys: %v", n, err)
+
+	// ... even if the keys are grouped
+	gfn := filepath.Join(dir, "allempty-groups.db")
+	wr, err = NewDBWriter(gfn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 5; k++ {
+		err = wr.AddGroup(uint32(k%2), k, []byte{})
+		assert(err == nil, "can't add key: %s", err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	grd, err := NewDBReader(gfn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer grd.Close()
+
+	n = 0
+	err = grd.ScanGroup(1, func(k uint64, v []byte) bool {
+		assert(k%2 == 1 && v != nil, "all empty values: group 1: key %d, value %q", k, v)
+		n++
+		return true
+	})
+	assert(err == nil && n == 3, "all empty values: group 1 has %d keys: %v", n, err)
+}
+
+func TestDBWriterLimits(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	// too many keys; the writer stays usable
+	fn := filepath.Join(dir, "keys.db")
+	wr, err := NewDBWriter(fn, WithMaxKeys(10))
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 10; k++ {
+		err = wr.Add(k, []byte("val"))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Add(11, []byte("val"))
+	assert(errors.Is(err, ErrTooManyKeys), "exp ErrTooManyKeys, saw %v", err)
+	err = wr.Add(5, []byte("val"))
+	assert(err == ErrExists, "exp ErrExists, saw %v", err)
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "open failed: %s", err)
+	assert(rd.Len() >= 10, "exp 10 keys, saw %d slots", rd.Len())
+	rd.Close()
+
+	// records past the size limit
+	fn = filepath.Join(dir, "size.db")
+	wr, err = NewDBWriter(fn, WithMaxFileSize(200))
+	assert(err == nil, "can't create db: %s", err)
+	err = wr.Add(1, make([]byte, 64))
+	assert(err == nil, "can't add key: %s", err)
+	err = wr.Add(2, make([]byte, 128))
+	assert(errors.Is(err, ErrFileTooLarge), "exp ErrFileTooLarge, saw %v", err)
+	err = wr.Add(3, make([]byte, 8))
+	assert(err == nil, "writer unusable after a rejected record: %s", err)
+
+	// the tables start at a page boundary: way past the limit
+	err = wr.Freeze(0.9)
+	assert(errors.Is(err, ErrFileTooLarge), "exp ErrFileTooLarge, saw %v", err)
+	_, err = os.Stat(fn)
+	assert(os.IsNotExist(err), "DB written past the limit")
+
+	// a DB that fits
+	fn = filepath.Join(dir, "fits.db")
+	wr, err = NewDBWriter(fn, WithMaxFileSize(1<<20), WithMaxKeys(1000))
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 1000; k++ {
+		err = wr.Add(k, []byte("val"))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	st, err := os.Stat(fn)
+	assert(err == nil, "can't stat: %s", err)
+	assert(st.Size() <= 1<<20, "DB is %d bytes", st.Size())
+
+	// set operations honor the key limit
+	fn = filepath.Join(dir, "set.db")
+	wr, err = NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 1000; k++ {
+		err = wr.Add(k, nil)
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	a, err := NewDBReader(fn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer a.Close()
+
+	err = Union(filepath.Join(dir, "union.db"), a, a, 0.9, WithMaxKeys(100))
+	assert(errors.Is(err, ErrTooManyKeys), "exp ErrTooManyKeys, saw %v", err)
+}
+
+func TestDBWriterSelfCheck(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "check.db")
+
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 500; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+
+	xf := NewKeyTransform(7, func(k uint64) uint64 {
+		return k ^ 0x5a5a
+	})
+
+	tl := &testLogger{}
+	wr, err := NewDBWriter(fn, WithSelfCheck(0), WithWriterLogger(tl), WithWriterKeyTransform(xf))
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kv {
+		err = wr.Add(k, []byte(v))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+	assert(tl.saw("self-check of 500 keys passed"), "no self-check: %v", tl.msgs)
+
+	// keys-only
+	kfn := filepath.Join(dir, "keys.db")
+	wr, err = NewDBWriter(kfn, WithSelfCheck(10))
+	assert(err == nil, "can't create db: %s", err)
+	for k := uint64(1); k <= 500; k++ {
+		err = wr.Add(k, nil)
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	// a bad build doesn't replace the good DB
+	wr, err = NewDBWriter(fn, WithSelfCheck(0))
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kv {
+		err = wr.Add(k, []byte(v+"-new"))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	wr.keymap[7].off++
+	err = wr.Freeze(0.9)
+	assert(err != nil && strings.Contains(err.Error(), "self-check"), "exp self-check failure, saw %v", err)
+
+	rd, err := NewDBReader(fn, 10, WithKeyTransform(xf))
+	assert(err == nil, "open failed: %s", err)
+	defer rd.Close()
+
+	v, err := rd.Find(7)
+	assert(err == nil && string(v) == kv[7], "old DB replaced: %q %v", v, err)
+
+	ents, err := ioutil.ReadDir(dir)
+	assert(err == nil, "can't read dir: %s", err)
+	assert(len(ents) == 2, "exp 2 files, saw %d", len(ents))
+}
+
+func TestDBKeyAt(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "pos.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 1000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer rd.Close()
+
+	seen := make(map[uint64]bool)
+	for i := uint64(0); i < uint64(rd.Len()); i++ {
+		k, err := rd.KeyAt(i)
+		if err == ErrNoKey {
+			_, err = rd.ValueAt(i)
+			assert(err == ErrNoKey, "slot %d: exp ErrNoKey, saw %v", i, err)
+			continue
+		}
+		assert(err == nil, "slot %d: %s", i, err)
+		assert(!seen[k], "slot %d: key %d seen twice", i, k)
+		seen[k] = true
+
+		v, err := rd.ValueAt(i)
+		assert(err == nil, "slot %d: %s", i, err)
+		assert(string(v) == kv[k], "slot %d: key %d: exp %s, saw %s", i, k, kv[k], v)
+	}
+	assert(len(seen) == len(kv), "exp %d keys, saw %d", len(kv), len(seen))
+
+	_, err = rd.KeyAt(uint64(rd.Len()))
+	assert(err != nil && err != ErrNoKey, "exp range error, saw %v", err)
+	_, err = rd.ValueAt(uint64(rd.Len()))
+	assert(err != nil && err != ErrNoKey, "exp range error, saw %v", err)
+}
+
+func TestDBIndexOf(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "idx.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 1000; i++ {
+		kv[i] = fmt.Sprintf("val-%d", i)
+	}
+	makeDB(t, fn, kv)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "open failed: %s", err)
+	defer rd.Close()
+
+	idx := make(map[uint64]uint64)
+	for k := range kv {
+		i, ok, err := rd.IndexOf(k)
+		assert(err == nil && ok, "no index for key %d: %v", k, err)
+		assert(i < uint64(rd.Len()), "key %d: index %d out of range", k, i)
+
+		key, err := rd.KeyAt(i)
+		assert(err == nil && key == k, "key %d: slot %d has key %d: %v", k, i, key, err)
+		idx[k] = i
+	}
+	_, ok, err := rd.IndexOf(1001)
+	assert(err == nil && !ok, "found index of missing key")
+
+	var b bytes.Buffer
+	n, err := rd.ExportIndex(&b)
+	assert(err == nil, "export failed: %s", err)
+	assert(n == uint64(len(kv)), "exp %d entries, saw %d", len(kv), n)
+
+	buf := b.Bytes()
+	le := binary.LittleEndian
+	assert(string(buf[:4]) == "CHDI", "bad magic %q", buf[:4])
+	assert(le.Uint64(buf[8:]) == n, "header: exp %d entries, saw %d", n, le.Uint64(buf[8:]))
+	assert(len(buf) == 16+16*int(n), "exp %d bytes, saw %d", 16+16*n, len(buf))
+
+	var prev uint64
+	for j := uint64(0); j < n; j++ {
+		e := buf[16+j*16:]
+		k, i := le.Uint64(e[:8]), le.Uint64(e[8:16])
+		assert(idx[k] == i, "key %d: exp index %d, saw %d", k, idx[k], i)
+		assert(j == 0 || i > prev, "export not in slot order")
+		prev = i
+	}
+}
+
+func TestDBSecretKeys(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "secret.db")
+	kv := make(map[uint64]string)
+	for i := uint64(1); i <= 1000; i++ {
+		kv[i*0x9e3779b97f4a7c15] = fmt.Sprintf("val-%d", i)
+	}
+	kv[0] = "zero"
+	makeDB(t, fn, kv)
+
+	c := NewLRUCache(100, 0)
+	rd, err := NewDBReader(fn, 0, WithCache(c), WithSecretKeys())
+	assert(err == nil, "open failed: %s", err)
+	defer rd.Close()
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %#x: %s", k, err)
+		assert(string(val) == v, "key %#x: exp %s, saw %s", k, v, val)
+
+		// and again via the cache
+		val, err = rd.Find(k)
+		assert(err == nil && string(val) == v, "key %#x: cached: exp %s, saw %s (%v)", k, v, val, err)
+	}
+
+	vals, err := rd.FindMany([]uint64{0x9e3779b97f4a7c15, 1, 0})
+	assert(err == nil, "find many failed: %s", err)
+	assert(string(vals[0]) == "val-1" && vals[1] == nil && string(vals[2]) == "zero", "wrong values %q", vals)
+
+	for i := uint64(1); i <= 1000; i++ {
+		_, err := rd.Find(i)
+		assert(err == ErrNoKey, "key %d: exp ErrNoKey, saw %v", i, err)
+	}
+
+	// the keys are never in the cache
+	keys := c.Keys()
+	assert(len(keys) == 100, "exp 100 cached keys, saw %d", len(keys))
+	for _, k := range keys {
+		_, ok := kv[k]
+		assert(!ok, "key %#x in the cache", k)
+	}
+	assert(rd.Stats().CacheHits > 0, "no cache hits: %+v", rd.Stats())
+
+	var b bytes.Buffer
+	err = rd.SaveHotSet(&b)
+	assert(err != nil, "saved the hot set of secret keys")
+
+	for _, x := range []struct {
+		a, b uint64
+		eq   int
+	}{
+		{0, 0, 1},
+		{1, 0, 0},
+		{1 << 32, 0, 0},
+		{1<<63 | 5, 1<<63 | 5, 1},
+		{^uint64(0), ^uint64(0) >> 1, 0},
+	} {
+		assert(ctEq(x.a, x.b) == x.eq, "ctEq(%#x, %#x): exp %d", x.a, x.b, x.eq)
+	}
+}
+
+func TestDBRecordBounds(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "bounds.db")
+	kv := keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "read failed: %s", err)
+	i := rd.chd.Find(1)
+	vlenOff := rd.offtbl + rd.nkeys*16 + 4*i
+	rd.Close()
+
+	// a value of 'n' bytes fits; n-1 doesn't
+	n := uint32(len(kv[1]))
+	rd, err = NewDBReader(fn, 0, WithMaxValueSize(n))
+	assert(err == nil, "read failed: %s", err)
+	v, err := rd.Find(1)
+	assert(err == nil && string(v) == kv[1], "key 1: exp %s, saw %s (%v)", kv[1], v, err)
+	rd.Close()
+
+	rd, err = NewDBReader(fn, 0, WithMaxValueSize(n-1))
+	assert(err == nil, "read failed: %s", err)
+	_, err = rd.Find(1)
+	assert(errors.Is(err, ErrCorrupt), "exp ErrCorrupt, saw %v", err)
+	rd.Close()
+
+	// a hostile vlen fails every read path without a 4GB allocation
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "open failed: %s", err)
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], 0xfffffff0)
+	_, err = fd.WriteAt(b[:], int64(vlenOff))
+	assert(err == nil, "write failed: %s", err)
+	fd.Close()
+
+	rd, err = NewDBReader(fn, 10, WithIntegrity(HeaderOnly))
+	assert(err == nil, "header only: read failed: %s", err)
+	defer rd.Close()
+
+	_, err = rd.Find(1)
+	assert(errors.Is(err, ErrCorrupt), "find: exp ErrCorrupt, saw %v", err)
+	_, err = rd.FindInto(1, nil)
+	assert(errors.Is(err, ErrCorrupt), "find into: exp ErrCorrupt, saw %v", err)
+	_, err = rd.FindMany([]uint64{2, 1})
+	assert(errors.Is(err, ErrCorrupt), "find many: exp ErrCorrupt, saw %v", err)
+	_, err = rd.ValueAt(i)
+	assert(errors.Is(err, ErrCorrupt), "value at: exp ErrCorrupt, saw %v", err)
+	err = rd.Scan(func(uint64, []byte) bool { return true })
+	assert(errors.Is(err, ErrCorrupt), "scan: exp ErrCorrupt, saw %v", err)
+
+	v, err = rd.Find(2)
+	assert(err == nil && string(v) == kv[2], "key 2: exp %s, saw %s (%v)", kv[2], v, err)
+
+	// the limit applies to decoded values too; and they aren't decoded
+	// beyond the limit
+	big := bytes.Repeat([]byte("a"), 16*1024*1024)
+	for _, c := range []ValueCodec{Flate, Zstd} {
+		fn = filepath.Join(dir, fmt.Sprintf("codec-%x.db", c.ID()))
+		wr, err := NewDBWriter(fn, WithValueCodec(c))
+		assert(err == nil, "can't create db: %s", err)
+		err = wr.Add(7, big)
+		assert(err == nil, "add failed: %s", err)
+		err = wr.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+
+		fr, err := NewDBReader(fn, 0, WithMaxValueSize(64*1024))
+		assert(err == nil, "read failed: %s", err)
+		defer fr.Close()
+
+		var m0, m1 runtime.MemStats
+		runtime.ReadMemStats(&m0)
+		_, err = fr.Find(7)
+		runtime.ReadMemStats(&m1)
+		assert(errors.Is(err, ErrCorrupt), "codec %#x: exp ErrCorrupt, saw %v", c.ID(), err)
+		alloc := m1.TotalAlloc - m0.TotalAlloc
+		assert(alloc < 1024*1024, "codec %#x: decoding allocated %d bytes; limit is 64k", c.ID(), alloc)
+	}
+}
+
+func TestDBReaderFromFd(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "fd.db")
+	kv := keywDB(t, fn)
+
+	fd, err := os.Open(fn)
+	assert(err == nil, "open failed: %s", err)
+
+	// the reader neither needs the name nor the file position
+	_, err = fd.Seek(100, io.SeekStart)
+	assert(err == nil, "seek failed: %s", err)
+	err = os.Remove(fn)
+	assert(err == nil, "remove failed: %s", err)
+
+	rd, err := NewDBReaderFromFd(fd, 10, WithVerifyCache(""), WithIntegrity(FullVerify))
+	assert(err == nil, "open from fd failed: %s", err)
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+	}
+
+	in, err := rd.Info()
+	assert(err == nil, "info failed: %s", err)
+	assert(in.File == fd.Name() && in.Keys == uint64(len(kv)), "wrong info %+v", in)
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert(err == nil && len(names) == 0, "files created by name: %v", names)
+
+	// the reader owns the fd
+	rd.Close()
+	assert(fd.Close() != nil, "fd not closed by the reader")
+
+	// a bad DB leaves the fd to the caller
+	bad := filepath.Join(dir, "bad.db")
+	err = ioutil.WriteFile(bad, bytes.Repeat([]byte{1}, 1024), 0600)
+	assert(err == nil, "write failed: %s", err)
+	fd, err = os.Open(bad)
+	assert(err == nil, "open failed: %s", err)
+	defer fd.Close()
+
+	_, err = NewDBReaderFromFd(fd, 10)
+	assert(err != nil, "bad DB opened")
+	_, err = fd.Stat()
+	assert(err == nil, "fd closed on failure: %s", err)
+}
+
+func TestDBEphemeral(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	assert(err == nil, "getwd failed: %s", err)
+	err = os.Chdir(dir)
+	assert(err == nil, "chdir failed: %s", err)
+	defer os.Chdir(wd)
+
+	kv := make(map[uint64]string)
+	for i, s := range keyw {
+		kv[uint64(i+1)] = s
+	}
+
+	w, err := NewEphemeralDBWriter("request-42", WithSelfCheck(0))
+	assert(err == nil, "can't create writer: %s", err)
+	defer w.Close()
+
+	for k, v := range kv {
+		err = w.Add(k, []byte(v))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+
+	rd, err := w.FreezeReader(0.9, 10)
+	assert(err == nil, "freeze failed: %s", err)
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %s, saw %s", k, v, val)
+	}
+
+	in, err := rd.Info()
+	assert(err == nil, "info failed: %s", err)
+	assert(strings.Contains(in.File, "request-42"), "wrong name %s", in.File)
+	rd.Close()
+
+	// nothing was ever named in the filesystem
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert(err == nil && len(names) == 0, "files created: %v", names)
+
+	err = w.Add(100, []byte("late"))
+	assert(err == ErrFrozen, "exp ErrFrozen, saw %v", err)
+	assert(w.Close() == nil, "close failed")
+
+	// a DB frozen without a reader and an aborted one are discarded
+	for _, freeze := range []bool{true, false} {
+		w, err := NewEphemeralDBWriter("discard")
+		assert(err == nil, "can't create writer: %s", err)
+		err = w.Add(1, []byte("one"))
+		assert(err == nil, "can't add: %s", err)
+		if freeze {
+			err = w.Freeze(0.9)
+			assert(err == nil, "freeze failed: %s", err)
+		}
+		assert(w.Close() == nil, "close failed")
+		assert(w.fd == nil || w.fd.Close() != nil, "file not closed")
+	}
+
+	// a regular DB is opened by name
+	fn := filepath.Join(dir, "named.db")
+	w, err = NewDBWriter(fn)
+	assert(err == nil, "can't create writer: %s", err)
+	err = w.Add(1, []byte("one"))
+	assert(err == nil, "can't add: %s", err)
+	rd, err = w.FreezeReader(0.9, 10)
+	assert(err == nil, "freeze failed: %s", err)
+	defer rd.Close()
+	assert(rd.Name() == fn, "exp name %s, saw %s", fn, rd.Name())
+}
+
+func TestDBGroups(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "groups.db")
+
+	w, err := NewDBWriter(fn, WithContentAddressed(), WithRecordAlign(16))
+	assert(err == nil, "can't create writer: %s", err)
+	defer w.Close()
+
+	// interleave the groups; some values are shared across groups and
+	// group 7 only has empty values
+	kv := make(map[uint64]string)
+	grp := make(map[uint64]uint32)
+	for i, s := range keyw {
+		k := uint64(i + 1)
+		g := uint32(i % 4)
+		v := s
+		switch {
+		case i%5 == 0:
+			v = "shared"
+		case g == 3 && i%2 == 1:
+			v = ""
+		}
+
+		if g == 0 {
+			err = w.Add(k, []byte(v))
+		} else {
+			err = w.AddGroup(g, k, []byte(v))
+		}
+		assert(err == nil, "can't add key %d: %s", k, err)
+		kv[k], grp[k] = v, g
+	}
+	for k := uint64(1000); k < 1003; k++ {
+		err = w.AddGroup(7, k, nil)
+		assert(err == nil, "can't add key %d: %s", k, err)
+		kv[k], grp[k] = "", 7
+	}
+
+	err = w.AddGroup(2, 1, []byte("dup"))
+	assert(err == ErrExists, "exp ErrExists, saw %v", err)
+
+	err = w.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert(err == nil && len(names) == 1, "stray files: %v", names)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open: %s", err)
+	defer rd.Close()
+
+	assert((rd.Flags()&FlagGroups) != 0, "no groups flag")
+
+	for k, v := range kv {
+		val, err := rd.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(val) == v, "key %d: exp %q, saw %q", k, v, val)
+	}
+
+	ext := rd.Extents()
+	assert(len(ext) == 5, "exp 5 extents, saw %d", len(ext))
+
+	pgsz := uint64(os.Getpagesize())
+	for j, e := range ext {
+		exp := []uint32{0, 1, 2, 3, 7}[j]
+		assert(e.Group == exp, "extent %d: exp group %d, saw %d", j, exp, e.Group)
+		if j > 0 {
+			assert(e.Off%pgsz == 0, "group %d: unaligned extent at %d", e.Group, e.Off)
+			p := ext[j-1]
+			assert(e.Off >= p.Off+p.Size, "group %d overlaps group %d", e.Group, p.Group)
+		}
+
+		x, ok := rd.Extent(e.Group)
+		assert(ok && x == e, "group %d: exp %+v, saw %+v", e.Group, e, x)
+
+		seen := make(map[uint64]bool)
+		err = rd.ScanGroup(e.Group, func(k uint64, val []byte) bool {
+			assert(grp[k] == e.Group, "group %d: key %d of group %d", e.Group, k, grp[k])
+			assert(string(val) == kv[k], "key %d: exp %q, saw %q", k, kv[k], val)
+			seen[k] = true
+			return true
+		})
+		assert(err == nil, "group %d: scan failed: %s", e.Group, err)
+		assert(uint64(len(seen)) == e.Keys, "group %d: exp %d keys, saw %d", e.Group, e.Keys, len(seen))
+	}
+	assert(ext[4].Size == 0, "group 7 has records: %+v", ext[4])
+
+	_, ok := rd.Extent(5)
+	assert(!ok, "group 5 exists")
+	err = rd.ScanGroup(5, func(uint64, []byte) bool { return true })
+	assert(errors.Is(err, ErrNoGroup), "exp ErrNoGroup, saw %v", err)
+
+	r, err := rd.VerifyAll(context.Background(), 2)
+	assert(err == nil && len(r.Failures()) == 0, "verify failed: %v %+v", err, r.Failures())
+}
+
+func TestDBConvertGroups(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	dst := filepath.Join(dir, "dst.db")
+
+	w, err := NewDBWriter(src)
+	assert(err == nil, "can't create writer: %s", err)
+
+	grp := make(map[uint64]uint32)
+	for i, s := range keyw {
+		k, g := uint64(i+1), uint32(i%3)
+		v := s
+		if i%4 == 3 {
+			v = ""
+		}
+		err = w.AddGroup(g, k, []byte(v))
+		assert(err == nil, "can't add key %d: %s", k, err)
+		grp[k] = g
+	}
+	err = w.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = Convert(src, dst, WithValueCodec(Flate))
+	assert(err == nil, "convert failed: %s", err)
+
+	rs, err := NewDBReader(src, 10)
+	assert(err == nil, "can't open: %s", err)
+	defer rs.Close()
+
+	rd, err := NewDBReader(dst, 10)
+	assert(err == nil, "can't open: %s", err)
+	defer rd.Close()
+
+	exp, ext := rs.Extents(), rd.Extents()
+	assert(len(ext) == 3 && len(ext) == len(exp), "exp %d extents, saw %d", len(exp), len(ext))
+	for j, e := range ext {
+		assert(e.Group == exp[j].Group && e.Keys == exp[j].Keys, "extent %d: exp %+v, saw %+v", j, exp[j], e)
+
+		n := 0
+		err = rd.ScanGroup(e.Group, func(k uint64, val []byte) bool {
+			want, err := rs.Find(k)
+			assert(err == nil, "can't find key %d: %s", k, err)
+			assert(grp[k] == e.Group, "group %d: key %d of group %d", e.Group, k, grp[k])
+			assert(string(val) == string(want), "key %d: exp %q, saw %q", k, want, val)
+			n++
+			return true
+		})
+		assert(err == nil, "group %d: scan failed: %s", e.Group, err)
+		assert(uint64(n) == e.Keys, "group %d: exp %d keys, saw %d", e.Group, e.Keys, n)
+	}
+
+	// a keys-only DB doesn't know the groups of its keys
+	w, err = NewDBWriter(src)
+	assert(err == nil, "can't create writer: %s", err)
+	for k, g := range grp {
+		err = w.AddGroup(g, k, nil)
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = w.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	err = Convert(src, dst)
+	assert(err != nil, "converted a grouped keys-only DB")
+}
+
+func TestDBGroupQuota(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "quota.db")
+
+	w, err := NewDBWriter(fn, WithContentAddressed(), WithGroupQuota(1, 40), WithGroupQuota(0, 20))
+	assert(err == nil, "can't create writer: %s", err)
+	defer w.Close()
+
+	// 8 byte checksum + 8 byte value per record
+	err = w.AddGroup(1, 1, []byte("aaaaaaaa"))
+	assert(err == nil, "can't add: %s", err)
+	err = w.AddGroup(1, 2, []byte("bbbbbbbb"))
+	assert(err == nil, "can't add: %s", err)
+	err = w.AddGroup(1, 3, []byte("cccccccc"))
+	assert(errors.Is(err, ErrQuota), "exp ErrQuota, saw %v", err)
+
+	// shared records and empty values don't use any quota
+	err = w.AddGroup(1, 3, []byte("aaaaaaaa"))
+	assert(err == nil, "can't add: %s", err)
+	err = w.AddGroup(1, 4, nil)
+	assert(err == nil, "can't add: %s", err)
+
+	// but records of another group aren't shared
+	err = w.AddGroup(2, 5, []byte("aaaaaaaa"))
+	assert(err == nil, "can't add: %s", err)
+
+	var st []AddStatus
+	n, err := w.AddKeyValsFunc([]uint64{6, 7}, [][]byte{[]byte("dddddddd"), []byte("eeeeeeee")}, func(i int, s AddStatus) {
+		st = append(st, s)
+	})
+	assert(err == nil && n == 1, "exp 1 record, saw %d: %v", n, err)
+	assert(st[0] == AddOK && st[1] == AddOverQuota, "wrong status %v", st)
+	assert(st[1].String() == "over-quota", "wrong name %s", st[1])
+
+	exp := []GroupStats{
+		{Group: 0, Keys: 1, Bytes: 16},
+		{Group: 1, Keys: 4, Bytes: 32},
+		{Group: 2, Keys: 1, Bytes: 16},
+	}
+	gs := w.GroupStats()
+	assert(reflect.DeepEqual(gs, exp), "writer: exp %+v, saw %+v", exp, gs)
+
+	err = w.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open: %s", err)
+	defer rd.Close()
+
+	gs = rd.GroupStats()
+	assert(reflect.DeepEqual(gs, exp), "reader: exp %+v, saw %+v", exp, gs)
+	for _, e := range rd.Extents() {
+		assert(e.Bytes <= e.Size, "group %d: %d bytes in %d", e.Group, e.Bytes, e.Size)
+	}
+
+	val, err := rd.Find(5)
+	assert(err == nil && string(val) == "aaaaaaaa", "key 5: %s %v", val, err)
+}
+
+func TestDBChecksumSections(t *testing.T) {
+	assert := newAsserter(t)
+
+	fn := filepath.Join(t.TempDir(), "sections.db")
+	keywDB(t, fn)
+
+	rd, err := NewDBReader(fn, 10)
+	assert(err == nil, "can't open: %s", err)
+
+	secs, err := rd.ChecksumSections()
+	assert(err == nil, "sections failed: %s", err)
+	rd.Close()
+
+	_, err = rd.ChecksumSections()
+	assert(err == ErrClosed, "exp ErrClosed, saw %v", err)
+
+	names := make(map[string]int)
+	for _, s := range secs {
+		names[s.Name]++
+	}
+	assert(names["header"] == 1 && names["records"] > 0 && names["tables"] > 0 && names["trailer"] == 1,
+		"wrong sections %v", names)
+
+	data, err := ioutil.ReadFile(fn)
+	assert(err == nil, "can't read: %s", err)
+
+	// stream the file in odd sized pieces
+	stream := func(data []byte) (*SectionVerifier, error) {
+		v, err := NewSectionVerifier(secs)
+		assert(err == nil, "can't create verifier: %s", err)
+		for b := data; len(b) > 0; {
+			n := 97
+			if n > len(b) {
+				n = len(b)
+			}
+			if _, err := v.Write(b[:n]); err != nil {
+				return v, err
+			}
+			b = b[n:]
+		}
+		return v, v.Close()
+	}
+
+	v, err := stream(data)
+	assert(err == nil, "verify failed: %s", err)
+	assert(v.Verified() == uint64(len(data)), "exp %d bytes verified, saw %d", len(data), v.Verified())
+
+	// a corrupt record fails its section; the header is still good
+	bad := append([]byte(nil), data...)
+	bad[80] ^= 0xff
+	v, err = stream(bad)
+	assert(errors.Is(err, ErrCorrupt), "exp ErrCorrupt, saw %v", err)
+	assert(v.Verified() == 64, "exp 64 bytes verified, saw %d", v.Verified())
+
+	_, err = stream(data[:len(data)-1])
+	assert(errors.Is(err, ErrCorrupt), "truncated file: exp ErrCorrupt, saw %v", err)
+	_, err = stream(append(data, 0))
+	assert(errors.Is(err, ErrCorrupt), "long file: exp ErrCorrupt, saw %v", err)
+
+	_, err = NewSectionVerifier(secs[1:])
+	assert(err != nil, "accepted sections with a gap")
+}
+
+func TestDBSigned(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	assert(err == nil, "can't generate key: %s", err)
+	other, _, err := ed25519.GenerateKey(nil)
+	assert(err == nil, "can't generate key: %s", err)
+
+	_, err = NewDBWriter(filepath.Join(dir, "crc.db"), WithSigningKey(priv), WithChecksum(ChecksumCRC32C))
+	assert(err != nil, "signed a CRC checksum")
+
+	build := func(name string, opts ...WriterOption) string {
+		fn := filepath.Join(dir, name)
+		w, err := NewDBWriter(fn, opts...)
+		assert(err == nil, "can't create writer: %s", err)
+		defer w.Close()
+
+		for i, s := range keyw {
+			err = w.AddGroup(uint32(i%3), uint64(i+1), []byte(s))
+			assert(err == nil, "can't add: %s", err)
+		}
+		err = w.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+		return fn
+	}
+
+	fn := build("signed.db", WithSigningKey(priv))
+	plain := build("plain.db")
+
+	rd, err := NewDBReader(fn, 10, WithTrustedKeys(other, pub))
+	assert(err == nil, "can't open: %s", err)
+	assert(bytes.Equal(rd.Signer(), pub), "wrong signer %x", rd.Signer())
+	assert((rd.Flags()&FlagSigned) != 0, "no signed flag")
+	assert(len(rd.Extents()) == 3, "exp 3 extents, saw %d", len(rd.Extents()))
+	for i, s := range keyw {
+		val, err := rd.Find(uint64(i + 1))
+		assert(err == nil && string(val) == s, "key %d: exp %s, saw %s %v", i+1, s, val, err)
+	}
+	rd.Close()
+
+	_, err = NewDBReader(fn, 10, WithTrustedKeys(other))
+	assert(errors.Is(err, ErrSignature), "untrusted key: exp ErrSignature, saw %v", err)
+	_, err = NewDBReader(plain, 10, WithTrustedKeys(pub))
+	assert(errors.Is(err, ErrSignature), "unsigned DB: exp ErrSignature, saw %v", err)
+
+	rd, err = NewDBReader(plain, 10)
+	assert(err == nil, "can't open: %s", err)
+	assert(rd.Signer() == nil, "unsigned DB has a signer")
+	rd.Close()
+
+	// a forged record passes its own checksum but not the signature
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "can't open: %s", err)
+	i := rd.chd.Find(1)
+	off, vlen := rd.offAt(i), rd.vlenAt(i)
+	salt := rd.Salt()
+	rd.Close()
+
+	val := []byte(strings.Repeat("x", int(vlen)))
+	var o [8]byte
+	binary.BigEndian.PutUint64(o[:], off)
+	h := siphash.New(salt)
+	h.Write(o[:])
+	h.Write(val)
+	var rec [8]byte
+	binary.BigEndian.PutUint64(rec[:], h.Sum64())
+
+	fd, err := os.OpenFile(fn, os.O_RDWR, 0)
+	assert(err == nil, "can't open file: %s", err)
+	_, err = fd.WriteAt(append(rec[:], val...), int64(off))
+	assert(err == nil, "can't write: %s", err)
+	fd.Close()
+
+	rd, err = NewDBReader(fn, 10)
+	assert(err == nil, "can't open: %s", err)
+	v, err := rd.Find(1)
+	assert(err == nil && string(v) == string(val), "forged record not read: %s %v", v, err)
+	rd.Close()
+
+	_, err = NewDBReader(fn, 10, WithTrustedKeys(pub))
+	assert(errors.Is(err, ErrSignature), "forged record: exp ErrSignature, saw %v", err)
+}
+
+func TestDBKeysOnlyZeroKey(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+	keysDB := func(name string, lo, hi uint64) *DBReader {
+		fn := filepath.Join(dir, name)
+		wr, err := NewDBWriter(fn)
+		assert(err == nil, "can't create db %s: %s", fn, err)
+		for k := lo; k < hi; k++ {
+			err = wr.Add(k, nil)
+			assert(err == nil, "can't add key %d: %s", k, err)
+		}
+		err = wr.Freeze(0.75)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := NewDBReader(fn, 10)
+		assert(err == nil, "read %s failed: %s", fn, err)
+		return rd
+	}
+
+	for _, lo := range []uint64{0, 1} {
+		rd := keysDB(fmt.Sprintf("keys%d.db", lo), lo, 500)
+		defer rd.Close()
+
+		zero := lo == 0
+		assert(((rd.Flags()&FlagZeroKey) > 0) == zero, "lo %d: zero key flag %#x", lo, rd.Flags())
+
+		n := uint64(0)
+		sawZero := false
+		err := rd.Scan(func(k uint64, _ []byte) bool {
+			if k == 0 {
+				sawZero = true
+			}
+			n++
+			return true
+		})
+		assert(err == nil, "lo %d: scan failed: %s", lo, err)
+		assert(sawZero == zero, "lo %d: scan saw key 0: %v", lo, sawZero)
+		assert(n == 500-lo, "lo %d: exp %d keys, saw %d", lo, 500-lo, n)
+
+		info, err := rd.Info()
+		assert(err == nil, "lo %d: info failed: %s", lo, err)
+		assert(info.Keys == 500-lo, "lo %d: exp %d keys, info saw %d", lo, 500-lo, info.Keys)
+
+		_, err = rd.Find(0)
+		if zero {
+			assert(err == nil, "can't find key 0: %s", err)
+		} else {
+			assert(err == ErrNoKey, "found phantom key 0: %v", err)
+		}
+	}
+}
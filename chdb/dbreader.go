@@ -0,0 +1,1185 @@
+// dbreader.go -- Constant DB built on top of the CHD MPH
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"crypto/subtle"
+
+	"github.com/dchest/siphash"
+	"github.com/opencoff/go-chd"
+)
+
+// DBReader represents the query interface for a previously constructed
+// constant database (built using NewDBWriter()). The only meaningful
+// operation on such a database is Lookup().
+type DBReader struct {
+	chd *chd.Chd
+
+	cache Cache
+
+	// keys the cache by an HMAC of the key; nil if not (see
+	// WithSecretKeys())
+	secret *secretKeys
+
+	flags uint32
+
+	// memory mapped offset+hashkey table and vlen table; split into
+	// windows of 2^wshift slots (see WithMapWindow())
+	offset [][]uint64
+	vlen   [][]uint32
+	wshift uint
+	wmask  uint64
+
+	// the tables read in windows on demand; nil if they are in memory
+	// (see WithWindowedReads())
+	paged *pagedTables
+
+	nkeys  uint64
+	salt   []byte
+	offtbl uint64
+
+	// siphash keys derived from salt
+	k0, k1 uint64
+
+	// location of the build info record; zero if none
+	binfoOff uint64
+	binfoLen uint32
+
+	// alignment of the records; 0 if none
+	align uint32
+
+	// extents of the groups of records; nil if none (see AddGroup())
+	extents []Extent
+
+	// public key of the signer; nil if the DB isn't signed
+	signer ed25519.PublicKey
+
+	// codec the values were encoded with; nil if none
+	codecID uint32
+	codec   ValueCodec
+
+	// key transform recorded in the header and the one applied to keys
+	xformID uint32
+	xform   KeyTransform
+
+	// deserializer for FindAs()
+	serializer Codec
+
+	// scratch buffers for reading records from disk
+	bufs sync.Pool
+
+	// max size of a value; zero if there is no limit
+	maxValue uint32
+
+	// record verification policy; for VerifyOnce, 'verified' has a bit per
+	// slot that is set once the record in the slot is verified.
+	verify   VerifyPolicy
+	verified []uint64
+
+	// a bit per slot that is set if its key is masked by a tombstone;
+	// nil if there are none (see WithTombstones())
+	dead []uint64
+
+	// in-flight disk reads by Find()
+	flight flightGroup
+
+	// lookup and i/o counters
+	stats *readerStats
+
+	// optional lookup hooks
+	tracer Tracer
+
+	// lifecycle events
+	log Logger
+
+	// optional sampled access counters
+	heat *heatMap
+
+	// batched record reads for FindMany() and iteration
+	bio batchIO
+
+	// reference count of the reader and its snapshots; the mmap and fd
+	// are released when this drops to zero.
+	mu     sync.Mutex
+	refs   int
+	closed bool
+
+	// original mmap slice; or the mappings of a windowed DB
+	mmap    []byte
+	windows [][]byte
+	fd      *os.File
+	fn      string
+
+	// size of the metadata in memory
+	metasz uint64
+
+	// size of the DB file when it was opened
+	size uint64
+
+	// true if mmap holds the metadata read into memory
+	inmem bool
+
+	// true if the metadata is in anonymous memory rather than mapped
+	// from the file
+	anon bool
+}
+
+// ReaderOption configures optional behavior of a DBReader
+type ReaderOption func(o *readerOpts)
+
+type readerOpts struct {
+	// hold a shared flock on the DB file
+	lock bool
+
+	// heat map sidecar file and sampling rate
+	heatfn   string
+	heatrate uint64
+
+	// read the metadata into memory instead of mmap'ing it
+	nommap bool
+
+	// back the metadata with huge pages
+	hugepages bool
+
+	// copy the metadata into memory local to this NUMA node
+	numa bool
+	node int
+
+	// codecs to decode values with
+	codecs []ValueCodec
+
+	// max size of a mapping of the metadata
+	window uint64
+
+	// read the tables in windows on demand; and the max number of
+	// windows in memory
+	paged    bool
+	resident int
+
+	// transform applied to keys before lookup; or skip checking it
+	xform   KeyTransform
+	rawKeys bool
+
+	// record cache; the default is a ShardedCache
+	cache       Cache
+	cacheBytes  uint64
+	cacheShards int
+
+	// deserializer for FindAs()
+	serializer Codec
+
+	// keys to pre-warm the cache with
+	hotset io.Reader
+
+	// tombstone file
+	tombfn string
+
+	// the keys are secrets (see WithSecretKeys())
+	secret bool
+
+	// max size of a value (see WithMaxValueSize())
+	maxValue uint32
+
+	// the DB must be signed by one of these keys (see WithTrustedKeys())
+	trusted []ed25519.PublicKey
+
+	// the DB was opened by NewDBReaderFromFd(); its name can't be used
+	// to open anything
+	byFd bool
+
+	// lookup hooks
+	tracer Tracer
+
+	// lifecycle events
+	log Logger
+
+	// how often to validate records
+	verify VerifyPolicy
+
+	// how much to verify when opening the DB
+	integrity Integrity
+
+	// metadata verification cache
+	vcache      bool
+	vcachefn    string
+	forceVerify bool
+}
+
+// WithSharedLock makes the DBReader hold a shared advisory lock (flock(2)) on
+// the DB file for as long as it is open. Tools can detect such in-use DBs
+// via InUse().
+func WithSharedLock() ReaderOption {
+	return func(o *readerOpts) {
+		o.lock = true
+	}
+}
+
+// WithoutMmap makes the DBReader read the offset table and the hash table into
+// memory with regular reads instead of mmap(2). This is useful on platforms or
+// filesystems where mmap misbehaves (e.g., NFS, FUSE); lookups are otherwise
+// identical.
+func WithoutMmap() ReaderOption {
+	return func(o *readerOpts) {
+		o.nommap = true
+	}
+}
+
+// WithHugePages asks the kernel to back the offset table and the hash table
+// with (transparent) huge pages. For very large DBs, this reduces the TLB
+// misses that dominate lookups. Huge pages for file mappings aren't supported
+// by all filesystems; combining this option with WithoutMmap() reads the
+// metadata into anonymous memory - where huge pages are reliably available.
+// This is advisory: if huge pages are unavailable, the DB is read normally.
+func WithHugePages() ReaderOption {
+	return func(o *readerOpts) {
+		o.hugepages = true
+	}
+}
+
+// WithNUMANode makes the DBReader copy the offset table and the hash table
+// into memory that is local to NUMA node 'node'. It implies WithoutMmap().
+// This is the building block of ReaderPool; most callers should use that
+// instead. On systems without NUMA, this is the same as WithoutMmap().
+func WithNUMANode(node int) ReaderOption {
+	return func(o *readerOpts) {
+		o.nommap = true
+		o.numa = true
+		o.node = node
+	}
+}
+
+// NewDBReader reads a previously construct database in file 'fn' and prepares
+// it for querying. Records are opportunistically cached after reading from disk.
+// We retain upto 'cache' number of records in memory (default 128); see WithCache(),
+// WithCacheBytes() and WithCacheShards() to change the cache.
+func NewDBReader(fn string, cache int, opts ...ReaderOption) (*DBReader, error) {
+	var o readerOpts
+
+	for _, fp := range opts {
+		fp(&o)
+	}
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		logger(o.log).Printf("chdb: %s: open failed: %s", fn, err)
+		return nil, err
+	}
+
+	rd, err := newDBReader(fd, fn, cache, &o)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// NewDBReaderFromFd is NewDBReader() for the DB in the open file 'fd'; e.g.,
+// a descriptor passed down by a supervisor or a memfd. The reader never
+// opens anything by the name of 'fd' - which is only used in messages; so
+// WithVerifyCache() needs an explicit sidecar file. On success, the reader
+// owns 'fd' and closes it when it is closed; on failure, 'fd' is left open.
+func NewDBReaderFromFd(fd *os.File, cache int, opts ...ReaderOption) (*DBReader, error) {
+	var o readerOpts
+
+	for _, fp := range opts {
+		fp(&o)
+	}
+
+	o.byFd = true
+	return newDBReader(fd, fd.Name(), cache, &o)
+}
+
+// prepare the DB in 'fd' named 'fn' for querying
+func newDBReader(fd *os.File, fn string, cache int, op *readerOpts) (rd *DBReader, err error) {
+	o := *op
+	log := logger(o.log)
+
+	defer func() {
+		if err != nil {
+			log.Printf("chdb: %s: open failed: %s", fn, err)
+		}
+	}()
+
+	if o.lock {
+		if err = flock(fd, syscall.LOCK_SH); err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+	}
+
+	// Number of records to cache
+	if cache <= 0 {
+		cache = 128
+	}
+
+	if o.serializer == nil {
+		o.serializer = JSON
+	}
+
+	rd = &DBReader{
+		chd:        &chd.Chd{},
+		salt:       make([]byte, 16),
+		serializer: o.serializer,
+		fd:         fd,
+		fn:         fn,
+		refs:       1,
+		stats:      &readerStats{},
+		tracer:     o.tracer,
+		log:        log,
+	}
+
+	rd.bufs.New = func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	}
+
+	var st os.FileInfo
+
+	st, err = fd.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't stat: %s", fn, err)
+	}
+
+	if st.Size() < (64 + 32) {
+		return nil, fmt.Errorf("%s: file too small or corrupted", fn)
+	}
+	rd.size = uint64(st.Size())
+
+	var hdrb [64]byte
+
+	_, err = fd.ReadAt(hdrb[:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't read header: %s", fn, err)
+	}
+
+	offtbl, err := rd.decodeHeader(hdrb[:], st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is only as good as the checksum it signs
+	if len(o.trusted) > 0 {
+		if err = rd.verifyChecksum(hdrb[:], offtbl, st.Size()); err != nil {
+			return nil, err
+		}
+	} else if o.integrity != HeaderOnly {
+		if err = rd.verifyMeta(hdrb[:], offtbl, st, &o); err != nil {
+			return nil, err
+		}
+	}
+
+	if rd.codecID != 0 {
+		for _, c := range append(o.codecs, builtinCodecs...) {
+			if c.ID() == rd.codecID {
+				rd.codec = c
+				break
+			}
+		}
+		if rd.codec == nil {
+			return nil, fmt.Errorf("%s: values are encoded with unknown codec %d", fn, rd.codecID)
+		}
+	}
+
+	if err = rd.checkTransform(o.xform, o.rawKeys); err != nil {
+		return nil, err
+	}
+
+	// All metadata is now verified (unless the caller opted out).
+	// sanity check - even though we have verified the strong checksum
+	// 8 + 8 + 4: offset, hashkey, vlen
+	tblsz := rd.nkeys * (8 + 8 + 4)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		tblsz = rd.nkeys * 8
+	}
+
+	// 64 + 32: 64 bytes of header, 32 bytes of sha trailer
+	if uint64(st.Size()) < (64 + 32 + tblsz) {
+		return nil, fmt.Errorf("%s: corrupt header1", fn)
+	}
+
+	rd.cache = o.cache
+	if rd.cache == nil {
+		shards := o.cacheShards
+		if shards <= 0 {
+			shards = cacheShards(cache)
+		}
+		rd.cache = NewShardedLRUCache(shards, cache, o.cacheBytes)
+	}
+	if o.secret {
+		rd.secret = newSecretKeys()
+	}
+	rd.maxValue = o.maxValue
+
+	if err = rd.loadExtents(); err != nil {
+		return nil, err
+	}
+	if err = rd.loadSignature(o.trusted); err != nil {
+		return nil, err
+	}
+
+	// Now, we are certain that the header, the offset-table and chd bits are
+	// all valid and uncorrupted - unless the caller asked for HeaderOnly.
+
+	// if this DB has only keys, then the offtbl is just u64 hash keys
+	offsz := rd.nkeys * (8 + 8)
+	vlensz := rd.nkeys * 4
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		offsz = rd.nkeys * 8
+		vlensz = 0
+	}
+
+	// the chd table starts at the next 64 bit boundary after the tables
+	chdoff := (offsz + vlensz + 7) &^ 7
+
+	// the tables and the chd header must fit in the metadata; only a
+	// corrupt DB opened with HeaderOnly can fail this.
+	mmapsz := st.Size() - int64(offtbl) - 32
+	if uint64(mmapsz) < chdoff+16 {
+		return nil, fmt.Errorf("%s: corrupt header2", fn)
+	}
+
+	var bs []byte
+	if o.paged || (_Is32Bit && mmapsz > _Max32BitMap) {
+		// 32-bit platforms can't map (or even address) large tables
+		if bs, err = rd.pageTables(offtbl, offsz, vlensz, chdoff, uint64(mmapsz), &o); err != nil {
+			return nil, err
+		}
+	} else if win := mapWindow(&o); !o.nommap && uint64(mmapsz) > win {
+		// too large for a single mapping
+		bs, err = rd.mapWindows(offtbl, offsz, vlensz, chdoff, uint64(mmapsz), win)
+		if err != nil {
+			rd.unmapMeta()
+			return nil, err
+		}
+		if o.hugepages {
+			for _, w := range rd.windows {
+				adviseHugePages(w)
+			}
+		}
+	} else {
+		// mmap the offset table
+		if bs, err = rd.mapMeta(int64(offtbl), mmapsz, &o); err != nil {
+			return nil, err
+		}
+
+		rd.setTables(bs[:offsz], bs[offsz:offsz+vlensz])
+		bs = bs[chdoff:]
+	}
+
+	// The CHD table starts here
+	if err := rd.chd.UnmarshalBinaryMmap(bs); err != nil {
+		rd.unmapMeta()
+		return nil, fmt.Errorf("%s: can't unmarshal hash table: %s", fn, err)
+	}
+	if uint64(rd.chd.Len()) != rd.nkeys {
+		rd.unmapMeta()
+		return nil, fmt.Errorf("%s: hash table has %d slots; exp %d", fn, rd.chd.Len(), rd.nkeys)
+	}
+
+	rd.verify = o.verify
+	if rd.verify == VerifyOnce {
+		rd.verified = make([]uint64, (rd.nkeys+63)/64)
+	}
+
+	if len(o.tombfn) > 0 {
+		if err := rd.loadTombstones(o.tombfn); err != nil {
+			rd.unmapMeta()
+			return nil, fmt.Errorf("%s: can't load tombstones: %w", fn, err)
+		}
+	}
+
+	if o.integrity == FullVerify {
+		var r Report
+
+		r, err = rd.VerifyAll(context.Background(), 0)
+		if err == nil && !r.OK() {
+			f := r.Failures()[0]
+			if err = f.Err; err == nil {
+				err = fmt.Errorf("%s: corrupt record for key %#x", fn, f.Corrupt[0])
+			}
+		}
+		if err != nil {
+			rd.unmapMeta()
+			return nil, err
+		}
+	}
+
+	// warm the cache before the heat map and the counters see lookups
+	if o.hotset != nil {
+		if err := rd.loadHotSet(o.hotset); err != nil {
+			rd.log.Printf("chdb: %s: can't warm the cache: %s", fn, err)
+		}
+		rd.stats = &readerStats{}
+	}
+
+	if len(o.heatfn) > 0 {
+		rd.heat = &heatMap{
+			fn:   o.heatfn,
+			rate: o.heatrate,
+			hits: make([]uint32, rd.nkeys),
+		}
+	}
+
+	rd.log.Printf("chdb: %s: opened %d slots; %d bytes of metadata at off %d %s",
+		fn, rd.nkeys, rd.metasz, offtbl, rd.mapping(&o))
+	return rd, nil
+}
+
+// describe how the metadata is held in memory
+func (rd *DBReader) mapping(o *readerOpts) string {
+	switch {
+	case rd.paged != nil:
+		return fmt.Sprintf("read in windows of %d slots on demand", rd.wmask+1)
+	case len(rd.windows) > 0:
+		return fmt.Sprintf("mmap'd in %d windows", len(rd.windows))
+	case !rd.anon:
+		if o.hugepages {
+			return "mmap'd (huge pages advised)"
+		}
+		return "mmap'd"
+	case rd.inmem:
+		return "read into the heap"
+	case o.hugepages:
+		return "read into huge pages"
+	default:
+		return fmt.Sprintf("read into memory on NUMA node %d", o.node)
+	}
+}
+
+// map 'sz' bytes of metadata at offset 'off' of the file into memory - either
+// via mmap or by reading it into a memory buffer
+func (rd *DBReader) mapMeta(off, sz int64, o *readerOpts) ([]byte, error) {
+	if o.nommap {
+		var bs []byte
+
+		rd.anon = true
+
+		// memory for a NUMA node must be freshly mapped - so that the
+		// first touch (by the read below) happens on the right node.
+		read := func() error {
+			var err error
+
+			switch {
+			case o.hugepages:
+				bs, err = allocHugePages(int(sz))
+			case o.numa:
+				bs, err = syscall.Mmap(-1, 0, int(sz), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+			}
+
+			if err != nil {
+				rd.log.Printf("chdb: %s: can't allocate anonymous memory; using the heap: %s", rd.fn, err)
+			}
+			rd.inmem = err != nil || bs == nil
+
+			// allocate as uint64 to keep the tables suitably aligned
+			if rd.inmem {
+				buf := make([]uint64, (sz+7)/8)
+				bs = u64sToByteSlice(buf)[:sz]
+			}
+
+			rd.mmap = bs
+			rd.metasz = uint64(sz)
+			if _, err = rd.fd.ReadAt(bs, off); err != nil {
+				rd.unmapMeta()
+				return fmt.Errorf("%s: can't read %d bytes at off %d: %s",
+					rd.fn, sz, off, err)
+			}
+			return nil
+		}
+
+		var err error
+		if o.numa {
+			err = onNode(o.node, read)
+		} else {
+			err = read()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bs, nil
+	}
+
+	bs, err := syscall.Mmap(int(rd.fd.Fd()), off, int(sz), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't mmap %d bytes at off %d: %s",
+			rd.fn, sz, off, err)
+	}
+
+	if o.hugepages {
+		adviseHugePages(bs)
+	}
+
+	rd.mmap = bs
+	rd.metasz = uint64(sz)
+	return bs, nil
+}
+
+// release the metadata mapped by mapMeta()
+func (rd *DBReader) unmapMeta() error {
+	var err error
+
+	// huge page allocations are rounded up; munmap needs the whole mapping
+	if !rd.inmem && rd.mmap != nil {
+		err = syscall.Munmap(rd.mmap[:cap(rd.mmap)])
+	}
+	for _, bs := range rd.windows {
+		if e := syscall.Munmap(bs); err == nil {
+			err = e
+		}
+	}
+	rd.mmap = nil
+	rd.windows = nil
+	return err
+}
+
+// Name returns the file name of the DB
+func (rd *DBReader) Name() string {
+	return rd.fn
+}
+
+// TotalKeys returns the total number of distinct keys in the DB
+func (rd *DBReader) Len() int {
+	return int(rd.nkeys)
+}
+
+// Salt returns a copy of the 16 byte salt of the DB; see DBWriter.Salt()
+func (rd *DBReader) Salt() []byte {
+	return append([]byte(nil), rd.salt...)
+}
+
+// Close closes the db. If there are outstanding snapshots, the underlying
+// mmap and file are released only after the last of them is closed.
+func (rd *DBReader) Close() {
+	rd.mu.Lock()
+	if rd.closed {
+		rd.mu.Unlock()
+		return
+	}
+	rd.closed = true
+	rd.mu.Unlock()
+
+	rd.unref()
+}
+
+// drop a reference and release the resources when the last one is gone
+func (rd *DBReader) unref() {
+	rd.mu.Lock()
+	rd.refs--
+	if rd.refs > 0 {
+		rd.mu.Unlock()
+		return
+	}
+	rd.mu.Unlock()
+
+	// best effort
+	if err := rd.FlushHeatMap(); err != nil {
+		rd.log.Printf("chdb: %s: can't flush heat map: %s", rd.fn, err)
+	}
+
+	rd.log.Printf("chdb: %s: closed", rd.fn)
+	rd.bio.close()
+	if err := rd.unmapMeta(); err != nil {
+		rd.log.Printf("chdb: %s: can't unmap metadata: %s", rd.fn, err)
+	}
+	rd.fd.Close()
+	rd.cache.Purge()
+	rd.chd = nil
+	rd.fd = nil
+	rd.salt = nil
+	rd.fn = ""
+}
+
+// Lookup looks up 'key' in the table and returns the corresponding value.
+// If the key is not found, value is nil and returns false. The value of a
+// key in a keys-only DB is nil too; Get() tells them apart.
+func (rd *DBReader) Lookup(key uint64) ([]byte, bool) {
+	v, err := rd.Find(key)
+	if err != nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
+// Dump the metadata to io.Writer 'w'; an error reading the lookup table
+// ends the dump with that error.
+func (rd *DBReader) DumpMeta(w io.Writer) {
+	var err error
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(w, "  error: %s\n", err)
+		}
+	}()
+	defer catchTableRead(&err)
+
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		fmt.Fprintf(w, "CHDB: <KEYS> %d keys, hash-salt %#x, offtbl at %#x\n",
+			rd.nkeys, rd.salt, rd.offtbl)
+
+		rd.chd.DumpMeta(w)
+		for i := uint64(0); i < rd.nkeys; i++ {
+			fmt.Fprintf(w, "  %3d: %x\n", i, rd.keyAt(i))
+		}
+	} else {
+		fmt.Fprintf(w, "CHDB: <KEYS+VALS> %d keys, hash-salt %#x, offtbl at %#x\n",
+			rd.nkeys, rd.salt, rd.offtbl)
+
+		rd.chd.DumpMeta(w)
+		for i := uint64(0); i < rd.nkeys; i++ {
+			fmt.Fprintf(w, "  %3d: %#x, %d bytes at %#x\n", i, rd.keyAt(i), rd.vlenAt(i), rd.offAt(i))
+		}
+	}
+}
+
+// Find looks up 'key' in the table and returns the corresponding value.
+// It returns an error if the key is not found or the disk i/o failed or
+// the record checksum failed. Keys of a keys-only DB have a nil value and
+// empty values are returned as non-nil empty slices; see Get().
+func (rd *DBReader) Find(key uint64) ([]byte, error) {
+	if rd.tracer == nil {
+		return rd.find(key)
+	}
+
+	rd.tracer.OnLookupStart(key)
+	t0 := time.Now()
+	val, err := rd.find(key)
+	rd.traceEnd(key, t0, err)
+	return val, err
+}
+
+// look up 'key' via the cache
+func (rd *DBReader) find(key uint64) (_ []byte, err error) {
+	defer catchTableRead(&err)
+
+	key = rd.xkey(key)
+	ck := rd.ckey(key)
+	rd.stats.lookup()
+	if v, ok := rd.cache.Get(ck); ok {
+		rd.stats.cacheHit()
+		rd.touch(key)
+		return v, nil
+	}
+
+	// Not in cache. So, go to disk and find it.
+	// We are guaranteed that: 0 <= i < rd.nkeys
+	i := rd.chd.Find(key)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		// offtbl is just the keys; no values.
+		if !rd.has(i, key) {
+			rd.stats.miss()
+			return nil, ErrNoKey
+		}
+
+		rd.stats.hit()
+		rd.cache.Add(ck, nil)
+		rd.touch(key)
+		return nil, nil
+	}
+
+	// we have keys _and_ values
+
+	if !rd.has(i, key) {
+		rd.stats.miss()
+		return nil, ErrNoKey
+	}
+
+	vlen := rd.vlenAt(i)
+	off := rd.offAt(i)
+
+	// concurrent lookups of the same cold key share one disk read
+	val, err := rd.flight.do(ck, func() ([]byte, error) {
+		val, err := rd.readValue(off, vlen, i)
+		if err == nil {
+			rd.cache.Add(ck, val)
+		}
+		return val, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rd.stats.hit()
+	rd.touch(key)
+	return val, nil
+}
+
+// read, verify and decode the value of 'vlen' bytes at offset 'off' of slot
+// 'i'; the returned value is freshly allocated.
+func (rd *DBReader) readValue(off uint64, vlen uint32, i uint64) ([]byte, error) {
+	// empty values have no record on disk
+	if vlen == 0 {
+		return []byte{}, nil
+	}
+	if err := rd.checkExtent(off, vlen, i); err != nil {
+		return nil, err
+	}
+
+	bp := rd.bufs.Get().(*[]byte)
+	data := *bp
+	if n := int(vlen) + 8; cap(data) < n {
+		data = make([]byte, n)
+	} else {
+		data = data[:n]
+	}
+
+	err := rd.decodeRecord(data, off, i)
+	*bp = data
+	if err != nil {
+		rd.bufs.Put(bp)
+		return nil, err
+	}
+
+	var val []byte
+	if rd.codec != nil && vlen > 0 {
+		val, err = rd.decode(nil, data[8:])
+	} else {
+		val = make([]byte, vlen)
+		copy(val, data[8:])
+	}
+	rd.bufs.Put(bp)
+	return val, err
+}
+
+// FindInto looks up 'key' in the table and reads the corresponding value
+// into 'buf' - growing it if it is too small. It returns the slice of 'buf'
+// holding the value. Unlike Find(), FindInto doesn't consult or populate the
+// record cache; callers that reuse 'buf' across calls can do lookups without
+// any allocation.
+func (rd *DBReader) FindInto(key uint64, buf []byte) ([]byte, error) {
+	if rd.tracer == nil {
+		return rd.findInto(key, buf)
+	}
+
+	rd.tracer.OnLookupStart(key)
+	t0 := time.Now()
+	val, err := rd.findInto(key, buf)
+	rd.traceEnd(key, t0, err)
+	return val, err
+}
+
+// FindTrusted returns the value of 'key' - which the caller guarantees is in
+// the DB; e.g., because it came from iterating the same DB. It skips the
+// record cache and the key comparison of Find(); so it is faster for bulk
+// joins. For keys that aren't in the DB, FindTrusted returns an arbitrary
+// value or a record checksum error. The returned value is freshly allocated.
+func (rd *DBReader) FindTrusted(key uint64) ([]byte, error) {
+	if rd.tracer == nil {
+		return rd.findTrusted(key)
+	}
+
+	rd.tracer.OnLookupStart(key)
+	t0 := time.Now()
+	val, err := rd.findTrusted(key)
+	rd.traceEnd(key, t0, err)
+	return val, err
+}
+
+// read the value of the slot of 'key' without checking the key
+func (rd *DBReader) findTrusted(key uint64) (_ []byte, err error) {
+	defer catchTableRead(&err)
+
+	key = rd.xkey(key)
+	rd.stats.lookup()
+	i := rd.chd.Find(key)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		rd.stats.hit()
+		return nil, nil
+	}
+
+	val, err := rd.readValue(rd.offAt(i), rd.vlenAt(i), i)
+	if err != nil {
+		return nil, err
+	}
+
+	rd.stats.hit()
+	rd.touch(key)
+	return val, nil
+}
+
+// look up 'key' and read its value into 'buf'
+func (rd *DBReader) findInto(key uint64, buf []byte) (_ []byte, err error) {
+	defer catchTableRead(&err)
+
+	key = rd.xkey(key)
+	rd.stats.lookup()
+	i := rd.chd.Find(key)
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		if !rd.has(i, key) {
+			rd.stats.miss()
+			return nil, ErrNoKey
+		}
+		rd.stats.hit()
+		rd.touch(key)
+		return buf[:0], nil
+	}
+
+	if !rd.has(i, key) {
+		rd.stats.miss()
+		return nil, ErrNoKey
+	}
+
+	vlen := rd.vlenAt(i)
+	off := rd.offAt(i)
+	if vlen == 0 {
+		rd.stats.hit()
+		rd.touch(key)
+		return buf[:0], nil
+	}
+	if err := rd.checkExtent(off, vlen, i); err != nil {
+		return nil, err
+	}
+
+	n := int(vlen) + 8
+	if rd.codec != nil {
+		// read into scratch space and decode into the caller's buffer
+		bp := rd.bufs.Get().(*[]byte)
+		data := *bp
+		if cap(data) < n {
+			data = make([]byte, n)
+		} else {
+			data = data[:n]
+		}
+
+		err := rd.decodeRecord(data, off, i)
+		if err == nil {
+			buf, err = rd.decode(buf[:0], data[8:])
+		}
+		*bp = data
+		rd.bufs.Put(bp)
+		if err != nil {
+			return nil, err
+		}
+
+		rd.stats.hit()
+		rd.touch(key)
+		return buf, nil
+	}
+
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+
+	data := buf[:n]
+	if err := rd.decodeRecord(data, off, i); err != nil {
+		return nil, err
+	}
+
+	// move the value to the start of the caller's buffer
+	copy(data, data[8:])
+	rd.stats.hit()
+	rd.touch(key)
+	return data[:vlen], nil
+}
+
+// The offset and vlen tables are little-endian and used in place; all
+// accesses to them go through keyAt(), offAt() and vlenAt().
+
+// return the key stored in slot 'i' of the offset table
+func (rd *DBReader) keyAt(i uint64) uint64 {
+	t, j := rd.offWindow(i), i&rd.wmask
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return toLittleEndianUint64(t[j])
+	}
+	return toLittleEndianUint64(t[j*2])
+}
+
+// return the file offset of the record in slot 'i'
+func (rd *DBReader) offAt(i uint64) uint64 {
+	return toLittleEndianUint64(rd.offWindow(i)[(i&rd.wmask)*2+1])
+}
+
+// return the length of the value in slot 'i'
+func (rd *DBReader) vlenAt(i uint64) uint32 {
+	if rd.paged != nil {
+		return toLittleEndianUint32(rd.paged.window(i).vlen[i&rd.wmask])
+	}
+	return toLittleEndianUint32(rd.vlen[i>>rd.wshift][i&rd.wmask])
+}
+
+// return the window of the offset table holding slot 'i'
+func (rd *DBReader) offWindow(i uint64) []uint64 {
+	if rd.paged != nil {
+		return rd.paged.window(i).off
+	}
+	return rd.offset[i>>rd.wshift]
+}
+
+// read the full record of slot 'i' at offset 'off' into 'data'; 'data' must
+// be exactly large enough to hold the record checksum and the value.
+// calculate the record checksum, validate it and so on.
+// NB: the checksum bytes at the start of 'data' may be overwritten.
+func (rd *DBReader) decodeRecord(data []byte, off, i uint64) error {
+	n, err := rd.fd.ReadAt(data, int64(off))
+	rd.stats.read(n)
+	if err != nil {
+		return err
+	}
+
+	return rd.checkRecord(data, off, i)
+}
+
+// validate the checksum of the record at offset 'off' already read into 'data'
+func (rd *DBReader) verifyRecord(data []byte, off uint64) error {
+	be := binary.BigEndian
+	csum := be.Uint64(data[:8])
+
+	// The checksum covers the big-endian offset followed by the value;
+	// we reuse the checksum slot so we can hash the record in one shot.
+	be.PutUint64(data[:8], off)
+	exp := siphash.Hash(rd.k0, rd.k1, data)
+
+	if csum != exp {
+		rd.stats.csumFailed()
+		rd.log.Printf("chdb: %s: checksum failed for record at off %d", rd.fn, off)
+		return fmt.Errorf("%s: corrupted record at off %d (exp %#x, saw %#x)", rd.fn, off, exp, csum)
+	}
+	return nil
+}
+
+// verify the metadata checksum - unless the verification cache says that
+// the DB is unchanged since the last successful verification.
+func (rd *DBReader) verifyMeta(hdrb []byte, offtbl uint64, st os.FileInfo, o *readerOpts) error {
+	if !o.vcache {
+		return rd.verifyChecksum(hdrb, offtbl, st.Size())
+	}
+
+	fn := o.vcachefn
+	if len(fn) == 0 {
+		if o.byFd {
+			rd.log.Printf("chdb: %s: no verify cache file for a DB opened by fd", rd.fn)
+			return rd.verifyChecksum(hdrb, offtbl, st.Size())
+		}
+		fn = rd.fn + ".verified"
+	}
+
+	tok, err := rd.verifyToken(st)
+	if err != nil {
+		return err
+	}
+
+	if !o.forceVerify && validToken(fn, tok) {
+		rd.log.Printf("chdb: %s: metadata unchanged since last verified; skipping checksum", rd.fn)
+		return nil
+	}
+
+	if err := rd.verifyChecksum(hdrb, offtbl, st.Size()); err != nil {
+		return err
+	}
+
+	// best effort
+	if err := writeToken(fn, tok); err != nil {
+		rd.log.Printf("chdb: %s: can't update verify cache %s: %s", rd.fn, fn, err)
+	}
+	return nil
+}
+
+// Verify checksum of all metadata: offset table, chd bits and the file header.
+// We know that offtbl is within the size bounds of the file - see decodeHeader() below.
+// sz is the actual file size (includes the header we already read)
+func (rd *DBReader) verifyChecksum(hdrb []byte, offtbl uint64, sz int64) error {
+	h := rd.Checksum().hash()
+	h.Write(hdrb[:])
+
+	// remsz is the size of the remaining metadata (which begins at offset 'offtbl')
+	// 32 bytes of SHA512_256 and the values already recorded.
+	remsz := sz - int64(offtbl) - 32
+
+	rd.fd.Seek(int64(offtbl), 0)
+
+	nw, err := io.CopyN(h, rd.fd, remsz)
+	if err != nil {
+		return fmt.Errorf("%s: metadata i/o error: %s", rd.fn, err)
+	}
+	if nw != remsz {
+		return fmt.Errorf("%s: partial read while verifying checksum, exp %d, saw %d", rd.fn, remsz, nw)
+	}
+
+	var expsum [32]byte
+
+	// Read the trailer -- which is the expected checksum
+	rd.fd.Seek(sz-32, 0)
+	_, err = io.ReadFull(rd.fd, expsum[:])
+	if err != nil {
+		return fmt.Errorf("%s: checksum i/o error: %s", rd.fn, err)
+	}
+
+	csum := trailer(h)
+	if subtle.ConstantTimeCompare(csum[:], expsum[:]) != 1 {
+		return fmt.Errorf("%s: checksum failure; exp %#x, saw %#x", rd.fn, expsum[:], csum[:])
+	}
+
+	rd.fd.Seek(int64(offtbl), 0)
+	return nil
+}
+
+// Checksum returns the algorithm of the metadata checksum of the DB
+func (rd *DBReader) Checksum() Checksum {
+	return Checksum((rd.flags & FlagChecksumMask) >> flagChecksumShift)
+}
+
+// entry condition: b is 64 bytes long.
+func (rd *DBReader) decodeHeader(b []byte, sz int64) (uint64, error) {
+	if string(b[:4]) != "CHDB" {
+		return 0, fmt.Errorf("%s: bad file magic", rd.fn)
+	}
+
+	be := binary.BigEndian
+	i := 4
+
+	rd.flags = be.Uint32(b[i : i+4])
+	i += 4
+
+	rd.salt = b[i : i+16]
+	rd.k0 = binary.LittleEndian.Uint64(rd.salt[:8])
+	rd.k1 = binary.LittleEndian.Uint64(rd.salt[8:])
+	i += 16
+	rd.nkeys = be.Uint64(b[i : i+8])
+	i += 8
+	rd.offtbl = be.Uint64(b[i : i+8])
+	i += 8
+	rd.codecID = be.Uint32(b[i : i+4])
+	i += 4
+	rd.binfoOff = be.Uint64(b[i : i+8])
+	i += 8
+	rd.binfoLen = be.Uint32(b[i : i+4])
+	i += 4
+	rd.align = be.Uint32(b[i : i+4])
+	i += 4
+	rd.xformID = be.Uint32(b[i : i+4])
+
+	if f := rd.flags & FlagFormatMask &^ knownFlags; f != 0 {
+		return 0, fmt.Errorf("%s: unsupported format flags %#x", rd.fn, f)
+	}
+	if !validAlign(uint64(rd.align)) {
+		return 0, fmt.Errorf("%s: invalid record alignment %d", rd.fn, rd.align)
+	}
+	if rd.Checksum().hash() == nil {
+		return 0, fmt.Errorf("%s: unsupported checksum algorithm %d", rd.fn, rd.Checksum())
+	}
+
+	if rd.offtbl < 64 || rd.offtbl >= uint64(sz-32) {
+		return 0, fmt.Errorf("%s: corrupt header0", rd.fn)
+	}
+	if rd.binfoOff > 0 && (rd.binfoOff < 64 || rd.binfoOff+8+uint64(rd.binfoLen) > rd.offtbl) {
+		return 0, fmt.Errorf("%s: corrupt header3", rd.fn)
+	}
+
+	return rd.offtbl, nil
+}
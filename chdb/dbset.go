@@ -0,0 +1,165 @@
+// dbset.go -- a family of constant DBs: a base DB and newer delta DBs
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"sync"
+)
+
+// DBSet manages a base constant DB and zero or more delta DBs layered on top
+// of it. This gives an "almost updatable" DB: new or changed records are
+// written to a (small) delta DB instead of rebuilding the base; lookups
+// consult the deltas newest-first before falling back to the base.
+// Compact() folds all the layers into a single new base DB.
+//
+// Since each layer is a constant DB, records can't be deleted - only
+// shadowed by a newer value.
+type DBSet struct {
+	mu sync.RWMutex
+
+	// layers, newest first; the base is last
+	dbs   []*DBReader
+	cache int
+
+	// reader options of NewDBSet(); Compact() reopens the set with them
+	opts []ReaderOption
+}
+
+// NewDBSet opens the base DB in file 'base' and the delta DBs in 'deltas';
+// the deltas are ordered oldest to newest. Each DB retains upto 'cache'
+// records in memory; see NewDBReader().
+func NewDBSet(base string, deltas []string, cache int, opts ...ReaderOption) (*DBSet, error) {
+	s := &DBSet{
+		cache: cache,
+		opts:  opts,
+	}
+
+	fns := append([]string{base}, deltas...)
+	for _, fn := range fns {
+		rd, err := NewDBReader(fn, cache, opts...)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.dbs = append([]*DBReader{rd}, s.dbs...)
+	}
+	return s, nil
+}
+
+// AddDelta opens the DB in file 'fn' and layers it on top of all the existing
+// DBs in the set.
+func (s *DBSet) AddDelta(fn string, opts ...ReaderOption) error {
+	rd, err := NewDBReader(fn, s.cache, opts...)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.dbs = append([]*DBReader{rd}, s.dbs...)
+	s.mu.Unlock()
+	return nil
+}
+
+// Layers returns the number of DBs in the set
+func (s *DBSet) Layers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.dbs)
+}
+
+// Find looks up 'key' in the DBs newest-first and returns the first value
+// found. It returns ErrNoKey if none of the DBs have the key.
+func (s *DBSet) Find(key uint64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rd := range s.dbs {
+		v, err := rd.Find(key)
+		if err == ErrNoKey {
+			continue
+		}
+		return v, err
+	}
+	return nil, ErrNoKey
+}
+
+// Lookup looks up 'key' in the DBs newest-first and returns the first value
+// found. If the key is not found, value is nil and returns false.
+func (s *DBSet) Lookup(key uint64) ([]byte, bool) {
+	v, err := s.Find(key)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Get looks up 'key' in the DBs newest-first; see DBReader.Get().
+func (s *DBSet) Get(key uint64) ([]byte, bool, error) {
+	return getResult(s.Find(key))
+}
+
+// Compact writes the merged view of all the DBs in the set to a new DB in
+// file 'fn' (see DBWriter.Freeze() for 'load'). On success, the set is
+// re-opened with 'fn' as its only DB - with the reader options given to
+// NewDBSet(); the older DB files are no longer used and may be removed by
+// the caller.
+func (s *DBSet) Compact(fn string, load float64, opts ...WriterOption) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the keys of the layers are already transformed
+	top := s.dbs[0]
+	opts = append([]WriterOption{withStoredKeys(top.xformID)}, opts...)
+	wr, err := NewDBWriter(fn, opts...)
+	if err != nil {
+		return err
+	}
+
+	defer wr.Close()
+
+	// newer layers shadow older ones; so the first value we see wins.
+	for _, rd := range s.dbs {
+		err = rd.iter(func(k uint64, v []byte) error {
+			_, err := wr.addUnique(k, v)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = wr.Freeze(load); err != nil {
+		return err
+	}
+
+	rd, err := NewDBReader(fn, s.cache, s.opts...)
+	if err != nil {
+		return err
+	}
+
+	for _, old := range s.dbs {
+		old.Close()
+	}
+	s.dbs = []*DBReader{rd}
+	return nil
+}
+
+// Close closes all the DBs in the set
+func (s *DBSet) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rd := range s.dbs {
+		rd.Close()
+	}
+	s.dbs = nil
+}
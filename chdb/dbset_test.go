@@ -0,0 +1,119 @@
+// dbset_test.go -- test suite for DBSet
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDBSet(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "chdset")
+	assert(err == nil, "tempdir: %s", err)
+	defer os.RemoveAll(dir)
+
+	fn0 := filepath.Join(dir, "base.db")
+	base := keywDB(t, fn0)
+
+	d1 := map[uint64]string{
+		1:   "one",
+		100: "hundred",
+	}
+	d2 := map[uint64]string{
+		1:   "uno",
+		200: "two hundred",
+	}
+
+	fn1 := filepath.Join(dir, "d1.db")
+	fn2 := filepath.Join(dir, "d2.db")
+	makeDB(t, fn1, d1)
+	makeDB(t, fn2, d2)
+
+	s, err := NewDBSet(fn0, []string{fn1}, 10)
+	assert(err == nil, "dbset: %s", err)
+
+	err = s.AddDelta(fn2)
+	assert(err == nil, "add delta: %s", err)
+	assert(s.Layers() == 3, "exp 3 layers, saw %d", s.Layers())
+
+	exp := make(map[uint64]string)
+	for _, m := range []map[uint64]string{base, d1, d2} {
+		for k, v := range m {
+			exp[k] = v
+		}
+	}
+
+	check := func(pref string) {
+		for k, v := range exp {
+			x, err := s.Find(k)
+			assert(err == nil, "%s: can't find key %d: %s", pref, k, err)
+			assert(string(x) == v, "%s: key %d: exp '%s', saw '%s'", pref, k, v, string(x))
+		}
+
+		_, err := s.Find(5000)
+		assert(err == ErrNoKey, "%s: found non-existent key", pref)
+	}
+
+	check("layered")
+
+	fn := filepath.Join(dir, "compact.db")
+	err = s.Compact(fn, 0.9)
+	assert(err == nil, "compact: %s", err)
+	assert(s.Layers() == 1, "exp 1 layer after compaction, saw %d", s.Layers())
+
+	check("compacted")
+	s.Close()
+}
+
+// the compacted DB is opened with the options of the set
+func TestDBSetCompactOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	dir := t.TempDir()
+
+	xor := func(v []byte) ([]byte, error) {
+		r := make([]byte, len(v))
+		for i := range v {
+			r[i] = v[i] ^ 0x55
+		}
+		return r, nil
+	}
+	codec := NewValueCodec(9, xor, xor)
+
+	kv := map[uint64]string{1: "one", 2: "two", 3: "three"}
+	fn0 := filepath.Join(dir, "base.db")
+	wr, err := NewDBWriter(fn0, WithValueCodec(codec))
+	assert(err == nil, "can't create db: %s", err)
+	for k, v := range kv {
+		err = wr.Add(k, []byte(v))
+		assert(err == nil, "can't add key %d: %s", k, err)
+	}
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze failed: %s", err)
+
+	s, err := NewDBSet(fn0, nil, 10, WithValueCodecs(codec))
+	assert(err == nil, "dbset: %s", err)
+	defer s.Close()
+
+	fn := filepath.Join(dir, "compact.db")
+	err = s.Compact(fn, 0.9, WithValueCodec(codec))
+	assert(err == nil, "compact: %s", err)
+
+	for k, v := range kv {
+		x, err := s.Find(k)
+		assert(err == nil, "can't find key %d: %s", k, err)
+		assert(string(x) == v, "key %d: exp '%s', saw '%s'", k, v, string(x))
+	}
+}
@@ -0,0 +1,1186 @@
+// dbwriter.go -- Constant DB built on top of the CHD MPH
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package chdb implements a fast, constant-time DB for read-only workloads.
+// DBWriter serializes the key,value pairs and builds a CHD minimal perfect hash
+// function (see package github.com/opencoff/go-chd) over the given keys. The
+// serialized DB can be read back via DBReader for constant time lookups of
+// the MPH DB.
+package chdb
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/dchest/siphash"
+	"github.com/opencoff/go-chd"
+)
+
+// Most data is serialized as big-endian integers. The exceptions are:
+// Offset table:
+//     This is mmap'd into the process and written as a little-endian uint64.
+//     This is arguably an optimization -- most systems we work with are
+//     little-endian. On big-endian systems, the DBReader code will convert
+//     it on the fly to native-endian.
+
+// DBWriter represents an abstraction to construct a read-only constant database.
+// This database uses CHD as the underlying mechanism for constant time lookups
+// of keys; keys and values are represented as arbitrary byte sequences ([]byte).
+// The DB meta-data is protected by strong checksum (SHA512-256) and each stored value
+// is protected by a distinct siphash-2-4.  Once all addition of key/val is complete,
+// the DB is written to disk via the Freeze() function.
+//
+// We don't want to use SHA512-256 over the entire file - because it will mean reading
+// a potentially large file in DBReader(). By using checksums separately per record, we
+// increase the overhead a bit - but speeds up DBReader initialization for the common case;
+// we will be verifying actual records opportunistically.
+//
+// The DB has the following general structure:
+//   - 64 byte file header: big-endian encoding of all multibyte ints
+//      * magic    [4]byte "CHDB"
+//      * flags    uint32  format and application flags (see flags.go)
+//      * salt     [16]byte random salt for siphash record integrity
+//      * nkeys    uint64  Number of keys in the DB
+//      * offtbl   uint64  File offset of <offset, hash> table
+//      * codec    uint32  ID of the ValueCodec of the values; 0 if none
+//      * binfo    uint64  File offset of the build info record; 0 if none
+//      * binfolen uint32  Length of the build info (see BuildInfo)
+//      * align    uint32  Alignment of the records; 0 if none
+//      * xform    uint32  ID of the KeyTransform of the keys; 0 if none
+//
+//   - Contiguous series of records; each record is a key/value pair:
+//      * cksum    uint64  Siphash checksum of value, offset (big endian)
+//      * val      []byte  value bytes
+//     With WithRecordAlign(), each record starts at a multiple of the
+//     alignment. With WithContentAddressed(), keys with identical values
+//     refer to the same record.
+//
+//   - Possibly a gap until the next PageSize boundary (4096 bytes)
+//   - Offset table: nkeys worth of offsets, hash pairs. Everything in this
+//     table is little-endian encoded so we can mmap() it into memory.
+//     Entry 'i' has two 64-bit words:
+//      * offset in the file  where the corresponding value can be found
+//      * hash key corresponding to the value
+//   - Val_len table: nkeys worth of little-endian uint32 value lengths
+//     corresponding to each key - on every host, like the offset table.
+//     Keys-only DBs have neither the hash keys nor this table.
+//   - Marshaled Chd bytes (Chd:MarshalBinary())
+//   - 32 bytes of strong checksum (SHA512_256 by default; see WithChecksum());
+//     this checksum is done over the file header, offset-table, val_len
+//     table and marshaled chd.
+type DBWriter struct {
+	fd *os.File
+	bb *chd.ChdBuilder
+
+	// exclusive lock on the target DB
+	lock *os.File
+
+	// to detect duplicates
+	keymap map[uint64]*value
+
+	// siphash key: just binary encoded salt
+	salt []byte
+
+	// running count of current offset within fd where we are writing
+	// records
+	off uint64
+
+	valSize uint64
+
+	// true if a key was added with a value - even an empty one; DBs
+	// without values are keys-only.
+	values bool
+
+	fntmp  string // tmp file name
+	fn     string // final file holding the PHF
+	frozen bool
+
+	// set once the tmpfile is either renamed or removed
+	done bool
+
+	// the first error that left the tmpfile inconsistent (e.g., a short
+	// write or ENOSPC); all later calls fail with it.
+	err error
+
+	// distinct values written so far; nil unless content addressed
+	arena *valueArena
+
+	// keys of a keys-only DB that aren't in keymap; e.g., from a key file
+	keysrc func(fp func(k uint64) error) error
+
+	// true if keysrc has the key 0
+	zeroKey bool
+
+	// true if AddGroup() was called; the keys and record bytes of each
+	// group
+	grouped bool
+	gstats  map[uint32]*GroupStats
+
+	// the extents of the groups; set by Freeze()
+	extents []Extent
+
+	opt writerOpts
+}
+
+// WriterOption configures optional behavior of a DBWriter
+type WriterOption func(o *writerOpts)
+
+type writerOpts struct {
+	// directory for the temp file; default is the dir of the output file
+	tmpdir string
+
+	// suffix of the temp file name; default ".tmp"
+	suffix string
+
+	// remove the temp file if a panic unwinds through the writer
+	panicCleanup bool
+
+	// encode values with this codec
+	codec ValueCodec
+
+	// fixed salt instead of a random one
+	salt []byte
+
+	// forced and maximum seed sizes of the MPH table
+	seedsz, maxsz int
+
+	// keys per shard of a multi-level MPH table
+	shardsz int
+
+	// largest displacement seed of the MPH table
+	maxseed uint32
+
+	// alignment of the records; 0 if none
+	align int
+
+	// content addressed values
+	shared bool
+
+	// transform applied to every key; or the transform the keys already
+	// have
+	xform   KeyTransform
+	xformID uint32
+
+	// application flags for the header
+	appFlags uint16
+
+	// algorithm of the metadata checksum
+	checksum Checksum
+
+	// build info
+	buildTime time.Time
+	srcDigest []byte
+
+	// load factor for Convert()
+	load float64
+
+	// build phases
+	log Logger
+
+	// limits on the number of keys and the size of the file
+	maxKeys, maxSize uint64
+
+	// byte quotas of groups (see WithGroupQuota())
+	quotas map[uint32]uint64
+
+	// verify the DB before renaming it into place; and the number of
+	// keys to look up
+	selfCheck bool
+	checkKeys int
+
+	// build in an anonymous file (see NewEphemeralDBWriter())
+	ephemeral bool
+
+	// sign the DB with this key (see WithSigningKey())
+	signKey ed25519.PrivateKey
+}
+
+// WithTempDir makes the DBWriter build the DB in a temp file in directory
+// 'dir' - e.g., a fast scratch disk. If 'dir' is on a different filesystem
+// than the output file, Freeze() copies the finished DB next to the output
+// file before atomically renaming it into place.
+func WithTempDir(dir string) WriterOption {
+	return func(o *writerOpts) {
+		o.tmpdir = dir
+	}
+}
+
+// WithTempSuffix sets the suffix of the temp file name; the temp file is
+// named "<output-file-name><suffix>.<random-number>".
+func WithTempSuffix(sfx string) WriterOption {
+	return func(o *writerOpts) {
+		o.suffix = sfx
+	}
+}
+
+// WithPanicCleanup makes the DBWriter remove its temp file when a panic
+// unwinds through any of its methods. The panic is propagated after the
+// cleanup.
+func WithPanicCleanup() WriterOption {
+	return func(o *writerOpts) {
+		o.panicCleanup = true
+	}
+}
+
+// WithSalt makes the DBWriter use the 16 byte 'salt' instead of a random
+// one. The salt keys the record checksums and also determines the salt of
+// the MPH table; so the same records added in the same order with the same
+// salt always produce an identical DB. This is meant for test fixtures and
+// reproducible builds; production DBs should use random salts.
+func WithSalt(salt []byte) WriterOption {
+	return func(o *writerOpts) {
+		o.salt = salt
+	}
+}
+
+// WithSeedSize forces the seeds of the MPH table to be 'n' bytes wide;
+// see ChdBuilder.SetSeedSize().
+func WithSeedSize(n int) WriterOption {
+	return func(o *writerOpts) {
+		o.seedsz = n
+	}
+}
+
+// WithMaxSeedSize makes Freeze() fail if the seeds of the MPH table need
+// more than 'n' bytes; see ChdBuilder.SetMaxSeedSize().
+func WithMaxSeedSize(n int) WriterOption {
+	return func(o *writerOpts) {
+		o.maxsz = n
+	}
+}
+
+// WithMaxSeed limits the displacement seeds tried when building the MPH
+// table; see ChdBuilder.SetMaxSeed(). When the limit is exceeded, Freeze()
+// returns an error that matches ErrMPHFail and unwraps to a *chd.SeedError.
+func WithMaxSeed(n uint32) WriterOption {
+	return func(o *writerOpts) {
+		o.maxseed = n
+	}
+}
+
+// WithShardSize builds a multi-level MPH table with shards of about 'n'
+// keys when the DB has more than 'n' keys; see ChdBuilder.SetShardSize().
+func WithShardSize(n int) WriterOption {
+	return func(o *writerOpts) {
+		o.shardsz = n
+	}
+}
+
+const (
+	// Flags
+	_DB_KeysOnly = FlagKeysOnly
+	_DB_ZeroKey  = FlagZeroKey
+)
+
+// things associated with each key/value pair
+type value struct {
+	off   uint64
+	vlen  uint32
+	group uint32
+}
+
+// NewDBWriter prepares file 'fn' to hold a constant DB built using
+// CHD minimal perfect hash function. Once written, the DB is "frozen"
+// and readers will open it using NewDBReader() to do constant time lookups
+// of key to value. The DB is built in a temp file which is renamed to 'fn'
+// when frozen; see WriterOption for ways to control the temp file.
+func NewDBWriter(fn string, opts ...WriterOption) (*DBWriter, error) {
+	o := writerOpts{
+		tmpdir: filepath.Dir(fn),
+		suffix: ".tmp",
+	}
+
+	for _, fp := range opts {
+		fp(&o)
+	}
+	o.log = logger(o.log)
+
+	if len(o.srcDigest) > 65535 {
+		return nil, fmt.Errorf("chd: source digest too long (%d bytes)", len(o.srcDigest))
+	}
+
+	salt := o.salt
+	if salt == nil {
+		salt = randbytes(16)
+	} else if len(salt) != 16 {
+		return nil, fmt.Errorf("chd: salt must be 16 bytes, not %d", len(salt))
+	}
+
+	if o.align < 0 || !validAlign(uint64(o.align)) {
+		return nil, fmt.Errorf("chd: invalid record alignment %d", o.align)
+	}
+
+	if o.xform != nil && o.xform.ID() == 0 {
+		return nil, fmt.Errorf("chd: key transform ID must be non-zero")
+	}
+
+	if o.checksum.hash() == nil {
+		return nil, fmt.Errorf("chd: unknown checksum algorithm %d", o.checksum)
+	}
+
+	if o.signKey != nil {
+		if len(o.signKey) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("chd: signing key must be %d bytes, not %d", ed25519.PrivateKeySize, len(o.signKey))
+		}
+		if o.checksum != ChecksumSHA512_256 {
+			return nil, fmt.Errorf("chd: signed DBs need the %s checksum", ChecksumSHA512_256)
+		}
+	}
+
+	bb, err := chd.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bb.SetSeedSize(o.seedsz); err != nil {
+		return nil, err
+	}
+	if err := bb.SetMaxSeedSize(o.maxsz); err != nil {
+		return nil, err
+	}
+	if err := bb.SetShardSize(o.shardsz); err != nil {
+		return nil, err
+	}
+	if err := bb.SetMaxSeed(o.maxseed); err != nil {
+		return nil, err
+	}
+
+	if o.salt != nil {
+		k0 := binary.LittleEndian.Uint64(salt[:8])
+		k1 := binary.LittleEndian.Uint64(salt[8:])
+		bb.SetSalt(siphash.Hash(k0, k1, []byte("chd table salt")))
+	}
+
+	var lock, fd *os.File
+	var tmp string
+
+	if o.ephemeral {
+		if fd, err = anonFile(fn); err != nil {
+			return nil, err
+		}
+		tmp = fd.Name()
+	} else {
+		// Serialize concurrent builds of the same DB
+		if lock, err = lockWriter(fn); err != nil {
+			return nil, err
+		}
+
+		tmp = o.tmpName(fn)
+		fd, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			unlockWriter(lock)
+			return nil, err
+		}
+	}
+
+	w := &DBWriter{
+		fd:     fd,
+		bb:     bb,
+		lock:   lock,
+		keymap: make(map[uint64]*value),
+		gstats: make(map[uint32]*GroupStats),
+		salt:   append([]byte(nil), salt...),
+		off:    64, // starting offset past the header
+		fn:     fn,
+		fntmp:  tmp,
+		opt:    o,
+	}
+
+	if o.shared {
+		w.arena = newValueArena()
+	}
+
+	// Leave some space for a header; we will fill this in when we
+	// are done Freezing.
+	var z [64]byte
+	if _, err := writeAll(fd, z[:]); err != nil {
+		w.Abort()
+		return nil, err
+	}
+
+	// don't leak the tmpfile if the caller forgets to Close() or Freeze()
+	runtime.SetFinalizer(w, func(w *DBWriter) {
+		w.cleanup()
+	})
+
+	o.log.Printf("chdb: %s: building in %s", fn, tmp)
+
+	return w, nil
+}
+
+// return a new temp file name for the DB 'fn'
+func (o *writerOpts) tmpName(fn string) string {
+	return filepath.Join(o.tmpdir, fmt.Sprintf("%s%s.%d", filepath.Base(fn), o.suffix, rand32()))
+}
+
+// Len returns the total number of distinct keys in the DB
+func (w *DBWriter) Len() int {
+	return len(w.keymap)
+}
+
+// Salt returns a copy of the 16 byte random salt of the DB; it is stored in
+// the DB and is available to readers via DBReader.Salt(). Applications can
+// key the hash of their keys with it (e.g., siphash) so that the keys of a
+// DB can't be predicted before it is built.
+func (w *DBWriter) Salt() []byte {
+	return append([]byte(nil), w.salt...)
+}
+
+// AddKeyVals adds a series of key-value matched pairs to the db. If they are of
+// unequal length, only the smaller of the lengths are used. Records with duplicate
+// keys - within 'keys' or with previously added keys - are silently discarded;
+// use AddKeyValsFunc() to account for every record.
+// Returns number of records added.
+func (w *DBWriter) AddKeyVals(keys []uint64, vals [][]byte) (int, error) {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return 0, err
+	}
+
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
+
+	var z int
+	for i := 0; i < n; i++ {
+		if ok, err := w.addUnique(keys[i], vals[i]); err != nil {
+			return z, err
+		} else if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddMap adds all the key-value pairs in 'm' to the db. Keys that were
+// previously added are silently discarded.
+// Returns number of records added.
+func (w *DBWriter) AddMap(m map[uint64][]byte) (int, error) {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return 0, err
+	}
+
+	var z int
+	for k, v := range m {
+		if ok, err := w.addUnique(k, v); err != nil {
+			return z, err
+		} else if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddPairs adds key-value pairs returned by successive calls to 'iter' until
+// it returns false. Records with duplicate keys are silently discarded.
+// Returns number of records added.
+func (w *DBWriter) AddPairs(iter func() (key uint64, val []byte, ok bool)) (int, error) {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return 0, err
+	}
+
+	var z int
+	for {
+		k, v, more := iter()
+		if !more {
+			break
+		}
+
+		if ok, err := w.addUnique(k, v); err != nil {
+			return z, err
+		} else if ok {
+			z++
+		}
+	}
+
+	return z, nil
+}
+
+// AddStatus is the outcome of adding a single record with AddKeyValsFunc()
+type AddStatus int
+
+const (
+	// AddOK means the record was added to the DB
+	AddOK AddStatus = iota
+
+	// AddDuplicate means the key was already added; the record is discarded
+	AddDuplicate
+
+	// AddTooLarge means the (encoded) value is larger than 2^32-1 bytes
+	AddTooLarge
+
+	// AddEncodeFailed means the ValueCodec of the DB couldn't encode the value
+	AddEncodeFailed
+
+	// AddOverQuota means the record would exceed the quota of its group;
+	// see WithGroupQuota().
+	AddOverQuota
+)
+
+// String returns a short description of the outcome
+func (s AddStatus) String() string {
+	switch s {
+	case AddOK:
+		return "added"
+	case AddDuplicate:
+		return "duplicate"
+	case AddTooLarge:
+		return "too-large"
+	case AddEncodeFailed:
+		return "encode-failed"
+	case AddOverQuota:
+		return "over-quota"
+	}
+	return "unknown"
+}
+
+// AddKeyValsFunc is like AddKeyVals() - except that it calls 'fp' with the
+// index and outcome of every record in 'keys' and 'vals'. Rejected records
+// (duplicate keys, values that are too large, can't be encoded or exceed the
+// quota of group 0) don't stop the batch; so ETL jobs can account for every
+// input row. It only stops at errors that leave the DB unusable (e.g., a
+// failed write) and returns the number of records added until then.
+func (w *DBWriter) AddKeyValsFunc(keys []uint64, vals [][]byte, fp func(i int, st AddStatus)) (int, error) {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return 0, err
+	}
+
+	n := len(keys)
+	if len(vals) < n {
+		n = len(vals)
+	}
+
+	var z int
+	for i := 0; i < n; i++ {
+		st := AddOK
+		_, err := w.addRecord(0, keys[i], vals[i])
+		switch {
+		case err == nil:
+			z++
+		case err == ErrExists:
+			st = AddDuplicate
+		case err == ErrValueTooLarge:
+			st = AddTooLarge
+		case errors.Is(err, errEncode):
+			st = AddEncodeFailed
+		case errors.Is(err, ErrQuota):
+			st = AddOverQuota
+		default:
+			return z, err
+		}
+		fp(i, st)
+	}
+
+	return z, nil
+}
+
+// Adds adds a single key,value pair. A DB whose keys are all added with a
+// nil value is keys-only; an empty (non-nil) value is stored as such.
+func (w *DBWriter) Add(key uint64, val []byte) error {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return err
+	}
+
+	if _, err := w.addRecord(0, key, val); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Freeze builds the minimal perfect hash, writes the DB and closes it. The parameter
+// 'load' controls the MPHF table size (load): 0 < load < 1.
+// If space is not an issue, use a lower value of load. Typical values are between
+// 0.75 and 0.9.
+//
+// A failed write (e.g., a short write or ENOSPC) - while adding records or
+// freezing - makes the writer unusable: every later call returns that error
+// and the DB is never renamed into place.
+func (w *DBWriter) Freeze(load float64) error {
+	return w.freeze(func() (*chd.Chd, error) {
+		log := w.opt.log
+		log.Printf("chdb: %s: building MPH of %d keys with load %.2f", w.fn, len(w.keymap), load)
+
+		t0 := time.Now()
+		c, err := w.bb.Freeze(load)
+		if err != nil {
+			return nil, &mphError{err}
+		}
+
+		cs := c.Stats()
+		log.Printf("chdb: %s: built MPH of %d slots in %s; %d seed retries, %d byte seeds",
+			w.fn, cs.Slots, time.Since(t0), cs.Tries, cs.SeedSize)
+		return c, nil
+	})
+}
+
+// write the DB with the MPH table returned by 'build'
+func (w *DBWriter) freeze(build func() (*chd.Chd, error)) (err error) {
+	log := w.opt.log
+
+	defer func() {
+		// undo the tmpfile; a partially written DB is never renamed
+		// into place.
+		if err != nil && err != ErrFrozen {
+			log.Printf("chdb: %s: freeze failed: %s", w.fn, err)
+			w.poison(err)
+			w.cleanup()
+		}
+		w.unlock()
+	}()
+
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return err
+	}
+
+	c, err := build()
+	if err != nil {
+		return err
+	}
+
+	// the records of each group must be contiguous
+	if err = w.regroup(); err != nil {
+		return err
+	}
+
+	// the build info is the last record; the extent table of the
+	// groups follows it.
+	binfoOff, binfoLen, err := w.writeBuildInfo()
+	if err != nil {
+		return err
+	}
+	if err = w.writeExtents(); err != nil {
+		return err
+	}
+
+	// the signature is written once the trailer is known
+	sigOff, recSum, err := w.reserveSignature()
+	if err != nil {
+		return err
+	}
+
+	// calculate strong checksum for all data from this point on.
+	h := w.opt.checksum.hash()
+
+	tee := io.MultiWriter(w.fd, h)
+
+	// We align the offset table to pagesize - so we can mmap it when we read it back.
+	pgsz := uint64(os.Getpagesize())
+	pgsz_m1 := pgsz - 1
+	offtbl := w.off + pgsz_m1
+	offtbl &= ^pgsz_m1
+
+	if err = w.checkLayout(c, offtbl); err != nil {
+		return err
+	}
+	if err = w.padTo(offtbl); err != nil {
+		return err
+	}
+
+	// Now offset is at a page boundary.
+
+	var ehdr [64]byte
+
+	// header is encoded in big-endian format
+	// 4 byte magic
+	// 4 byte flags
+	// 8 byte salt
+	// 8 byte nkeys
+	// 8 byte offtbl
+	// 4 byte codec id
+	// 8 byte build info offset
+	// 4 byte build info length
+	// 4 byte record alignment
+	// 4 byte key transform id
+	be := binary.BigEndian
+	copy(ehdr[:4], []byte{'C', 'H', 'D', 'B'})
+
+	i := 4
+	flags := uint32(w.opt.appFlags) << FlagAppShift
+	if !w.values {
+		flags |= _DB_KeysOnly
+		if _, ok := w.keymap[0]; ok || w.zeroKey {
+			flags |= _DB_ZeroKey
+		}
+	}
+	if w.opt.codec != nil {
+		flags |= FlagValueCodec
+	}
+	if w.arena != nil && w.arena.hits > 0 {
+		flags |= FlagSharedValues
+	}
+	if w.extents != nil {
+		flags |= FlagGroups
+	}
+	if sigOff > 0 {
+		flags |= FlagSigned
+	}
+	flags |= uint32(w.opt.checksum) << flagChecksumShift
+	be.PutUint32(ehdr[i:i+4], flags)
+	i += 4
+
+	i += copy(ehdr[i:], w.salt)
+	be.PutUint64(ehdr[i:i+8], uint64(c.Len()))
+	i += 8
+	be.PutUint64(ehdr[i:i+8], offtbl)
+	i += 8
+	if w.opt.codec != nil {
+		be.PutUint32(ehdr[i:i+4], w.opt.codec.ID())
+	}
+	i += 4
+	be.PutUint64(ehdr[i:i+8], binfoOff)
+	i += 8
+	be.PutUint32(ehdr[i:i+4], binfoLen)
+	i += 4
+	if w.opt.align > 1 {
+		be.PutUint32(ehdr[i:i+4], uint32(w.opt.align))
+	}
+	i += 4
+	be.PutUint32(ehdr[i:i+4], w.opt.transformID())
+
+	// add header to checksum
+	h.Write(ehdr[:])
+
+	// write to file and checksum together
+	if err := w.marshalOffsets(tee, c); err != nil {
+		return err
+	}
+
+	// align the offset to next 64 bit boundary
+	offtbl = w.off + 7
+	offtbl &= ^uint64(7)
+	if offtbl > w.off {
+		zeroes := make([]byte, offtbl-w.off)
+		if _, err = writeAll(tee, zeroes); err != nil {
+			return err
+		}
+		w.off = offtbl
+	}
+
+	// Next, we now encode the chd and write to disk.
+	nw, err := c.MarshalBinary(tee)
+	if err != nil {
+		return err
+	}
+	w.off += uint64(nw)
+	if err = w.checkSize(w.off + 32); err != nil {
+		return err
+	}
+
+	// Trailer is the checksum of everything
+	t := trailer(h)
+	if _, err := writeAll(w.fd, t); err != nil {
+		return err
+	}
+	if err = w.writeSignature(sigOff, recSum, t); err != nil {
+		return err
+	}
+
+	// Finally, write the header at start of file
+	if _, err = w.fd.Seek(0, 0); err != nil {
+		return err
+	}
+	if _, err = writeAll(w.fd, ehdr[:]); err != nil {
+		return err
+	}
+
+	// delayed write errors (e.g., ENOSPC on some filesystems) only show
+	// up here; the DB must be on disk before it is renamed into place.
+	if err = w.fd.Sync(); err != nil {
+		return err
+	}
+
+	// an ephemeral DB lives only in its open file
+	if !w.opt.ephemeral {
+		if err = w.fd.Close(); err != nil {
+			return err
+		}
+	}
+
+	if w.opt.selfCheck {
+		if err = w.selfCheck(); err != nil {
+			return err
+		}
+	}
+
+	w.frozen = true
+	if !w.opt.ephemeral {
+		if err = moveFile(w.fntmp, w.fn); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("chdb: %s: wrote %d bytes", w.fn, w.off+32)
+	w.done = true
+	runtime.SetFinalizer(w, nil)
+	return nil
+}
+
+// Abort stops the construction of the perfect hash db
+func (w *DBWriter) Abort() {
+	w.cleanup()
+}
+
+// Close releases all resources held by the writer. If the DB hasn't been
+// frozen, the construction is aborted and the tmpfile removed. Close is
+// idempotent; so callers can safely "defer w.Close()" right after creating
+// the writer.
+func (w *DBWriter) Close() error {
+	return w.cleanup()
+}
+
+// close and remove the tmpfile and release the lock - unless we are
+// already done.
+func (w *DBWriter) cleanup() error {
+	if w.done {
+		// the file of a frozen ephemeral DB that no reader took over
+		if w.opt.ephemeral && w.fd != nil {
+			fd := w.fd
+			w.fd = nil
+			return fd.Close()
+		}
+		return nil
+	}
+
+	w.done = true
+	runtime.SetFinalizer(w, nil)
+	w.opt.log.Printf("chdb: %s: aborted; removing %s", w.fn, w.fntmp)
+
+	err := w.fd.Close()
+	if w.opt.ephemeral {
+		return err
+	}
+	if rerr := os.Remove(w.fntmp); err == nil && rerr != nil && !os.IsNotExist(rerr) {
+		err = rerr
+	}
+	w.unlock()
+	return err
+}
+
+// if enabled, undo the tmpfile when a panic unwinds through the writer
+func (w *DBWriter) catchPanic() {
+	if !w.opt.panicCleanup {
+		return
+	}
+
+	if r := recover(); r != nil {
+		w.Abort()
+		panic(r)
+	}
+}
+
+// release the exclusive lock on the target DB
+func (w *DBWriter) unlock() {
+	if w.lock != nil {
+		unlockWriter(w.lock)
+		w.lock = nil
+	}
+}
+
+// write the offset mapping table and value-len table
+func (w *DBWriter) marshalOffsets(tee io.Writer, c *chd.Chd) error {
+	if !w.values {
+		return w.marshalKeys(tee, c)
+	}
+
+	n := uint64(c.Len())
+	offset := make([]uint64, 2*n)
+	vlen := make([]uint32, n)
+
+	// the tables are little-endian regardless of the host
+	for k, r := range w.keymap {
+		i := c.Find(k)
+
+		vlen[i] = toLittleEndianUint32(r.vlen)
+
+		// each entry is 2 64-bit words
+		j := i * 2
+		offset[j] = toLittleEndianUint64(k)
+		offset[j+1] = toLittleEndianUint64(r.off)
+	}
+
+	bs := u64sToByteSlice(offset)
+	if _, err := writeAll(tee, bs); err != nil {
+		return err
+	}
+
+	// Now write the value-length table
+	bs = u32sToByteSlice(vlen)
+	if _, err := writeAll(tee, bs); err != nil {
+		return err
+	}
+
+	w.off += uint64(n * (8 + 8 + 4))
+	return nil
+}
+
+// write just the keys - since we don't have values
+func (w *DBWriter) marshalKeys(tee io.Writer, c *chd.Chd) error {
+	n := uint64(c.Len())
+	offset := make([]uint64, n)
+	put := func(k uint64) error {
+		i := c.Find(k)
+		offset[i] = toLittleEndianUint64(k)
+		return nil
+	}
+
+	if w.keysrc != nil {
+		if err := w.keysrc(put); err != nil {
+			return err
+		}
+	} else {
+		for k := range w.keymap {
+			put(k)
+		}
+	}
+
+	bs := u64sToByteSlice(offset)
+	if _, err := writeAll(tee, bs); err != nil {
+		return err
+	}
+	w.off += uint64(n * 8)
+	return nil
+}
+
+// add a record; duplicates are skipped without an error
+func (w *DBWriter) addUnique(key uint64, val []byte) (bool, error) {
+	ok, err := w.addRecord(0, key, val)
+	if err == ErrExists {
+		return false, nil
+	}
+	return ok, err
+}
+
+// add a record to group 'g'; errors other than rejections of the record
+// poison the writer: the tmpfile may have a partial record.
+func (w *DBWriter) addRecord(g uint32, key uint64, val []byte) (bool, error) {
+	ok, err := w.add(g, key, val)
+	switch {
+	case err == nil, err == ErrExists, err == ErrValueTooLarge, errors.Is(err, errEncode):
+	case errors.Is(err, ErrQuota):
+	case errors.Is(err, ErrTooManyKeys), errors.Is(err, ErrFileTooLarge):
+	default:
+		w.poison(err)
+	}
+	return ok, err
+}
+
+// compute checksums and add a record to the file at the current offset.
+func (w *DBWriter) add(g uint32, key uint64, val []byte) (bool, error) {
+	if w.opt.xform != nil {
+		key = w.opt.xform.Transform(key)
+	}
+
+	_, ok := w.keymap[key]
+	if ok {
+		return false, ErrExists
+	}
+
+	if err := w.checkKeys(); err != nil {
+		return false, err
+	}
+
+	if c := w.opt.codec; c != nil && len(val) > 0 {
+		v, err := c.Encode(nil, val)
+		if err != nil {
+			return false, fmt.Errorf("%w: %s", errEncode, err)
+		}
+		val = v
+	}
+
+	if uint64(len(val)) > uint64(1<<32)-1 {
+		return false, ErrValueTooLarge
+	}
+
+	// content addressed DBs reuse the record of an identical value in
+	// the same group
+	var sum uint64
+	if w.arena != nil && len(val) > 0 {
+		v, h, err := w.findValue(val, g)
+		if err != nil {
+			return false, err
+		}
+		if v != nil {
+			if err := w.bb.Add(key); err != nil {
+				return false, err
+			}
+			w.keymap[key] = v
+			w.groupStats(g).Keys++
+			return true, nil
+		}
+		sum = h
+	}
+
+	if len(val) > 0 {
+		if err := w.checkRecordSize(len(val)); err != nil {
+			return false, err
+		}
+		if err := w.checkQuota(g, len(val)); err != nil {
+			return false, err
+		}
+		if err := w.alignRecord(); err != nil {
+			return false, err
+		}
+	}
+
+	// first add to the underlying PHF constructor
+	if err := w.bb.Add(key); err != nil {
+		return false, err
+	}
+
+	v := &value{
+		off:   w.off,
+		vlen:  uint32(len(val)),
+		group: g,
+	}
+	w.keymap[key] = v
+	if val != nil {
+		w.values = true
+	}
+
+	gs := w.groupStats(g)
+	gs.Keys++
+
+	// Don't write values if we don't need to
+	if len(val) > 0 {
+		if err := w.writeRecord(val, v.off); err != nil {
+			return false, err
+		}
+
+		w.valSize += uint64(len(val))
+		gs.Bytes += uint64(len(val)) + 8
+		if w.arena != nil {
+			w.arena.recs[sum] = v
+		}
+	}
+
+	return true, nil
+}
+
+func (w *DBWriter) writeRecord(val []byte, off uint64) error {
+	var c [8]byte
+
+	binary.BigEndian.PutUint64(c[:], w.recordSum(val, off))
+
+	// Checksum at the start of record
+	if _, err := writeAll(w.fd, c[:]); err != nil {
+		return err
+	}
+
+	if _, err := writeAll(w.fd, val); err != nil {
+		return err
+	}
+
+	w.off += uint64(len(val)) + 8
+	return nil
+}
+
+// return the checksum of the record of 'val' at offset 'off'
+func (w *DBWriter) recordSum(val []byte, off uint64) uint64 {
+	var o [8]byte
+
+	binary.BigEndian.PutUint64(o[:], off)
+
+	h := siphash.New(w.salt)
+	h.Write(o[:])
+	h.Write(val)
+	return h.Sum64()
+}
+
+// return an error if the writer can't take more records
+func (w *DBWriter) usable() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.frozen {
+		return ErrFrozen
+	}
+	return nil
+}
+
+// remember the first error that left the writer unusable
+func (w *DBWriter) poison(err error) {
+	if w.err == nil {
+		w.err = fmt.Errorf("chd: %s: writer failed: %w", w.fn, err)
+	}
+}
+
+func writeAll(w io.Writer, buf []byte) (int, error) {
+	n, err := w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(buf) {
+		return n, errShortWrite(n)
+	}
+	return n, nil
+}
+
+// rename 'src' to 'dst'. If they are on different filesystems, we copy 'src'
+// (preserving its holes) to a temp file next to 'dst' and atomically rename
+// that into place.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+
+	var le *os.LinkError
+	if err == nil || !errors.As(err, &le) || le.Err != syscall.EXDEV {
+		return err
+	}
+
+	s, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer s.Close()
+
+	tmp := fmt.Sprintf("%s.tmp.%d", dst, rand32())
+	d, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err = copySparse(d, s); err == nil {
+		err = d.Sync()
+	}
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(src)
+}
@@ -0,0 +1,73 @@
+// endian.go -- endian conversion routines
+//
+// The offset and value-length tables of a DB are little-endian on disk and
+// are used in place (mmap); every access goes through the conversions below.
+// The host byte order is detected once at startup and the conversions are
+// branch free: on little-endian hosts the byte-swapped value is masked out.
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+var (
+	// true if the host is big-endian
+	bigEndian = isBigEndian()
+
+	// all ones on big-endian hosts and zero on little-endian hosts
+	beMask = mask(bigEndian)
+
+	// all ones on little-endian hosts and zero on big-endian hosts
+	leMask = ^beMask
+)
+
+func isBigEndian() bool {
+	v := uint16(1)
+	return (*[2]byte)(unsafe.Pointer(&v))[0] == 0
+}
+
+func mask(b bool) uint64 {
+	if b {
+		return ^uint64(0)
+	}
+	return 0
+}
+
+// pick the swapped value 's' of 'v' where 'm' is set
+func pick64(v, s, m uint64) uint64 {
+	return v ^ ((v ^ s) & m)
+}
+
+func toLittleEndianUint64(v uint64) uint64 {
+	return pick64(v, bits.ReverseBytes64(v), beMask)
+}
+
+func toLittleEndianUint32(v uint32) uint32 {
+	return uint32(pick64(uint64(v), uint64(bits.ReverseBytes32(v)), beMask))
+}
+
+func toLittleEndianUint16(v uint16) uint16 {
+	return uint16(pick64(uint64(v), uint64(bits.ReverseBytes16(v)), beMask))
+}
+
+func toBigEndianUint64(v uint64) uint64 {
+	return pick64(v, bits.ReverseBytes64(v), leMask)
+}
+
+func toBigEndianUint32(v uint32) uint32 {
+	return uint32(pick64(uint64(v), uint64(bits.ReverseBytes32(v)), leMask))
+}
+
+func toBigEndianUint16(v uint16) uint16 {
+	return uint16(pick64(uint64(v), uint64(bits.ReverseBytes16(v)), leMask))
+}
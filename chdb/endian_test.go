@@ -0,0 +1,81 @@
+// endian_test.go -- test suite for endian-convertors
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestEndian(t *testing.T) {
+	assert := newAsserter(t)
+
+	// native in-memory representation of a uint64, uint32, uint16
+	a1 := uint64(0xabcd1234baadf00d)
+	n1 := (*[8]byte)(unsafe.Pointer(&a1))[:]
+	a0 := uint32(0xabcd1234)
+	n0 := (*[4]byte)(unsafe.Pointer(&a0))[:]
+	a2 := uint16(0xabcd)
+	n2 := (*[2]byte)(unsafe.Pointer(&a2))[:]
+
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	// toLittleEndian() of a natively loaded value must equal the LE decode
+	// of its bytes; likewise for BE.
+	assert(toLittleEndianUint64(a1) == le.Uint64(n1), "le64: %#x", toLittleEndianUint64(a1))
+	assert(toBigEndianUint64(a1) == be.Uint64(n1), "be64: %#x", toBigEndianUint64(a1))
+	assert(toLittleEndianUint32(a0) == le.Uint32(n0), "le32: %#x", toLittleEndianUint32(a0))
+	assert(toBigEndianUint32(a0) == be.Uint32(n0), "be32: %#x", toBigEndianUint32(a0))
+	assert(toLittleEndianUint16(a2) == le.Uint16(n2), "le16: %#x", toLittleEndianUint16(a2))
+	assert(toBigEndianUint16(a2) == be.Uint16(n2), "be16: %#x", toBigEndianUint16(a2))
+
+	switch runtime.GOARCH {
+	case "ppc64", "mips", "mips64", "s390x":
+		assert(bigEndian, "%s: not detected as big-endian", runtime.GOARCH)
+	case "386", "amd64", "arm", "arm64", "ppc64le", "mipsle", "mips64le", "riscv64":
+		assert(!bigEndian, "%s: not detected as little-endian", runtime.GOARCH)
+	}
+}
+
+// TestCrossEndian runs the test suites of chd, chdb and of the reference
+// corpus (built on a little-endian host) on an emulated big-endian host.
+// It needs qemu user mode emulation (qemu-s390x) and is skipped otherwise;
+// set $CHD_QEMU to the emulator to use a different one.
+func TestCrossEndian(t *testing.T) {
+	if testing.Short() || bigEndian {
+		t.Skip("not needed")
+	}
+
+	qemu := os.Getenv("CHD_QEMU")
+	if len(qemu) == 0 {
+		for _, nm := range []string{"qemu-s390x-static", "qemu-s390x"} {
+			if p, err := exec.LookPath(nm); err == nil {
+				qemu = p
+				break
+			}
+		}
+	}
+	if len(qemu) == 0 {
+		t.Skip("qemu-s390x not found")
+	}
+
+	cmd := exec.Command("go", "test", "-short", "-count=1", "-exec", qemu, "..", ".", "../chdtest")
+	cmd.Env = append(os.Environ(), "GOOS=linux", "GOARCH=s390x", "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("big-endian tests failed: %s\n%s", err, out)
+	}
+	t.Logf("%s", out)
+}
@@ -0,0 +1,91 @@
+// ephemeral.go -- DBs built in memory for the life of a process
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// An ephemeral DB is built in an anonymous file: a memfd on linux or a file
+// on tmpfs that is unlinked as soon as it is created elsewhere. It never has
+// a name in the filesystem; so it needs no cleanup and can't collide with
+// other builds. It is meant for request scoped lookup tables built on the
+// fly; FreezeReader() freezes it and returns a reader over it - which owns
+// the file from then on. The memory is released when the reader is closed.
+
+// the directory of the anonymous files where memfds are unavailable
+var _TmpfsDir = "/dev/shm"
+
+// NewEphemeralDBWriter returns a DBWriter that builds an ephemeral DB (see
+// above); 'name' only labels the DB in messages. All the WriterOptions
+// except those that deal with the temp file apply. Freeze the DB with
+// FreezeReader(); a DB frozen with Freeze() is discarded by Close().
+func NewEphemeralDBWriter(name string, opts ...WriterOption) (*DBWriter, error) {
+	return NewDBWriter(name, append(opts, func(o *writerOpts) {
+		o.ephemeral = true
+	})...)
+}
+
+// FreezeReader freezes the DB (see Freeze()) and opens it for lookups with
+// 'cache' and 'opts' (see NewDBReader()). The reader of an ephemeral DB
+// takes over its file.
+func (w *DBWriter) FreezeReader(load float64, cache int, opts ...ReaderOption) (*DBReader, error) {
+	if err := w.Freeze(load); err != nil {
+		return nil, err
+	}
+
+	if !w.opt.ephemeral {
+		return NewDBReader(w.fn, cache, opts...)
+	}
+
+	fd := w.fd
+	w.fd = nil
+	rd, err := NewDBReaderFromFd(fd, cache, opts...)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
+
+// return a file that is never visible in the filesystem
+func anonFile(name string) (*os.File, error) {
+	fd, err := memfdCreate("chdb:" + name)
+	if err == nil {
+		return fd, nil
+	}
+
+	dir := _TmpfsDir
+	if st, err := os.Stat(dir); err != nil || !st.IsDir() {
+		dir = os.TempDir()
+	}
+
+	if fd, err = ioutil.TempFile(dir, "chdb-*.tmp"); err != nil {
+		return nil, err
+	}
+	if err = os.Remove(fd.Name()); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// return a new descriptor of the open file 'fd'
+func dupFile(fd *os.File) (*os.File, error) {
+	nfd, err := syscall.Dup(int(fd.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(nfd)
+	return os.NewFile(uintptr(nfd), fd.Name()), nil
+}
@@ -0,0 +1,96 @@
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opencoff/go-chd"
+)
+
+func errShortWrite(n int) error {
+	return fmt.Errorf("chd: incomplete write; exp 8, saw %d", n)
+}
+
+var (
+	// ErrMPHFail is returned when the gamma value provided to Freeze() is too small to
+	// build a minimal perfect hash table.
+	ErrMPHFail = errors.New("failed to build MPH")
+
+	// ErrFrozen is returned when attempting to add new records to an already frozen DB
+	// It is also returned when trying to freeze a DB that's already frozen.
+	ErrFrozen = chd.ErrFrozen
+
+	// ErrValueTooLarge is returned if the value-length is larger than 2^32-1 bytes
+	ErrValueTooLarge = errors.New("value is larger than 2^32-1 bytes")
+
+	// ErrExists is returned if a duplicate key is added to the DB
+	ErrExists = errors.New("key exists in DB")
+
+	// ErrNoKey is returned when a key cannot be found in the DB
+	ErrNoKey = errors.New("No such key")
+
+	// ErrClosed is returned when using a DBReader or Snapshot that is already closed
+	ErrClosed = errors.New("DB closed")
+
+	// ErrLocked is returned when the DB (or its writer lock) is held by someone else
+	ErrLocked = errors.New("DB is locked")
+
+	// ErrMapLimit is returned when the metadata of a DB can't be mapped
+	// into memory; see WithMapWindow().
+	ErrMapLimit = errors.New("can't map DB metadata")
+
+	// ErrTooManyKeys is returned when a DB has more keys than the limit
+	// of the writer (see WithMaxKeys()) or than its tables can hold
+	ErrTooManyKeys = errors.New("too many keys")
+
+	// ErrFileTooLarge is returned when a DB outgrows the size limit of the
+	// writer; see WithMaxFileSize().
+	ErrFileTooLarge = errors.New("DB file too large")
+
+	// ErrCorrupt is returned when the tables of a DB describe a record that
+	// can't be in the file or is larger than the limit of the reader; see
+	// WithMaxValueSize().
+	ErrCorrupt = errors.New("corrupt DB")
+
+	// ErrNoGroup is returned for a group that has no keys in the DB; see
+	// AddGroup().
+	ErrNoGroup = errors.New("no such group")
+
+	// ErrQuota is returned when a record would exceed the byte quota of
+	// its group; see WithGroupQuota().
+	ErrQuota = errors.New("group quota exceeded")
+
+	// ErrSignature is returned when a DB isn't signed by a trusted key;
+	// see WithTrustedKeys().
+	ErrSignature = errors.New("bad or missing signature")
+)
+
+// errEncode is returned when the ValueCodec of a DBWriter fails
+var errEncode = errors.New("chd: can't encode value")
+
+// mphError wraps the error from building the MPH table; it matches
+// ErrMPHFail and unwraps to the underlying error (e.g., *chd.SeedError).
+type mphError struct {
+	err error
+}
+
+func (e *mphError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrMPHFail, e.err)
+}
+
+func (e *mphError) Unwrap() error {
+	return e.err
+}
+
+func (e *mphError) Is(target error) bool {
+	return target == ErrMPHFail
+}
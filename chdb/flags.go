@@ -0,0 +1,80 @@
+// flags.go -- DB file header flags
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// The 32-bit flags field of the DB file header is split in two halves:
+//
+//   - bits 0-15 describe the file format. Readers refuse to open a DB with
+//     format flags they don't know about; new format features (e.g.,
+//     compression or wide value lengths) get the next free bit.
+//   - bits 16-31 belong to the application: the DBWriter stores them as
+//     given by WithAppFlags() and the DBReader returns them via AppFlags().
+const (
+	// FlagKeysOnly marks a DB without values
+	FlagKeysOnly uint32 = 1 << 0
+
+	// FlagValueCodec marks a DB whose values are encoded with a ValueCodec;
+	// the codec ID is in the header.
+	FlagValueCodec uint32 = 1 << 1
+
+	// FlagSharedValues marks a DB whose records may be shared by several
+	// keys; see WithContentAddressed().
+	FlagSharedValues uint32 = 1 << 4
+
+	// FlagGroups marks a DB whose records are clustered by group; the
+	// extent table of the groups follows the build info record. See
+	// AddGroup().
+	FlagGroups uint32 = 1 << 5
+
+	// FlagSigned marks a DB with an ed25519 signature; see
+	// WithSigningKey().
+	FlagSigned uint32 = 1 << 6
+
+	// FlagZeroKey marks a keys-only DB that has the key 0; the empty slots
+	// of its key table are 0 as well.
+	FlagZeroKey uint32 = 1 << 7
+
+	// FlagChecksumMask covers the algorithm of the metadata checksum; see
+	// Checksum.
+	FlagChecksumMask uint32 = 3 << flagChecksumShift
+
+	// FlagFormatMask covers the flags reserved for the file format
+	FlagFormatMask uint32 = 0x0000ffff
+
+	// FlagAppMask covers the application defined flags
+	FlagAppMask uint32 = 0xffff0000
+
+	// FlagAppShift is the position of the application flags
+	FlagAppShift = 16
+
+	// format flags known to this version
+	knownFlags = FlagKeysOnly | FlagValueCodec | FlagChecksumMask | FlagSharedValues | FlagGroups | FlagSigned | FlagZeroKey
+)
+
+// WithAppFlags stores the application defined flags 'f' in the header of
+// the DB; see DBReader.AppFlags().
+func WithAppFlags(f uint16) WriterOption {
+	return func(o *writerOpts) {
+		o.appFlags = f
+	}
+}
+
+// Flags returns the flags field of the DB header: the format flags in the
+// low 16 bits and the application flags in the high 16 bits.
+func (rd *DBReader) Flags() uint32 {
+	return rd.flags
+}
+
+// AppFlags returns the application defined flags that the DB was written
+// with.
+func (rd *DBReader) AppFlags() uint16 {
+	return uint16((rd.flags & FlagAppMask) >> FlagAppShift)
+}
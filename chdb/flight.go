@@ -0,0 +1,58 @@
+// flight.go -- collapse concurrent reads of the same record
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"sync"
+)
+
+// flightGroup ensures that only one disk read is in flight per key; callers
+// that ask for a key already being read wait for, and share, its result.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[uint64]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// do calls fn for 'key' unless a call for the same key is already in flight;
+// in which case it waits for that call and returns its results.
+func (g *flightGroup) do(key uint64, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[uint64]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	// always release the waiters - even if fn panics.
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,41 @@
+// get.go -- lookups that tell absent keys from empty values
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// Find() and Lookup() return a nil value for the keys of a keys-only DB;
+// and a DB with values can hold keys with an empty value. Get() has the same
+// semantics for both kinds of DBs and for every reader:
+//
+//   - key present: a non-nil value (empty for keys-only DBs and for empty
+//     values), true and a nil error
+//   - key absent: nil, false and a nil error
+//   - lookup failed (i/o error, corrupt record, closed DB): nil, false and
+//     the error
+//
+// i.e., the value is non-nil if and only if the key is present.
+
+// Get looks up 'key' in the DB; see above for the semantics.
+func (rd *DBReader) Get(key uint64) ([]byte, bool, error) {
+	return getResult(rd.Find(key))
+}
+
+// turn the result of a Find() into that of a Get()
+func getResult(v []byte, err error) ([]byte, bool, error) {
+	switch {
+	case err == ErrNoKey:
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	case v == nil:
+		return []byte{}, true, nil
+	}
+	return v, true, nil
+}
@@ -0,0 +1,25 @@
+// getter.go -- the DB readers are lookup tables too
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"github.com/opencoff/go-chd"
+)
+
+// all the readers can stand in for each other (and for chd.Map) via the
+// chd.Getter interface.
+var (
+	_ chd.Getter = &DBReader{}
+	_ chd.Getter = &DBSet{}
+	_ chd.Getter = &Snapshot{}
+	_ chd.Getter = &ReaderPool{}
+	_ chd.Getter = &LazyDBReader{}
+)
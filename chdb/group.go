@@ -0,0 +1,397 @@
+// group.go -- records clustered by group into extents
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Records are written in the order they are added; so the records of a
+// namespace (e.g., a tenant) of a multi-tenant DB are scattered over the
+// file. AddGroup() tags each key with a group ID; Freeze() then rewrites the
+// records group by group - in ascending order of the group IDs - so that
+// each group occupies a contiguous extent of the file. Extents after the
+// first start at a page boundary; so callers can madvise(2) or fadvise(2)
+// the records of a group without touching those of its neighbors. Keys added
+// with Add() and friends are in group 0.
+//
+// The extent table is an extra record right after the build info record
+// (see BuildInfo); the header flag FlagGroups marks its presence. The record
+// value is (big-endian):
+//
+//	magic   [4]byte "CHDG"
+//	n       uint32  number of extents
+//	n x:
+//	  group uint32
+//	  resv  uint32
+//	  keys  uint64  number of keys in the group
+//	  bytes uint64  bytes of the records of the group (see GroupStats)
+//	  off   uint64  file offset of the extent
+//	  size  uint64  size of the extent in bytes
+//
+// Keys with an empty value have no record; their offset is that of the
+// extent of their group. Keys-only DBs have no records; their extents only
+// count the keys of each group.
+
+// Extent describes the part of the DB file that holds the records of a group
+type Extent struct {
+	GroupStats
+	Off  uint64 `json:"off"`
+	Size uint64 `json:"size"`
+}
+
+// return true if a record at 'off' belongs to the extent
+func (e *Extent) has(off uint64) bool {
+	return off >= e.Off && (off == e.Off || off-e.Off < e.Size)
+}
+
+// AddGroup adds a single key,value pair to group 'group'; see Add(). When
+// the DB is frozen, the records of each group are stored contiguously.
+func (w *DBWriter) AddGroup(group uint32, key uint64, val []byte) error {
+	defer w.catchPanic()
+
+	if err := w.usable(); err != nil {
+		return err
+	}
+
+	w.grouped = true
+	if _, err := w.addRecord(group, key, val); err != nil {
+		return err
+	}
+	return nil
+}
+
+// rewrite the records group by group into a new temp file and note the
+// extent of each group
+func (w *DBWriter) regroup() error {
+	if !w.grouped {
+		return nil
+	}
+
+	// records are never shared across groups; see add()
+	keys := make(map[uint32][]uint64)
+	for k, v := range w.keymap {
+		keys[v.group] = append(keys[v.group], k)
+	}
+
+	ids := make([]uint32, 0, len(keys))
+	for g := range keys {
+		ids = append(ids, g)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a] < ids[b]
+	})
+
+	w.extents = make([]Extent, 0, len(ids))
+	if !w.values {
+		for _, g := range ids {
+			w.extents = append(w.extents, Extent{
+				GroupStats: GroupStats{Group: g, Keys: uint64(len(keys[g]))},
+			})
+		}
+		return nil
+	}
+
+	fd, tmp, err := w.createTmp()
+	if err != nil {
+		return err
+	}
+
+	old, oldtmp, oldoff := w.fd, w.fntmp, w.off
+	w.fd, w.fntmp, w.off = fd, tmp, 0
+
+	if err = w.copyGroups(old, ids, keys); err != nil {
+		// cleanup() removes the old temp file
+		w.removeTmp(fd, tmp)
+		w.fd, w.fntmp, w.off = old, oldtmp, oldoff
+		return err
+	}
+
+	w.removeTmp(old, oldtmp)
+	w.opt.log.Printf("chdb: %s: clustered %d keys in %d groups; rebuilding in %s",
+		w.fn, len(w.keymap), len(ids), tmp)
+	return nil
+}
+
+// copy the records of the groups 'ids' from 'old' to the current temp file
+func (w *DBWriter) copyGroups(old *os.File, ids []uint32, keys map[uint32][]uint64) error {
+	var z [64]byte
+
+	// space for the header
+	if _, err := writeAll(w.fd, z[:]); err != nil {
+		return err
+	}
+	w.off = 64
+
+	var buf []byte
+	var err error
+
+	pgsz := uint64(os.Getpagesize())
+	for j, g := range ids {
+		if j > 0 {
+			// an empty extent still needs an offset of its own
+			next := w.off
+			if next == w.extents[j-1].Off {
+				next++
+			}
+			if err = w.padTo((next + pgsz - 1) &^ (pgsz - 1)); err != nil {
+				return err
+			}
+		}
+
+		// keep the order the records were added in
+		ks := keys[g]
+		sort.Slice(ks, func(a, b int) bool {
+			return w.keymap[ks[a]].off < w.keymap[ks[b]].off
+		})
+
+		// keys that share a record keep sharing it
+		var nb uint64
+		start := w.off
+		moved := make(map[*value]*value)
+		for _, k := range ks {
+			v := w.keymap[k]
+			nv, ok := moved[v]
+			if !ok {
+				nv = &value{off: start, vlen: v.vlen, group: g}
+				if v.vlen > 0 {
+					if buf, err = w.readRecord(old, v, buf); err != nil {
+						return err
+					}
+					if err = w.alignRecord(); err != nil {
+						return err
+					}
+					nv.off = w.off
+					if err = w.writeRecord(buf[8:], nv.off); err != nil {
+						return err
+					}
+					nb += uint64(len(buf))
+				}
+				moved[v] = nv
+			}
+			w.keymap[k] = nv
+		}
+
+		w.extents = append(w.extents, Extent{
+			GroupStats: GroupStats{Group: g, Keys: uint64(len(ks)), Bytes: nb},
+			Off:        start,
+			Size:       w.off - start,
+		})
+	}
+	return nil
+}
+
+// read the record of 'v' from 'fd' into 'buf' and verify its checksum
+func (w *DBWriter) readRecord(fd *os.File, v *value, buf []byte) ([]byte, error) {
+	n := 8 + int(v.vlen)
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+
+	buf = buf[:n]
+	if _, err := fd.ReadAt(buf, int64(v.off)); err != nil {
+		return nil, fmt.Errorf("chd: %s: can't read record at off %d: %s", w.fn, v.off, err)
+	}
+	if binary.BigEndian.Uint64(buf) != w.recordSum(buf[8:], v.off) {
+		return nil, fmt.Errorf("chd: %s: %w: record at off %d changed on disk", w.fn, ErrCorrupt, v.off)
+	}
+	return buf, nil
+}
+
+// create a new temp file for the DB
+func (w *DBWriter) createTmp() (*os.File, string, error) {
+	if w.opt.ephemeral {
+		fd, err := anonFile(w.fn)
+		if err != nil {
+			return nil, "", err
+		}
+		return fd, fd.Name(), nil
+	}
+
+	tmp := w.opt.tmpName(w.fn)
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	return fd, tmp, nil
+}
+
+// close and remove a temp file
+func (w *DBWriter) removeTmp(fd *os.File, tmp string) {
+	fd.Close()
+	if !w.opt.ephemeral {
+		os.Remove(tmp)
+	}
+}
+
+// write the extent table at the current offset
+func (w *DBWriter) writeExtents() error {
+	if w.extents == nil {
+		return nil
+	}
+
+	buf := make([]byte, 8+40*len(w.extents))
+
+	be := binary.BigEndian
+	copy(buf[:4], []byte{'C', 'H', 'D', 'G'})
+	be.PutUint32(buf[4:], uint32(len(w.extents)))
+
+	b := buf[8:]
+	for _, e := range w.extents {
+		be.PutUint32(b[0:], e.Group)
+		be.PutUint64(b[8:], e.Keys)
+		be.PutUint64(b[16:], e.Bytes)
+		be.PutUint64(b[24:], e.Off)
+		be.PutUint64(b[32:], e.Size)
+		b = b[40:]
+	}
+	return w.writeRecord(buf, w.off)
+}
+
+// read and verify the extent table of the DB
+func (rd *DBReader) loadExtents() error {
+	if (rd.flags & FlagGroups) == 0 {
+		return nil
+	}
+
+	bad := func(why string) error {
+		return fmt.Errorf("%s: %w: extent table: %s", rd.fn, ErrCorrupt, why)
+	}
+
+	if rd.binfoOff == 0 {
+		return bad("no build info")
+	}
+
+	off := rd.binfoOff + 8 + uint64(rd.binfoLen)
+	if off+16 > rd.offtbl {
+		return bad("truncated")
+	}
+
+	var hdr [16]byte
+	if _, err := rd.fd.ReadAt(hdr[:], int64(off)); err != nil {
+		return fmt.Errorf("%s: can't read extent table: %s", rd.fn, err)
+	}
+
+	be := binary.BigEndian
+	if string(hdr[8:12]) != "CHDG" {
+		return bad("bad magic")
+	}
+
+	n := uint64(be.Uint32(hdr[12:]))
+	if n > (rd.offtbl-off-16)/40 {
+		return bad("truncated")
+	}
+
+	data := make([]byte, 16+40*n)
+	if _, err := rd.fd.ReadAt(data, int64(off)); err != nil {
+		return fmt.Errorf("%s: can't read extent table: %s", rd.fn, err)
+	}
+	if err := rd.verifyRecord(data, off); err != nil {
+		return err
+	}
+
+	var keys uint64
+	var prev *Extent
+
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+	ext := make([]Extent, n)
+	b := data[16:]
+	for i := range ext {
+		e := &ext[i]
+		e.Group = be.Uint32(b[0:])
+		e.Keys = be.Uint64(b[8:])
+		e.Bytes = be.Uint64(b[16:])
+		e.Off = be.Uint64(b[24:])
+		e.Size = be.Uint64(b[32:])
+		b = b[40:]
+
+		switch {
+		case prev != nil && e.Group <= prev.Group:
+			return bad("groups out of order")
+		case e.Keys > rd.nkeys-keys:
+			return bad("too many keys")
+		case keysOnly:
+			if e.Off != 0 || e.Size != 0 || e.Bytes != 0 {
+				return bad("records in a keys-only DB")
+			}
+		case e.Off < 64 || e.Size > rd.binfoOff || e.Off > rd.binfoOff-e.Size:
+			return bad(fmt.Sprintf("group %d is outside the records", e.Group))
+		case prev != nil && (e.Off <= prev.Off || e.Off < prev.Off+prev.Size):
+			return bad(fmt.Sprintf("group %d overlaps group %d", e.Group, prev.Group))
+		case e.Bytes > e.Size:
+			return bad(fmt.Sprintf("group %d has %d bytes in %d", e.Group, e.Bytes, e.Size))
+		}
+		keys += e.Keys
+		prev = e
+	}
+
+	rd.extents = ext
+	return nil
+}
+
+// Extents returns the extents of the groups of the DB in ascending order of
+// the group IDs; it returns nil if the DB wasn't built with AddGroup().
+func (rd *DBReader) Extents() []Extent {
+	if rd.extents == nil {
+		return nil
+	}
+	return append([]Extent(nil), rd.extents...)
+}
+
+// Extent returns the extent of group 'group' and true if the group has
+// keys in the DB.
+func (rd *DBReader) Extent(group uint32) (Extent, bool) {
+	ext := rd.extents
+	i := sort.Search(len(ext), func(i int) bool {
+		return ext[i].Group >= group
+	})
+	if i == len(ext) || ext[i].Group != group {
+		return Extent{}, false
+	}
+	return ext[i], true
+}
+
+// ScanGroup is like Scan() - except that it only visits the keys of group
+// 'group' and only reads the extent of the group. It returns an error that
+// matches ErrNoGroup if the group has no keys in the DB. Keys-only DBs have
+// no records to scan; their keys aren't visited.
+func (rd *DBReader) ScanGroup(group uint32, fn func(key uint64, val []byte) bool) (err error) {
+	defer catchTableRead(&err)
+
+	e, ok := rd.Extent(group)
+	if !ok {
+		return fmt.Errorf("%s: %w: %d", rd.fn, ErrNoGroup, group)
+	}
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return fmt.Errorf("%s: keys-only DB has no records to scan by group", rd.fn)
+	}
+
+	var slots []uint64
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.live(i) && e.has(rd.offAt(i)) {
+			slots = append(slots, i)
+		}
+	}
+
+	sort.Slice(slots, func(a, b int) bool {
+		return rd.offAt(slots[a]) < rd.offAt(slots[b])
+	})
+	return rd.scanValues(slots, fn)
+}
+
+// ScanGroup calls 'fn' for every key, value pair of group 'group' in the
+// snapshot; see DBReader.ScanGroup().
+func (s *Snapshot) ScanGroup(group uint32, fn func(key uint64, val []byte) bool) error {
+	return s.rd.ScanGroup(group, fn)
+}
@@ -0,0 +1,180 @@
+// heat.go -- sampled per-record access counters (heat map)
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// A heat map sidecar file is a series of blocks appended by successive
+// flushes; all multibyte ints are little-endian:
+//   - magic    [4]byte "CHDH"
+//   - resv     [4]byte
+//   - n        uint64  number of entries that follow
+//   - n entries of:
+//      * key   uint64
+//      * count uint64
+
+// per-reader state of the access counters
+type heatMap struct {
+	fn   string
+	rate uint64
+
+	// running count of lookups for sampling
+	n uint64
+
+	// sampled hits per slot of the offset table
+	hits []uint32
+}
+
+// WithHeatMap makes the DBReader count a sample of 1 in 'rate' successful
+// lookups per record and append the counters to the sidecar file 'fn' when
+// the reader is closed (or when FlushHeatMap() is called). Counting is
+// lock-free and best effort. A subsequent build can use ReadHeatMap() to lay
+// out the hot records together.
+func WithHeatMap(fn string, rate int) ReaderOption {
+	return func(o *readerOpts) {
+		if rate <= 0 {
+			rate = 1
+		}
+		o.heatfn = fn
+		o.heatrate = uint64(rate)
+	}
+}
+
+// count a successful lookup of 'key' if it is sampled
+func (rd *DBReader) touch(key uint64) {
+	h := rd.heat
+	if h == nil {
+		return
+	}
+
+	if atomic.AddUint64(&h.n, 1)%h.rate != 0 {
+		return
+	}
+
+	i := rd.chd.Find(key)
+	atomic.AddUint32(&h.hits[i], 1)
+}
+
+// FlushHeatMap appends the sampled access counters to the heat map sidecar
+// file and resets them. It is a no-op if the reader wasn't opened with
+// WithHeatMap().
+func (rd *DBReader) FlushHeatMap() (err error) {
+	defer catchTableRead(&err)
+
+	h := rd.heat
+	if h == nil {
+		return nil
+	}
+
+	var ents []uint64
+	for i := range h.hits {
+		c := atomic.SwapUint32(&h.hits[i], 0)
+		if c == 0 {
+			continue
+		}
+
+		ents = append(ents, rd.keyAt(uint64(i)), uint64(c))
+	}
+
+	if len(ents) == 0 {
+		return nil
+	}
+
+	fd, err := os.OpenFile(h.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	var hdr [16]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'H'})
+	le.PutUint64(hdr[8:], uint64(len(ents)/2))
+
+	wr := bufio.NewWriter(fd)
+	writeAll(wr, hdr[:])
+
+	var b [8]byte
+	for _, v := range ents {
+		le.PutUint64(b[:], v)
+		writeAll(wr, b[:])
+	}
+
+	err = wr.Flush()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// HeatMap is the aggregate of all the access counters in a heat map sidecar
+// file.
+type HeatMap map[uint64]uint64
+
+// ReadHeatMap reads and aggregates the access counters in the heat map
+// sidecar file 'fn'.
+func ReadHeatMap(fn string) (HeatMap, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	le := binary.LittleEndian
+	rd := bufio.NewReader(fd)
+	hm := make(HeatMap)
+
+	var hdr [16]byte
+	var b [16]byte
+	for {
+		_, err := io.ReadFull(rd, hdr[:])
+		if err == io.EOF {
+			return hm, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read heat map header: %w", fn, err)
+		}
+
+		if string(hdr[:4]) != "CHDH" {
+			return nil, fmt.Errorf("%s: bad heat map magic", fn)
+		}
+
+		n := le.Uint64(hdr[8:])
+		for i := uint64(0); i < n; i++ {
+			if _, err := io.ReadFull(rd, b[:]); err != nil {
+				return nil, fmt.Errorf("%s: can't read heat map entry: %w", fn, err)
+			}
+			hm[le.Uint64(b[:8])] += le.Uint64(b[8:])
+		}
+	}
+}
+
+// Count returns the number of sampled accesses of 'key'
+func (hm HeatMap) Count(key uint64) uint64 {
+	return hm[key]
+}
+
+// Sort orders 'keys' in place by decreasing access count - hottest first.
+// Adding records to a DBWriter in this order places the hot records together.
+func (hm HeatMap) Sort(keys []uint64) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return hm[keys[i]] > hm[keys[j]]
+	})
+}
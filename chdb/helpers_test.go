@@ -0,0 +1,84 @@
+// helpers_test.go - helper routines for tests
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
+
+// write a DB with the given key-value pairs to file 'fn'
+func makeDB(t *testing.T, fn string, kv map[uint64]string, opts ...WriterOption) {
+	assert := newAsserter(t)
+
+	wr, err := NewDBWriter(fn, opts...)
+	assert(err == nil, "can't create db %s: %s", fn, err)
+
+	for k, v := range kv {
+		err = wr.Add(k, []byte(v))
+		assert(err == nil, "can't add key %x: %s", k, err)
+	}
+
+	err = wr.Freeze(0.9)
+	assert(err == nil, "freeze %s failed: %s", fn, err)
+}
+
+// write a DB of the words in keyw - keyed by their position (from 1) - to
+// file 'fn'; it returns the key-value pairs of the DB.
+func keywDB(t *testing.T, fn string, opts ...WriterOption) map[uint64]string {
+	kv := make(map[uint64]string)
+	for i, s := range keyw {
+		kv[uint64(i+1)] = s
+	}
+	makeDB(t, fn, kv, opts...)
+	return kv
+}
+
+var keyw = []string{
+	"expectoration",
+	"mizzenmastman",
+	"stockfather",
+	"pictorialness",
+	"villainous",
+	"unquality",
+	"sized",
+	"Tarahumari",
+	"endocrinotherapy",
+	"quicksandy",
+	"heretics",
+	"pediment",
+	"spleen's",
+	"Shepard's",
+	"paralyzed",
+	"megahertzes",
+	"Richardson's",
+	"mechanics's",
+	"Springfield",
+	"burlesques",
+}
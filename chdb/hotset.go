@@ -0,0 +1,115 @@
+// hotset.go -- save and restore the keys of the record cache
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A hot set is the list of keys in the record cache; all multibyte ints are
+// little-endian:
+//   - magic    [4]byte "CHDW"
+//   - resv     [4]byte
+//   - n        uint64  number of keys that follow
+//   - n keys   uint64  least recently used first
+//
+// The keys are as stored in the DB (i.e., after any KeyTransform).
+
+// WithHotSet pre-warms the record cache with the records of the keys in the
+// hot set read from 'r' (see SaveHotSet()); e.g., so a restarted service
+// starts with the working set of its previous run. The records are read
+// when the DB is opened; this isn't counted in Stats(). The hot set is best
+// effort: errors reading it or its records are logged and the DB is opened
+// with whatever was warmed.
+func WithHotSet(r io.Reader) ReaderOption {
+	return func(o *readerOpts) {
+		o.hotset = r
+	}
+}
+
+// SaveHotSet writes the keys in the record cache to 'w'; WithHotSet() reads
+// them back. The cache must implement CacheKeys (the default cache and the
+// ARC cache in package chdb/arc do); readers of secret keys can't save
+// their hot set (see WithSecretKeys()).
+func (rd *DBReader) SaveHotSet(w io.Writer) error {
+	if rd.secret != nil {
+		return fmt.Errorf("%s: cache of secret keys can't list its keys", rd.fn)
+	}
+
+	c, ok := rd.cache.(CacheKeys)
+	if !ok {
+		return fmt.Errorf("%s: cache %T can't list its keys", rd.fn, rd.cache)
+	}
+
+	keys := c.Keys()
+
+	var hdr [16]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'W'})
+	le.PutUint64(hdr[8:], uint64(len(keys)))
+
+	wr := bufio.NewWriter(w)
+	writeAll(wr, hdr[:])
+
+	var b [8]byte
+	for _, k := range keys {
+		le.PutUint64(b[:], k)
+		writeAll(wr, b[:])
+	}
+	return wr.Flush()
+}
+
+// read the hot set in 'r' and cache the records of its keys
+func (rd *DBReader) loadHotSet(r io.Reader) error {
+	keys, err := rd.readHotSet(r)
+	if err != nil {
+		return err
+	}
+
+	// findStored() caches the records in the order of the keys
+	_, err = rd.findStored(keys)
+	return err
+}
+
+// read the keys of the hot set in 'r'
+func (rd *DBReader) readHotSet(r io.Reader) ([]uint64, error) {
+	le := binary.LittleEndian
+	br := bufio.NewReader(r)
+
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%s: can't read hot set header: %w", rd.fn, err)
+	}
+
+	if string(hdr[:4]) != "CHDW" {
+		return nil, fmt.Errorf("%s: bad hot set magic", rd.fn)
+	}
+
+	// every cached key is in the DB
+	n := le.Uint64(hdr[8:])
+	if n > rd.nkeys {
+		return nil, fmt.Errorf("%s: hot set has %d keys; DB has %d", rd.fn, n, rd.nkeys)
+	}
+
+	var b [8]byte
+	keys := make([]uint64, n)
+	for i := range keys {
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return nil, fmt.Errorf("%s: can't read hot set key: %w", rd.fn, err)
+		}
+		keys[i] = le.Uint64(b[:])
+	}
+	return keys, nil
+}
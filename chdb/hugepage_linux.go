@@ -0,0 +1,41 @@
+// hugepage_linux.go -- transparent huge pages for the DB metadata on linux
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package chdb
+
+import (
+	"syscall"
+)
+
+// ask the kernel to back 'b' with huge pages; this is advisory and we
+// ignore failures (e.g., THP disabled or unsupported for this mapping).
+func adviseHugePages(b []byte) {
+	syscall.Madvise(b, syscall.MADV_HUGEPAGE)
+}
+
+// allocate 'sz' bytes of anonymous memory backed by huge pages (if
+// possible). The memory must be released with syscall.Munmap() of the
+// whole mapping: b[:cap(b)].
+func allocHugePages(sz int) ([]byte, error) {
+	// round up to a multiple of the huge page size (2MB)
+	const hpsz = 2 * 1024 * 1024
+	n := (sz + hpsz - 1) &^ (hpsz - 1)
+
+	b, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, err
+	}
+
+	adviseHugePages(b)
+	return b[:sz], nil
+}
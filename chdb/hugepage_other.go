@@ -0,0 +1,25 @@
+// hugepage_other.go -- huge pages are only supported on linux
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package chdb
+
+import (
+	"syscall"
+)
+
+func adviseHugePages(b []byte) {
+}
+
+func allocHugePages(sz int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, sz, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+}
@@ -0,0 +1,146 @@
+// index.go -- positional access to the slots of the lookup table
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The lookup table has Len() slots numbered 0..Len()-1; every key maps to
+// its own slot and the slots without a key are empty. The slot numbers are
+// fixed for the life of the DB file - so they can be used for sampling,
+// pagination or as row IDs of external indexes.
+//
+// ExportIndex() writes the key to slot mapping as follows; all multibyte
+// ints are little-endian:
+//   - magic    [4]byte "CHDI"
+//   - resv     [4]byte
+//   - n        uint64  number of entries that follow
+//   - n entries in slot order of:
+//      * key   uint64  the stored key
+//      * slot  uint64
+
+// KeyAt returns the key in slot 'i' of the lookup table. It returns ErrNoKey
+// if the slot is empty (or masked by a tombstone). The key is the stored key
+// - i.e., after any KeyTransform.
+func (rd *DBReader) KeyAt(i uint64) (_ uint64, err error) {
+	defer catchTableRead(&err)
+
+	if err := rd.checkIndex(i); err != nil {
+		return 0, err
+	}
+	if !rd.live(i) {
+		return 0, ErrNoKey
+	}
+	return rd.keyAt(i), nil
+}
+
+// ValueAt returns the value of the key in slot 'i' of the lookup table; see
+// KeyAt(). The value of a key in a keys-only DB is nil. The value is read
+// from disk (bypassing the record cache) and is freshly allocated.
+func (rd *DBReader) ValueAt(i uint64) (_ []byte, err error) {
+	defer catchTableRead(&err)
+
+	if err := rd.checkIndex(i); err != nil {
+		return nil, err
+	}
+	if !rd.live(i) {
+		return nil, ErrNoKey
+	}
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return nil, nil
+	}
+
+	return rd.readValue(rd.offAt(i), rd.vlenAt(i), i)
+}
+
+// return an error if 'i' isn't a slot of the lookup table
+func (rd *DBReader) checkIndex(i uint64) error {
+	if i >= rd.nkeys {
+		return fmt.Errorf("%s: slot %d out of range; table has %d slots", rd.fn, i, rd.nkeys)
+	}
+	return nil
+}
+
+// IndexOf returns the slot of 'key' in the lookup table and true; or false
+// if the key isn't in the DB. The slot is the minimal perfect hash of the
+// key; it is less than Len(). It returns an error if the lookup table can't
+// be read (see WithWindowedReads).
+func (rd *DBReader) IndexOf(key uint64) (_ uint64, _ bool, err error) {
+	defer catchTableRead(&err)
+
+	key = rd.xkey(key)
+	i := rd.chd.Find(key)
+	if !rd.has(i, key) {
+		return 0, false, nil
+	}
+	return i, true, nil
+}
+
+// EachIndex calls 'fp' for every key in the DB with its slot - in slot
+// order. The keys are the stored keys (i.e., after any KeyTransform). Any
+// error returned by 'fp' stops the iteration and is returned to the caller.
+func (rd *DBReader) EachIndex(fp func(key, i uint64) error) (err error) {
+	defer catchTableRead(&err)
+
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if !rd.live(i) {
+			continue
+		}
+		if err := fp(rd.keyAt(i), i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportIndex writes the slot of every key in the DB to 'w' (see the format
+// above); other systems can then use the slots as row IDs without
+// reimplementing the hash. It returns the number of entries written.
+func (rd *DBReader) ExportIndex(w io.Writer) (uint64, error) {
+	var n uint64
+	err := rd.EachIndex(func(_, _ uint64) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var hdr [16]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'I'})
+	le.PutUint64(hdr[8:], n)
+
+	wr := bufio.NewWriter(w)
+	if _, err := writeAll(wr, hdr[:]); err != nil {
+		return 0, err
+	}
+
+	var b [16]byte
+	err = rd.EachIndex(func(key, i uint64) error {
+		le.PutUint64(b[:8], key)
+		le.PutUint64(b[8:], i)
+		_, err := writeAll(wr, b[:])
+		return err
+	})
+	if err == nil {
+		err = wr.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,261 @@
+// info.go -- DB statistics
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencoff/go-chd"
+)
+
+// DBSizes is the number of bytes used by each section of a DB file
+type DBSizes struct {
+	// fixed size file header
+	Header uint64 `json:"header"`
+
+	// records: checksum and value of every key
+	Records uint64 `json:"records"`
+
+	// build info record
+	Build uint64 `json:"build"`
+
+	// alignment padding between the records (see WithRecordAlign) and
+	// before the offset table
+	Padding uint64 `json:"padding"`
+
+	// offset table: hash key and record offset of every slot
+	Offsets uint64 `json:"offsets"`
+
+	// value length of every slot; zero for keys-only DBs
+	Vlens uint64 `json:"vlens"`
+
+	// the marshaled CHD lookup table
+	Chd uint64 `json:"chd"`
+
+	// metadata checksum trailer
+	Trailer uint64 `json:"trailer"`
+}
+
+// Total returns the size of the DB file
+func (s *DBSizes) Total() uint64 {
+	return s.Header + s.Records + s.Build + s.Padding + s.Offsets + s.Vlens + s.Chd + s.Trailer
+}
+
+// SizeBreakdown returns the number of bytes used by each section of the DB
+// file. This helps understand where the file size goes - e.g., to evaluate
+// compressing values or a larger load factor. It returns an error if the
+// lookup table can't be read (see WithWindowedReads).
+func (rd *DBReader) SizeBreakdown() (_ DBSizes, err error) {
+	defer catchTableRead(&err)
+
+	s := DBSizes{
+		Header:  64,
+		Trailer: 32,
+		Offsets: rd.nkeys * 8,
+	}
+
+	if (rd.flags & _DB_KeysOnly) == 0 {
+		s.Offsets = rd.nkeys * (8 + 8)
+		s.Vlens = rd.nkeys * 4
+
+		// shared records are counted once
+		var seen map[uint64]bool
+		if rd.SharedValues() {
+			seen = make(map[uint64]bool)
+		}
+		for i := uint64(0); i < rd.nkeys; i++ {
+			if !rd.used(i) || rd.vlenAt(i) == 0 {
+				continue
+			}
+			if seen != nil {
+				off := rd.offAt(i)
+				if seen[off] {
+					continue
+				}
+				seen[off] = true
+			}
+			s.Records += 8 + uint64(rd.vlenAt(i))
+		}
+	}
+
+	if rd.binfoOff > 0 {
+		s.Build = 8 + uint64(rd.binfoLen)
+	}
+
+	s.Padding = rd.offtbl - s.Header - s.Records - s.Build
+	s.Chd = rd.metasz - s.Offsets - s.Vlens
+	return s, nil
+}
+
+// MemUsage is the memory used by an open DBReader
+type MemUsage struct {
+	// metadata (offset table, vlens and the CHD table) mmap'd from the
+	// DB file; it lives in the page cache and is reclaimable
+	Mapped uint64 `json:"mapped"`
+
+	// metadata read into anonymous memory (WithoutMmap, WithNUMANode,
+	// WithWindowedReads)
+	Heap uint64 `json:"heap"`
+
+	// the part of the metadata used by the CHD seeds
+	Seeds uint64 `json:"seeds"`
+
+	// values held in the record cache; zero if the cache doesn't report
+	// its size
+	Cache uint64 `json:"cache"`
+
+	// per-slot bookkeeping: the VerifyOnce bitmap, tombstones and heat map
+	// counters
+	Aux uint64 `json:"aux"`
+}
+
+// Total returns the total memory used by the DBReader; Seeds is already
+// accounted for in Mapped or Heap.
+func (m *MemUsage) Total() uint64 {
+	return m.Mapped + m.Heap + m.Cache + m.Aux
+}
+
+// MemUsage returns the memory used by the DB reader. The numbers are
+// point-in-time; the cache usage changes with every lookup.
+func (rd *DBReader) MemUsage() MemUsage {
+	var m MemUsage
+
+	meta := rd.metasz
+	if rd.paged != nil {
+		// only the CHD table and the resident windows are in memory
+		meta = uint64(len(rd.mmap)) + rd.paged.residentBytes()
+	}
+	if rd.anon {
+		m.Heap = meta
+	} else {
+		m.Mapped = meta
+	}
+
+	m.Seeds = uint64(rd.chd.Len()) * uint64(rd.chd.SeedSize())
+	if c, ok := rd.cache.(interface{ Bytes() uint64 }); ok {
+		m.Cache = c.Bytes()
+	}
+
+	m.Aux = uint64(len(rd.verified)+len(rd.dead)) * 8
+	if rd.heat != nil {
+		m.Aux += uint64(len(rd.heat.hits)) * 4
+	}
+	return m
+}
+
+// FileSize returns the size of the DB file in bytes
+func (rd *DBReader) FileSize() uint64 {
+	return rd.size
+}
+
+// DBInfo summarizes a DB without enumerating its keys
+type DBInfo struct {
+	// file name, size and modification time
+	File    string    `json:"file"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"mtime"`
+
+	// header flags
+	Flags    uint32 `json:"flags"`
+	KeysOnly bool   `json:"keys_only"`
+
+	// algorithm of the metadata checksum
+	Checksum string `json:"checksum"`
+
+	// number of keys, size of the lookup table and the resulting load factor
+	Keys  uint64  `json:"keys"`
+	Slots uint64  `json:"slots"`
+	Load  float64 `json:"load"`
+
+	// width of each CHD seed in bytes and the largest seed
+	SeedSize int    `json:"seed_size"`
+	MaxSeed  uint32 `json:"max_seed"`
+
+	// hash salt in hex
+	Salt string `json:"salt"`
+
+	// alignment of the records; 0 if none
+	Align int `json:"align"`
+
+	// ID of the key transform; 0 if none
+	KeyTransform uint32 `json:"key_transform"`
+
+	// build provenance; nil for DBs built without it
+	Build *BuildInfo `json:"build,omitempty"`
+
+	Sizes DBSizes `json:"sizes"`
+}
+
+// Info returns a summary of the DB; unlike DumpMeta(), its cost doesn't
+// depend on the output size - so it's suitable for very large DBs.
+func (rd *DBReader) Info() (_ *DBInfo, err error) {
+	defer catchTableRead(&err)
+
+	fd := rd.fd
+	if fd == nil {
+		return nil, ErrClosed
+	}
+
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cs := rd.chd.Stats()
+	info := &DBInfo{
+		File:         rd.fn,
+		Size:         uint64(st.Size()),
+		ModTime:      st.ModTime(),
+		Flags:        rd.flags,
+		KeysOnly:     (rd.flags & _DB_KeysOnly) > 0,
+		Checksum:     rd.Checksum().String(),
+		Slots:        rd.nkeys,
+		SeedSize:     cs.SeedSize,
+		MaxSeed:      cs.MaxSeed,
+		Salt:         fmt.Sprintf("%x", rd.salt),
+		Align:        rd.RecordAlign(),
+		KeyTransform: rd.KeyTransform(),
+	}
+
+	if info.Sizes, err = rd.SizeBreakdown(); err != nil {
+		return nil, err
+	}
+
+	occ, err := rd.Occupancy()
+	if err != nil {
+		return nil, err
+	}
+	info.Keys = occ.Count()
+	if info.Slots > 0 {
+		info.Load = float64(info.Keys) / float64(info.Slots)
+	}
+
+	if info.Build, err = rd.BuildInfo(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Occupancy returns a bitvector with a bit set for every occupied slot of
+// the DB's lookup table. It returns an error if the lookup table can't be
+// read (see WithWindowedReads).
+func (rd *DBReader) Occupancy() (_ *chd.BitVector, err error) {
+	defer catchTableRead(&err)
+
+	bv := chd.NewBitVector(rd.nkeys)
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.used(i) {
+			bv.Set(i)
+		}
+	}
+	return bv, nil
+}
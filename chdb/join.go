@@ -0,0 +1,93 @@
+// join.go -- join two DBs by key
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+)
+
+// Join calls 'fn' with the values 'va' and 'vb' of every key that is in
+// both 'a' and 'b'. It iterates the smaller DB and probes the larger one with
+// batched lookups (see FindMany()). The keys are visited in the table order
+// of the smaller DB; values of keys-only DBs are nil. The values are only
+// valid until 'fn' returns. Join stops at the first error returned by 'fn' or
+// when a record can't be read; that error is returned to the caller.
+//
+// The keys are joined as stored; so both DBs must have the same key
+// transform (if any).
+func Join(a, b *DBReader, fn func(key uint64, va, vb []byte) error) error {
+	if a.xformID != b.xformID {
+		return fmt.Errorf("chd: can't join %s and %s: key transforms %#x and %#x differ",
+			a.fn, b.fn, a.xformID, b.xformID)
+	}
+
+	small, large := a, b
+	swap := b.Len() < a.Len()
+	if swap {
+		small, large = b, a
+	}
+
+	keysOnly := (large.flags & _DB_KeysOnly) > 0
+
+	keys := make([]uint64, 0, _BatchSize)
+	vals := make([][]byte, 0, _BatchSize)
+
+	flush := func() error {
+		found, err := large.findStored(keys)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range found {
+			if v == nil {
+				continue
+			}
+			if keysOnly {
+				v = nil
+			}
+
+			va, vb := vals[i], v
+			if swap {
+				va, vb = vb, va
+			}
+			if err := fn(keys[i], va, vb); err != nil {
+				return err
+			}
+		}
+
+		keys = keys[:0]
+		vals = vals[:0]
+		return nil
+	}
+
+	err := small.iter(func(key uint64, val []byte) error {
+		// keep empty values non-nil; see Get()
+		var v []byte
+		if val != nil {
+			v = make([]byte, len(val))
+			copy(v, val)
+		}
+		keys = append(keys, key)
+		vals = append(vals, v)
+		if len(keys) == _BatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		return flush()
+	}
+	return nil
+}
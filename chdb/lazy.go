@@ -0,0 +1,165 @@
+// lazy.go -- DB readers that are opened on first use
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"os"
+	"sync"
+)
+
+// LazyDBReader is a DB that is opened - mmap'd and verified - on its first
+// lookup rather than when it is created. Services that open hundreds of DBs
+// at startup but touch few of them boot quickly and only pay for the DBs
+// they use. It is safe for concurrent use; concurrent first lookups wait for
+// a single open.
+//
+// A failed open is not retried: every later lookup returns the same error.
+type LazyDBReader struct {
+	fn    string
+	cache int
+	opts  []ReaderOption
+
+	once sync.Once
+	rd   *DBReader
+	err  error
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewDBReaderLazy prepares the DB in file 'fn' for querying without reading
+// it; see NewDBReader() for 'cache' and 'opts'. Only the existence of 'fn' is
+// checked here; errors from opening the DB are returned by the first lookup
+// (or by Reader()).
+func NewDBReaderLazy(fn string, cache int, opts ...ReaderOption) (*LazyDBReader, error) {
+	if _, err := os.Stat(fn); err != nil {
+		return nil, err
+	}
+
+	l := &LazyDBReader{
+		fn:    fn,
+		cache: cache,
+		opts:  opts,
+	}
+	return l, nil
+}
+
+// Reader opens the DB if it isn't open yet and returns it
+func (l *LazyDBReader) Reader() (*DBReader, error) {
+	l.once.Do(func() {
+		rd, err := NewDBReader(l.fn, l.cache, l.opts...)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		switch {
+		case err != nil:
+			l.err = err
+		case l.closed:
+			rd.Close()
+			l.err = ErrClosed
+		default:
+			l.rd = rd
+		}
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil, ErrClosed
+	}
+	return l.rd, l.err
+}
+
+// Opened returns true if the DB has been opened successfully
+func (l *LazyDBReader) Opened() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rd != nil && !l.closed
+}
+
+// Name returns the file name of the DB
+func (l *LazyDBReader) Name() string {
+	return l.fn
+}
+
+// Len opens the DB and returns the size of its lookup table; 0 if the DB
+// can't be opened.
+func (l *LazyDBReader) Len() int {
+	rd, err := l.Reader()
+	if err != nil {
+		return 0
+	}
+	return rd.Len()
+}
+
+// Find opens the DB and looks up 'key'; see DBReader.Find().
+func (l *LazyDBReader) Find(key uint64) ([]byte, error) {
+	rd, err := l.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return rd.Find(key)
+}
+
+// FindInto opens the DB and looks up 'key'; see DBReader.FindInto().
+func (l *LazyDBReader) FindInto(key uint64, buf []byte) ([]byte, error) {
+	rd, err := l.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return rd.FindInto(key, buf)
+}
+
+// FindMany opens the DB and looks up all 'keys'; see DBReader.FindMany().
+func (l *LazyDBReader) FindMany(keys []uint64) ([][]byte, error) {
+	rd, err := l.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return rd.FindMany(keys)
+}
+
+// Lookup opens the DB and looks up 'key'; see DBReader.Lookup(). It returns
+// false if the DB can't be opened.
+func (l *LazyDBReader) Lookup(key uint64) ([]byte, bool) {
+	rd, err := l.Reader()
+	if err != nil {
+		return nil, false
+	}
+	return rd.Lookup(key)
+}
+
+// Get opens the DB and looks up 'key'; see DBReader.Get(). Errors from
+// opening the DB are returned too.
+func (l *LazyDBReader) Get(key uint64) ([]byte, bool, error) {
+	rd, err := l.Reader()
+	if err != nil {
+		return nil, false, err
+	}
+	return rd.Get(key)
+}
+
+// Close closes the DB if it was opened; later lookups return ErrClosed.
+func (l *LazyDBReader) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.rd != nil {
+		l.rd.Close()
+		l.rd = nil
+	}
+}
@@ -0,0 +1,95 @@
+// limits.go -- guardrails on the size of the DB being built
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+
+	"github.com/opencoff/go-chd"
+)
+
+// largest slice length on this platform
+const _MaxInt = int(^uint(0) >> 1)
+
+// WithMaxKeys makes the DBWriter accept at most 'n' keys: adding more fails
+// with ErrTooManyKeys. The writer stays usable; it can be frozen with the
+// keys it has.
+func WithMaxKeys(n uint64) WriterOption {
+	return func(o *writerOpts) {
+		o.maxKeys = n
+	}
+}
+
+// WithMaxFileSize caps the size of the DB file at 'n' bytes. Adding a
+// record that grows the file past 'n' fails with ErrFileTooLarge (the writer
+// stays usable); and Freeze() fails with ErrFileTooLarge as soon as the
+// size of the tables is known - before they are written.
+func WithMaxFileSize(n uint64) WriterOption {
+	return func(o *writerOpts) {
+		o.maxSize = n
+	}
+}
+
+// return an error if the writer can't take another key
+func (w *DBWriter) checkKeys() error {
+	if max := w.opt.maxKeys; max > 0 && uint64(len(w.keymap)) >= max {
+		return fmt.Errorf("chd: %s: %w: limit is %d", w.fn, ErrTooManyKeys, max)
+	}
+	return nil
+}
+
+// return an error if a record with a value of 'vlen' bytes grows the file
+// past the size limit
+func (w *DBWriter) checkRecordSize(vlen int) error {
+	if max := w.opt.maxSize; max > 0 {
+		if end := w.off + 8 + uint64(vlen); end > max {
+			return fmt.Errorf("chd: %s: %w: record ends at %d; limit is %d", w.fn, ErrFileTooLarge, end, max)
+		}
+	}
+	return nil
+}
+
+// verify that the tables for 'c' fit the layout of the DB and the limits of
+// the writer; the offset table starts at 'offtbl'.
+func (w *DBWriter) checkLayout(c *chd.Chd, offtbl uint64) error {
+	nslots := uint64(c.Len())
+	if nkeys := uint64(len(w.keymap)); nslots < nkeys {
+		return fmt.Errorf("chd: %s: hash table has %d slots for %d keys", w.fn, nslots, nkeys)
+	}
+
+	// the tables are built in memory: the offset table has two words
+	// per slot (one if there are no values) and the vlen table one
+	// uint32 per slot.
+	esz := uint64(8)
+	if w.values {
+		esz = 8 + 8 + 4
+	}
+	if nslots > uint64(_MaxInt/2) {
+		return fmt.Errorf("chd: %s: %w: %d slots don't fit in memory", w.fn, ErrTooManyKeys, nslots)
+	}
+
+	// the tables are followed by the hash table and 32 bytes of trailer
+	if max := w.opt.maxSize; max > 0 {
+		if offtbl+32 > max || nslots > (max-offtbl-32)/esz {
+			return fmt.Errorf("chd: %s: %w: tables of %d slots at off %d; limit is %d",
+				w.fn, ErrFileTooLarge, nslots, offtbl, max)
+		}
+	}
+	return nil
+}
+
+// return an error if the DB of 'sz' bytes breaks the size limit
+func (w *DBWriter) checkSize(sz uint64) error {
+	if max := w.opt.maxSize; max > 0 && sz > max {
+		return fmt.Errorf("chd: %s: %w: DB is %d bytes; limit is %d", w.fn, ErrFileTooLarge, sz, max)
+	}
+	return nil
+}
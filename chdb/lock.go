@@ -0,0 +1,88 @@
+// lock.go -- advisory file locks for coordinating writers and readers
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// try to take a non-blocking flock(2) on 'fd'; 'how' is one of
+// syscall.LOCK_SH or syscall.LOCK_EX.
+func flock(fd *os.File, how int) error {
+	err := syscall.Flock(int(fd.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	if err != nil {
+		return fmt.Errorf("%s: can't lock: %s", fd.Name(), err)
+	}
+	return nil
+}
+
+// lock the target DB 'fn' for exclusive writing. We can't lock the target
+// itself - it doesn't exist until the writer is frozen. So, we lock a
+// companion file that is removed when the lock is released. If we raced
+// with a writer removing its lock file, we retry with a fresh one.
+func lockWriter(fn string) (*os.File, error) {
+	lf := fn + ".lock"
+	for {
+		fd, err := os.OpenFile(lf, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := flock(fd, syscall.LOCK_EX); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+
+		st, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+
+		// make sure we locked the file that's still in the filesystem
+		if cur, err := os.Stat(lf); err == nil && os.SameFile(st, cur) {
+			return fd, nil
+		}
+		fd.Close()
+	}
+}
+
+// release the writer lock obtained via lockWriter()
+func unlockWriter(fd *os.File) {
+	os.Remove(fd.Name())
+	fd.Close()
+}
+
+// InUse returns true if the DB in file 'fn' is opened by a DBReader holding
+// a shared lock (see WithSharedLock()).
+func InUse(fn string) (bool, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+
+	defer fd.Close()
+
+	err = flock(fd, syscall.LOCK_EX)
+	switch err {
+	case nil:
+		return false, nil
+	case ErrLocked:
+		return true, nil
+	default:
+		return false, err
+	}
+}
@@ -0,0 +1,47 @@
+// log.go -- optional logging of writer and reader lifecycle events
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// Logger receives the lifecycle events of DB writers and readers: build
+// phases, MPH construction retries, metadata mapping, verification and
+// checksum failures, opens and closes. The library is otherwise silent.
+// A *log.Logger satisfies this interface; so does a thin adapter over any
+// structured logger. Printf must be safe for concurrent use.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithLogger makes the DBReader log its lifecycle events to 'l'
+func WithLogger(l Logger) ReaderOption {
+	return func(o *readerOpts) {
+		o.log = l
+	}
+}
+
+// WithWriterLogger makes the DBWriter log the phases of the build to 'l'
+func WithWriterLogger(l Logger) WriterOption {
+	return func(o *writerOpts) {
+		o.log = l
+	}
+}
+
+// the default logger discards everything
+type nopLogger struct{}
+
+func (nopLogger) Printf(string, ...interface{}) {}
+
+// return 'l' or the default logger if it is nil
+func logger(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
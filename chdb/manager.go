@@ -0,0 +1,261 @@
+// manager.go -- open many DBs on demand
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// Manager opens DBs on demand and keeps at most a fixed number of them open;
+// the least recently used DB is closed to make room for a new one. This is
+// for applications with thousands of DB files (e.g., shards) that can't all
+// be open - mmap'd with a file descriptor - at the same time. DBs are keyed
+// by their (cleaned) path. It is safe for concurrent use.
+//
+// Lookups pin the DB with a Snapshot; so a DB that is closed to make room
+// stays usable until the lookups in progress are done. Callers that hold
+// snapshots from Acquire() can thus briefly keep more than the maximum
+// number of DBs mapped.
+type Manager struct {
+	mu sync.Mutex
+
+	// default options and per-DB overrides
+	cache int
+	opts  []ReaderOption
+	over  map[string][]ReaderOption
+
+	// open DBs; head.next is the most recently used
+	dbs  map[string]*mgrEntry
+	head mgrEntry
+	max  int
+
+	closed bool
+}
+
+type mgrEntry struct {
+	fn         string
+	prev, next *mgrEntry
+
+	// closed once the DB is opened; 'rd' and 'err' are valid after that
+	ready chan struct{}
+	rd    *DBReader
+	err   error
+}
+
+// NewManager returns a manager that keeps up to 'max' DBs open (at least 1).
+// DBs are opened with NewDBReader(fn, cache, opts...); SetOptions() adds
+// options for individual DBs.
+func NewManager(max int, cache int, opts ...ReaderOption) *Manager {
+	if max <= 0 {
+		max = 1
+	}
+
+	m := &Manager{
+		cache: cache,
+		opts:  opts,
+		over:  make(map[string][]ReaderOption),
+		dbs:   make(map[string]*mgrEntry),
+		max:   max,
+	}
+	m.head.next = &m.head
+	m.head.prev = &m.head
+	return m
+}
+
+// SetOptions sets the options of the DB in file 'fn'; they are applied after
+// the default options of the manager the next time the DB is opened.
+func (m *Manager) SetOptions(fn string, opts ...ReaderOption) {
+	m.mu.Lock()
+	m.over[filepath.Clean(fn)] = opts
+	m.mu.Unlock()
+}
+
+// Acquire opens the DB in file 'fn' (if it isn't open) and returns a
+// snapshot of it. Callers must Close() the snapshot when done; the DB stays
+// mapped until then even if the manager closes it.
+func (m *Manager) Acquire(fn string) (*Snapshot, error) {
+	fn = filepath.Clean(fn)
+	for {
+		e, err := m.get(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := e.rd.Snapshot()
+		if err != ErrClosed {
+			return s, err
+		}
+
+		// the DB was closed to make room before we could pin it; retry
+	}
+}
+
+// Find looks up 'key' in the DB in file 'fn'; see DBReader.Find().
+func (m *Manager) Find(fn string, key uint64) ([]byte, error) {
+	s, err := m.Acquire(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.Close()
+	return s.Find(key)
+}
+
+// Lookup looks up 'key' in the DB in file 'fn'; see DBReader.Lookup(). It
+// returns false if the DB can't be opened.
+func (m *Manager) Lookup(fn string, key uint64) ([]byte, bool) {
+	s, err := m.Acquire(fn)
+	if err != nil {
+		return nil, false
+	}
+
+	defer s.Close()
+	return s.Lookup(key)
+}
+
+// Get looks up 'key' in the DB in file 'fn'; see DBReader.Get(). Errors from
+// opening the DB are returned too.
+func (m *Manager) Get(fn string, key uint64) ([]byte, bool, error) {
+	s, err := m.Acquire(fn)
+	if err != nil {
+		return nil, false, err
+	}
+
+	defer s.Close()
+	return s.Get(key)
+}
+
+// Len returns the number of open DBs
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.dbs)
+}
+
+// Evict closes the DB in file 'fn' if it is open; e.g., before the file is
+// replaced.
+func (m *Manager) Evict(fn string) {
+	fn = filepath.Clean(fn)
+
+	m.mu.Lock()
+	e, ok := m.dbs[fn]
+	if ok {
+		m.remove(e)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		e.close()
+	}
+}
+
+// Close closes all the open DBs; later lookups return ErrClosed.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+
+	var all []*mgrEntry
+	for _, e := range m.dbs {
+		all = append(all, e)
+		m.remove(e)
+	}
+	m.mu.Unlock()
+
+	for _, e := range all {
+		e.close()
+	}
+}
+
+// return the entry of the open DB 'fn'; open it if needed
+func (m *Manager) get(fn string) (*mgrEntry, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	if e, ok := m.dbs[fn]; ok {
+		m.unlink(e)
+		m.pushFront(e)
+		m.mu.Unlock()
+
+		<-e.ready
+		return e, e.err
+	}
+
+	e := &mgrEntry{
+		fn:    fn,
+		ready: make(chan struct{}),
+	}
+	m.dbs[fn] = e
+	m.pushFront(e)
+
+	victims := m.evict()
+	opts := append(m.opts[:len(m.opts):len(m.opts)], m.over[fn]...)
+	m.mu.Unlock()
+
+	for _, v := range victims {
+		v.close()
+	}
+
+	// open outside the lock; others asking for this DB wait on 'ready'
+	e.rd, e.err = NewDBReader(fn, m.cache, opts...)
+	if e.err != nil {
+		m.mu.Lock()
+		if m.dbs[fn] == e {
+			m.remove(e)
+		}
+		m.mu.Unlock()
+	}
+	close(e.ready)
+	return e, e.err
+}
+
+// unlink the least recently used DBs beyond the limit and return them
+func (m *Manager) evict() []*mgrEntry {
+	var victims []*mgrEntry
+
+	for e := m.head.prev; len(m.dbs) > m.max && e != &m.head; {
+		prev := e.prev
+		m.remove(e)
+		victims = append(victims, e)
+		e = prev
+	}
+	return victims
+}
+
+// remove 'e' from the map and the LRU list
+func (m *Manager) remove(e *mgrEntry) {
+	delete(m.dbs, e.fn)
+	m.unlink(e)
+}
+
+func (m *Manager) unlink(e *mgrEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+}
+
+func (m *Manager) pushFront(e *mgrEntry) {
+	e.next = m.head.next
+	e.prev = &m.head
+	m.head.next.prev = e
+	m.head.next = e
+}
+
+// close the DB of an entry that is no longer in the manager; it waits for
+// an open in progress to finish.
+func (e *mgrEntry) close() {
+	<-e.ready
+	if e.rd != nil {
+		e.rd.Close()
+	}
+}
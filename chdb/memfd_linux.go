@@ -0,0 +1,65 @@
+// memfd_linux.go -- anonymous memory backed files on linux
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package chdb
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// memfd_create(2) predates the unified syscall numbers; and package syscall
+// doesn't know it on most platforms.
+var _SYS_MEMFD_CREATE = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+const _MFD_CLOEXEC = 0x1
+
+// return a file in anonymous memory; 'name' is only a label (see
+// /proc/self/fd). It fails with ENOSYS if memfd_create(2) is unavailable.
+func memfdCreate(name string) (*os.File, error) {
+	nr, ok := _SYS_MEMFD_CREATE[runtime.GOARCH]
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+
+	// the kernel limits the label to 249 bytes
+	if len(name) > 200 {
+		name = name[len(name)-200:]
+	}
+
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, _, e := syscall.Syscall(nr, uintptr(unsafe.Pointer(p)), _MFD_CLOEXEC, 0)
+	if e != 0 {
+		return nil, e
+	}
+	return os.NewFile(fd, "memfd:"+name), nil
+}
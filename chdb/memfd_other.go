@@ -0,0 +1,23 @@
+// memfd_other.go -- memfd_create(2) is only supported on linux
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package chdb
+
+import (
+	"os"
+	"syscall"
+)
+
+func memfdCreate(name string) (*os.File, error) {
+	return nil, syscall.ENOSYS
+}
@@ -0,0 +1,745 @@
+// msgpack.go -- minimal MessagePack encoding of Go values
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// This is a small, reflection based implementation of the MessagePack
+// format (https://msgpack.org). It handles the types one would store in a
+// DB: booleans, numbers, strings, byte slices, slices, arrays, maps,
+// pointers and structs. Structs are encoded as maps keyed by field name;
+// the name can be changed with a `msgpack:"name"` tag and a field is
+// skipped with `msgpack:"-"`. Extension types are not supported.
+
+const (
+	_mpNil     = 0xc0
+	_mpFalse   = 0xc2
+	_mpTrue    = 0xc3
+	_mpBin8    = 0xc4
+	_mpBin16   = 0xc5
+	_mpBin32   = 0xc6
+	_mpFloat32 = 0xca
+	_mpFloat64 = 0xcb
+	_mpUint8   = 0xcc
+	_mpUint16  = 0xcd
+	_mpUint32  = 0xce
+	_mpUint64  = 0xcf
+	_mpInt8    = 0xd0
+	_mpInt16   = 0xd1
+	_mpInt32   = 0xd2
+	_mpInt64   = 0xd3
+	_mpStr8    = 0xd9
+	_mpStr16   = 0xda
+	_mpStr32   = 0xdb
+	_mpArray16 = 0xdc
+	_mpArray32 = 0xdd
+	_mpMap16   = 0xde
+	_mpMap32   = 0xdf
+)
+
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	return mpEncode(nil, reflect.ValueOf(v))
+}
+
+func msgpackUnmarshal(b []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: unmarshal needs a non-nil pointer, not %T", v)
+	}
+
+	d := &mpDecoder{b: b}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.i != len(d.b) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.b)-d.i)
+	}
+	return nil
+}
+
+func mpEncode(b []byte, v reflect.Value) ([]byte, error) {
+	be := binary.BigEndian
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(b, _mpNil), nil
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(b, _mpNil), nil
+		}
+		return mpEncode(b, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, _mpTrue), nil
+		}
+		return append(b, _mpFalse), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return mpInt(b, v.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return mpUint(b, v.Uint()), nil
+
+	case reflect.Float32:
+		b = append(b, _mpFloat32, 0, 0, 0, 0)
+		be.PutUint32(b[len(b)-4:], math.Float32bits(float32(v.Float())))
+		return b, nil
+
+	case reflect.Float64:
+		b = append(b, _mpFloat64, 0, 0, 0, 0, 0, 0, 0, 0)
+		be.PutUint64(b[len(b)-8:], math.Float64bits(v.Float()))
+		return b, nil
+
+	case reflect.String:
+		s := v.String()
+		b = mpHeader(b, len(s), 0xa0, 32, _mpStr8, _mpStr16, _mpStr32)
+		return append(b, s...), nil
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, _mpNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			bs := v.Bytes()
+			b = mpHeader(b, len(bs), 0, 0, _mpBin8, _mpBin16, _mpBin32)
+			return append(b, bs...), nil
+		}
+		return mpArray(b, v)
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = mpHeader(b, v.Len(), 0, 0, _mpBin8, _mpBin16, _mpBin32)
+			for i := 0; i < v.Len(); i++ {
+				b = append(b, byte(v.Index(i).Uint()))
+			}
+			return b, nil
+		}
+		return mpArray(b, v)
+
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, _mpNil), nil
+		}
+		return mpMap(b, v)
+
+	case reflect.Struct:
+		fields := mpFields(v.Type())
+		b = mpHeader(b, len(fields), 0x80, 16, 0, _mpMap16, _mpMap32)
+		for _, f := range fields {
+			var err error
+
+			b = mpHeader(b, len(f.name), 0xa0, 32, _mpStr8, _mpStr16, _mpStr32)
+			b = append(b, f.name...)
+			if b, err = mpEncode(b, v.Field(f.index)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: can't encode %s", v.Type())
+}
+
+func mpArray(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+
+	n := v.Len()
+	b = mpHeader(b, n, 0x90, 16, 0, _mpArray16, _mpArray32)
+	for i := 0; i < n; i++ {
+		if b, err = mpEncode(b, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// maps are encoded with their keys in sorted (encoded) order so that the
+// same map always encodes to the same bytes.
+func mpMap(b []byte, v reflect.Value) ([]byte, error) {
+	type pair struct {
+		k, v []byte
+	}
+
+	pairs := make([]pair, 0, v.Len())
+	it := v.MapRange()
+	for it.Next() {
+		k, err := mpEncode(nil, it.Key())
+		if err != nil {
+			return nil, err
+		}
+		e, err := mpEncode(nil, it.Value())
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair{k, e})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].k, pairs[j].k) < 0
+	})
+
+	b = mpHeader(b, len(pairs), 0x80, 16, 0, _mpMap16, _mpMap32)
+	for _, p := range pairs {
+		b = append(b, p.k...)
+		b = append(b, p.v...)
+	}
+	return b, nil
+}
+
+// append the header for an object of 'n' elements. Objects smaller than
+// 'fixmax' use the fix format 'fix'; a zero 'op8' means there is no 8-bit
+// length variant.
+func mpHeader(b []byte, n int, fix byte, fixmax int, op8, op16, op32 byte) []byte {
+	switch {
+	case n < fixmax:
+		return append(b, fix|byte(n))
+	case op8 != 0 && n <= math.MaxUint8:
+		return append(b, op8, byte(n))
+	case n <= math.MaxUint16:
+		return append(b, op16, byte(n>>8), byte(n))
+	default:
+		return append(b, op32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func mpInt(b []byte, i int64) []byte {
+	if i >= 0 {
+		return mpUint(b, uint64(i))
+	}
+
+	switch {
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, _mpInt8, byte(i))
+	case i >= math.MinInt16:
+		return append(b, _mpInt16, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		return append(b, _mpInt32, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	default:
+		b = append(b, _mpInt64, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(i))
+		return b
+	}
+}
+
+func mpUint(b []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, _mpUint8, byte(u))
+	case u <= math.MaxUint16:
+		return append(b, _mpUint16, byte(u>>8), byte(u))
+	case u <= math.MaxUint32:
+		return append(b, _mpUint32, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+	default:
+		b = append(b, _mpUint64, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], u)
+		return b
+	}
+}
+
+type mpField struct {
+	name  string
+	index int
+}
+
+// exported fields of struct type 't' and their encoded names
+func mpFields(t reflect.Type) []mpField {
+	var fields []mpField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		if tag := f.Tag.Get("msgpack"); tag != "" {
+			if j := strings.IndexByte(tag, ','); j >= 0 {
+				tag = tag[:j]
+			}
+			if tag == "-" {
+				continue
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		fields = append(fields, mpField{name, i})
+	}
+	return fields
+}
+
+type mpDecoder struct {
+	b []byte
+	i int
+}
+
+var errMsgpackShort = fmt.Errorf("msgpack: truncated input")
+
+func (d *mpDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.b)-d.i < n {
+		return nil, errMsgpackShort
+	}
+	b := d.b[d.i : d.i+n]
+	d.i += n
+	return b, nil
+}
+
+func (d *mpDecoder) peek() (byte, error) {
+	if d.i >= len(d.b) {
+		return 0, errMsgpackShort
+	}
+	return d.b[d.i], nil
+}
+
+// read an unsigned big-endian int of 'n' bytes
+func (d *mpDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// read a length of 'n' bytes and make sure at least that many bytes
+// (times 'min' per element) remain.
+func (d *mpDecoder) length(n, min int) (int, error) {
+	u, err := d.uint(n)
+	if err != nil {
+		return 0, err
+	}
+	if u > uint64(len(d.b)-d.i)/uint64(min) {
+		return 0, errMsgpackShort
+	}
+	return int(u), nil
+}
+
+// the kinds of objects in the encoding
+const (
+	_mpkNil = iota
+	_mpkBool
+	_mpkInt
+	_mpkUint
+	_mpkFloat
+	_mpkStr
+	_mpkBin
+	_mpkArray
+	_mpkMap
+)
+
+// a decoded scalar or the header of a compound object
+type mpObj struct {
+	kind int
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	s    []byte // str, bin
+	n    int    // array, map
+}
+
+func (d *mpDecoder) obj() (mpObj, error) {
+	var o mpObj
+
+	c, err := d.next(1)
+	if err != nil {
+		return o, err
+	}
+
+	op := c[0]
+	switch {
+	case op < 0x80:
+		o.kind, o.u = _mpkUint, uint64(op)
+		return o, nil
+	case op >= 0xe0:
+		o.kind, o.i = _mpkInt, int64(int8(op))
+		return o, nil
+	case op&0xf0 == 0x80:
+		o.kind = _mpkMap
+		o.n, err = d.check(int(op&0x0f), 2)
+		return o, err
+	case op&0xf0 == 0x90:
+		o.kind = _mpkArray
+		o.n, err = d.check(int(op&0x0f), 1)
+		return o, err
+	case op&0xe0 == 0xa0:
+		o.kind = _mpkStr
+		o.s, err = d.next(int(op & 0x1f))
+		return o, err
+	}
+
+	var n int
+	switch op {
+	case _mpNil:
+		o.kind = _mpkNil
+	case _mpFalse, _mpTrue:
+		o.kind, o.b = _mpkBool, op == _mpTrue
+	case _mpUint8, _mpUint16, _mpUint32, _mpUint64:
+		o.kind = _mpkUint
+		o.u, err = d.uint(1 << (op - _mpUint8))
+	case _mpInt8, _mpInt16, _mpInt32, _mpInt64:
+		var u uint64
+
+		o.kind = _mpkInt
+		w := 1 << (op - _mpInt8)
+		u, err = d.uint(w)
+		o.i = int64(u<<(64-8*w)) >> (64 - 8*w)
+	case _mpFloat32:
+		var u uint64
+
+		o.kind = _mpkFloat
+		u, err = d.uint(4)
+		o.f = float64(math.Float32frombits(uint32(u)))
+	case _mpFloat64:
+		var u uint64
+
+		o.kind = _mpkFloat
+		u, err = d.uint(8)
+		o.f = math.Float64frombits(u)
+	case _mpStr8, _mpStr16, _mpStr32:
+		o.kind = _mpkStr
+		if n, err = d.length(1<<(op-_mpStr8), 1); err == nil {
+			o.s, err = d.next(n)
+		}
+	case _mpBin8, _mpBin16, _mpBin32:
+		o.kind = _mpkBin
+		if n, err = d.length(1<<(op-_mpBin8), 1); err == nil {
+			o.s, err = d.next(n)
+		}
+	case _mpArray16, _mpArray32:
+		o.kind = _mpkArray
+		o.n, err = d.length(2<<(op-_mpArray16), 1)
+	case _mpMap16, _mpMap32:
+		o.kind = _mpkMap
+		o.n, err = d.length(2<<(op-_mpMap16), 2)
+	default:
+		err = fmt.Errorf("msgpack: unsupported type %#x", op)
+	}
+	return o, err
+}
+
+// make sure 'n' elements of at least 'min' bytes each remain
+func (d *mpDecoder) check(n, min int) (int, error) {
+	if n*min > len(d.b)-d.i {
+		return 0, errMsgpackShort
+	}
+	return n, nil
+}
+
+func (d *mpDecoder) decode(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	if c == _mpNil {
+		d.i++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: can't decode into %s", v.Type())
+		}
+		x, err := d.any()
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	}
+
+	o, err := d.obj()
+	if err != nil {
+		return err
+	}
+
+	mismatch := func() error {
+		return fmt.Errorf("msgpack: can't decode %s into %s", mpKindNames[o.kind], v.Type())
+	}
+
+	switch o.kind {
+	case _mpkBool:
+		if v.Kind() != reflect.Bool {
+			return mismatch()
+		}
+		v.SetBool(o.b)
+
+	case _mpkInt, _mpkUint, _mpkFloat:
+		return mpSetNumber(v, &o, mismatch)
+
+	case _mpkStr, _mpkBin:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(o.s))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), o.s...))
+		case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+			if len(o.s) != v.Len() {
+				return fmt.Errorf("msgpack: can't decode %d bytes into %s", len(o.s), v.Type())
+			}
+			reflect.Copy(v, reflect.ValueOf(o.s))
+		default:
+			return mismatch()
+		}
+
+	case _mpkArray:
+		switch v.Kind() {
+		case reflect.Slice:
+			v.Set(reflect.MakeSlice(v.Type(), o.n, o.n))
+		case reflect.Array:
+			if o.n != v.Len() {
+				return fmt.Errorf("msgpack: can't decode %d elements into %s", o.n, v.Type())
+			}
+		default:
+			return mismatch()
+		}
+		for i := 0; i < o.n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case _mpkMap:
+		switch v.Kind() {
+		case reflect.Map:
+			return d.decodeMap(v, o.n)
+		case reflect.Struct:
+			return d.decodeStruct(v, o.n)
+		default:
+			return mismatch()
+		}
+	}
+	return nil
+}
+
+func (d *mpDecoder) decodeMap(v reflect.Value, n int) error {
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, n))
+	}
+
+	for i := 0; i < n; i++ {
+		k := reflect.New(t.Key()).Elem()
+		if err := d.decode(k); err != nil {
+			return err
+		}
+		e := reflect.New(t.Elem()).Elem()
+		if err := d.decode(e); err != nil {
+			return err
+		}
+		v.SetMapIndex(k, e)
+	}
+	return nil
+}
+
+// fields are matched by name; unknown fields are skipped
+func (d *mpDecoder) decodeStruct(v reflect.Value, n int) error {
+	fields := mpFields(v.Type())
+	for i := 0; i < n; i++ {
+		var name string
+
+		if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+			return err
+		}
+
+		f := -1
+		for _, x := range fields {
+			if x.name == name {
+				f = x.index
+				break
+			}
+		}
+
+		if f < 0 {
+			if _, err := d.any(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.Field(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode the next object into a generic value: nil, bool, int64, uint64
+// (only if it doesn't fit an int64), float64, string, []byte,
+// []interface{} or map[string]interface{} (map[interface{}]interface{} if
+// any key isn't a string).
+func (d *mpDecoder) any() (interface{}, error) {
+	o, err := d.obj()
+	if err != nil {
+		return nil, err
+	}
+
+	switch o.kind {
+	case _mpkNil:
+		return nil, nil
+	case _mpkBool:
+		return o.b, nil
+	case _mpkInt:
+		return o.i, nil
+	case _mpkUint:
+		if o.u > math.MaxInt64 {
+			return o.u, nil
+		}
+		return int64(o.u), nil
+	case _mpkFloat:
+		return o.f, nil
+	case _mpkStr:
+		return string(o.s), nil
+	case _mpkBin:
+		return append([]byte(nil), o.s...), nil
+
+	case _mpkArray:
+		a := make([]interface{}, o.n)
+		for i := range a {
+			if a[i], err = d.any(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+
+	// map
+	keys := make([]interface{}, o.n)
+	vals := make([]interface{}, o.n)
+	strKeys := true
+	for i := 0; i < o.n; i++ {
+		if keys[i], err = d.any(); err != nil {
+			return nil, err
+		}
+		if vals[i], err = d.any(); err != nil {
+			return nil, err
+		}
+		if _, ok := keys[i].(string); !ok {
+			strKeys = false
+		}
+	}
+
+	if strKeys {
+		m := make(map[string]interface{}, o.n)
+		for i := range keys {
+			m[keys[i].(string)] = vals[i]
+		}
+		return m, nil
+	}
+
+	m := make(map[interface{}]interface{}, o.n)
+	for i, k := range keys {
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("msgpack: unhashable map key of type %T", k)
+		}
+		m[k] = vals[i]
+	}
+	return m, nil
+}
+
+// store the number in 'o' in 'v' - checking for overflow
+func mpSetNumber(v reflect.Value, o *mpObj, mismatch func() error) error {
+	overflow := func() error {
+		return fmt.Errorf("msgpack: number overflows %s", v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch o.kind {
+		case _mpkInt:
+			i = o.i
+		case _mpkUint:
+			if o.u > math.MaxInt64 {
+				return overflow()
+			}
+			i = int64(o.u)
+		default:
+			return mismatch()
+		}
+		if v.OverflowInt(i) {
+			return overflow()
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch o.kind {
+		case _mpkUint:
+			u = o.u
+		case _mpkInt:
+			if o.i < 0 {
+				return overflow()
+			}
+			u = uint64(o.i)
+		default:
+			return mismatch()
+		}
+		if v.OverflowUint(u) {
+			return overflow()
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		switch o.kind {
+		case _mpkFloat:
+			v.SetFloat(o.f)
+		case _mpkInt:
+			v.SetFloat(float64(o.i))
+		default:
+			v.SetFloat(float64(o.u))
+		}
+
+	default:
+		return mismatch()
+	}
+	return nil
+}
+
+var mpKindNames = [...]string{
+	_mpkNil:   "nil",
+	_mpkBool:  "bool",
+	_mpkInt:   "int",
+	_mpkUint:  "uint",
+	_mpkFloat: "float",
+	_mpkStr:   "string",
+	_mpkBin:   "binary",
+	_mpkArray: "array",
+	_mpkMap:   "map",
+}
@@ -0,0 +1,103 @@
+// msgpack_test.go -- test suite for the msgpack codec
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMsgpackEncoding(t *testing.T) {
+	assert := newAsserter(t)
+
+	// encodings from the msgpack spec
+	tests := []struct {
+		v   interface{}
+		exp []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{false, []byte{0xc2}},
+		{5, []byte{0x05}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{200, []byte{0xcc, 0xc8}},
+		{1 << 16, []byte{0xce, 0, 1, 0, 0}},
+		{int64(math.MinInt64), []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{uint64(math.MaxUint64), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{[]byte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{[]int{1, 2}, []byte{0x92, 1, 2}},
+		{map[string]int{"b": 2, "a": 1}, []byte{0x82, 0xa1, 'a', 1, 0xa1, 'b', 2}},
+		{struct {
+			A int `msgpack:"x"`
+			B int `msgpack:"-"`
+		}{1, 2}, []byte{0x81, 0xa1, 'x', 1}},
+	}
+
+	for _, tc := range tests {
+		b, err := msgpackMarshal(tc.v)
+		assert(err == nil, "%v: marshal failed: %s", tc.v, err)
+		assert(bytes.Equal(b, tc.exp), "%v: exp %x, saw %x", tc.v, tc.exp, b)
+	}
+
+	long := string(bytes.Repeat([]byte{'z'}, 70000))
+	b, err := msgpackMarshal(long)
+	assert(err == nil, "marshal failed: %s", err)
+	assert(b[0] == 0xdb && len(b) == len(long)+5, "bad str32 header %x", b[:5])
+
+	var s string
+	err = msgpackUnmarshal(b, &s)
+	assert(err == nil && s == long, "str32 roundtrip failed: %s", err)
+}
+
+func TestMsgpackDecoding(t *testing.T) {
+	assert := newAsserter(t)
+
+	in := map[string]interface{}{
+		"n":   int64(-5),
+		"u":   uint64(math.MaxUint64),
+		"f":   2.25,
+		"s":   "hello",
+		"b":   []byte{9, 8},
+		"a":   []interface{}{true, nil, "x"},
+		"m":   map[string]interface{}{"k": int64(1)},
+		"nil": nil,
+	}
+
+	b, err := msgpackMarshal(in)
+	assert(err == nil, "marshal failed: %s", err)
+
+	var out interface{}
+	err = msgpackUnmarshal(b, &out)
+	assert(err == nil, "unmarshal failed: %s", err)
+	assert(reflect.DeepEqual(out, in), "exp %v, saw %v", in, out)
+
+	// type mismatch and overflow
+	var i8 int8
+	b, _ = msgpackMarshal(300)
+	assert(msgpackUnmarshal(b, &i8) != nil, "overflow not detected")
+
+	var str string
+	assert(msgpackUnmarshal(b, &str) != nil, "type mismatch not detected")
+
+	// truncated input must not panic
+	b, _ = msgpackMarshal(in)
+	for i := 0; i < len(b); i++ {
+		var x interface{}
+		assert(msgpackUnmarshal(b[:i], &x) != nil, "truncated input %d accepted", i)
+	}
+
+	assert(msgpackUnmarshal(b, out) != nil, "non-pointer accepted")
+}
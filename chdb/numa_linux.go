@@ -0,0 +1,160 @@
+// numa_linux.go -- NUMA topology and thread placement on Linux
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+// +build linux
+
+package chdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const _SysNodeDir = "/sys/devices/system/node"
+
+// getcpu(2) isn't in package syscall; its number varies by architecture.
+var sysGetcpu = map[string]uintptr{
+	"386":     318,
+	"amd64":   309,
+	"arm":     345,
+	"arm64":   168,
+	"ppc64":   302,
+	"ppc64le": 302,
+	"riscv64": 168,
+	"s390x":   311,
+}[runtime.GOARCH]
+
+// numaNodes returns the CPUs of each NUMA node indexed by node number;
+// nodes without CPUs (or missing node numbers) have a nil entry.
+func numaNodes() [][]int {
+	des, err := ioutil.ReadDir(_SysNodeDir)
+	if err != nil {
+		return nil
+	}
+
+	var nodes [][]int
+	for _, de := range des {
+		var n int
+		if _, err := fmt.Sscanf(de.Name(), "node%d", &n); err != nil {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/cpulist", _SysNodeDir, de.Name()))
+		if err != nil {
+			continue
+		}
+
+		cpus, err := parseCPUList(string(b))
+		if err != nil || len(cpus) == 0 {
+			continue
+		}
+
+		for len(nodes) <= n {
+			nodes = append(nodes, nil)
+		}
+		nodes[n] = cpus
+	}
+	return nodes
+}
+
+// parse a cpu list of the form "0-3,8,10-11"
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+
+	s = strings.TrimSpace(s)
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i > 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+
+		a, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		b, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, err
+		}
+
+		for ; a <= b; a++ {
+			cpus = append(cpus, a)
+		}
+	}
+	return cpus, nil
+}
+
+// curNode returns the NUMA node of the CPU the caller is running on
+func curNode() int {
+	var cpu, node uint32
+
+	if sysGetcpu == 0 {
+		return 0
+	}
+
+	_, _, e := syscall.RawSyscall(sysGetcpu, uintptr(unsafe.Pointer(&cpu)), uintptr(unsafe.Pointer(&node)), 0)
+	if e != 0 {
+		return 0
+	}
+	return int(node)
+}
+
+// cpu affinity mask; enough for 1024 CPUs
+type cpuMask [16]uint64
+
+func schedAffinity(trap uintptr, m *cpuMask) error {
+	_, _, e := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*m), uintptr(unsafe.Pointer(m)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// onNode calls 'fp' on an OS thread bound to the CPUs of NUMA node 'node'.
+// Memory first touched by 'fp' is thus allocated on that node. If the
+// thread can't be bound, 'fp' is called anyway.
+func onNode(node int, fp func() error) error {
+	nodes := numaNodes()
+	if node < 0 || node >= len(nodes) || len(nodes[node]) == 0 {
+		return fp()
+	}
+
+	var old, m cpuMask
+
+	for _, c := range nodes[node] {
+		if c < 64*len(m) {
+			m[c/64] |= 1 << uint(c%64)
+		}
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &old); err != nil {
+		return fp()
+	}
+
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &m); err != nil {
+		return fp()
+	}
+
+	defer schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &old)
+	return fp()
+}
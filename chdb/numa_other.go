@@ -0,0 +1,27 @@
+// numa_other.go -- NUMA stubs for non-Linux platforms
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+// +build !linux
+
+package chdb
+
+// we don't know the NUMA topology on this platform; treat it as a single node
+func numaNodes() [][]int {
+	return nil
+}
+
+func curNode() int {
+	return 0
+}
+
+func onNode(node int, fp func() error) error {
+	return fp()
+}
@@ -0,0 +1,221 @@
+// paged.go -- read the offset and vlen tables in windows on demand
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// true on 32-bit builds; their address space can't hold multi-GB mappings
+const _Is32Bit = ^uint(0)>>32 == 0
+
+// on 32-bit builds, tables with metadata larger than this are read in
+// windows rather than mapped
+const _Max32BitMap = 256 * 1024 * 1024
+
+const (
+	// default window size and number of resident windows
+	_PagedWindow   = 1 << 20
+	_PagedResident = 64
+)
+
+// WithWindowedReads makes the DBReader read the offset and vlen tables with
+// pread(2) - a window at a time, as lookups need them - instead of mapping
+// them. At most 'resident' windows (default 64) are held in memory; the
+// oldest is dropped to make room for a new one. The window size is 1MB
+// unless set with WithMapWindow(). The CHD table is read into the heap;
+// WithoutMmap(), WithHugePages() and WithNUMANode() have no effect. This
+// bounds the memory and address space used by a DB regardless of its size;
+// on 32-bit platforms, it is always used for DBs with more than 256MB of
+// metadata. An i/o error while reading a
+// window fails the lookup (or scan) that needs it with that error; a window
+// that failed to read is retried by the next lookup.
+func WithWindowedReads(resident int) ReaderOption {
+	return func(o *readerOpts) {
+		o.paged = true
+		o.resident = resident
+	}
+}
+
+// offset and vlen tables that are read in windows on demand
+type pagedTables struct {
+	rd *DBReader
+
+	// file offsets of the tables and the size of an offset table entry
+	off, vlenOff uint64
+	esz          uint64
+	vlens        bool
+
+	// resident windows: a *pagedWindow for each window; nil if not
+	// in memory
+	wins []atomic.Value
+
+	// FIFO of the resident windows
+	mu   sync.Mutex
+	fifo []uint64
+	next int
+}
+
+type pagedWindow struct {
+	off  []uint64
+	vlen []uint32
+}
+
+// set up windowed reads of the tables at file offset 'off'; the CHD table
+// starts at 'chdoff' (relative to 'off') and the metadata is 'sz' bytes
+// long. It returns the CHD table - read into the heap.
+func (rd *DBReader) pageTables(off, offsz, vlensz, chdoff, sz uint64, o *readerOpts) ([]byte, error) {
+	win := uint64(_PagedWindow)
+	if o.window > 0 {
+		win = mapWindow(o)
+	}
+
+	resident := o.resident
+	if resident <= 0 {
+		resident = _PagedResident
+	}
+
+	shift := uint(bits.Len64(win/16) - 1)
+	slots := uint64(1) << shift
+	nwin := (rd.nkeys + slots - 1) / slots
+	if uint64(resident) > nwin {
+		resident = int(nwin)
+	}
+
+	p := &pagedTables{
+		rd:      rd,
+		off:     off,
+		vlenOff: off + offsz,
+		esz:     16,
+		vlens:   vlensz > 0,
+		wins:    make([]atomic.Value, nwin),
+		fifo:    make([]uint64, 0, resident),
+	}
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		p.esz = 8
+	}
+
+	n := sz - chdoff
+	if n > uint64(^uint(0)>>1) {
+		return nil, fmt.Errorf("%s: %w: hash table of %d bytes is too large", rd.fn, ErrMapLimit, n)
+	}
+
+	// allocate as uint64 to keep the table suitably aligned
+	buf := make([]uint64, (n+7)/8)
+	bs := u64sToByteSlice(buf)[:n]
+	if _, err := rd.fd.ReadAt(bs, int64(off+chdoff)); err != nil {
+		return nil, fmt.Errorf("%s: can't read %d bytes at off %d: %s", rd.fn, n, off+chdoff, err)
+	}
+
+	rd.wshift = shift
+	rd.wmask = slots - 1
+	rd.paged = p
+	rd.mmap = bs
+	rd.metasz = sz
+	rd.inmem = true
+	rd.anon = true
+	return bs, nil
+}
+
+// return the window of slot 'i'
+func (p *pagedTables) window(i uint64) *pagedWindow {
+	w := i >> p.rd.wshift
+	if t, ok := p.wins[w].Load().(*pagedWindow); ok && t != nil {
+		return t
+	}
+	return p.load(w)
+}
+
+// read window 'w' and make it resident; the oldest resident window is
+// dropped if needed. Lookups still using a dropped window keep it alive
+// until they are done.
+func (p *pagedTables) load(w uint64) *pagedWindow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.wins[w].Load().(*pagedWindow); ok && t != nil {
+		return t
+	}
+
+	rd := p.rd
+	slots := rd.wmask + 1
+	first := w * slots
+	n := slots
+	if rem := rd.nkeys - first; rem < n {
+		n = rem
+	}
+
+	t := &pagedWindow{
+		off: make([]uint64, n*p.esz/8),
+	}
+
+	err := p.read(u64sToByteSlice(t.off), p.off+first*p.esz)
+	if err == nil && p.vlens {
+		t.vlen = make([]uint32, n)
+		err = p.read(u32sToByteSlice(t.vlen), p.vlenOff+first*4)
+	}
+	if err != nil {
+		// don't keep a bad window; the slots of an unread window aren't
+		// empty - so the lookup fails rather than miss the key.
+		panic(tableReadError{fmt.Errorf("%s: can't read table window %d: %w", rd.fn, w, err)})
+	}
+
+	if len(p.fifo) < cap(p.fifo) {
+		p.fifo = append(p.fifo, w)
+	} else {
+		var none *pagedWindow
+		p.wins[p.fifo[p.next]].Store(none)
+		p.fifo[p.next] = w
+		p.next = (p.next + 1) % len(p.fifo)
+	}
+	p.wins[w].Store(t)
+	return t
+}
+
+// a failed read of a table window; it unwinds the lookup that needed the
+// window and catchTableRead() returns it as the error of that lookup.
+type tableReadError struct {
+	err error
+}
+
+// recover from a failed read of a table window and return it in '*err';
+// other panics are passed on.
+func catchTableRead(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(tableReadError)
+		if !ok {
+			panic(r)
+		}
+		*err = e.err
+	}
+}
+
+func (p *pagedTables) read(b []byte, off uint64) error {
+	_, err := p.rd.fd.ReadAt(b, int64(off))
+	return err
+}
+
+// number of bytes of the tables in memory
+func (p *pagedTables) residentBytes() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n uint64
+	for _, w := range p.fifo {
+		if t, ok := p.wins[w].Load().(*pagedWindow); ok && t != nil {
+			n += uint64(len(t.off))*8 + uint64(len(t.vlen))*4
+		}
+	}
+	return n
+}
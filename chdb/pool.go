@@ -0,0 +1,113 @@
+// pool.go -- NUMA-aware pool of DB replicas
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// ReaderPool is a DB whose offset table and hash table are replicated into
+// the local memory of every NUMA node. Lookups are routed to the replica
+// local to the CPU the caller is running on. This avoids cross-socket
+// memory traffic when a single hot DB is queried from all sockets.
+//
+// On systems with a single NUMA node (or where the topology is unknown),
+// a ReaderPool is just a DBReader opened with the given options. Each
+// replica has its own record cache of 'cache' entries. WithHeatMap() must
+// not be used with a ReaderPool.
+type ReaderPool struct {
+	// replicas indexed by NUMA node; nil for nodes without CPUs
+	nodes []*DBReader
+
+	// distinct replicas
+	rds []*DBReader
+}
+
+// NewReaderPool opens the DB in file 'fn' and replicates its metadata onto
+// every NUMA node. See NewDBReader() for 'cache' and 'opts'.
+func NewReaderPool(fn string, cache int, opts ...ReaderOption) (*ReaderPool, error) {
+	p := &ReaderPool{}
+
+	topo := numaNodes()
+	if len(topo) <= 1 {
+		rd, err := NewDBReader(fn, cache, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		p.nodes = []*DBReader{rd}
+		p.rds = p.nodes
+		return p, nil
+	}
+
+	p.nodes = make([]*DBReader, len(topo))
+	for n, cpus := range topo {
+		if len(cpus) == 0 {
+			continue
+		}
+
+		o := append(opts[:len(opts):len(opts)], WithNUMANode(n))
+		rd, err := NewDBReader(fn, cache, o...)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.nodes[n] = rd
+		p.rds = append(p.rds, rd)
+	}
+	return p, nil
+}
+
+// Reader returns the replica local to the calling goroutine's current CPU.
+// Goroutines may migrate across CPUs; the returned reader remains valid
+// (merely remote) if that happens.
+func (p *ReaderPool) Reader() *DBReader {
+	if len(p.nodes) > 1 {
+		if n := curNode(); n < len(p.nodes) && p.nodes[n] != nil {
+			return p.nodes[n]
+		}
+	}
+	return p.rds[0]
+}
+
+// Replicas returns the number of copies of the DB metadata in the pool
+func (p *ReaderPool) Replicas() int {
+	return len(p.rds)
+}
+
+// Len returns the size of the DB lookup table
+func (p *ReaderPool) Len() int {
+	return p.rds[0].Len()
+}
+
+// Find looks up 'key' in the local replica. See DBReader.Find().
+func (p *ReaderPool) Find(key uint64) ([]byte, error) {
+	return p.Reader().Find(key)
+}
+
+// FindInto looks up 'key' in the local replica. See DBReader.FindInto().
+func (p *ReaderPool) FindInto(key uint64, buf []byte) ([]byte, error) {
+	return p.Reader().FindInto(key, buf)
+}
+
+// Lookup looks up 'key' in the local replica. See DBReader.Lookup().
+func (p *ReaderPool) Lookup(key uint64) ([]byte, bool) {
+	return p.Reader().Lookup(key)
+}
+
+// Get looks up 'key' in the local replica. See DBReader.Get().
+func (p *ReaderPool) Get(key uint64) ([]byte, bool, error) {
+	return p.Reader().Get(key)
+}
+
+// Close closes all the replicas
+func (p *ReaderPool) Close() {
+	for _, rd := range p.rds {
+		rd.Close()
+	}
+}
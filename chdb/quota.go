@@ -0,0 +1,99 @@
+// quota.go -- per-group statistics and byte quotas
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"sort"
+)
+
+// GroupStats counts the keys of a group (see AddGroup()) and the bytes of
+// their records: the checksum and the (encoded) value of each record.
+// Records shared by keys of the group (see WithContentAddressed()) are
+// counted once; padding between records is not counted.
+type GroupStats struct {
+	Group uint32 `json:"group"`
+	Keys  uint64 `json:"keys"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// WithGroupQuota limits the records of group 'group' to 'n' bytes (as
+// counted by GroupStats). Adding a record that exceeds the quota fails with
+// ErrQuota; the writer stays usable. Keys with empty values and keys that
+// share an existing record of the group don't use any quota.
+func WithGroupQuota(group uint32, n uint64) WriterOption {
+	return func(o *writerOpts) {
+		if o.quotas == nil {
+			o.quotas = make(map[uint32]uint64)
+		}
+		o.quotas[group] = n
+	}
+}
+
+// return the stats of group 'g'
+func (w *DBWriter) groupStats(g uint32) *GroupStats {
+	gs, ok := w.gstats[g]
+	if !ok {
+		gs = &GroupStats{Group: g}
+		w.gstats[g] = gs
+	}
+	return gs
+}
+
+// return an error if a record with a value of 'vlen' bytes exceeds the
+// quota of group 'g'
+func (w *DBWriter) checkQuota(g uint32, vlen int) error {
+	max, ok := w.opt.quotas[g]
+	if !ok {
+		return nil
+	}
+
+	var used uint64
+	if gs, ok := w.gstats[g]; ok {
+		used = gs.Bytes
+	}
+	if need := 8 + uint64(vlen); need > max || used > max-need {
+		return fmt.Errorf("chd: %s: %w: group %d: %d bytes used, %d more; quota is %d",
+			w.fn, ErrQuota, g, used, need, max)
+	}
+	return nil
+}
+
+// GroupStats returns the stats of every group with keys in the DB so far,
+// in ascending order of the group IDs. Keys added without a group are in
+// group 0.
+func (w *DBWriter) GroupStats() []GroupStats {
+	st := make([]GroupStats, 0, len(w.gstats))
+	for _, gs := range w.gstats {
+		if gs.Keys > 0 {
+			st = append(st, *gs)
+		}
+	}
+	sort.Slice(st, func(a, b int) bool {
+		return st[a].Group < st[b].Group
+	})
+	return st
+}
+
+// GroupStats returns the stats of the groups of the DB as they were built,
+// in ascending order of the group IDs; it returns nil if the DB wasn't built
+// with AddGroup(). Tombstones (see WithTombstones()) aren't accounted for.
+func (rd *DBReader) GroupStats() []GroupStats {
+	if rd.extents == nil {
+		return nil
+	}
+
+	st := make([]GroupStats, len(rd.extents))
+	for i := range rd.extents {
+		st[i] = rd.extents[i].GroupStats
+	}
+	return st
+}
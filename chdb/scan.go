@@ -0,0 +1,185 @@
+// scan.go -- sequential scan of all the records in a DB
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Scan calls 'fn' for every key, value pair in the DB in the order the
+// records are laid out in the file (i.e., not in table order). The values
+// region of the file is read sequentially and every record checksum is
+// verified - so a full scan proceeds at disk bandwidth rather than doing a
+// random read per key. Scan stops when 'fn' returns false.
+//
+// The value passed to 'fn' is only valid until 'fn' returns; callers must
+// copy it if they need to retain it. Scan bypasses the record cache. For
+// keys-only DBs, 'val' is always nil and the keys are visited in table order.
+// Scan returns an error if reading or validating a record failed.
+func (rd *DBReader) Scan(fn func(key uint64, val []byte) bool) (err error) {
+	defer catchTableRead(&err)
+
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		err := rd.iter(func(key uint64, _ []byte) error {
+			if !fn(key, nil) {
+				return io.EOF
+			}
+			return nil
+		})
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	}
+
+	return rd.scanValues(rd.sortedSlots(), fn)
+}
+
+// scanValues calls 'fn' with the key and value of 'slots' (in file order);
+// see Scan().
+func (rd *DBReader) scanValues(slots []uint64, fn func(key uint64, val []byte) bool) error {
+	var dbuf []byte
+
+	stop := io.EOF
+	err := rd.scanSlots(slots, func(i, key, off uint64, data []byte) error {
+		if data == nil {
+			if !fn(key, []byte{}) {
+				return stop
+			}
+			return nil
+		}
+
+		if err := rd.checkRecord(data, off, i); err != nil {
+			return err
+		}
+		val := data[8:]
+		if rd.codec != nil && len(val) > 0 {
+			var err error
+			if dbuf, err = rd.decode(dbuf[:0], val); err != nil {
+				return err
+			}
+			val = dbuf
+		}
+		if !fn(key, val) {
+			return stop
+		}
+		return nil
+	})
+	if err == stop {
+		err = nil
+	}
+	return err
+}
+
+// sortedSlots returns the occupied slots of the offset table in file order
+func (rd *DBReader) sortedSlots() []uint64 {
+	var slots []uint64
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if rd.live(i) {
+			slots = append(slots, i)
+		}
+	}
+
+	sort.Slice(slots, func(a, b int) bool {
+		return rd.offAt(slots[a]) < rd.offAt(slots[b])
+	})
+	return slots
+}
+
+// scanSlots reads the records of 'slots' (in file order) sequentially and
+// calls 'fp' with each record's slot, key, offset and raw bytes (checksum
+// followed by the value). The record bytes are only valid until 'fp' returns;
+// slots sharing a record see the same value bytes. Slots with an empty value
+// have no record; 'fp' sees them with nil bytes. Any
+// error returned by 'fp' stops the scan and is returned to the caller.
+func (rd *DBReader) scanSlots(slots []uint64, fp func(i, key, off uint64, data []byte) error) error {
+	if len(slots) == 0 {
+		return nil
+	}
+
+	start := rd.offAt(slots[0])
+	sr := io.NewSectionReader(rd.fd, int64(start), int64(rd.offtbl-start))
+	br := bufio.NewReaderSize(sr, 1<<20)
+	pos := start
+
+	var buf, data []byte
+	var csum [8]byte
+	prev := pos
+	for _, i := range slots {
+		key := rd.keyAt(i)
+		off := rd.offAt(i)
+		vlen := rd.vlenAt(i)
+
+		if vlen == 0 {
+			if err := fp(i, key, off, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// keys of a content addressed DB can share the record just read;
+		// verifying it clobbers the checksum - so restore it.
+		if data != nil && off == prev && rd.SharedValues() {
+			copy(data[:8], csum[:])
+			if err := fp(i, key, off, data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if off < pos {
+			return fmt.Errorf("%s: overlapping record at off %d", rd.fn, off)
+		}
+
+		// skip any padding between records; large gaps (e.g., holes
+		// left by WithRecordAlign) are seeked over rather than read.
+		if gap := off - pos; gap >= _HoleMin && gap > uint64(br.Buffered()) {
+			if _, err := sr.Seek(int64(off-start), io.SeekStart); err != nil {
+				return fmt.Errorf("%s: can't seek to record at off %d: %s", rd.fn, off, err)
+			}
+			br.Reset(sr)
+		} else if _, err := br.Discard(int(gap)); err != nil {
+			return fmt.Errorf("%s: can't seek to record at off %d: %s", rd.fn, off, err)
+		}
+
+		if err := rd.checkExtent(off, vlen, i); err != nil {
+			return err
+		}
+
+		n := int(vlen) + 8
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+
+		data = buf[:n]
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("%s: can't read record at off %d: %s", rd.fn, off, err)
+		}
+		rd.stats.read(n)
+		pos = off + uint64(n)
+		prev = off
+		copy(csum[:], data[:8])
+
+		if err := fp(i, key, off, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan calls 'fn' for every key, value pair in the snapshot in file order.
+// See DBReader.Scan().
+func (s *Snapshot) Scan(fn func(key uint64, val []byte) bool) error {
+	return s.rd.Scan(fn)
+}
@@ -0,0 +1,102 @@
+// secret.go -- lookups of keys derived from secrets
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"sync"
+)
+
+// WithSecretKeys hardens the reader for DBs keyed by secrets (e.g., hashes
+// of API tokens):
+//
+//   - the stored key in the slot of a key is compared in constant time; and
+//     the rest of the membership checks don't stop early on a mismatch
+//   - the record cache is keyed by an HMAC-SHA256 of the key with a random
+//     per-reader secret: the keys are never held in the cache and the
+//     cache's shard of a key can't be predicted
+//
+// This doesn't hide whether a key was in the cache: cache hits are faster
+// than lookups that go to disk. SaveHotSet() fails since the cache has no
+// keys to save. The HMAC makes every Find() slower by a microsecond or so.
+func WithSecretKeys() ReaderOption {
+	return func(o *readerOpts) {
+		o.secret = true
+	}
+}
+
+// per-reader HMAC of keys
+type secretKeys struct {
+	macs sync.Pool
+}
+
+func newSecretKeys() *secretKeys {
+	k := randbytes(32)
+	s := &secretKeys{}
+	s.macs.New = func() interface{} {
+		return hmac.New(sha256.New, k)
+	}
+	return s
+}
+
+// return the first 64 bits of the HMAC of 'key'
+func (s *secretKeys) mac(key uint64) uint64 {
+	var b [8]byte
+	var sum [sha256.Size]byte
+
+	h := s.macs.Get().(hash.Hash)
+	binary.LittleEndian.PutUint64(b[:], key)
+	h.Reset()
+	h.Write(b[:])
+	h.Sum(sum[:0])
+	s.macs.Put(h)
+	return binary.LittleEndian.Uint64(sum[:8])
+}
+
+// return the record cache key of 'key'
+func (rd *DBReader) ckey(key uint64) uint64 {
+	if rd.secret == nil {
+		return key
+	}
+	return rd.secret.mac(key)
+}
+
+// has() in constant time with respect to 'key'
+func (rd *DBReader) hasSecret(i, key uint64) bool {
+	eq := ctEq(rd.keyAt(i), key)
+	live := 1
+	if rd.deleted(i) {
+		live = 0
+	}
+
+	// a keys-only DB has no offsets; its key 0 is in the header flags
+	var off uint64
+	switch {
+	case (rd.flags & _DB_KeysOnly) == 0:
+		off = rd.offAt(i)
+	case (rd.flags & _DB_ZeroKey) > 0:
+		off = 1
+	}
+
+	// empty slots have key 0; records are always past the file header
+	empty := ctEq(key, 0) & ctEq(off, 0)
+	return eq&live&(empty^1) == 1
+}
+
+// return 1 if 'a' and 'b' are equal and 0 otherwise - in constant time
+func ctEq(a, b uint64) int {
+	x := a ^ b
+	return subtle.ConstantTimeEq(int32(x>>32)|int32(x), 0)
+}
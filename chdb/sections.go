@@ -0,0 +1,177 @@
+// sections.go -- digests of the sections of a DB for streaming verification
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// The metadata checksum in the trailer can only be verified once the whole
+// file is at hand; and the record checksums only when a record is read. A
+// DB that is downloaded (e.g., from object storage) can instead be verified
+// as it streams: the publisher of the DB lists the digests of consecutive
+// sections of the file with ChecksumSections() and ships them alongside the
+// DB (e.g., as JSON). The downloader feeds the bytes to a SectionVerifier,
+// which checks every section as soon as its last byte arrives; so a
+// corrupt download is detected early and the bytes verified so far can be
+// committed to disk.
+//
+// The sections cover the file in order: the header, the records in chunks
+// of 4MB, the tables (offset and vlen tables, and the hash table) in
+// chunks of 4MB and the trailer. The digests are SHA512-256 regardless of
+// the metadata checksum of the DB. The list of sections must come from a
+// trusted source; it vouches for the DB no more than the channel it came
+// over.
+
+// size of the chunks of the records and the tables
+const _SectionSize = 4 << 20
+
+// Section is a range of bytes of a DB file and its digest
+type Section struct {
+	Name   string `json:"name"`
+	Off    uint64 `json:"off"`
+	Size   uint64 `json:"size"`
+	Digest []byte `json:"digest"`
+}
+
+// ChecksumSections reads the DB file and returns the digests of its
+// sections (see above).
+func (rd *DBReader) ChecksumSections() ([]Section, error) {
+	fd := rd.fd
+	if fd == nil {
+		return nil, ErrClosed
+	}
+
+	var secs []Section
+	add := func(name string, off, end, chunk uint64) {
+		for off < end {
+			n := end - off
+			if n > chunk {
+				n = chunk
+			}
+			secs = append(secs, Section{Name: name, Off: off, Size: n})
+			off += n
+		}
+	}
+
+	add("header", 0, 64, 64)
+	add("records", 64, rd.offtbl, _SectionSize)
+	add("tables", rd.offtbl, rd.size-32, _SectionSize)
+	add("trailer", rd.size-32, rd.size, 32)
+
+	h := sha512.New512_256()
+	sr := io.NewSectionReader(fd, 0, int64(rd.size))
+	for i := range secs {
+		s := &secs[i]
+		h.Reset()
+		if _, err := io.CopyN(h, sr, int64(s.Size)); err != nil {
+			return nil, fmt.Errorf("%s: can't read %s at off %d: %s", rd.fn, s.Name, s.Off, err)
+		}
+		s.Digest = h.Sum(nil)
+	}
+	return secs, nil
+}
+
+// SectionVerifier verifies a DB file that is written to it in order
+// against the digests of its sections; see ChecksumSections().
+type SectionVerifier struct {
+	secs []Section
+	h    hash.Hash
+
+	// current section and the bytes verified so far
+	cur int
+	off uint64
+	ok  uint64
+
+	// the first failure; every later write fails with it
+	err error
+}
+
+// NewSectionVerifier returns a verifier for the sections 'secs'; they must
+// cover a file from its start without gaps or overlaps.
+func NewSectionVerifier(secs []Section) (*SectionVerifier, error) {
+	var off uint64
+	for i := range secs {
+		s := &secs[i]
+		if s.Off != off || s.Size == 0 || len(s.Digest) != sha512.Size256 {
+			return nil, fmt.Errorf("chd: invalid section %d (%s) at off %d", i, s.Name, s.Off)
+		}
+		off += s.Size
+	}
+
+	v := &SectionVerifier{
+		secs: secs,
+		h:    sha512.New512_256(),
+	}
+	return v, nil
+}
+
+// Write feeds the next bytes of the file to the verifier; it fails with an
+// error that matches ErrCorrupt as soon as a section doesn't match its
+// digest or the file is longer than the sections.
+func (v *SectionVerifier) Write(b []byte) (int, error) {
+	var nw int
+
+	for len(b) > 0 && v.err == nil {
+		if v.cur == len(v.secs) {
+			v.err = fmt.Errorf("chd: %w: %d bytes past the end of the sections", ErrCorrupt, len(b))
+			break
+		}
+
+		s := &v.secs[v.cur]
+		n := uint64(len(b))
+		if rem := s.Off + s.Size - v.off; n > rem {
+			n = rem
+		}
+
+		v.h.Write(b[:n])
+		v.off += n
+		nw += int(n)
+		b = b[n:]
+
+		if v.off < s.Off+s.Size {
+			break
+		}
+
+		if !bytes.Equal(v.h.Sum(nil), s.Digest) {
+			v.err = fmt.Errorf("chd: %w: section %d (%s) at off %d: digest mismatch", ErrCorrupt, v.cur, s.Name, s.Off)
+			break
+		}
+		v.h.Reset()
+		v.ok = v.off
+		v.cur++
+	}
+
+	return nw, v.err
+}
+
+// Verified returns the number of bytes from the start of the file that
+// are verified so far; they can be trusted even if a later section fails.
+func (v *SectionVerifier) Verified() uint64 {
+	return v.ok
+}
+
+// Close returns an error if a section failed or the file ended before the
+// last section.
+func (v *SectionVerifier) Close() error {
+	if v.err != nil {
+		return v.err
+	}
+	if v.cur < len(v.secs) {
+		return fmt.Errorf("chd: %w: file ends at off %d; exp %d sections, saw %d",
+			ErrCorrupt, v.off, len(v.secs), v.cur)
+	}
+	return nil
+}
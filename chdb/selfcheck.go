@@ -0,0 +1,105 @@
+// selfcheck.go -- verify a newly built DB before it replaces the old one
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WithSelfCheck makes Freeze() re-open the finished DB - before it is renamed
+// into place - and look up 'n' keys (all the keys if 'n' is zero or
+// negative) via the DBReader: the metadata checksum, the slots of the keys
+// and the checksums of their records are verified. A failure fails Freeze()
+// and leaves the existing DB file untouched; so a buggy build never replaces
+// a good DB. The keys are picked in map order - which is effectively random.
+func WithSelfCheck(n int) WriterOption {
+	return func(o *writerOpts) {
+		o.selfCheck = true
+		o.checkKeys = n
+	}
+}
+
+// errCheckDone stops the key sampling of the self-check
+var errCheckDone = errors.New("chd: self-check done")
+
+// open the DB in the tmpfile and spot check it
+func (w *DBWriter) selfCheck() error {
+	t0 := time.Now()
+	rd, err := w.openTmp(withoutTransform(), WithLogger(w.opt.log))
+	if err != nil {
+		return fmt.Errorf("chd: %s: self-check: %w", w.fn, err)
+	}
+
+	defer rd.Close()
+
+	keysOnly := (rd.flags & _DB_KeysOnly) > 0
+	want := w.opt.checkKeys
+	var n int
+	check := func(k uint64, v *value) (err error) {
+		defer catchTableRead(&err)
+
+		if want > 0 && n >= want {
+			return errCheckDone
+		}
+		n++
+
+		i := rd.chd.Find(k)
+		if !rd.has(i, k) {
+			return fmt.Errorf("key %#x is missing", k)
+		}
+		if v != nil && !keysOnly && (rd.offAt(i) != v.off || rd.vlenAt(i) != v.vlen) {
+			return fmt.Errorf("key %#x: exp %d bytes at off %d; saw %d bytes at off %d",
+				k, v.vlen, v.off, rd.vlenAt(i), rd.offAt(i))
+		}
+		if _, err := rd.Find(k); err != nil {
+			return fmt.Errorf("key %#x: %w", k, err)
+		}
+		return nil
+	}
+
+	if w.keysrc != nil {
+		err = w.keysrc(func(k uint64) error {
+			return check(k, nil)
+		})
+	} else {
+		for k, v := range w.keymap {
+			if err = check(k, v); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil && err != errCheckDone {
+		return fmt.Errorf("chd: %s: self-check: %w", w.fn, err)
+	}
+
+	w.opt.log.Printf("chdb: %s: self-check of %d keys passed in %s", w.fn, n, time.Since(t0))
+	return nil
+}
+
+// open the DB in the tmpfile; the tmpfile of an ephemeral DB stays open
+func (w *DBWriter) openTmp(opts ...ReaderOption) (*DBReader, error) {
+	if !w.opt.ephemeral {
+		return NewDBReader(w.fntmp, 0, opts...)
+	}
+
+	fd, err := dupFile(w.fd)
+	if err != nil {
+		return nil, err
+	}
+	rd, err := NewDBReaderFromFd(fd, 0, opts...)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return rd, nil
+}
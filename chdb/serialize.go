@@ -0,0 +1,110 @@
+// serialize.go -- storing and retrieving structured values
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec serializes Go values to bytes and back. It is used by
+// DBWriter.AddValue() and DBReader.FindAs() to store structured values.
+//
+// Unlike a ValueCodec - which transforms the bytes of every value in a DB,
+// a Codec only converts between Go values and the bytes passed to Add() and
+// returned by Find().
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var (
+	// JSON serializes values with encoding/json
+	JSON Codec = jsonCodec{}
+
+	// Gob serializes values with encoding/gob. Every value is a
+	// self-contained gob stream - so it carries its type information.
+	Gob Codec = gobCodec{}
+
+	// Msgpack serializes values in the MessagePack format. Structs are
+	// encoded as maps of field names; the name can be changed with a
+	// `msgpack:"name"` struct tag.
+	Msgpack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpackMarshal(v)
+}
+
+func (msgpackCodec) Unmarshal(b []byte, v interface{}) error {
+	return msgpackUnmarshal(b, v)
+}
+
+// AddValue serializes 'v' with 'codec' and adds it as the value of 'key'
+func (w *DBWriter) AddValue(key uint64, v interface{}, codec Codec) error {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("chd: can't marshal value of key %#x: %s", key, err)
+	}
+	return w.Add(key, b)
+}
+
+// WithCodec sets the Codec used by FindAs() to deserialize values; the
+// default is JSON.
+func WithCodec(c Codec) ReaderOption {
+	return func(o *readerOpts) {
+		o.serializer = c
+	}
+}
+
+// FindAs looks up 'key' and deserializes its value into 'out' - which must be
+// a pointer; the value must have been stored with the Codec the reader was
+// opened with (see WithCodec()).
+func (rd *DBReader) FindAs(key uint64, out interface{}) error {
+	b, err := rd.Find(key)
+	if err != nil {
+		return err
+	}
+
+	if err := rd.serializer.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("%s: can't unmarshal value of key %#x: %s", rd.fn, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+// setops.go -- set operations over keys-only DBs
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opencoff/go-chd"
+)
+
+// Union writes the keys that are in 'a' or 'b' to a new keys-only DB 'dst'.
+// See Difference() for the arguments.
+func Union(dst string, a, b *DBReader, load float64, opts ...WriterOption) error {
+	return setOp(dst, a, b, load, opts, func(emit func(k uint64) error) error {
+		if err := a.eachKey(emit); err != nil {
+			return err
+		}
+		return b.eachKey(func(k uint64) error {
+			if a.contains(k) {
+				return nil
+			}
+			return emit(k)
+		})
+	})
+}
+
+// Intersect writes the keys that are in both 'a' and 'b' to a new keys-only
+// DB 'dst'. See Difference() for the arguments.
+func Intersect(dst string, a, b *DBReader, load float64, opts ...WriterOption) error {
+	small, large := a, b
+	if b.Len() < a.Len() {
+		small, large = b, a
+	}
+
+	return setOp(dst, a, b, load, opts, func(emit func(k uint64) error) error {
+		return small.eachKey(func(k uint64) error {
+			if !large.contains(k) {
+				return nil
+			}
+			return emit(k)
+		})
+	})
+}
+
+// Difference writes the keys that are in 'a' but not in 'b' to a new
+// keys-only DB 'dst' with the load factor 'load' and the writer options
+// 'opts'. 'a' and 'b' must be keys-only DBs with the same key transform (if
+// any); the new DB records the same transform.
+//
+// The set operations are streaming: the resulting keys are spilled to a
+// temp file (in the temp dir of the DBWriter) and the MPH table is built from
+// it with chd.FreezeFromFile(). So, memory use is proportional to the size of
+// the lookup tables rather than the number of keys.
+func Difference(dst string, a, b *DBReader, load float64, opts ...WriterOption) error {
+	return setOp(dst, a, b, load, opts, func(emit func(k uint64) error) error {
+		return a.eachKey(func(k uint64) error {
+			if b.contains(k) {
+				return nil
+			}
+			return emit(k)
+		})
+	})
+}
+
+// write the keys generated by 'gen' to the keys-only DB 'dst'
+func setOp(dst string, a, b *DBReader, load float64, opts []WriterOption, gen func(emit func(k uint64) error) error) error {
+	for _, rd := range []*DBReader{a, b} {
+		if (rd.flags & _DB_KeysOnly) == 0 {
+			return fmt.Errorf("chd: %s is not a keys-only DB", rd.fn)
+		}
+	}
+	if a.xformID != b.xformID {
+		return fmt.Errorf("chd: key transforms of %s and %s differ: %#x vs. %#x",
+			a.fn, b.fn, a.xformID, b.xformID)
+	}
+
+	opts = append([]WriterOption{withStoredKeys(a.xformID)}, opts...)
+	wr, err := NewDBWriter(dst, opts...)
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(wr.opt.tmpdir, filepath.Base(dst)+".keys.")
+	if err != nil {
+		wr.Abort()
+		return err
+	}
+
+	keyfn := fd.Name()
+	defer os.Remove(keyfn)
+
+	var n uint64
+	var buf [8]byte
+
+	bw := bufio.NewWriter(fd)
+	err = gen(func(k uint64) error {
+		binary.LittleEndian.PutUint64(buf[:], k)
+		if n++; wr.opt.maxKeys > 0 && n > wr.opt.maxKeys {
+			return fmt.Errorf("chd: %s: %w: limit is %d", dst, ErrTooManyKeys, wr.opt.maxKeys)
+		}
+		if k == 0 {
+			wr.zeroKey = true
+		}
+		_, err := bw.Write(buf[:])
+		return err
+	})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		wr.Abort()
+		return err
+	}
+
+	return wr.freeze(func() (*chd.Chd, error) {
+		log := wr.opt.log
+		log.Printf("chdb: %s: building MPH of %d keys with load %.2f", wr.fn, n, load)
+
+		t0 := time.Now()
+		c, err := chd.FreezeFromFile(keyfn, load)
+		if err != nil {
+			return nil, &mphError{err}
+		}
+
+		cs := c.Stats()
+		log.Printf("chdb: %s: built MPH of %d slots in %s; %d seed retries, %d byte seeds",
+			wr.fn, cs.Slots, time.Since(t0), cs.Tries, cs.SeedSize)
+
+		wr.keysrc = func(fp func(k uint64) error) error {
+			return readKeyFile(keyfn, fp)
+		}
+		return c, nil
+	})
+}
+
+// call 'fp' for every key of a keys-only DB
+func (rd *DBReader) eachKey(fp func(k uint64) error) error {
+	return rd.iter(func(k uint64, _ []byte) error {
+		return fp(k)
+	})
+}
+
+// return true if the DB has 'key'
+func (rd *DBReader) contains(key uint64) bool {
+	return rd.has(rd.chd.Find(key), key)
+}
+
+// call 'fp' for every little-endian key in file 'fn'
+func readKeyFile(fn string, fp func(k uint64) error) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var buf [8]byte
+
+	br := bufio.NewReaderSize(fd, 1<<20)
+	for {
+		_, err := io.ReadFull(br, buf[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", fn, err)
+		}
+		if err := fp(binary.LittleEndian.Uint64(buf[:])); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// sign.go -- ed25519 signatures of DBs
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A DB built with WithSigningKey() carries an ed25519 signature of its
+// metadata checksum (the trailer) - which covers the header, the tables and
+// the hash table. The metadata checksum doesn't cover the records and the
+// record checksums are keyed by the salt in the header - which anyone can
+// read; so the signature also covers a SHA512-256 digest of the records.
+// Signing needs the SHA512-256 metadata checksum (the default); a CRC can
+// be forged. Readers opened with WithTrustedKeys() refuse DBs that aren't
+// signed by one of the trusted keys.
+//
+// The signature is an extra record right after the build info record and
+// the extent table (if any); the header flag FlagSigned marks its presence.
+// The record value is:
+//
+//	magic   [4]byte  "CHDS"
+//	resv    [4]byte
+//	pubkey  [32]byte public key of the signer
+//	records [32]byte SHA512-256 of the file from the end of the header
+//	                 to the start of this record
+//	sig     [64]byte signature of magic, records and the trailer
+
+// size of the value of the signature record
+const _SigLen = 4 + 4 + ed25519.PublicKeySize + sha512.Size256 + ed25519.SignatureSize
+
+// WithSigningKey makes the DBWriter sign the DB with 'key'; see above.
+// Freeze() reads back the records to compute their digest.
+func WithSigningKey(key ed25519.PrivateKey) WriterOption {
+	return func(o *writerOpts) {
+		o.signKey = key
+	}
+}
+
+// WithTrustedKeys makes NewDBReader() fail with ErrSignature unless the DB
+// is signed by one of 'keys'. The metadata checksum is always verified -
+// regardless of WithIntegrity() and the verification cache; and the
+// records are read to verify their digest.
+func WithTrustedKeys(keys ...ed25519.PublicKey) ReaderOption {
+	return func(o *readerOpts) {
+		o.trusted = append(o.trusted, keys...)
+	}
+}
+
+// return the digest of the records written so far
+func (w *DBWriter) recordsDigest() ([]byte, error) {
+	h := sha512.New512_256()
+	sr := io.NewSectionReader(w.fd, 64, int64(w.off-64))
+	if _, err := io.Copy(h, sr); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// compute the digest of the records and reserve the signature record at
+// the current offset; return its offset or 0 if the DB isn't signed
+func (w *DBWriter) reserveSignature() (uint64, []byte, error) {
+	if w.opt.signKey == nil {
+		return 0, nil, nil
+	}
+
+	sum, err := w.recordsDigest()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	off := w.off
+	if err = w.padTo(off + 8 + _SigLen); err != nil {
+		return 0, nil, err
+	}
+	return off, sum, nil
+}
+
+// write the signature of the records digest 'sum' and the trailer 't' in
+// the record reserved at 'off'
+func (w *DBWriter) writeSignature(off uint64, sum, t []byte) error {
+	if off == 0 {
+		return nil
+	}
+
+	key := w.opt.signKey
+	val := make([]byte, _SigLen)
+	copy(val[:4], []byte{'C', 'H', 'D', 'S'})
+	copy(val[8:], key.Public().(ed25519.PublicKey))
+	copy(val[8+ed25519.PublicKeySize:], sum)
+
+	sig := ed25519.Sign(key, signedMsg(val, t))
+	copy(val[_SigLen-ed25519.SignatureSize:], sig)
+
+	var rec [8 + _SigLen]byte
+	binary.BigEndian.PutUint64(rec[:8], w.recordSum(val, off))
+	copy(rec[8:], val)
+	_, err := w.fd.WriteAt(rec[:], int64(off))
+	return err
+}
+
+// return the message signed in the signature record 'val' for trailer 't'
+func signedMsg(val, t []byte) []byte {
+	msg := make([]byte, 0, 4+sha512.Size256+len(t))
+	msg = append(msg, val[:4]...)
+	msg = append(msg, val[8+ed25519.PublicKeySize:8+ed25519.PublicKeySize+sha512.Size256]...)
+	return append(msg, t...)
+}
+
+// read the signature record and verify it against the trusted keys
+func (rd *DBReader) loadSignature(trusted []ed25519.PublicKey) error {
+	if (rd.flags & FlagSigned) == 0 {
+		if len(trusted) > 0 {
+			return fmt.Errorf("%s: %w: DB is not signed", rd.fn, ErrSignature)
+		}
+		return nil
+	}
+
+	if rd.binfoOff == 0 {
+		return fmt.Errorf("%s: %w: signature: no build info", rd.fn, ErrCorrupt)
+	}
+
+	off := rd.binfoOff + 8 + uint64(rd.binfoLen)
+	if rd.extents != nil {
+		off += 16 + 40*uint64(len(rd.extents))
+	}
+	if off+8+_SigLen > rd.offtbl {
+		return fmt.Errorf("%s: %w: signature: truncated", rd.fn, ErrCorrupt)
+	}
+
+	data := make([]byte, 8+_SigLen)
+	if _, err := rd.fd.ReadAt(data, int64(off)); err != nil {
+		return fmt.Errorf("%s: can't read signature: %s", rd.fn, err)
+	}
+	if err := rd.verifyRecord(data, off); err != nil {
+		return err
+	}
+
+	val := data[8:]
+	if string(val[:4]) != "CHDS" {
+		return fmt.Errorf("%s: %w: signature: bad magic", rd.fn, ErrCorrupt)
+	}
+
+	pub := ed25519.PublicKey(val[8 : 8+ed25519.PublicKeySize])
+	rd.signer = append(ed25519.PublicKey(nil), pub...)
+	if len(trusted) == 0 {
+		return nil
+	}
+
+	var ok bool
+	for _, k := range trusted {
+		if bytes.Equal(k, pub) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w: signed by an untrusted key %x", rd.fn, ErrSignature, []byte(pub))
+	}
+	if c := rd.Checksum(); c != ChecksumSHA512_256 {
+		return fmt.Errorf("%s: %w: signs a %s checksum", rd.fn, ErrSignature, c)
+	}
+
+	var t [32]byte
+	if _, err := rd.fd.ReadAt(t[:], int64(rd.size-32)); err != nil {
+		return fmt.Errorf("%s: can't read trailer: %s", rd.fn, err)
+	}
+	if !ed25519.Verify(pub, signedMsg(val, t[:]), val[_SigLen-ed25519.SignatureSize:]) {
+		return fmt.Errorf("%s: %w: invalid signature", rd.fn, ErrSignature)
+	}
+
+	h := sha512.New512_256()
+	sr := io.NewSectionReader(rd.fd, 64, int64(off-64))
+	if _, err := io.Copy(h, sr); err != nil {
+		return fmt.Errorf("%s: can't read records: %s", rd.fn, err)
+	}
+	sum := val[8+ed25519.PublicKeySize : 8+ed25519.PublicKeySize+sha512.Size256]
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("%s: %w: records don't match the signed digest", rd.fn, ErrSignature)
+	}
+	return nil
+}
+
+// Signer returns the public key that signed the DB; nil if it isn't signed.
+// The signature is only verified by readers opened with WithTrustedKeys().
+func (rd *DBReader) Signer() ed25519.PublicKey {
+	return rd.signer
+}
@@ -0,0 +1,204 @@
+// snapshot.go -- read-only snapshot of a DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"sync"
+)
+
+// Snapshot is a lightweight read-only handle on a DBReader. It pins the
+// underlying mmap, file and record cache of the reader; they stay valid
+// until the snapshot is closed - even if the DBReader itself is closed in
+// the meantime. This allows a long running scan or a set of lookups to
+// proceed safely while the application swaps in a newer DB.
+type Snapshot struct {
+	rd   *DBReader
+	once sync.Once
+}
+
+// Snapshot returns a new snapshot of the DB. Callers must Close() the
+// snapshot when done.
+func (rd *DBReader) Snapshot() (*Snapshot, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if rd.closed {
+		return nil, ErrClosed
+	}
+
+	rd.refs++
+	return &Snapshot{rd: rd}, nil
+}
+
+// Len returns the size of the DB lookup table
+func (s *Snapshot) Len() int {
+	return s.rd.Len()
+}
+
+// Find looks up 'key' in the snapshot and returns the corresponding value.
+// See DBReader.Find().
+func (s *Snapshot) Find(key uint64) ([]byte, error) {
+	return s.rd.Find(key)
+}
+
+// Lookup looks up 'key' in the snapshot and returns the corresponding value.
+// See DBReader.Lookup().
+func (s *Snapshot) Lookup(key uint64) ([]byte, bool) {
+	return s.rd.Lookup(key)
+}
+
+// Get looks up 'key' in the snapshot. See DBReader.Get().
+func (s *Snapshot) Get(key uint64) ([]byte, bool, error) {
+	return s.rd.Get(key)
+}
+
+// Iter calls 'fp' for every key, value pair in the snapshot in table
+// order. For keys-only DBs, 'val' is always nil. Iteration stops at the first
+// error returned by 'fp' or when a record can't be read; that error is
+// returned to the caller.
+func (s *Snapshot) Iter(fp func(key uint64, val []byte) error) error {
+	return s.rd.iter(fp)
+}
+
+// Close releases the snapshot. It is safe to call Close more than once.
+func (s *Snapshot) Close() {
+	s.once.Do(s.rd.unref)
+}
+
+// iterate over every occupied slot of the offset table
+func (rd *DBReader) iter(fp func(key uint64, val []byte) error) (err error) {
+	defer catchTableRead(&err)
+
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		for i := uint64(0); i < rd.nkeys; i++ {
+			if !rd.live(i) {
+				continue
+			}
+
+			key := rd.keyAt(i)
+
+			if err := fp(key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var reqs []readReq
+	var keys []uint64
+	var dbuf []byte
+
+	flush := func() error {
+		rd.readBatch(reqs)
+		for i := range reqs {
+			r := &reqs[i]
+			if r.err == nil {
+				r.err = rd.checkRecord(r.buf, r.off, r.slot)
+			}
+			if r.err != nil {
+				return r.err
+			}
+
+			val := r.buf[8:]
+			if rd.codec != nil && len(val) > 0 {
+				var err error
+				if dbuf, err = rd.decode(dbuf[:0], val); err != nil {
+					return err
+				}
+				val = dbuf
+			}
+			if err := fp(keys[i], val); err != nil {
+				return err
+			}
+		}
+
+		reqs = reqs[:0]
+		keys = keys[:0]
+		return nil
+	}
+
+	for i := uint64(0); i < rd.nkeys; i++ {
+		if !rd.live(i) {
+			continue
+		}
+
+		key := rd.keyAt(i)
+		off := rd.offAt(i)
+		vlen := rd.vlenAt(i)
+		if vlen == 0 {
+			// empty values have no record on disk; keep the table order
+			if len(reqs) > 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			if err := fp(key, []byte{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := rd.checkExtent(off, vlen, i); err != nil {
+			return err
+		}
+
+		reqs = append(reqs, readReq{
+			off:  off,
+			slot: i,
+			buf:  make([]byte, int(vlen)+8),
+		})
+		keys = append(keys, key)
+
+		if len(reqs) == _BatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(reqs) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// has returns true if slot 'i' of the offset table holds 'key'
+func (rd *DBReader) has(i, key uint64) bool {
+	if rd.secret != nil {
+		return rd.hasSecret(i, key)
+	}
+	if rd.keyAt(i) != key || rd.deleted(i) {
+		return false
+	}
+
+	// empty slots have key 0; records are always past the file header
+	switch {
+	case key != 0:
+		return true
+	case (rd.flags & _DB_KeysOnly) > 0:
+		return (rd.flags & _DB_ZeroKey) > 0
+	default:
+		return rd.offAt(i) != 0
+	}
+}
+
+// used returns true if slot 'i' of the offset table holds a key
+func (rd *DBReader) used(i uint64) bool {
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		// empty slots are zero; a real key 0 hashes to its own slot
+		if rd.keyAt(i) != 0 {
+			return true
+		}
+		return (rd.flags&_DB_ZeroKey) > 0 && rd.chd.Find(0) == i
+	}
+
+	// records are always past the file header; so offset 0 is an empty slot
+	return rd.offAt(i) != 0
+}
@@ -0,0 +1,84 @@
+// sparse.go -- padding as file holes
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Padding of at least this many bytes is left as a hole in the file;
+// smaller gaps don't free up any disk blocks and are written as zeroes.
+const _HoleMin = 4096
+
+// pad the DB file with zeroes up to offset 'off'. Large gaps are skipped
+// over - leaving a hole that reads back as zeroes and takes no disk space.
+// The padding is never part of the metadata checksum.
+func (w *DBWriter) padTo(off uint64) error {
+	if off <= w.off {
+		return nil
+	}
+
+	n := off - w.off
+	if n >= _HoleMin {
+		if _, err := w.fd.Seek(int64(n), io.SeekCurrent); err != nil {
+			return err
+		}
+	} else {
+		zeroes := make([]byte, n)
+		if _, err := writeAll(w.fd, zeroes); err != nil {
+			return err
+		}
+	}
+
+	w.off = off
+	return nil
+}
+
+// copy 's' to 'd' preserving holes: blocks of _HoleMin zeroes are skipped
+// over rather than written.
+func copySparse(d, s *os.File) error {
+	var zero [_HoleMin]byte
+	var size int64
+
+	buf := make([]byte, 64*_HoleMin)
+	for {
+		n, rerr := io.ReadFull(s, buf)
+		for b := buf[:n]; len(b) > 0; {
+			z := len(b)
+			if z > _HoleMin {
+				z = _HoleMin
+			}
+
+			var err error
+			if bytes.Equal(b[:z], zero[:z]) {
+				_, err = d.Seek(int64(z), io.SeekCurrent)
+			} else {
+				_, err = writeAll(d, b[:z])
+			}
+			if err != nil {
+				return err
+			}
+			b = b[z:]
+		}
+		size += int64(n)
+
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			// a trailing hole isn't materialized by the seek alone
+			return d.Truncate(size)
+		default:
+			return rerr
+		}
+	}
+}
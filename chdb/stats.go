@@ -0,0 +1,92 @@
+// stats.go -- DBReader lookup and i/o counters
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"sync/atomic"
+)
+
+// ReaderStats is a point-in-time copy of the counters of a DBReader
+type ReaderStats struct {
+	// keys looked up via Find(), FindInto(), FindMany() and friends
+	Lookups uint64 `json:"lookups"`
+
+	// lookups that found the key; CacheHits of them were served from
+	// the record cache
+	Hits      uint64 `json:"hits"`
+	CacheHits uint64 `json:"cache_hits"`
+
+	// lookups of keys that aren't in the DB
+	Misses uint64 `json:"misses"`
+
+	// records that failed the checksum
+	ChecksumFailures uint64 `json:"checksum_failures"`
+
+	// record bytes read from the DB file (including scans and
+	// verification)
+	BytesRead uint64 `json:"bytes_read"`
+}
+
+// the live counters; updated atomically. This is allocated separately from
+// the DBReader to keep the counters 64-bit aligned on 32-bit platforms.
+type readerStats struct {
+	lookups   uint64
+	hits      uint64
+	cacheHits uint64
+	misses    uint64
+	csumFail  uint64
+	bytesRead uint64
+}
+
+// Stats returns the lookup and i/o counters of the DB reader. The counters
+// accumulate over the life of the reader and are shared with its snapshots.
+func (rd *DBReader) Stats() ReaderStats {
+	s := rd.stats
+	return ReaderStats{
+		Lookups:          atomic.LoadUint64(&s.lookups),
+		Hits:             atomic.LoadUint64(&s.hits),
+		CacheHits:        atomic.LoadUint64(&s.cacheHits),
+		Misses:           atomic.LoadUint64(&s.misses),
+		ChecksumFailures: atomic.LoadUint64(&s.csumFail),
+		BytesRead:        atomic.LoadUint64(&s.bytesRead),
+	}
+}
+
+// Stats returns the counters of the underlying DB reader.
+// See DBReader.Stats().
+func (s *Snapshot) Stats() ReaderStats {
+	return s.rd.Stats()
+}
+
+func (s *readerStats) lookup() {
+	atomic.AddUint64(&s.lookups, 1)
+}
+
+func (s *readerStats) hit() {
+	atomic.AddUint64(&s.hits, 1)
+}
+
+func (s *readerStats) cacheHit() {
+	atomic.AddUint64(&s.hits, 1)
+	atomic.AddUint64(&s.cacheHits, 1)
+}
+
+func (s *readerStats) miss() {
+	atomic.AddUint64(&s.misses, 1)
+}
+
+func (s *readerStats) csumFailed() {
+	atomic.AddUint64(&s.csumFail, 1)
+}
+
+func (s *readerStats) read(n int) {
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+}
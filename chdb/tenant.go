@@ -0,0 +1,110 @@
+// tenant.go -- many tenants in one DB
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+// keeps tenant 0 from mapping keys to themselves
+const _TenantSalt uint64 = 0x9e3779b97f4a7c15
+
+// TenantKey returns the key stored in a shared DB for the key 'key' of
+// tenant 'tenant'. For a given tenant, distinct keys always map to distinct
+// stored keys; keys of different tenants collide only with the probability
+// of a random 64-bit collision. So many tenants can share one DB while
+// keeping their key spaces disjoint.
+func TenantKey(tenant, key uint64) uint64 {
+	return fmix64(key ^ fmix64(tenant^_TenantSalt))
+}
+
+// murmur3 64-bit finalizer; it is a bijection
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// TenantDBWriter adds the records of one tenant to a shared DBWriter
+type TenantDBWriter struct {
+	w      *DBWriter
+	tenant uint64
+}
+
+// TenantWriter returns a writer that adds the records of tenant 'tenant' to
+// 'w'; every key is mapped with TenantKey(). The shared DBWriter is frozen
+// as usual once all the tenants are added.
+func TenantWriter(w *DBWriter, tenant uint64) *TenantDBWriter {
+	return &TenantDBWriter{w, tenant}
+}
+
+// Tenant returns the tenant ID of the writer
+func (t *TenantDBWriter) Tenant() uint64 {
+	return t.tenant
+}
+
+// Add adds a single key, value pair of the tenant; see DBWriter.Add().
+func (t *TenantDBWriter) Add(key uint64, val []byte) error {
+	return t.w.Add(TenantKey(t.tenant, key), val)
+}
+
+// AddKeyVals adds a series of key-value pairs of the tenant; see
+// DBWriter.AddKeyVals().
+func (t *TenantDBWriter) AddKeyVals(keys []uint64, vals [][]byte) (int, error) {
+	return t.w.AddKeyVals(tenantKeys(t.tenant, keys), vals)
+}
+
+// TenantDBReader looks up the keys of one tenant in a shared DBReader
+type TenantDBReader struct {
+	rd     *DBReader
+	tenant uint64
+}
+
+// TenantReader returns a reader that looks up the keys of tenant 'tenant' in
+// 'rd'; every key is mapped with TenantKey(). Closing 'rd' invalidates the
+// tenant reader.
+func TenantReader(rd *DBReader, tenant uint64) *TenantDBReader {
+	return &TenantDBReader{rd, tenant}
+}
+
+// Tenant returns the tenant ID of the reader
+func (t *TenantDBReader) Tenant() uint64 {
+	return t.tenant
+}
+
+// Find looks up the tenant's 'key'; see DBReader.Find().
+func (t *TenantDBReader) Find(key uint64) ([]byte, error) {
+	return t.rd.Find(TenantKey(t.tenant, key))
+}
+
+// Lookup looks up the tenant's 'key'; see DBReader.Lookup().
+func (t *TenantDBReader) Lookup(key uint64) ([]byte, bool) {
+	return t.rd.Lookup(TenantKey(t.tenant, key))
+}
+
+// FindInto looks up the tenant's 'key' and reads its value into 'buf'; see
+// DBReader.FindInto().
+func (t *TenantDBReader) FindInto(key uint64, buf []byte) ([]byte, error) {
+	return t.rd.FindInto(TenantKey(t.tenant, key), buf)
+}
+
+// FindMany looks up all the tenant's 'keys'; see DBReader.FindMany().
+func (t *TenantDBReader) FindMany(keys []uint64) ([][]byte, error) {
+	return t.rd.FindMany(tenantKeys(t.tenant, keys))
+}
+
+// map 'keys' of tenant 'tenant' to a new slice of stored keys
+func tenantKeys(tenant uint64, keys []uint64) []uint64 {
+	tk := make([]uint64, len(keys))
+	for i, k := range keys {
+		tk[i] = TenantKey(tenant, k)
+	}
+	return tk
+}
@@ -0,0 +1,167 @@
+// tombstone.go -- mask keys of a frozen DB without rebuilding it
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// A tombstone file lists the keys to treat as absent; all multibyte ints
+// are little-endian:
+//   - magic    [4]byte "CHDT"
+//   - resv     [4]byte
+//   - n        uint64  number of keys that follow
+//   - n keys   uint64  in increasing order; no duplicates
+//
+// The keys are application keys (i.e., before any KeyTransform).
+
+// Tombstones is a set of keys to mask in a DB; e.g., records found to be bad
+// after the DB was built. Write it to a file with WriteFile() and open the
+// DB with WithTombstones(). It is not safe for concurrent use.
+type Tombstones struct {
+	keys map[uint64]bool
+}
+
+// NewTombstones returns an empty set of tombstones
+func NewTombstones() *Tombstones {
+	return &Tombstones{
+		keys: make(map[uint64]bool),
+	}
+}
+
+// ReadTombstones reads the tombstone file 'fn'; e.g., to add more keys to it
+func ReadTombstones(fn string) (*Tombstones, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 16 || string(b[:4]) != "CHDT" {
+		return nil, fmt.Errorf("%s: bad tombstone magic", fn)
+	}
+
+	le := binary.LittleEndian
+	n := le.Uint64(b[8:])
+	b = b[16:]
+	if uint64(len(b)) != n*8 || n > uint64(len(b)) {
+		return nil, fmt.Errorf("%s: corrupt tombstones; exp %d keys in %d bytes", fn, n, len(b))
+	}
+
+	t := NewTombstones()
+	var prev uint64
+	for i := uint64(0); i < n; i++ {
+		k := le.Uint64(b[i*8:])
+		if i > 0 && k <= prev {
+			return nil, fmt.Errorf("%s: corrupt tombstones; keys out of order", fn)
+		}
+		t.keys[k] = true
+		prev = k
+	}
+	return t, nil
+}
+
+// Add adds 'keys' to the set
+func (t *Tombstones) Add(keys ...uint64) {
+	for _, k := range keys {
+		t.keys[k] = true
+	}
+}
+
+// Has returns true if 'key' is in the set
+func (t *Tombstones) Has(key uint64) bool {
+	return t.keys[key]
+}
+
+// Len returns the number of keys in the set
+func (t *Tombstones) Len() int {
+	return len(t.keys)
+}
+
+// Keys returns the keys in the set in increasing order
+func (t *Tombstones) Keys() []uint64 {
+	keys := make([]uint64, 0, len(t.keys))
+	for k := range t.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// WriteFile atomically replaces the tombstone file 'fn' with the keys in
+// the set.
+func (t *Tombstones) WriteFile(fn string) error {
+	keys := t.Keys()
+	b := make([]byte, 16+8*len(keys))
+
+	le := binary.LittleEndian
+	copy(b[:4], []byte{'C', 'H', 'D', 'T'})
+	le.PutUint64(b[8:], uint64(len(keys)))
+	for i, k := range keys {
+		le.PutUint64(b[16+i*8:], k)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp.%d", fn, rand32())
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// WithTombstones makes the DBReader treat the keys in the tombstone file
+// 'fn' (see Tombstones) as absent: lookups return ErrNoKey and iteration,
+// Scan() and VerifyAll() skip their records. Keys that aren't in the DB are
+// ignored. The DB fails to open if the file can't be read.
+func WithTombstones(fn string) ReaderOption {
+	return func(o *readerOpts) {
+		o.tombfn = fn
+	}
+}
+
+// mark the slots of the keys in the tombstone file 'fn' as deleted
+func (rd *DBReader) loadTombstones(fn string) (err error) {
+	defer catchTableRead(&err)
+
+	t, err := ReadTombstones(fn)
+	if err != nil {
+		return err
+	}
+
+	dead := make([]uint64, (rd.nkeys+63)/64)
+	for k := range t.keys {
+		key := rd.xkey(k)
+		if i := rd.chd.Find(key); rd.has(i, key) {
+			dead[i/64] |= 1 << (i % 64)
+		}
+	}
+
+	rd.dead = dead
+	return nil
+}
+
+// return true if the key in slot 'i' is masked by a tombstone
+func (rd *DBReader) deleted(i uint64) bool {
+	return rd.dead != nil && (rd.dead[i/64]&(1<<(i%64))) != 0
+}
+
+// return true if slot 'i' holds a key that isn't masked
+func (rd *DBReader) live(i uint64) bool {
+	return rd.used(i) && !rd.deleted(i)
+}
@@ -0,0 +1,45 @@
+// trace.go -- lookup tracing hooks
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"time"
+)
+
+// Tracer receives a callback at the start and end of every lookup done by
+// a DBReader (Find(), FindInto(), FindMany() and the calls built on them).
+// It lets applications trace individual lookups - e.g., as OpenTelemetry
+// spans or latency histograms - without wrapping every call site.
+//
+// OnLookupEnd is called with 'hit' set if the key was found; 'err' is nil
+// for keys that aren't in the DB and is only set if the lookup failed (disk
+// i/o, checksum etc.). The hooks are called synchronously on the lookup
+// path and must be safe for concurrent use.
+type Tracer interface {
+	OnLookupStart(key uint64)
+	OnLookupEnd(key uint64, hit bool, dur time.Duration, err error)
+}
+
+// WithTracer makes the DBReader call the hooks of 't' around every lookup
+func WithTracer(t Tracer) ReaderOption {
+	return func(o *readerOpts) {
+		o.tracer = t
+	}
+}
+
+// finish tracing the lookup of 'key' started at 't0' that returned 'err'
+func (rd *DBReader) traceEnd(key uint64, t0 time.Time, err error) {
+	hit := err == nil
+	if err == ErrNoKey {
+		err = nil
+	}
+	rd.tracer.OnLookupEnd(key, hit, time.Since(t0), err)
+}
@@ -0,0 +1,117 @@
+// transform.go -- key transforms
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+)
+
+// KeyTransform maps application keys to the keys stored in a DB; e.g., to
+// mask tenant bits or to apply a versioned salt. A DBWriter built with
+// WithWriterKeyTransform() transforms every key it is given and records the
+// transform ID in the file header. A DBReader with WithKeyTransform()
+// transforms every key before looking it up; opening a DB that records a
+// different transform (or opening it without one) fails. Keys returned by
+// Iter() and Scan() are the stored keys.
+type KeyTransform interface {
+	// ID identifies the transform in the file header; it must be non-zero.
+	ID() uint32
+
+	// Transform returns the stored key for the application key 'key'
+	Transform(key uint64) uint64
+}
+
+// NewKeyTransform returns a KeyTransform with the given ID that maps keys
+// with 'fn'.
+func NewKeyTransform(id uint32, fn func(key uint64) uint64) KeyTransform {
+	return &funcTransform{id, fn}
+}
+
+type funcTransform struct {
+	id uint32
+	fn func(key uint64) uint64
+}
+
+func (t *funcTransform) ID() uint32 {
+	return t.id
+}
+
+func (t *funcTransform) Transform(key uint64) uint64 {
+	return t.fn(key)
+}
+
+// WithKeyTransform makes the DBReader apply 't' to every key before looking
+// it up; see KeyTransform.
+func WithKeyTransform(t KeyTransform) ReaderOption {
+	return func(o *readerOpts) {
+		o.xform = t
+	}
+}
+
+// WithWriterKeyTransform makes the DBWriter apply 't' to every key it is
+// given and record the ID of 't' in the file header; see KeyTransform.
+func WithWriterKeyTransform(t KeyTransform) WriterOption {
+	return func(o *writerOpts) {
+		o.xform = t
+	}
+}
+
+// withStoredKeys tells the DBWriter that the keys it is given are already
+// transformed by the key transform 'id'; e.g., when copying another DB.
+func withStoredKeys(id uint32) WriterOption {
+	return func(o *writerOpts) {
+		o.xformID = id
+	}
+}
+
+// withoutTransform opens a DB without checking its key transform; lookups
+// then need stored keys.
+func withoutTransform() ReaderOption {
+	return func(o *readerOpts) {
+		o.rawKeys = true
+	}
+}
+
+// ID of the key transform to record in the header
+func (o *writerOpts) transformID() uint32 {
+	if o.xform != nil {
+		return o.xform.ID()
+	}
+	return o.xformID
+}
+
+// KeyTransform returns the ID of the key transform recorded in the DB
+// header; 0 if none.
+func (rd *DBReader) KeyTransform() uint32 {
+	return rd.xformID
+}
+
+// make sure the key transform of the reader matches the one of the DB
+func (rd *DBReader) checkTransform(t KeyTransform, raw bool) error {
+	switch {
+	case rd.xformID == 0 || raw:
+	case t == nil:
+		return fmt.Errorf("%s: keys need transform %#x", rd.fn, rd.xformID)
+	case t.ID() != rd.xformID:
+		return fmt.Errorf("%s: keys need transform %#x; saw %#x", rd.fn, rd.xformID, t.ID())
+	}
+
+	rd.xform = t
+	return nil
+}
+
+// return the stored key for application key 'key'
+func (rd *DBReader) xkey(key uint64) uint64 {
+	if rd.xform == nil {
+		return key
+	}
+	return rd.xform.Transform(key)
+}
@@ -0,0 +1,247 @@
+// verify.go -- parallel verification of all the records in a DB
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// VerifyPolicy determines how often the DBReader validates the checksum of
+// the records it reads from disk.
+type VerifyPolicy int
+
+const (
+	// VerifyAlways validates every record read from disk (the default)
+	VerifyAlways VerifyPolicy = iota
+
+	// VerifyOnce validates a record only the first time it is read; the
+	// verified records are tracked in a bitmask (one bit per slot).
+	// VerifyAll() marks every good record as verified.
+	VerifyOnce
+
+	// VerifyNever skips record validation; use it only for DBs on trusted
+	// media or DBs that were verified out of band. The metadata is still
+	// verified when the DB is opened.
+	VerifyNever
+)
+
+// Integrity determines how much of the DB the DBReader verifies when it
+// opens the DB.
+type Integrity int
+
+const (
+	// MetadataVerify validates the strong checksum of the header, the
+	// offset table and the hash table (the default). It reads all the
+	// metadata once.
+	MetadataVerify Integrity = iota
+
+	// HeaderOnly only sanity checks the header and the table sizes; it is
+	// the fastest way to open a large DB that is known to be good.
+	HeaderOnly
+
+	// FullVerify validates the metadata and every record (see VerifyAll());
+	// NewDBReader fails if any record is corrupt.
+	FullVerify
+)
+
+// WithIntegrity sets how much of the DB the DBReader verifies when it opens
+// the DB.
+func WithIntegrity(l Integrity) ReaderOption {
+	return func(o *readerOpts) {
+		o.integrity = l
+	}
+}
+
+// WithVerify sets how often the DBReader validates the records it reads
+func WithVerify(p VerifyPolicy) ReaderOption {
+	return func(o *readerOpts) {
+		o.verify = p
+	}
+}
+
+// validate the record in slot 'i' at offset 'off' already read into 'data' -
+// as dictated by the verification policy.
+func (rd *DBReader) checkRecord(data []byte, off, i uint64) error {
+	switch rd.verify {
+	case VerifyNever:
+		return nil
+	case VerifyOnce:
+		w := &rd.verified[i/64]
+		bit := uint64(1) << (i % 64)
+		if atomic.LoadUint64(w)&bit != 0 {
+			return nil
+		}
+		if err := rd.verifyRecord(data, off); err != nil {
+			return err
+		}
+		rd.markVerified(i)
+		return nil
+	}
+	return rd.verifyRecord(data, off)
+}
+
+// remember that the record in slot 'i' is good
+func (rd *DBReader) markVerified(i uint64) {
+	if rd.verified == nil {
+		return
+	}
+
+	w := &rd.verified[i/64]
+	bit := uint64(1) << (i % 64)
+	for {
+		old := atomic.LoadUint64(w)
+		if old&bit != 0 || atomic.CompareAndSwapUint64(w, old, old|bit) {
+			return
+		}
+	}
+}
+
+// VerifyRange is the outcome of verifying a contiguous range of records
+type VerifyRange struct {
+	// file offsets of the first byte of the range and one past its last
+	Start, End uint64
+
+	// number of records verified in this range
+	Records uint64
+
+	// keys whose records failed the checksum
+	Corrupt []uint64
+
+	// i/o error (or cancellation) that stopped the verification of this range
+	Err error
+}
+
+// OK returns true if every record in the range was verified successfully
+func (v *VerifyRange) OK() bool {
+	return v.Err == nil && len(v.Corrupt) == 0
+}
+
+// Report is the outcome of DBReader.VerifyAll()
+type Report struct {
+	// total number of records verified
+	Records uint64
+
+	// ranges in file order
+	Ranges []VerifyRange
+}
+
+// OK returns true if every record in the DB was verified successfully
+func (r *Report) OK() bool {
+	for i := range r.Ranges {
+		if !r.Ranges[i].OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// Failures returns the ranges that had corrupt records or errors
+func (r *Report) Failures() []VerifyRange {
+	var f []VerifyRange
+	for i := range r.Ranges {
+		if !r.Ranges[i].OK() {
+			f = append(f, r.Ranges[i])
+		}
+	}
+	return f
+}
+
+// VerifyAll validates the checksum of every record in the DB. The record
+// region of the file is split into 'parallelism' ranges (default: number of
+// CPUs) that are read sequentially and verified concurrently. Verification
+// doesn't stop at a corrupt record; all failures are collected in the
+// returned report. The metadata is already verified by NewDBReader(); keys-only
+// DBs have no records and always verify successfully.
+//
+// VerifyAll returns an error only if 'ctx' is cancelled or the lookup tables
+// can't be read (see WithWindowedReads()); the report then covers the
+// records verified until that point.
+func (rd *DBReader) VerifyAll(ctx context.Context, parallelism int) (_ Report, err error) {
+	defer catchTableRead(&err)
+
+	var r Report
+
+	if (rd.flags & _DB_KeysOnly) > 0 {
+		return r, nil
+	}
+
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	slots := rd.sortedSlots()
+	if len(slots) == 0 {
+		return r, nil
+	}
+	if parallelism > len(slots) {
+		parallelism = len(slots)
+	}
+
+	// split the slots into ranges of roughly equal number of records
+	r.Ranges = make([]VerifyRange, parallelism)
+	bounds := make([]int, parallelism+1)
+	for i := range bounds {
+		bounds[i] = i * len(slots) / parallelism
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		go func(v *VerifyRange, slots []uint64) {
+			defer wg.Done()
+			rd.verifyRange(ctx, v, slots)
+		}(&r.Ranges[i], slots[bounds[i]:bounds[i+1]])
+	}
+	wg.Wait()
+
+	for i := range r.Ranges {
+		r.Records += r.Ranges[i].Records
+	}
+	return r, ctx.Err()
+}
+
+// verify the records of 'slots' (in file order) and record the outcome in 'v'
+func (rd *DBReader) verifyRange(ctx context.Context, v *VerifyRange, slots []uint64) {
+	defer catchTableRead(&v.Err)
+
+	first, last := slots[0], slots[len(slots)-1]
+	v.Start = rd.offAt(first)
+	v.End = rd.offAt(last)
+	if n := rd.vlenAt(last); n > 0 {
+		v.End += 8 + uint64(n)
+	}
+
+	v.Err = rd.scanSlots(slots, func(i, key, off uint64, data []byte) error {
+		// empty values have no record to verify
+		if data == nil {
+			return nil
+		}
+
+		// don't check for cancellation on every record
+		if v.Records%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		v.Records++
+		if err := rd.verifyRecord(data, off); err != nil {
+			v.Corrupt = append(v.Corrupt, key)
+		} else {
+			rd.markVerified(i)
+		}
+		return nil
+	})
+}
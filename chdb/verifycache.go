@@ -0,0 +1,101 @@
+// verifycache.go -- remember successful metadata verification across opens
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// The verification token is a small sidecar file that records the identity
+// of a DB whose metadata checksum was verified:
+//
+//	magic   [4]byte "CHDV"
+//	resv    [4]byte zeroes
+//	size    uint64  file size
+//	mtime   int64   modification time in nanoseconds
+//	dev     uint64  device of the file
+//	ino     uint64  inode of the file
+//	csum    [32]byte the metadata checksum (trailer) of the DB
+//
+// All multibyte ints are big-endian. A DB that is rewritten in place or
+// replaced changes at least one of these.
+const _VerifyTokenSize = 4 + 4 + 8 + 8 + 8 + 8 + 32
+
+// WithVerifyCache makes the DBReader remember a successful metadata
+// verification in the sidecar file 'fn' (the DB file name + ".verified" if
+// 'fn' is empty). Later opens of the unchanged DB skip the expensive
+// metadata checksum. The sidecar is written on a best effort basis; failure
+// to write it doesn't fail the open.
+func WithVerifyCache(fn string) ReaderOption {
+	return func(o *readerOpts) {
+		o.vcache = true
+		o.vcachefn = fn
+	}
+}
+
+// WithForceVerify makes the DBReader verify the metadata checksum even if
+// the verification cache says the DB is unchanged; the cache is refreshed
+// after a successful verification.
+func WithForceVerify() ReaderOption {
+	return func(o *readerOpts) {
+		o.forceVerify = true
+	}
+}
+
+// make the verification token of the open DB described by 'st'
+func (rd *DBReader) verifyToken(st os.FileInfo) ([]byte, error) {
+	var tok [_VerifyTokenSize]byte
+	var dev, ino uint64
+
+	if s, ok := st.Sys().(*syscall.Stat_t); ok {
+		dev = uint64(s.Dev)
+		ino = uint64(s.Ino)
+	}
+
+	be := binary.BigEndian
+	copy(tok[:4], []byte{'C', 'H', 'D', 'V'})
+	be.PutUint64(tok[8:], uint64(st.Size()))
+	be.PutUint64(tok[16:], uint64(st.ModTime().UnixNano()))
+	be.PutUint64(tok[24:], dev)
+	be.PutUint64(tok[32:], ino)
+
+	if _, err := rd.fd.ReadAt(tok[40:], st.Size()-32); err != nil {
+		return nil, fmt.Errorf("%s: checksum i/o error: %s", rd.fn, err)
+	}
+	return tok[:], nil
+}
+
+// return true if the sidecar 'fn' holds the token 'tok'
+func validToken(fn string, tok []byte) bool {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(b, tok)
+}
+
+// atomically replace the sidecar 'fn' with the token 'tok'
+func writeToken(fn string, tok []byte) error {
+	tmp := fmt.Sprintf("%s.tmp.%d", fn, rand32())
+	if err := ioutil.WriteFile(tmp, tok, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
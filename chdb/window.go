@@ -0,0 +1,129 @@
+// window.go -- map the offset and vlen tables in windows
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdb
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"syscall"
+)
+
+// largest mapping the platform can address
+const _MaxMapWindow = uint64(^uint(0) >> 1)
+
+// smallest map window; it holds a whole number of pages of both tables
+const _MinMapWindow = 64 * 1024
+
+// WithMapWindow limits each mmap(2) of the DB metadata to 'n' bytes (rounded
+// down to a power of two; at least 64KB). When the metadata is larger, the
+// offset and vlen tables are mapped in several windows of 'n' bytes and
+// lookups pick the window of a slot transparently; the CHD table is always
+// mapped whole. This keeps DBs with huge offset tables usable where a single
+// mapping is too large for the platform (or the address space). The default
+// is the largest mapping the platform supports. It has no effect with
+// WithoutMmap().
+func WithMapWindow(n uint64) ReaderOption {
+	return func(o *readerOpts) {
+		o.window = n
+	}
+}
+
+// effective size of a map window
+func mapWindow(o *readerOpts) uint64 {
+	win := o.window
+	if win == 0 {
+		return _MaxMapWindow
+	}
+
+	min := uint64(_MinMapWindow)
+	if pg := 16 * uint64(os.Getpagesize()); pg > min {
+		min = pg
+	}
+	if win < min {
+		win = min
+	}
+	return uint64(1) << uint(bits.Len64(win)-1)
+}
+
+// use 'off' and 'vlen' as the (single window) offset and vlen tables
+func (rd *DBReader) setTables(off, vlen []byte) {
+	rd.wshift = 63
+	rd.wmask = (1 << 63) - 1
+	rd.offset = [][]uint64{bsToUint64Slice(off)}
+	if len(vlen) > 0 {
+		rd.vlen = [][]uint32{bsToUint32Slice(vlen)}
+	}
+}
+
+// map the offset and vlen tables at file offset 'off' in windows of at most
+// 'win' bytes (see mapWindow()); the metadata is 'sz' bytes long and the
+// CHD table starts at 'chdoff' (relative to 'off'). It returns the CHD table.
+func (rd *DBReader) mapWindows(off, offsz, vlensz, chdoff, sz, win uint64) ([]byte, error) {
+	pgsz := uint64(os.Getpagesize())
+
+	// a window holds 2^shift slots of either table
+	shift := uint(bits.Len64(win/16) - 1)
+	slots := uint64(1) << shift
+
+	esz := offsz / rd.nkeys
+	nwin := (rd.nkeys + slots - 1) / slots
+
+	if sz-chdoff > win {
+		return nil, fmt.Errorf("%s: %w: hash table of %d bytes exceeds the %d byte map window",
+			rd.fn, ErrMapLimit, sz-chdoff, win)
+	}
+
+	rd.wshift = shift
+	rd.wmask = slots - 1
+	rd.offset = make([][]uint64, 0, nwin)
+	if vlensz > 0 {
+		rd.vlen = make([][]uint32, 0, nwin)
+	}
+
+	for j := uint64(0); j < nwin; j++ {
+		n := slots
+		if rem := rd.nkeys - j*slots; rem < n {
+			n = rem
+		}
+
+		bs, err := rd.mapRange(off+j*slots*esz, n*esz, pgsz)
+		if err != nil {
+			return nil, err
+		}
+		rd.offset = append(rd.offset, bsToUint64Slice(bs))
+
+		if vlensz > 0 {
+			if bs, err = rd.mapRange(off+offsz+j*slots*4, n*4, pgsz); err != nil {
+				return nil, err
+			}
+			rd.vlen = append(rd.vlen, bsToUint32Slice(bs))
+		}
+	}
+
+	return rd.mapRange(off+chdoff, sz-chdoff, pgsz)
+}
+
+// mmap 'sz' bytes at file offset 'off' which need not be page aligned
+func (rd *DBReader) mapRange(off, sz, pgsz uint64) ([]byte, error) {
+	start := off &^ (pgsz - 1)
+	skip := off - start
+
+	bs, err := syscall.Mmap(int(rd.fd.Fd()), int64(start), int(sz+skip), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: can't mmap window %d of %d bytes at off %d: %s",
+			rd.fn, ErrMapLimit, len(rd.windows), sz, off, err)
+	}
+
+	rd.windows = append(rd.windows, bs)
+	rd.metasz += sz
+	return bs[skip : skip+sz], nil
+}
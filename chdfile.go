@@ -0,0 +1,144 @@
+// chdfile.go -- standalone MPH files
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// MPH file format - all multibyte ints are little-endian:
+//   - 32 byte header:
+//      * magic    [4]byte "CHDF"
+//      * version  byte    currently 1
+//      * resv     [3]byte
+//      * salt     uint64
+//      * nslots   uint64  number of slots of the table
+//      * size     uint64  size of the marshalled table
+//   - the table as written by Chd.MarshalBinary()
+//   - 32 bytes of strong checksum (SHA512_256) over the header and table
+
+const _ChdFileHeaderSize = 32
+
+// WriteFile writes the lookup table to a standalone, checksummed file 'fn'
+// that can be read back with LoadChdFile(). It is meant for users who only
+// need the minimal perfect hash; there are no keys or values in the file.
+// The file is written to a temporary file and renamed into place.
+func (c *Chd) WriteFile(fn string) error {
+	var tbl bytes.Buffer
+
+	if _, err := c.MarshalBinary(&tbl); err != nil {
+		return fmt.Errorf("%s: can't marshal table: %w", fn, err)
+	}
+
+	var hdr [_ChdFileHeaderSize]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'F'})
+	hdr[4] = 1
+	le.PutUint64(hdr[8:], c.salt)
+	le.PutUint64(hdr[16:], uint64(c.Len()))
+	le.PutUint64(hdr[24:], uint64(tbl.Len()))
+
+	h := sha512.New512_256()
+	h.Write(hdr[:])
+	h.Write(tbl.Bytes())
+
+	fd, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp.")
+	if err != nil {
+		return err
+	}
+
+	tmp := fd.Name()
+	abort := func(err error) error {
+		fd.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	for _, b := range [][]byte{hdr[:], tbl.Bytes(), h.Sum(nil)} {
+		if _, err := writeAll(fd, b); err != nil {
+			return abort(err)
+		}
+	}
+	if err := fd.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := fd.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// LoadChdFile reads a lookup table previously written by Chd.WriteFile()
+// from file 'fn'. The checksum, salt and size of the table are verified
+// before it is returned.
+func LoadChdFile(fn string) (*Chd, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < _ChdFileHeaderSize+32 {
+		return nil, fmt.Errorf("%s: file too small (%d bytes)", fn, len(buf))
+	}
+
+	hdr := buf[:_ChdFileHeaderSize]
+	if string(hdr[:4]) != "CHDF" {
+		return nil, fmt.Errorf("%s: bad MPH file magic", fn)
+	}
+	if hdr[4] != 1 {
+		return nil, fmt.Errorf("%s: no support to read MPH file version %d", fn, hdr[4])
+	}
+
+	le := binary.LittleEndian
+	salt := le.Uint64(hdr[8:])
+	nslots := le.Uint64(hdr[16:])
+	size := le.Uint64(hdr[24:])
+
+	if size != uint64(len(buf)-_ChdFileHeaderSize-32) {
+		return nil, fmt.Errorf("%s: table size mismatch; exp %d, saw %d bytes",
+			fn, size, len(buf)-_ChdFileHeaderSize-32)
+	}
+
+	body := buf[:len(buf)-32]
+	exp := buf[len(body):]
+
+	h := sha512.New512_256()
+	h.Write(body)
+	csum := h.Sum(nil)
+	if subtle.ConstantTimeCompare(csum, exp) != 1 {
+		return nil, fmt.Errorf("%s: checksum failure; exp %#x, saw %#x", fn, exp, csum)
+	}
+
+	c := &Chd{}
+	if err := c.UnmarshalBinaryMmap(body[_ChdFileHeaderSize:]); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if c.salt != salt {
+		return nil, fmt.Errorf("%s: salt mismatch; exp %#x, saw %#x", fn, salt, c.salt)
+	}
+	if uint64(c.Len()) != nslots {
+		return nil, fmt.Errorf("%s: table has %d slots; exp %d", fn, c.Len(), nslots)
+	}
+	return c, nil
+}
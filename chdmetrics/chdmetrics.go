@@ -0,0 +1,108 @@
+// chdmetrics.go -- publish DBReader counters via expvar
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package chdmetrics publishes the lookup, i/o and memory counters of
+// chdb.DBReaders via expvar; they appear under the "chdb" variable of
+// /debug/vars:
+//
+//	rd, err := chdb.NewDBReader(fn, 0)
+//	...
+//	chdmetrics.Register("users", rd)
+//	defer chdmetrics.Unregister("users")
+//
+// The counters are read when /debug/vars is fetched - so registration
+// doesn't add any cost to lookups. Other metrics systems (e.g., a
+// Prometheus collector) can poll Snapshot() instead.
+package chdmetrics
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// Metrics is a point-in-time view of a registered DB reader
+type Metrics struct {
+	File string `json:"file"`
+	Keys int    `json:"keys"`
+
+	// size of the DB file in bytes
+	FileSize uint64 `json:"file_size"`
+
+	Stats chdb.ReaderStats `json:"stats"`
+	Mem   chdb.MemUsage    `json:"mem"`
+}
+
+var (
+	mu  sync.Mutex
+	dbs = make(map[string]*chdb.DBReader)
+
+	publish sync.Once
+)
+
+// Register publishes the counters of 'rd' under 'label'; an empty label
+// uses the file name of the DB. It returns an error if the label is
+// already registered. Callers must Unregister() the label before closing
+// 'rd'.
+func Register(label string, rd *chdb.DBReader) error {
+	if len(label) == 0 {
+		label = rd.Name()
+	}
+
+	publish.Do(func() {
+		expvar.Publish("chdb", expvar.Func(vars))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := dbs[label]; ok {
+		return fmt.Errorf("chdmetrics: %s is already registered", label)
+	}
+	dbs[label] = rd
+	return nil
+}
+
+// Unregister removes the DB reader registered under 'label'
+func Unregister(label string) {
+	mu.Lock()
+	delete(dbs, label)
+	mu.Unlock()
+}
+
+// Snapshot returns the metrics of every registered DB reader keyed by its
+// label
+func Snapshot() map[string]Metrics {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m := make(map[string]Metrics, len(dbs))
+	for label, rd := range dbs {
+		m[label] = Metrics{
+			File:     rd.Name(),
+			Keys:     rd.Len(),
+			FileSize: rd.FileSize(),
+			Stats:    rd.Stats(),
+			Mem:      rd.MemUsage(),
+		}
+	}
+	return m
+}
+
+// the value of the "chdb" expvar
+func vars() interface{} {
+	m := Snapshot()
+	return struct {
+		Open int                `json:"open"`
+		DBs  map[string]Metrics `json:"dbs"`
+	}{len(m), m}
+}
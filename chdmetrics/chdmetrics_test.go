@@ -0,0 +1,85 @@
+// chdmetrics_test.go -- tests for the expvar metrics
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdmetrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/go-chd/chdtest"
+)
+
+func TestMetrics(t *testing.T) {
+	kv := map[string]string{
+		"apple":  "red",
+		"banana": "yellow",
+		"grape":  "purple",
+	}
+
+	fn := chdtest.BuildDB(t, kv)
+	rd, err := chdb.NewDBReader(fn, 10)
+	if err != nil {
+		t.Fatalf("can't open %s: %s", fn, err)
+	}
+	defer rd.Close()
+
+	if err := Register("fruit", rd); err != nil {
+		t.Fatalf("register: %s", err)
+	}
+	defer Unregister("fruit")
+
+	if err := Register("fruit", rd); err == nil {
+		t.Fatalf("duplicate label registered")
+	}
+
+	for k := range kv {
+		if _, err := rd.Find(chdtest.Key(k)); err != nil {
+			t.Fatalf("can't find %s: %s", k, err)
+		}
+	}
+	if _, err := rd.Find(chdtest.Key("durian")); err != chdb.ErrNoKey {
+		t.Fatalf("found durian: %v", err)
+	}
+
+	var v struct {
+		Open int                `json:"open"`
+		DBs  map[string]Metrics `json:"dbs"`
+	}
+
+	ev := expvar.Get("chdb")
+	if ev == nil {
+		t.Fatalf("chdb expvar not published")
+	}
+	if err := json.Unmarshal([]byte(ev.String()), &v); err != nil {
+		t.Fatalf("can't decode expvar: %s", err)
+	}
+
+	m, ok := v.DBs["fruit"]
+	if !ok || v.Open != 1 {
+		t.Fatalf("exp 1 registered db, saw %d: %+v", v.Open, v)
+	}
+	if m.File != fn || m.FileSize == 0 {
+		t.Fatalf("wrong file info: %+v", m)
+	}
+	if m.Stats.Lookups != 4 || m.Stats.Hits != 3 || m.Stats.Misses != 1 {
+		t.Fatalf("wrong counters: %+v", m.Stats)
+	}
+	if m.Stats.BytesRead == 0 || m.Mem.Mapped == 0 {
+		t.Fatalf("wrong i/o or memory counters: %+v, %+v", m.Stats, m.Mem)
+	}
+
+	Unregister("fruit")
+	if n := len(Snapshot()); n != 0 {
+		t.Fatalf("exp no registered dbs, saw %d", n)
+	}
+}
@@ -0,0 +1,153 @@
+// fake.go -- an in-memory stand-in for chdb.DBReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdtest
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// FakeReader is an in-memory implementation of the lookup methods of
+// chdb.DBReader. Unit tests of code that reads a DB can use it instead of
+// building a DB file on disk. It returns the same errors as DBReader:
+// chdb.ErrNoKey for missing keys and chdb.ErrClosed once it is closed.
+type FakeReader struct {
+	mu     sync.RWMutex
+	kv     map[uint64][]byte
+	keys   []uint64
+	closed bool
+}
+
+var _ chd.Getter = &FakeReader{}
+
+// NewFakeReader returns a FakeReader holding the key, value pairs in 'kv'.
+// The map is copied; later changes to it are not visible to the reader.
+func NewFakeReader(kv map[uint64][]byte) *FakeReader {
+	f := &FakeReader{
+		kv:   make(map[uint64][]byte, len(kv)),
+		keys: make([]uint64, 0, len(kv)),
+	}
+
+	for k, v := range kv {
+		f.kv[k] = append([]byte(nil), v...)
+		f.keys = append(f.keys, k)
+	}
+
+	sort.Slice(f.keys, func(i, j int) bool {
+		return f.keys[i] < f.keys[j]
+	})
+	return f
+}
+
+// Len returns the number of keys
+func (f *FakeReader) Len() int {
+	return len(f.keys)
+}
+
+// Find returns the value of 'key'; see chdb.DBReader.Find()
+func (f *FakeReader) Find(key uint64) ([]byte, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return nil, chdb.ErrClosed
+	}
+
+	v, ok := f.kv[key]
+	if !ok {
+		return nil, chdb.ErrNoKey
+	}
+	return v, nil
+}
+
+// FindInto copies the value of 'key' into 'buf'; see chdb.DBReader.FindInto()
+func (f *FakeReader) FindInto(key uint64, buf []byte) ([]byte, error) {
+	v, err := f.Find(key)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf[:0], v...), nil
+}
+
+// FindMany returns the values of all the keys in 'keys'; missing keys have
+// a nil value. See chdb.DBReader.FindMany().
+func (f *FakeReader) FindMany(keys []uint64) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		v, err := f.Find(k)
+		switch err {
+		case nil:
+			if v == nil {
+				v = []byte{}
+			}
+			vals[i] = v
+		case chdb.ErrNoKey:
+		default:
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// Lookup returns the value of 'key' and true if it exists
+func (f *FakeReader) Lookup(key uint64) ([]byte, bool) {
+	v, err := f.Find(key)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Iter calls 'fp' for every key, value pair in increasing order of keys.
+// Iteration stops at the first error returned by 'fp'; that error is
+// returned to the caller. See chdb.Snapshot.Iter().
+func (f *FakeReader) Iter(fp func(key uint64, val []byte) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.closed {
+		return chdb.ErrClosed
+	}
+
+	for _, k := range f.keys {
+		if err := fp(k, f.kv[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan calls 'fn' for every key, value pair in increasing order of keys
+// until it returns false. See chdb.DBReader.Scan().
+func (f *FakeReader) Scan(fn func(key uint64, val []byte) bool) error {
+	stop := io.EOF
+	err := f.Iter(func(k uint64, v []byte) error {
+		if !fn(k, v) {
+			return stop
+		}
+		return nil
+	})
+	if err == stop {
+		err = nil
+	}
+	return err
+}
+
+// Close closes the reader; subsequent lookups fail with chdb.ErrClosed.
+func (f *FakeReader) Close() {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+}
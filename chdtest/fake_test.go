@@ -0,0 +1,82 @@
+// fake_test.go -- tests for the in-memory FakeReader
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdtest
+
+import (
+	"testing"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+func TestFakeReader(t *testing.T) {
+	kv := make(map[uint64][]byte)
+	for i, w := range words {
+		kv[uint64(i+1)] = []byte(w)
+	}
+
+	f := NewFakeReader(kv)
+	if f.Len() != len(kv) {
+		t.Fatalf("exp %d keys, saw %d", len(kv), f.Len())
+	}
+
+	var buf []byte
+	for k, v := range kv {
+		s, err := f.Find(k)
+		if err != nil || string(s) != string(v) {
+			t.Fatalf("find %d: exp '%s', saw '%s' (%v)", k, v, s, err)
+		}
+
+		buf, err = f.FindInto(k, buf)
+		if err != nil || string(buf) != string(v) {
+			t.Fatalf("findinto %d: exp '%s', saw '%s' (%v)", k, v, buf, err)
+		}
+	}
+
+	if _, err := f.Find(0); err != chdb.ErrNoKey {
+		t.Fatalf("find missing key: exp ErrNoKey, saw %v", err)
+	}
+	if _, ok := f.Lookup(0); ok {
+		t.Fatalf("lookup found missing key")
+	}
+
+	vals, err := f.FindMany([]uint64{1, 0, 2})
+	if err != nil || vals[1] != nil || string(vals[0]) != words[0] || string(vals[2]) != words[1] {
+		t.Fatalf("findmany: unexpected result %q (%v)", vals, err)
+	}
+
+	var prev uint64
+	n := 0
+	err = f.Iter(func(k uint64, v []byte) error {
+		if k <= prev {
+			t.Fatalf("iter: key %d after %d", k, prev)
+		}
+		prev = k
+		n++
+		return nil
+	})
+	if err != nil || n != len(kv) {
+		t.Fatalf("iter: exp %d keys, saw %d (%v)", len(kv), n, err)
+	}
+
+	n = 0
+	err = f.Scan(func(k uint64, v []byte) bool {
+		n++
+		return n < 2
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("scan didn't stop: saw %d (%v)", n, err)
+	}
+
+	f.Close()
+	if _, err := f.Find(1); err != chdb.ErrClosed {
+		t.Fatalf("find after close: exp ErrClosed, saw %v", err)
+	}
+}
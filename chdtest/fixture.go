@@ -0,0 +1,70 @@
+// fixture.go -- build small, reproducible DBs for tests
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdtest
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/go-fasthash"
+)
+
+// FixtureSalt is the fixed salt of the DBs built by BuildDB()
+var FixtureSalt = []byte("chdtest-fixture!")
+
+// FixtureKeySeed is the seed of the hash that maps the string keys of
+// BuildDB() to DB keys; see Key().
+const FixtureKeySeed uint64 = 0x6368647465737430
+
+// FixtureTime is the build time recorded in the DBs built by BuildDB()
+var FixtureTime = time.Unix(1514764800, 0).UTC()
+
+// Key returns the DB key of the string key 's' in a DB built by BuildDB()
+func Key(s string) uint64 {
+	return fasthash.Hash64(FixtureKeySeed, []byte(s))
+}
+
+// BuildDB builds a DB of the key, value pairs in 'kv' in a temporary
+// directory and returns its path; the directory is removed when the test
+// ends. Every key is mapped to a DB key with Key(). The DB is built with
+// FixtureSalt and FixtureTime, and the records are added in sorted key
+// order - so the same 'kv' always yields a byte for byte identical file for
+// a given platform and version of this package. Any error fails the test.
+func BuildDB(t testing.TB, kv map[string]string) string {
+	t.Helper()
+
+	fn := filepath.Join(t.TempDir(), "fixture.db")
+	wr, err := chdb.NewDBWriter(fn, chdb.WithSalt(FixtureSalt), chdb.WithBuildTime(FixtureTime))
+	if err != nil {
+		t.Fatalf("chdtest: can't create %s: %s", fn, err)
+	}
+
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := wr.Add(Key(k), []byte(kv[k])); err != nil {
+			wr.Abort()
+			t.Fatalf("chdtest: can't add key '%s': %s", k, err)
+		}
+	}
+
+	if err := wr.Freeze(0.9); err != nil {
+		t.Fatalf("chdtest: can't build %s: %s", fn, err)
+	}
+	return fn
+}
@@ -0,0 +1,54 @@
+// fixture_test.go -- tests for the DB fixture builder
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+func TestBuildDB(t *testing.T) {
+	kv := make(map[string]string)
+	for i, w := range words {
+		kv[w] = words[len(words)-1-i]
+	}
+
+	a := BuildDB(t, kv)
+	b := BuildDB(t, kv)
+
+	x, err := ioutil.ReadFile(a)
+	if err != nil {
+		t.Fatalf("can't read %s: %s", a, err)
+	}
+	y, err := ioutil.ReadFile(b)
+	if err != nil {
+		t.Fatalf("can't read %s: %s", b, err)
+	}
+	if !bytes.Equal(x, y) {
+		t.Fatalf("fixtures %s and %s differ", a, b)
+	}
+
+	rd, err := chdb.NewDBReader(a, 10)
+	if err != nil {
+		t.Fatalf("can't open %s: %s", a, err)
+	}
+	defer rd.Close()
+
+	for k, v := range kv {
+		s, err := rd.Find(Key(k))
+		if err != nil || string(s) != v {
+			t.Fatalf("key '%s': exp '%s', saw '%s' (%v)", k, v, s, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// reference.go -- conformance tests against the reference corpus
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package chdtest provides helpers for testing go-chd and the code that uses
+// it. It also holds the conformance checks against the reference corpus of
+// canonical CHD files in testdata/ref of the go-chd module; ports of the
+// reader to other languages can validate against the same corpus.
+package chdtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// GoldenFile is the name of the file describing the reference corpus
+const GoldenFile = "golden.json"
+
+// Golden describes the expected contents of the reference corpus. All keys
+// and values are hex encoded strings - JSON numbers can't represent all
+// uint64 values in many languages.
+type Golden struct {
+	Version int `json:"version"`
+
+	// Reference DBs built by DBWriter
+	DBs []GoldenDB `json:"dbs"`
+
+	// Reference CHD tables built by ChdBuilder
+	Chds []GoldenChd `json:"chds"`
+}
+
+// GoldenDB describes one reference DB
+type GoldenDB struct {
+	File     string         `json:"file"`
+	KeysOnly bool           `json:"keys_only"`
+	Records  []GoldenRecord `json:"records"`
+
+	// keys that are not in the DB
+	Absent []string `json:"absent"`
+}
+
+// GoldenRecord is a key, value pair in a reference DB
+type GoldenRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// GoldenChd describes a marshaled CHD table (Chd.MarshalBinary()) and its
+// textual form (Chd.MarshalText()) along with the expected index of every
+// key.
+type GoldenChd struct {
+	File    string            `json:"file"`
+	Text    string            `json:"text"`
+	Indexes map[string]uint64 `json:"indexes"`
+}
+
+// ReadGolden reads the description of the reference corpus in 'dir'
+func ReadGolden(dir string) (*Golden, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, GoldenFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var g Golden
+	if err := json.Unmarshal(b, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// VerifyReference verifies the go-chd reader implementation against the
+// reference corpus in 'dir' (testdata/ref in the go-chd module).
+func VerifyReference(t testing.TB, dir string) {
+	t.Helper()
+
+	g, err := ReadGolden(dir)
+	if err != nil {
+		t.Fatalf("%s: can't read golden file: %s", dir, err)
+	}
+
+	if g.Version != 1 {
+		t.Fatalf("%s: unknown golden file version %d", dir, g.Version)
+	}
+
+	for i := range g.DBs {
+		verifyDB(t, dir, &g.DBs[i])
+	}
+
+	for i := range g.Chds {
+		verifyChd(t, dir, &g.Chds[i])
+	}
+}
+
+func verifyDB(t testing.TB, dir string, gd *GoldenDB) {
+	t.Helper()
+
+	fn := filepath.Join(dir, gd.File)
+	rd, err := chdb.NewDBReader(fn, 1)
+	if err != nil {
+		t.Fatalf("%s: %s", fn, err)
+	}
+
+	defer rd.Close()
+
+	if !gd.KeysOnly {
+		verifyVlens(t, fn, gd)
+	}
+
+	for _, r := range gd.Records {
+		k := parseKey(t, fn, r.Key)
+		v, err := rd.Find(k)
+		if err != nil {
+			t.Fatalf("%s: key %s: %s", fn, r.Key, err)
+		}
+
+		if gd.KeysOnly {
+			if v != nil {
+				t.Fatalf("%s: key %s: exp no value, saw %x", fn, r.Key, v)
+			}
+			continue
+		}
+
+		exp, err := hex.DecodeString(r.Value)
+		if err != nil {
+			t.Fatalf("%s: key %s: bad golden value: %s", fn, r.Key, err)
+		}
+		if !bytes.Equal(v, exp) {
+			t.Fatalf("%s: key %s: exp %x, saw %x", fn, r.Key, exp, v)
+		}
+	}
+
+	for _, s := range gd.Absent {
+		k := parseKey(t, fn, s)
+		if v, err := rd.Find(k); err == nil {
+			t.Fatalf("%s: absent key %s found: %x", fn, s, v)
+		}
+	}
+}
+
+// verify the raw vlen table of DB 'fn': it is little-endian on every host;
+// so the lengths must decode as such regardless of the host that wrote the
+// file or runs the test.
+func verifyVlens(t testing.TB, fn string, gd *GoldenDB) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s: %s", fn, err)
+	}
+	if len(b) < 64 {
+		t.Fatalf("%s: file too small", fn)
+	}
+
+	// the header is big-endian: nkeys at 24, offtbl at 32
+	nkeys := binary.BigEndian.Uint64(b[24:])
+	off := binary.BigEndian.Uint64(b[32:]) + nkeys*16
+	if off+nkeys*4 > uint64(len(b)) {
+		t.Fatalf("%s: vlen table past EOF", fn)
+	}
+
+	exp := make(map[uint32]int)
+	for _, r := range gd.Records {
+		exp[uint32(len(r.Value)/2)]++
+	}
+
+	vlen := b[off : off+nkeys*4]
+	for i := uint64(0); i < nkeys; i++ {
+		n := binary.LittleEndian.Uint32(vlen[i*4:])
+		if n == 0 {
+			continue
+		}
+		if exp[n] == 0 {
+			t.Fatalf("%s: slot %d: unexpected value length %d (%#x)", fn, i, n, n)
+		}
+		exp[n]--
+	}
+
+	for n, c := range exp {
+		if c != 0 {
+			t.Fatalf("%s: %d values of length %d missing from the vlen table", fn, c, n)
+		}
+	}
+}
+
+func verifyChd(t testing.TB, dir string, gc *GoldenChd) {
+	t.Helper()
+
+	fn := filepath.Join(dir, gc.File)
+	bin, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("%s: %s", fn, err)
+	}
+
+	var c chd.Chd
+	if err := c.UnmarshalBinaryMmap(bin); err != nil {
+		t.Fatalf("%s: %s", fn, err)
+	}
+
+	// the encoding must round trip byte-for-byte
+	var b bytes.Buffer
+	if _, err := c.MarshalBinary(&b); err != nil {
+		t.Fatalf("%s: marshal: %s", fn, err)
+	}
+	if !bytes.Equal(b.Bytes(), bin) {
+		t.Fatalf("%s: binary encoding doesn't round trip", fn)
+	}
+
+	tfn := filepath.Join(dir, gc.Text)
+	txt, err := ioutil.ReadFile(tfn)
+	if err != nil {
+		t.Fatalf("%s: %s", tfn, err)
+	}
+
+	mt, err := c.MarshalText()
+	if err != nil {
+		t.Fatalf("%s: marshal text: %s", fn, err)
+	}
+	if !bytes.Equal(mt, txt) {
+		t.Fatalf("%s: text encoding differs from %s", fn, tfn)
+	}
+
+	for s, idx := range gc.Indexes {
+		k := parseKey(t, fn, s)
+		if j := c.Find(k); j != idx {
+			t.Fatalf("%s: key %s: exp index %d, saw %d", fn, s, idx, j)
+		}
+	}
+}
+
+func parseKey(t testing.TB, fn, s string) uint64 {
+	t.Helper()
+
+	k, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		t.Fatalf("%s: bad golden key '%s': %s", fn, s, err)
+	}
+	return k
+}
@@ -0,0 +1,170 @@
+// reference_test.go -- verify and (re)generate the reference corpus
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chdtest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-chd/chdb"
+)
+
+var update = flag.Bool("update", false, "Regenerate the reference corpus")
+
+const refDir = "../testdata/ref"
+
+var words = []string{
+	"expectoration",
+	"mizzenmastman",
+	"stockfather",
+	"pictorialness",
+	"villainous",
+	"unquality",
+	"sized",
+	"Tarahumari",
+	"endocrinotherapy",
+	"quicksandy",
+	"heretics",
+	"pediment",
+	"spleen's",
+	"Shepard's",
+	"paralyzed",
+	"megahertzes",
+	"Richardson's",
+	"mechanics's",
+	"Springfield",
+	"burlesques",
+}
+
+// fixed, well spread keys
+func refKey(i int) uint64 {
+	return uint64(i+1) * 0x9e3779b97f4a7c15
+}
+
+func TestReference(t *testing.T) {
+	if *update {
+		if err := genReference(refDir); err != nil {
+			t.Fatalf("can't generate reference corpus: %s", err)
+		}
+	}
+
+	VerifyReference(t, refDir)
+}
+
+func genReference(dir string) error {
+	g := Golden{
+		Version: 1,
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, keysOnly := range []bool{false, true} {
+		gd := GoldenDB{
+			File:     "kv.db",
+			KeysOnly: keysOnly,
+		}
+		if keysOnly {
+			gd.File = "keys.db"
+		}
+
+		wr, err := chdb.NewDBWriter(filepath.Join(dir, gd.File))
+		if err != nil {
+			return err
+		}
+
+		for i, w := range words {
+			var v []byte
+			if !keysOnly {
+				v = []byte(w)
+			}
+
+			k := refKey(i)
+			if err := wr.Add(k, v); err != nil {
+				wr.Close()
+				return err
+			}
+
+			gd.Records = append(gd.Records, GoldenRecord{
+				Key:   fmt.Sprintf("%#x", k),
+				Value: hex.EncodeToString(v),
+			})
+		}
+
+		if err := wr.Freeze(0.9); err != nil {
+			return err
+		}
+
+		for i := len(words); i < len(words)+10; i++ {
+			gd.Absent = append(gd.Absent, fmt.Sprintf("%#x", refKey(i)))
+		}
+		g.DBs = append(g.DBs, gd)
+	}
+
+	b, err := chd.New()
+	if err != nil {
+		return err
+	}
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		b.Add(refKey(i))
+	}
+
+	c, err := b.Freeze(0.9)
+	if err != nil {
+		return err
+	}
+
+	gc := GoldenChd{
+		File:    "chd.bin",
+		Text:    "chd.txt",
+		Indexes: make(map[string]uint64),
+	}
+
+	for i := 0; i < n; i++ {
+		k := refKey(i)
+		gc.Indexes[fmt.Sprintf("%#x", k)] = c.Find(k)
+	}
+
+	var bin bytes.Buffer
+	if _, err := c.MarshalBinary(&bin); err != nil {
+		return err
+	}
+
+	txt, err := c.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, gc.File), bin.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, gc.Text), txt, 0644); err != nil {
+		return err
+	}
+	g.Chds = append(g.Chds, gc)
+
+	js, err := json.MarshalIndent(&g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, GoldenFile), append(js, '\n'), 0644)
+}
@@ -0,0 +1,247 @@
+// chdtext.go -- stable textual and JSON encoding of a Chd for debugging
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// number of seeds per line in the text encoding
+const _SeedsPerLine = 16
+
+var errMultiLevelText = errors.New("chd: no text encoding for multi-level tables")
+
+// MarshalText encodes the Chd in a stable, line oriented textual form suitable
+// for diffing two builds and for cross-language reimplementation tests:
+//
+//	chd 1
+//	salt 0x<16 hex digits>
+//	seedsize <1|2|4>
+//	keys <number of keys; 0 if unknown>
+//	slots <number of seeds>
+//	<seeds in decimal; 16 per line>
+//
+// Tables with key fingerprints are encoded as "chd 2"; they have a
+// "fpbits <8|16>" line after the slots line and the fingerprints in decimal
+// (16 per line) after the seeds. Multi-level tables (see
+// ChdBuilder.SetShardSize()) have no text encoding.
+//
+// It implements encoding.TextMarshaler.
+func (c *Chd) MarshalText() ([]byte, error) {
+	if c.shards != nil {
+		return nil, errMultiLevelText
+	}
+
+	var b bytes.Buffer
+
+	ver := 1
+	if c.fp != nil {
+		ver = 2
+	}
+
+	n := c.seed.length()
+	fmt.Fprintf(&b, "chd %d\nsalt %#016x\nseedsize %d\nkeys %d\nslots %d\n",
+		ver, c.salt, c.SeedSize(), c.nkeys, n)
+	if c.fp != nil {
+		fmt.Fprintf(&b, "fpbits %d\n", c.FingerprintBits())
+	}
+
+	writeNums(&b, n, func(i uint64) uint32 {
+		return c.seed.seed(i)
+	})
+	if c.fp != nil {
+		writeNums(&b, n, func(i uint64) uint32 {
+			return uint32(c.fp.get(i))
+		})
+	}
+	return b.Bytes(), nil
+}
+
+// write the 'n' numbers returned by 'fp' in decimal; 16 per line
+func writeNums(b *bytes.Buffer, n int, fp func(i uint64) uint32) {
+	for i := 0; i < n; i++ {
+		sep := byte(' ')
+		if (i+1)%_SeedsPerLine == 0 || i == n-1 {
+			sep = '\n'
+		}
+
+		b.WriteString(strconv.FormatUint(uint64(fp(uint64(i))), 10))
+		b.WriteByte(sep)
+	}
+}
+
+// UnmarshalText reconstructs a Chd from the output of MarshalText().
+// It implements encoding.TextUnmarshaler.
+func (c *Chd) UnmarshalText(txt []byte) error {
+	sc := bufio.NewScanner(bytes.NewReader(txt))
+	sc.Buffer(make([]byte, 4096), 1<<20)
+
+	var ver, size int
+	var salt, nkeys, n uint64
+
+	hdr := []struct {
+		name string
+		v    interface{}
+	}{
+		{"chd", &ver},
+		{"salt", &salt},
+		{"seedsize", &size},
+		{"keys", &nkeys},
+		{"slots", &n},
+	}
+
+	for _, h := range hdr {
+		if !sc.Scan() {
+			return fmt.Errorf("chd: text: missing %s", h.name)
+		}
+
+		var err error
+		line := sc.Text()
+		switch v := h.v.(type) {
+		case *int:
+			_, err = fmt.Sscanf(line, h.name+" %d", v)
+		case *uint64:
+			_, err = fmt.Sscanf(line, h.name+" %v", v)
+		}
+		if err != nil {
+			return fmt.Errorf("chd: text: bad %s line '%s': %s", h.name, line, err)
+		}
+	}
+
+	if ver != 1 && ver != 2 {
+		return fmt.Errorf("chd: text: no support to un-marshal version %d", ver)
+	}
+
+	var fpbits int
+	if ver == 2 {
+		if !sc.Scan() {
+			return fmt.Errorf("chd: text: missing fpbits")
+		}
+		line := sc.Text()
+		if _, err := fmt.Sscanf(line, "fpbits %d", &fpbits); err != nil {
+			return fmt.Errorf("chd: text: bad fpbits line '%s': %s", line, err)
+		}
+		if fpbits != 8 && fpbits != 16 {
+			return fmt.Errorf("chd: text: unknown fingerprint size %d bits", fpbits)
+		}
+	}
+
+	seeds := make([]uint32, 0, n)
+	var fps []uint16
+	var max uint32
+	for sc.Scan() {
+		for _, f := range strings.Fields(sc.Text()) {
+			if uint64(len(seeds)) == n && fpbits > 0 {
+				v, err := strconv.ParseUint(f, 10, fpbits)
+				if err != nil {
+					return fmt.Errorf("chd: text: bad fingerprint '%s': %s", f, err)
+				}
+				fps = append(fps, uint16(v))
+				continue
+			}
+
+			s, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return fmt.Errorf("chd: text: bad seed '%s': %s", f, err)
+			}
+			if s > uint64(max) {
+				max = uint32(s)
+			}
+			seeds = append(seeds, uint32(s))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	if uint64(len(seeds)) != n {
+		return fmt.Errorf("chd: text: exp %d seeds, saw %d", n, len(seeds))
+	}
+	if fpbits > 0 && uint64(len(fps)) != n {
+		return fmt.Errorf("chd: text: exp %d fingerprints, saw %d", n, len(fps))
+	}
+
+	var seed seeder
+	switch size {
+	case 1:
+		if max > 255 {
+			return fmt.Errorf("chd: text: seed %d too large for 8-bit seeds", max)
+		}
+		seed = newU8(seeds)
+	case 2:
+		if max > 65535 {
+			return fmt.Errorf("chd: text: seed %d too large for 16-bit seeds", max)
+		}
+		seed = newU16(seeds)
+	case 4:
+		seed = newU32(seeds)
+	default:
+		return fmt.Errorf("chd: text: unknown seed-size %d", size)
+	}
+
+	*c = Chd{
+		seed:  seed,
+		salt:  salt,
+		nkeys: nkeys,
+	}
+	if fpbits > 0 {
+		c.fp = makeFingerprints(fpbits, fps)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the Chd as a JSON object with the same information as
+// MarshalText() - and the same limitations. It implements json.Marshaler.
+func (c *Chd) MarshalJSON() ([]byte, error) {
+	if c.shards != nil {
+		return nil, errMultiLevelText
+	}
+
+	n := c.seed.length()
+	seeds := make([]uint32, n)
+	for i := range seeds {
+		seeds[i] = c.seed.seed(uint64(i))
+	}
+
+	v := struct {
+		Version      int      `json:"version"`
+		Salt         string   `json:"salt"`
+		SeedSize     int      `json:"seed_size"`
+		Keys         uint64   `json:"keys"`
+		Slots        int      `json:"slots"`
+		Seeds        []uint32 `json:"seeds"`
+		FPBits       int      `json:"fpbits,omitempty"`
+		Fingerprints []uint16 `json:"fingerprints,omitempty"`
+	}{
+		Version:  1,
+		Salt:     fmt.Sprintf("%#016x", c.salt),
+		SeedSize: int(c.SeedSize()),
+		Keys:     c.nkeys,
+		Slots:    n,
+		Seeds:    seeds,
+	}
+
+	if c.fp != nil {
+		v.Version = 2
+		v.FPBits = c.FingerprintBits()
+		v.Fingerprints = make([]uint16, n)
+		for i := range v.Fingerprints {
+			v.Fingerprints[i] = c.fp.get(uint64(i))
+		}
+	}
+	return json.Marshal(&v)
+}
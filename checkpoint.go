@@ -0,0 +1,136 @@
+// checkpoint.go -- serialize and restore the state of a ChdBuilder
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Checkpoint format - all multibyte ints are little-endian:
+//   - 32 byte header:
+//      * magic    [4]byte "CHDK"
+//      * version  byte    currently 1
+//      * resv     [3]byte
+//      * salt     uint64
+//      * nkeys    uint64
+//      * resv     uint64
+//   - nkeys worth of uint64 keys
+//   - 32 bytes of strong checksum (SHA512_256) over the header and keys
+
+const _CheckpointHeaderSize = 32
+
+// WriteTo writes the accumulated key set and salt of the builder to 'w' -
+// so that a later call to ReadFrom() - possibly on a different machine - can
+// resume the construction. It implements io.WriterTo.
+func (c *ChdBuilder) WriteTo(w io.Writer) (int64, error) {
+	var hdr [_CheckpointHeaderSize]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'K'})
+	hdr[4] = 1
+	le.PutUint64(hdr[8:], c.salt)
+	le.PutUint64(hdr[16:], uint64(len(c.data)))
+
+	h := sha512.New512_256()
+	bw := bufio.NewWriterSize(w, 65536)
+	tee := io.MultiWriter(bw, h)
+
+	n, err := writeAll(tee, hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+
+	nw := int64(n)
+
+	var b [8]byte
+	for k := range c.data {
+		le.PutUint64(b[:], k)
+		if n, err = writeAll(tee, b[:]); err != nil {
+			return nw + int64(n), err
+		}
+		nw += int64(n)
+	}
+
+	cksum := h.Sum(nil)
+	if n, err = writeAll(bw, cksum); err != nil {
+		return nw + int64(n), err
+	}
+	nw += int64(n)
+
+	return nw, bw.Flush()
+}
+
+// ReadFrom restores the builder state from a checkpoint previously written
+// by WriteTo(). The keys and salt already in the builder are replaced by those
+// in the checkpoint; a frozen builder is unfrozen. It implements io.ReaderFrom.
+func (c *ChdBuilder) ReadFrom(r io.Reader) (int64, error) {
+	var hdr [_CheckpointHeaderSize]byte
+
+	br := bufio.NewReaderSize(r, 65536)
+	h := sha512.New512_256()
+	tee := io.TeeReader(br, h)
+
+	nr, err := io.ReadFull(tee, hdr[:])
+	if err != nil {
+		return int64(nr), fmt.Errorf("chd: can't read checkpoint header: %w", err)
+	}
+
+	if string(hdr[:4]) != "CHDK" {
+		return int64(nr), fmt.Errorf("chd: bad checkpoint magic")
+	}
+	if hdr[4] != 1 {
+		return int64(nr), fmt.Errorf("chd: no support to read checkpoint version %d", hdr[4])
+	}
+
+	le := binary.LittleEndian
+	salt := le.Uint64(hdr[8:])
+	nkeys := le.Uint64(hdr[16:])
+
+	tot := int64(nr)
+	data := make(map[uint64]bool)
+
+	var b [8]byte
+	for i := uint64(0); i < nkeys; i++ {
+		n, err := io.ReadFull(tee, b[:])
+		tot += int64(n)
+		if err != nil {
+			return tot, fmt.Errorf("chd: can't read checkpoint key %d: %w", i, err)
+		}
+
+		k := le.Uint64(b[:])
+		if _, ok := data[k]; ok {
+			return tot, fmt.Errorf("chd: duplicate key %x in checkpoint", k)
+		}
+		data[k] = true
+	}
+
+	var exp [32]byte
+	n, err := io.ReadFull(br, exp[:])
+	tot += int64(n)
+	if err != nil {
+		return tot, fmt.Errorf("chd: can't read checkpoint checksum: %w", err)
+	}
+
+	csum := h.Sum(nil)
+	if subtle.ConstantTimeCompare(csum, exp[:]) != 1 {
+		return tot, fmt.Errorf("chd: checkpoint checksum failure; exp %#x, saw %#x", exp[:], csum)
+	}
+
+	c.data = data
+	c.salt = salt
+	c.frozen = false
+	return tot, nil
+}
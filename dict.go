@@ -0,0 +1,393 @@
+// dict.go -- dictionaries of values in slices parallel to a Chd
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DictU64 and DictBytes pair a Chd with slices of keys and values that are
+// indexed by the slot of each key - i.e., Chd.Find(key). This makes the MPH
+// a dictionary encoder for columnar data: a column stores the slots and the
+// dictionary maps them back to the values. Build the Chd of all the keys,
+// create the dictionary with it and Set() the value of every key. The value
+// slices are available to the caller via Values().
+//
+// The marshaled dictionaries have the following layout; all multibyte ints
+// are little-endian:
+//   - magic    [4]byte "CHDU" (DictU64) or "CHDV" (DictBytes)
+//   - resv     [4]byte
+//   - nslots   uint64
+//   - nkeys    uint64
+//   - the occupied slots: a bitvector (see bitVector.MarshalBinary())
+//   - keys     nslots x uint64
+//   - values:
+//      * DictU64: nslots x uint64
+//      * DictBytes: nslots+1 x uint64 offsets of the values in the blob
+//        that follows; the blob is zero padded to a multiple of 8 bytes
+//   - the marshaled Chd (see Chd.MarshalBinary())
+//
+// A dictionary is not safe for concurrent use while it is being filled.
+
+// slots of the keys of a dictionary
+type dict struct {
+	chd  *Chd
+	keys []uint64
+	used *bitVector
+	n    int
+}
+
+func newDict(c *Chd) dict {
+	n := uint64(c.Len())
+	return dict{
+		chd:  c,
+		keys: make([]uint64, n),
+		used: newBitVector(n),
+	}
+}
+
+// Len returns the number of keys in the dictionary
+func (d *dict) Len() int {
+	return d.n
+}
+
+// Slots returns the number of slots of the dictionary; the length of the
+// value slices
+func (d *dict) Slots() int {
+	return len(d.keys)
+}
+
+// Index returns the slot of 'key' and true if it is in the dictionary
+func (d *dict) Index(key uint64) (uint64, bool) {
+	if d.n == 0 {
+		return 0, false
+	}
+
+	i := d.chd.Find(key)
+	if !d.used.IsSet(i) || d.keys[i] != key {
+		return 0, false
+	}
+	return i, true
+}
+
+// Key returns the key in slot 'i' and true; or false if the slot is empty
+func (d *dict) Key(i uint64) (uint64, bool) {
+	if i >= uint64(len(d.keys)) || !d.used.IsSet(i) {
+		return 0, false
+	}
+	return d.keys[i], true
+}
+
+// claim the slot of 'key'; it fails if the slot belongs to another key -
+// i.e., 'key' isn't one of the keys the Chd was built with.
+func (d *dict) set(key uint64) (uint64, error) {
+	i := d.chd.Find(key)
+	if d.used.IsSet(i) {
+		if d.keys[i] != key {
+			return 0, fmt.Errorf("chd: dict: slot %d of key %#x belongs to key %#x", i, key, d.keys[i])
+		}
+		return i, nil
+	}
+
+	d.keys[i] = key
+	d.used.Set(i)
+	d.n++
+	return i, nil
+}
+
+// write the header, the occupied slots and the keys
+func (d *dict) marshal(w io.Writer, magic string) (int, error) {
+	var hdr [24]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], magic)
+	le.PutUint64(hdr[8:], uint64(len(d.keys)))
+	le.PutUint64(hdr[16:], uint64(d.n))
+
+	nw, err := writeAll(w, hdr[:])
+	if err != nil {
+		return nw, err
+	}
+
+	m, err := d.used.MarshalBinary(w)
+	nw += m
+	if err != nil {
+		return nw, err
+	}
+
+	m, err = writeAll(w, u64sToLE(d.keys))
+	return nw + m, err
+}
+
+// read what marshal() wrote and return the rest of 'buf'
+func (d *dict) unmarshal(buf []byte, magic string) ([]byte, error) {
+	if len(buf) < 24 || string(buf[:4]) != magic {
+		return nil, fmt.Errorf("chd: dict: bad header")
+	}
+
+	le := binary.LittleEndian
+	nslots := le.Uint64(buf[8:])
+	nkeys := le.Uint64(buf[16:])
+	if nkeys > nslots {
+		return nil, fmt.Errorf("chd: dict: %d keys in %d slots", nkeys, nslots)
+	}
+
+	used := &bitVector{}
+	m, err := used.UnmarshalBinary(buf[24:])
+	if err != nil {
+		return nil, fmt.Errorf("chd: dict: %s", err)
+	}
+	if used.Size() < nslots || used.Count() != nkeys {
+		return nil, fmt.Errorf("chd: dict: corrupt slot map")
+	}
+
+	buf = buf[24+m:]
+	keys, buf, err := leToU64s(buf, nslots)
+	if err != nil {
+		return nil, err
+	}
+
+	d.keys = keys
+	d.used = used
+	d.n = int(nkeys)
+	return buf, nil
+}
+
+// read the Chd in 'buf' - which must hold exactly the Chd
+func (d *dict) unmarshalChd(buf []byte) error {
+	c := &Chd{}
+	if err := c.UnmarshalBinary(buf); err != nil {
+		return err
+	}
+	if c.Len() != len(d.keys) {
+		return fmt.Errorf("chd: dict: hash table has %d slots; exp %d", c.Len(), len(d.keys))
+	}
+	d.chd = c
+	return nil
+}
+
+// DictU64 is a dictionary of uint64 values; see above.
+type DictU64 struct {
+	dict
+	vals []uint64
+}
+
+// NewDictU64 returns an empty dictionary for the keys of 'c'
+func NewDictU64(c *Chd) *DictU64 {
+	return &DictU64{
+		dict: newDict(c),
+		vals: make([]uint64, c.Len()),
+	}
+}
+
+// Set sets the value of 'key' and returns its slot. It fails if 'key' isn't
+// one of the keys 'c' was built with and maps to the slot of another key.
+func (d *DictU64) Set(key, val uint64) (uint64, error) {
+	i, err := d.set(key)
+	if err != nil {
+		return 0, err
+	}
+	d.vals[i] = val
+	return i, nil
+}
+
+// Get returns the value of 'key' and true if it is in the dictionary
+func (d *DictU64) Get(key uint64) (uint64, bool) {
+	i, ok := d.Index(key)
+	if !ok {
+		return 0, false
+	}
+	return d.vals[i], true
+}
+
+// Values returns the values indexed by slot; empty slots hold zero
+func (d *DictU64) Values() []uint64 {
+	return d.vals
+}
+
+// MarshalBinary writes the dictionary to 'w' and returns the number of
+// bytes written.
+func (d *DictU64) MarshalBinary(w io.Writer) (int, error) {
+	nw, err := d.marshal(w, "CHDU")
+	if err != nil {
+		return nw, err
+	}
+
+	m, err := writeAll(w, u64sToLE(d.vals))
+	nw += m
+	if err != nil {
+		return nw, err
+	}
+
+	m, err = d.chd.MarshalBinary(w)
+	return nw + m, err
+}
+
+// UnmarshalDictU64 reads a dictionary written by DictU64.MarshalBinary().
+// The dictionary doesn't refer to 'buf' once it returns.
+func UnmarshalDictU64(buf []byte) (*DictU64, error) {
+	d := &DictU64{}
+	buf, err := d.unmarshal(buf, "CHDU")
+	if err != nil {
+		return nil, err
+	}
+
+	if d.vals, buf, err = leToU64s(buf, uint64(len(d.keys))); err != nil {
+		return nil, err
+	}
+	if err = d.unmarshalChd(buf); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// DictBytes is a dictionary of byte slice values; see above.
+type DictBytes struct {
+	dict
+	vals [][]byte
+}
+
+// NewDictBytes returns an empty dictionary for the keys of 'c'
+func NewDictBytes(c *Chd) *DictBytes {
+	return &DictBytes{
+		dict: newDict(c),
+		vals: make([][]byte, c.Len()),
+	}
+}
+
+// Set sets the value of 'key' and returns its slot; the value is not
+// copied. It fails if 'key' isn't one of the keys 'c' was built with and
+// maps to the slot of another key.
+func (d *DictBytes) Set(key uint64, val []byte) (uint64, error) {
+	i, err := d.set(key)
+	if err != nil {
+		return 0, err
+	}
+	d.vals[i] = val
+	return i, nil
+}
+
+// Get returns the value of 'key' and true if it is in the dictionary
+func (d *DictBytes) Get(key uint64) ([]byte, bool) {
+	i, ok := d.Index(key)
+	if !ok {
+		return nil, false
+	}
+	return d.vals[i], true
+}
+
+// Values returns the values indexed by slot; empty slots hold nil
+func (d *DictBytes) Values() [][]byte {
+	return d.vals
+}
+
+// MarshalBinary writes the dictionary to 'w' and returns the number of
+// bytes written.
+func (d *DictBytes) MarshalBinary(w io.Writer) (int, error) {
+	nw, err := d.marshal(w, "CHDV")
+	if err != nil {
+		return nw, err
+	}
+
+	offs := make([]uint64, len(d.vals)+1)
+	for i, v := range d.vals {
+		offs[i+1] = offs[i] + uint64(len(v))
+	}
+
+	m, err := writeAll(w, u64sToLE(offs))
+	nw += m
+	if err != nil {
+		return nw, err
+	}
+
+	for _, v := range d.vals {
+		if m, err = writeAll(w, v); err != nil {
+			return nw + m, err
+		}
+		nw += m
+	}
+
+	var z [8]byte
+	pad := (8 - offs[len(d.vals)]%8) % 8
+	m, err = writeAll(w, z[:pad])
+	nw += m
+	if err != nil {
+		return nw, err
+	}
+
+	m, err = d.chd.MarshalBinary(w)
+	return nw + m, err
+}
+
+// UnmarshalDictBytes reads a dictionary written by DictBytes.MarshalBinary().
+// The dictionary doesn't refer to 'buf' once it returns.
+func UnmarshalDictBytes(buf []byte) (*DictBytes, error) {
+	d := &DictBytes{}
+	buf, err := d.unmarshal(buf, "CHDV")
+	if err != nil {
+		return nil, err
+	}
+
+	n := uint64(len(d.keys))
+	offs, buf, err := leToU64s(buf, n+1)
+	if err != nil {
+		return nil, err
+	}
+
+	sz := offs[n]
+	pad := (8 - sz%8) % 8
+	if sz > uint64(len(buf)) || sz+pad > uint64(len(buf)) {
+		return nil, fmt.Errorf("chd: dict: values truncated")
+	}
+
+	blob := make([]byte, sz)
+	copy(blob, buf)
+
+	d.vals = make([][]byte, n)
+	for i := range d.vals {
+		a, b := offs[i], offs[i+1]
+		if a > b || b > sz {
+			return nil, fmt.Errorf("chd: dict: corrupt value offsets")
+		}
+		if d.used.IsSet(uint64(i)) {
+			d.vals[i] = blob[a:b:b]
+		}
+	}
+
+	if err = d.unmarshalChd(buf[sz+pad:]); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// encode 'v' as little-endian bytes
+func u64sToLE(v []uint64) []byte {
+	b := make([]byte, 8*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint64(b[8*i:], x)
+	}
+	return b
+}
+
+// decode 'n' little-endian uint64s from 'buf' and return the rest of it
+func leToU64s(buf []byte, n uint64) ([]uint64, []byte, error) {
+	if n > uint64(len(buf))/8 {
+		return nil, nil, fmt.Errorf("chd: dict: truncated table of %d words", n)
+	}
+
+	v := make([]uint64, n)
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint64(buf[8*i:])
+	}
+	return v, buf[8*n:], nil
+}
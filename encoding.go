@@ -0,0 +1,62 @@
+// encoding.go -- standard encoding interfaces for Chd
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+)
+
+// Chd.MarshalBinary() writes to an io.Writer and predates
+// encoding.BinaryMarshaler; so the methods below let a Chd be embedded in
+// user structs that are serialized with encoding/gob (or any encoder that
+// uses encoding.BinaryUnmarshaler). They use the format of MarshalBinary()
+// and, unlike the text encoding (see chdtext.go), support multi-level
+// tables. A zero Chd encodes to an empty byte slice.
+
+var (
+	_ gob.GobEncoder             = &Chd{}
+	_ gob.GobDecoder             = &Chd{}
+	_ encoding.BinaryUnmarshaler = &Chd{}
+)
+
+// GobEncode implements gob.GobEncoder
+func (c *Chd) GobEncode() ([]byte, error) {
+	if c.seed == nil && c.shards == nil {
+		return []byte{}, nil
+	}
+
+	var b bytes.Buffer
+	if _, err := c.MarshalBinary(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder
+func (c *Chd) GobDecode(buf []byte) error {
+	return c.UnmarshalBinary(buf)
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. Unlike
+// UnmarshalBinaryMmap(), the table doesn't refer to 'buf' once it returns.
+func (c *Chd) UnmarshalBinary(buf []byte) error {
+	if len(buf) == 0 {
+		*c = Chd{}
+		return nil
+	}
+
+	// a fresh copy is suitably aligned for the seed tables
+	b := make([]byte, len(buf))
+	copy(b, buf)
+	return c.UnmarshalBinaryMmap(b)
+}
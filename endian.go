@@ -0,0 +1,39 @@
+// endian.go -- endian conversion routines
+//
+// The seed table is little-endian on disk and is used in place (mmap); the
+// host byte order is detected once at startup and the conversions are branch
+// free.
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"math/bits"
+	"unsafe"
+)
+
+// all ones on big-endian hosts and zero on little-endian hosts
+var beMask = func() uint64 {
+	v := uint16(1)
+	if (*[2]byte)(unsafe.Pointer(&v))[0] == 0 {
+		return ^uint64(0)
+	}
+	return 0
+}()
+
+func toLittleEndianUint32(v uint32) uint32 {
+	s := uint64(bits.ReverseBytes32(v))
+	return uint32(uint64(v) ^ ((uint64(v) ^ s) & beMask))
+}
+
+func toLittleEndianUint16(v uint16) uint16 {
+	s := uint64(bits.ReverseBytes16(v))
+	return uint16(uint64(v) ^ ((uint64(v) ^ s) & beMask))
+}
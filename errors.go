@@ -12,27 +12,41 @@ package chd
 import (
 	"errors"
 	"fmt"
+	"io"
 )
 
 func errShortWrite(n int) error {
 	return fmt.Errorf("chd: incomplete write; exp 8, saw %d", n)
 }
 
-var (
-	// ErrMPHFail is returned when the gamma value provided to Freeze() is too small to
-	// build a minimal perfect hash table.
-	ErrMPHFail = errors.New("failed to build MPH")
-
-	// ErrFrozen is returned when attempting to add new records to an already frozen DB
-	// It is also returned when trying to freeze a DB that's already frozen.
-	ErrFrozen = errors.New("DB already frozen")
-
-	// ErrValueTooLarge is returned if the value-length is larger than 2^32-1 bytes
-	ErrValueTooLarge = errors.New("value is larger than 2^32-1 bytes")
+// ErrFrozen is returned when attempting to add new keys to an already frozen
+// ChdBuilder. It is also returned when trying to freeze a ChdBuilder that's
+// already frozen.
+var ErrFrozen = errors.New("DB already frozen")
+
+// SeedError is returned by Freeze() when no seed up to the builder's max seed
+// displaces the keys of a bucket into free slots of the table. Lowering the
+// load factor or raising the max seed usually fixes it.
+type SeedError struct {
+	// index of the failing bucket and the number of keys in it
+	Bucket uint64
+	Keys   int
+
+	// largest seed that was tried
+	MaxSeed uint32
+}
 
-	// ErrExists is returned if a duplicate key is added to the DB
-	ErrExists = errors.New("key exists in DB")
+func (e *SeedError) Error() string {
+	return fmt.Sprintf("chd: no MPH; bucket %d of %d keys needs a seed > %d", e.Bucket, e.Keys, e.MaxSeed)
+}
 
-	// ErrNoKey is returned when a key cannot be found in the DB
-	ErrNoKey = errors.New("No such key")
-)
+func writeAll(w io.Writer, buf []byte) (int, error) {
+	n, err := w.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(buf) {
+		return n, errShortWrite(n)
+	}
+	return n, nil
+}
@@ -0,0 +1,46 @@
+// convert.go -- rewrite a constant DB in the current format
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// convert rewrites DB 'src' in the current format to 'dst' (which may be the
+// same file) with the given load factor, value compression and checksum.
+func convert(src, dst string, load float64, compress, checksum string) {
+	opts := []chdb.WriterOption{chdb.WithLoad(load)}
+
+	switch compress {
+	case "", "none":
+	case "flate":
+		opts = append(opts, chdb.WithValueCodec(chdb.Flate))
+	case "zstd":
+		opts = append(opts, chdb.WithValueCodec(chdb.Zstd))
+	default:
+		die("unsupported compression '%s'", compress)
+	}
+
+	switch checksum {
+	case "", "sha512-256":
+	case "crc32c":
+		opts = append(opts, chdb.WithChecksum(chdb.ChecksumCRC32C))
+	default:
+		die("unsupported checksum '%s'", checksum)
+	}
+
+	start := time.Now()
+	if err := chdb.Convert(src, dst, opts...); err != nil {
+		die("can't convert %s: %s", src, err)
+	}
+	fmt.Printf("%s: converted to %s in %s\n", src, dst, time.Since(start))
+}
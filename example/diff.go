@@ -0,0 +1,87 @@
+// diff.go -- compare two constant DBs
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// diff prints the keys that are only in DB 'afn' (-), only in DB 'bfn' (+)
+// and the keys whose values differ (~); with 'values', it also prints the
+// differing values. It returns the number of differences.
+func diff(afn, bfn string, values bool) int {
+	a, err := chdb.NewDBReader(afn, 1)
+	if err != nil {
+		die("Can't read %s: %s", afn, err)
+	}
+	defer a.Close()
+
+	b, err := chdb.NewDBReader(bfn, 1)
+	if err != nil {
+		die("Can't read %s: %s", bfn, err)
+	}
+	defer b.Close()
+
+	var onlyA, onlyB, changed int
+	var buf []byte
+
+	err = a.Scan(func(k uint64, av []byte) bool {
+		bv, err := b.FindInto(k, buf)
+		switch {
+		case err == chdb.ErrNoKey:
+			onlyA++
+			fmt.Printf("- %#x\n", k)
+			if values {
+				fmt.Printf("    %q\n", av)
+			}
+			return true
+		case err != nil:
+			die("%s: key %#x: %s", bfn, k, err)
+		}
+
+		buf = bv
+		if !bytes.Equal(av, bv) {
+			changed++
+			fmt.Printf("~ %#x\n", k)
+			if values {
+				fmt.Printf("    - %q\n    + %q\n", av, bv)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		die("%s: %s", afn, err)
+	}
+
+	err = b.Scan(func(k uint64, bv []byte) bool {
+		_, err := a.FindInto(k, buf)
+		switch {
+		case err == chdb.ErrNoKey:
+			onlyB++
+			fmt.Printf("+ %#x\n", k)
+			if values {
+				fmt.Printf("    %q\n", bv)
+			}
+		case err != nil:
+			die("%s: key %#x: %s", afn, k, err)
+		}
+		return true
+	})
+	if err != nil {
+		die("%s: %s", bfn, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%d only in %s, %d only in %s, %d changed\n",
+		onlyA, afn, onlyB, bfn, changed)
+	return onlyA + onlyB + changed
+}
@@ -0,0 +1,90 @@
+// hash.go -- print the key hashes of strings
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/go-chd/ingest"
+)
+
+// keyHasher returns the hash function 'name' keyed with 'salt'; the salt is
+// upto 16 bytes of hex. siphash uses the 16 bytes as its key - the importer
+// keys it with the salt of the DB (see ingest.DBHash()). fasthash and
+// xxhash use the first 8 bytes as a little-endian seed; the importer uses
+// an empty salt (all zeroes) for them.
+func keyHasher(name, salt string) (ingest.HashFunc, error) {
+	var k [16]byte
+
+	b, err := hex.DecodeString(strings.TrimPrefix(salt, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt '%s': %s", salt, err)
+	}
+	if len(b) > len(k) {
+		return nil, fmt.Errorf("salt '%s' is longer than %d bytes", salt, len(k))
+	}
+	copy(k[:], b)
+
+	k0 := binary.LittleEndian.Uint64(k[:8])
+	switch name {
+	case "fasthash":
+		return ingest.FastHash(k0), nil
+	case "siphash":
+		return ingest.DBHash(k[:]), nil
+	case "xxhash":
+		return ingest.XXHash(k0), nil
+	}
+	return nil, fmt.Errorf("unknown key hash '%s'", name)
+}
+
+// dbSalt returns the salt of DB 'fn' in hex
+func dbSalt(fn string) string {
+	db, err := chdb.NewDBReader(fn, 1)
+	if err != nil {
+		die("Can't read %s: %s", fn, err)
+	}
+
+	defer db.Close()
+	return hex.EncodeToString(db.Salt())
+}
+
+// hashKeys reads keys - one per line - from 'r' and prints the uint64 hash
+// of each as the importer computes it for a list of keys: white space
+// around the line is trimmed, the key is lower cased (if asked) and hashed
+// with 'h'. Like the importer, it skips empty lines and comments.
+func hashKeys(r io.Reader, h ingest.HashFunc, lower bool) {
+	rd := bufio.NewScanner(r)
+	rd.Buffer(make([]byte, 64*1024), 1<<20)
+
+	wr := bufio.NewWriter(os.Stdout)
+	for rd.Scan() {
+		key := strings.TrimSpace(rd.Text())
+		if len(key) == 0 || key[0] == '#' {
+			continue
+		}
+		if lower {
+			key = strings.ToLower(key)
+		}
+		fmt.Fprintf(wr, "0x%016x\t%s\n", h([]byte(key)), key)
+	}
+
+	if err := wr.Flush(); err != nil {
+		die("can't write hashes: %s", err)
+	}
+	if err := rd.Err(); err != nil {
+		die("can't read STDIN: %s", err)
+	}
+}
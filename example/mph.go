@@ -0,0 +1,53 @@
+// mph.go -- extract a standalone MPH file from a constant DB
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// mph builds a minimal perfect hash of the keys in DB 'src' with the given
+// load factor and writes it to the standalone MPH file 'dst'; see
+// chd.LoadChdFile().
+func mph(src, dst string, load float64) {
+	db, err := chdb.NewDBReader(src, 1)
+	if err != nil {
+		die("Can't read %s: %s", src, err)
+	}
+
+	defer db.Close()
+
+	b, err := chd.New()
+	if err != nil {
+		die("%s", err)
+	}
+
+	err = db.Scan(func(k uint64, _ []byte) bool {
+		b.AddUnique(k)
+		return true
+	})
+	if err != nil {
+		die("can't read keys of %s: %s", src, err)
+	}
+
+	start := time.Now()
+	c, err := b.Freeze(load)
+	if err != nil {
+		die("can't build MPH of %s: %s", src, err)
+	}
+	if err := c.WriteFile(dst); err != nil {
+		die("can't write %s: %s", dst, err)
+	}
+	fmt.Printf("%s: %d keys, %d slots written to %s in %s\n",
+		src, db.Len(), c.Len(), dst, time.Since(start))
+}
@@ -10,6 +10,17 @@
 // One can construct the on-disk MPH DB using a variety of input:
 //   - white space delimited text file: first field is key, second field is value
 //   - Comma Separated text file (CSV): first field is key, second field is value
+//   - with --keys-only: a list of keys, one per line; the DB has no values
+//
+// 'mphdb mph' writes just the minimal perfect hash of the keys of a DB to a
+// standalone file (see chd.LoadChdFile()).
+//
+// 'mphdb hash' prints the uint64 keys of the strings on STDIN - one per line
+// - as the importer hashes them; use it to pre-compute keys for other tools
+// or to debug lookups that miss. The keys are hashed with siphash keyed by
+// the random salt of each DB; so 'hash' needs the DB (or its salt).
+//
+// Input files may be gzip or zstd compressed (e.g., foo.txt.gz, foo.csv.zst).
 //
 // Sometimes, bbhash gets into a pathological state while constructing MPH out of very
 // large data sets. This can be alleviated by using a larger "gamma". mphdb tries to
@@ -18,13 +29,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
-	"strings"
+	"runtime"
 
 	"time"
 
-	"github.com/opencoff/go-chd"
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/go-chd/ingest"
 
 	flag "github.com/opencoff/pflag"
 )
@@ -39,12 +52,37 @@ func main() {
 	var load float64
 	var verify bool
 	var dump bool
+	var jsonOut bool
+	var workers int
+	var keyHash string
+	var keyField, valField int
+	var lower, trim, b64 bool
+	var failFast bool
+	var keysOnly bool
+	var showValues bool
+	var compress, checksum string
+	var salt string
 
-	usage := fmt.Sprintf("%s [options] OUTPUT [INPUT ...]", os.Args[0])
+	usage := fmt.Sprintf("%s [options] OUTPUT [INPUT ...]\n       %s info [--json] DB\n       %s diff [--values] A B\n       %s [--load L] [--compress C] [--checksum S] convert OLD NEW\n       %s [--load L] mph DB OUTPUT\n       %s [--key-hash H] [--salt S] [--lower] hash [DB]",
+		os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 
 	flag.Float64VarP(&load, "load", "l", 0.85, "Use `L` as the hash table load factor")
 	flag.BoolVarP(&verify, "verify", "V", false, "Verify a constant DB")
 	flag.BoolVarP(&dump, "dump-meta", "d", false, "Dump db meta-data")
+	flag.IntVarP(&workers, "workers", "w", runtime.NumCPU(), "Read upto `N` input files concurrently")
+	flag.IntVarP(&keyField, "key-field", "", 0, "Use field# `N` of each input line as the key")
+	flag.IntVarP(&valField, "val-field", "", 1, "Use field# `N` of each input line as the value")
+	flag.BoolVarP(&lower, "lower", "", false, "Lower case the keys")
+	flag.BoolVarP(&trim, "trim", "", false, "Trim white space around keys and values")
+	flag.StringVarP(&keyHash, "key-hash", "", "siphash", "Hash keys with `H` (siphash keyed by the DB salt, fasthash, xxhash)")
+	flag.BoolVarP(&b64, "value-base64", "", false, "Decode base64 encoded values")
+	flag.BoolVarP(&keysOnly, "keys-only", "k", false, "Build a keys-only DB from a list of keys (one per line)")
+	flag.BoolVarP(&failFast, "fail-fast", "", false, "Stop at the first bad input line or duplicate key")
+	flag.BoolVarP(&jsonOut, "json", "j", false, "Print the output of 'info' as JSON")
+	flag.BoolVarP(&showValues, "values", "", false, "Print the differing values in 'diff'")
+	flag.StringVarP(&compress, "compress", "", "none", "Compress the values with `C` (none, flate, zstd) in 'convert'")
+	flag.StringVarP(&salt, "salt", "", "", "Key the hash function with the hex salt `S` in 'hash'; siphash needs it or a DB")
+	flag.StringVarP(&checksum, "checksum", "", "sha512-256", "Use `S` (sha512-256, crc32c) as the metadata checksum in 'convert'")
 	flag.Usage = func() {
 		fmt.Printf("mphdb - create MPH DB from txt or CSV files using CHD\nUsage: %s\n", usage)
 		flag.PrintDefaults()
@@ -53,15 +91,124 @@ func main() {
 	flag.Parse()
 	args := flag.Args()
 
+	// the importer keys siphash with the salt of the DB it builds
+	var h ingest.HashFunc
+	var err error
+	if keyHash != "siphash" {
+		if h, err = keyHasher(keyHash, ""); err != nil {
+			die("%s", err)
+		}
+	}
+
+	if keysOnly && b64 {
+		die("--keys-only and --value-base64 are mutually exclusive")
+	}
+
+	if keyField < 0 || valField < 0 || keyField == valField {
+		die("invalid key field %d and value field %d", keyField, valField)
+	}
+
+	opts := []ingest.Option{
+		ingest.WithHash(h),
+		ingest.WithFields(keyField, valField),
+		ingest.WithWorkers(workers),
+		ingest.WithSkipHandler(func(src string, line int, err error) {
+			warn("%s: %d: skipped: %s", src, line, err)
+		}),
+		ingest.WithProgress(func(fn string, s *ingest.Summary, err error) {
+			if err != nil {
+				warn("can't add %s: %s", fn, err)
+			} else {
+				summary(fn, s)
+			}
+		}),
+	}
+
+	if failFast {
+		opts = append(opts, ingest.WithErrorPolicy(ingest.FailOnBadLine))
+	}
+
+	if lower {
+		opts = append(opts, ingest.WithLower())
+	}
+	if trim {
+		opts = append(opts, ingest.WithTrim())
+	}
+	if b64 {
+		opts = append(opts, ingest.WithBase64Values())
+	}
+	if keysOnly {
+		opts = append(opts, ingest.WithKeysOnly())
+	}
+
 	if len(args) < 1 {
 		die("No output file name!\nUsage: %s\n", usage)
 	}
 
+	if args[0] == "info" {
+		if len(args) != 2 {
+			die("Usage: %s\n", usage)
+		}
+		info(args[1], jsonOut)
+		return
+	}
+
+	if args[0] == "diff" {
+		if len(args) != 3 {
+			die("Usage: %s\n", usage)
+		}
+		if diff(args[1], args[2], showValues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if args[0] == "convert" {
+		if len(args) != 3 {
+			die("Usage: %s\n", usage)
+		}
+		convert(args[1], args[2], load, compress, checksum)
+		return
+	}
+
+	if args[0] == "hash" {
+		if len(args) > 2 {
+			die("Usage: %s\n", usage)
+		}
+		if len(args) == 2 && len(salt) > 0 {
+			die("--salt and DB are mutually exclusive")
+		}
+
+		// the importer keys only siphash with the salt of the DB; the
+		// other hashes are unsalted (see keyHasher()).
+		if keyHash == "siphash" {
+			if len(args) == 2 {
+				salt = dbSalt(args[1])
+			}
+			if len(salt) == 0 {
+				die("siphash needs a salt: use --salt or name the DB")
+			}
+		}
+		if h, err = keyHasher(keyHash, salt); err != nil {
+			die("%s", err)
+		}
+		hashKeys(os.Stdin, h, lower)
+		return
+	}
+
+	if args[0] == "mph" {
+		if len(args) != 3 {
+			die("Usage: %s\n", usage)
+		}
+		mph(args[1], args[2], load)
+		return
+	}
+
 	fn := args[0]
 	args = args[1:]
 
 	if verify || dump {
-		db, err := chd.NewDBReader(fn, 1000)
+		db, err := chdb.NewDBReader(fn, 1000)
 		if err != nil {
 			die("Can't read %s: %s", fn, err)
 		}
@@ -76,46 +223,29 @@ func main() {
 		return
 	}
 
-	db, err := chd.NewDBWriter(fn)
+	db, err := chdb.NewDBWriter(fn)
 	if err != nil {
 		die("can't create MPH DB: %s", err)
 	}
 
 	var tot uint64
 	if len(args) > 0 {
-		var n uint64
-		for _, f := range args {
-			switch {
-			case strings.HasSuffix(f, ".txt"):
-				n, err = AddTextFile(db, f, " \t")
-
-			case strings.HasSuffix(f, ".csv"):
-				n, err = AddCSVFile(db, f, ',', '#', 0, 1)
-
-			default:
-				warn("Don't know how to add %s", f)
-				continue
-			}
-
-			if err != nil {
-				warn("can't add %s: %s", f, err)
-				continue
-			}
-
-			fmt.Printf("+ %s: %d records\n", f, n)
-			tot += n
+		// failures of individual files are reported via the progress callback
+		s, err := ingest.AddFiles(db, args, opts...)
+		if err != nil && failFast {
+			db.Abort()
+			die("%s", err)
 		}
+		tot = s.Records
 	} else {
-		var n uint64
-
-		n, err = AddTextStream(db, os.Stdin, " \t")
+		s, err := ingest.AddTextStream(db, os.Stdin, opts...)
 		if err != nil {
 			db.Abort()
 			die("can't add STDIN: %s", err)
 		}
 
-		fmt.Printf("+ <STDIN>: %d records\n", n)
-		tot += n
+		summary("<STDIN>", s)
+		tot = s.Records
 	}
 
 	start := time.Now()
@@ -129,6 +259,80 @@ func main() {
 	fmt.Printf("%d keys, %s (%3.2f keys/sec)\n", tot, delta, speed)
 }
 
+// print the import summary of input 'fn'
+func summary(fn string, s *ingest.Summary) {
+	fmt.Printf("+ %s: %d records", fn, s.Records)
+	if s.Skipped > 0 || s.Rejected > 0 {
+		fmt.Printf(" (%d bad lines, %d duplicates)", s.Skipped, s.Rejected)
+	}
+	fmt.Printf("\n")
+}
+
+// print a summary of the DB in 'fn'
+func info(fn string, jsonOut bool) {
+	db, err := chdb.NewDBReader(fn, 1)
+	if err != nil {
+		die("Can't read %s: %s", fn, err)
+	}
+
+	defer db.Close()
+
+	in, err := db.Info()
+	if err != nil {
+		die("%s: %s", fn, err)
+	}
+
+	if jsonOut {
+		b, err := json.MarshalIndent(in, "", "  ")
+		if err != nil {
+			die("%s: %s", fn, err)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+
+	typ := "keys+values"
+	if in.KeysOnly {
+		typ = "keys only"
+	}
+
+	fmt.Printf("%s: %s, %d bytes, modified %s\n", in.File, typ, in.Size, in.ModTime.Format(time.RFC3339))
+	fmt.Printf("  keys %d, slots %d, load %4.3f, flags %#x\n", in.Keys, in.Slots, in.Load, in.Flags)
+	fmt.Printf("  seed size %d bytes, max seed %d, salt %s\n", in.SeedSize, in.MaxSeed, in.Salt)
+	fmt.Printf("  checksum %s\n", in.Checksum)
+	if in.Align > 0 {
+		fmt.Printf("  records aligned to %d bytes\n", in.Align)
+	}
+	if b := in.Build; b != nil {
+		fmt.Printf("  built %s by %s", b.Time.Format(time.RFC3339), b.Tool)
+		if len(b.Source) > 0 {
+			fmt.Printf(", source %x", b.Source)
+		}
+		fmt.Printf("\n")
+	}
+
+	s := &in.Sizes
+	pct := func(n uint64) float64 {
+		return (100.0 * float64(n)) / float64(in.Size)
+	}
+
+	for _, r := range []struct {
+		name string
+		sz   uint64
+	}{
+		{"header", s.Header},
+		{"records", s.Records},
+		{"build info", s.Build},
+		{"padding", s.Padding},
+		{"offset table", s.Offsets},
+		{"vlen table", s.Vlens},
+		{"chd", s.Chd},
+		{"trailer", s.Trailer},
+	} {
+		fmt.Printf("  %-12s %12d %6.2f%%\n", r.name, r.sz, pct(r.sz))
+	}
+}
+
 // die with error
 func die(f string, v ...interface{}) {
 	warn(f, v...)
@@ -0,0 +1,190 @@
+// fingerprint.go -- per-slot key fingerprints for approximate membership
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"fmt"
+	"io"
+)
+
+// A minimal perfect hash maps every key - member or not - to some slot of
+// the table. A fingerprint is a few bits of an independent hash of the key
+// stored in the key's slot; a non-member key that maps to the slot matches
+// the fingerprint with probability 2^-bits. This lets a standalone Chd reject
+// most non-member keys without an external table of keys.
+
+// fingerprints holds the fingerprint of the key in every slot of the
+// table; 16 bit fingerprints are kept little-endian so they can be marshaled
+// and mmap'd as is.
+type fingerprints struct {
+	fp8  []uint8
+	fp16 []uint16
+}
+
+// make a zeroed fingerprint table of 'm' slots of 'bits' bits each
+func newFingerprints(bits int, m uint64) *fingerprints {
+	if bits == 16 {
+		return &fingerprints{fp16: make([]uint16, m)}
+	}
+	return &fingerprints{fp8: make([]uint8, m)}
+}
+
+// hash of 'key' that is independent of the slot it maps to
+func fphash(key, salt uint64) uint64 {
+	const m uint64 = 0x9e3779b97f4a7c15
+	var h uint64 = key
+
+	h *= m
+	h ^= mix(^salt)
+	h *= m
+	return mix(h)
+}
+
+// record the fingerprint of hash 'h' in slot 'i'
+func (f *fingerprints) set(i, h uint64) {
+	if f.fp16 != nil {
+		f.fp16[i] = toLittleEndianUint16(uint16(h >> 48))
+		return
+	}
+	f.fp8[i] = uint8(h >> 56)
+}
+
+// return true if slot 'i' holds the fingerprint of hash 'h'
+func (f *fingerprints) match(i, h uint64) bool {
+	return f.get(i) == uint16(h>>(64-8*uint(f.size())))
+}
+
+// return the fingerprint in slot 'i'
+func (f *fingerprints) get(i uint64) uint16 {
+	if f.fp16 != nil {
+		return toLittleEndianUint16(f.fp16[i])
+	}
+	return uint16(f.fp8[i])
+}
+
+// size of each fingerprint in bytes
+func (f *fingerprints) size() byte {
+	if f.fp16 != nil {
+		return 2
+	}
+	return 1
+}
+
+func (f *fingerprints) marshal(w io.Writer) (int, error) {
+	if f.fp16 != nil {
+		return writeAll(w, u16sToByteSlice(f.fp16))
+	}
+	return writeAll(w, f.fp8)
+}
+
+// unmarshal a fingerprint table of 'sz' byte fingerprints from mem-mapped
+// byte slice 'b'
+func unmarshalFingerprints(sz byte, b []byte) (*fingerprints, error) {
+	switch sz {
+	case 1:
+		return &fingerprints{fp8: b}, nil
+	case 2:
+		if len(b)%2 != 0 {
+			return nil, fmt.Errorf("chd: partial 16 bit fingerprints (%d bytes)", len(b))
+		}
+		return &fingerprints{fp16: bsToUint16Slice(b)}, nil
+	}
+	return nil, fmt.Errorf("chd: unknown fingerprint size %d", sz)
+}
+
+// make a fingerprint table of 'bits' bits each from the values in 'v'
+func makeFingerprints(bits int, v []uint16) *fingerprints {
+	f := newFingerprints(bits, uint64(len(v)))
+	for i, x := range v {
+		if f.fp16 != nil {
+			f.fp16[i] = toLittleEndianUint16(x)
+		} else {
+			f.fp8[i] = uint8(x)
+		}
+	}
+	return f
+}
+
+// SetFingerprintBits makes Freeze() store a 'n' bit fingerprint of every key
+// in its slot (see Chd.FindWithFingerprint()); 'n' is 8 or 16 - for a false
+// positive rate of 1/256 and 1/65536 respectively. Each fingerprint adds n/8
+// bytes per slot to the table. 0 (the default) disables fingerprints.
+func (c *ChdBuilder) SetFingerprintBits(n int) error {
+	switch n {
+	case 0, 8, 16:
+		c.fpbits = n
+		return nil
+	}
+	return fmt.Errorf("chd: invalid fingerprint size %d bits", n)
+}
+
+// SetFalsePositiveRate picks the smallest fingerprint that rejects all but a
+// fraction 'p' of the keys that aren't in the key set (see
+// SetFingerprintBits()); 'p' of 1 disables fingerprints. It returns an
+// error if no supported fingerprint size achieves 'p'.
+func (c *ChdBuilder) SetFalsePositiveRate(p float64) error {
+	switch {
+	case p < 0 || p > 1:
+		return fmt.Errorf("chd: invalid false positive rate %f", p)
+	case p == 1:
+		c.fpbits = 0
+	case p >= 1.0/256:
+		c.fpbits = 8
+	case p >= 1.0/65536:
+		c.fpbits = 16
+	default:
+		return fmt.Errorf("chd: false positive rate %g needs more than 16 bit fingerprints", p)
+	}
+	return nil
+}
+
+// FindWithFingerprint returns the slot of key 'k' like Find() - and false if
+// 'k' is definitely not in the key set of the table: either the table is
+// empty or the fingerprint of 'k' doesn't match the one in its slot. A true
+// result means 'k' is probably in the key set; the false positive rate is
+// 2^-bits for a 'bits' bit fingerprint. Tables built without fingerprints
+// can only reject keys when they are empty.
+func (c *Chd) FindWithFingerprint(k uint64) (uint64, bool) {
+	if c.shards != nil {
+		s, base := c.findShard(k)
+		i, ok := s.FindWithFingerprint(k)
+		return base + i, ok
+	}
+
+	if c.seed.length() == 0 {
+		return 0, false
+	}
+
+	i := c.Find(k)
+	if c.fp == nil {
+		return i, true
+	}
+	return i, c.fp.match(i, fphash(k, c.salt))
+}
+
+// Contains returns true if 'k' is probably in the key set of the table and
+// false if it definitely isn't; see FindWithFingerprint().
+func (c *Chd) Contains(k uint64) bool {
+	_, ok := c.FindWithFingerprint(k)
+	return ok
+}
+
+// FingerprintBits returns the size of the key fingerprints of the table in
+// bits; 0 if the table has no fingerprints.
+func (c *Chd) FingerprintBits() int {
+	if c.shards != nil {
+		return c.shards[0].FingerprintBits()
+	}
+	if c.fp == nil {
+		return 0
+	}
+	return 8 * int(c.fp.size())
+}
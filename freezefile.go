@@ -0,0 +1,402 @@
+// freezefile.go -- build a CHD from keys in a file without holding them in memory
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// max number of keys we sort in memory at a time; 64MB worth of run entries
+var freezeRunKeys = 1 << 22
+
+// FreezeFromFile builds a constant-time lookup table from the keys in file 'fn'
+// using the given load factor (see ChdBuilder.Freeze()). Files with a ".txt"
+// suffix have one key per line (decimal, or hex with a "0x" prefix; blank lines
+// and lines starting with '#' are ignored); all other files are a sequence of
+// little-endian uint64 keys.
+//
+// Unlike ChdBuilder, the keys are never held in memory at once: they are
+// partitioned into sorted runs in temporary files and merged back in the order
+// the CHD algorithm needs them. Memory use is proportional to the size of the
+// lookup table - a few bytes per key. Duplicate keys in the file are an error.
+func FreezeFromFile(fn string, load float64) (*Chd, error) {
+	if load <= 0 || load > 1 {
+		return nil, fmt.Errorf("chd: invalid load factor %f", load)
+	}
+
+	each := func(fp func(k uint64) error) error {
+		return forEachKey(fn, fp)
+	}
+
+	// pass 1: count the keys so we can size the table
+	var n uint64
+	err := each(func(k uint64) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return freezeKeys(fn, n, load, rand64(), each)
+}
+
+// build a table with 'salt' for the 'n' keys enumerated by 'each' - which is
+// called once for each pass over the keys. 'name' identifies the keys in
+// errors.
+func freezeKeys(name string, n uint64, load float64, salt uint64, each func(fp func(k uint64) error) error) (*Chd, error) {
+	m := nextpow2(uint64(float64(n) / load))
+
+	// pass 2: bucket sizes; they saturate at 255 keys. A bucket that large
+	// is usually many copies of a key - which the merge reports as a
+	// duplicate; otherwise doBucket() rejects it.
+	sizes := make([]uint8, m)
+	err := each(func(k uint64) error {
+		j := rhash(0, k, m, salt)
+		if sizes[j] < 255 {
+			sizes[j]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// pass 3: sorted runs of keys in the order we process buckets
+	ps := &partitions{
+		sizes: sizes,
+		m:     m,
+		salt:  salt,
+	}
+
+	defer ps.cleanup()
+
+	err = each(ps.add)
+	if err == nil {
+		err = ps.flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Finally, merge the runs and displace one bucket at a time
+	var bhist []uint64
+	if m > 0 {
+		var max uint8
+		for _, z := range sizes {
+			if z > max {
+				max = z
+			}
+		}
+
+		bhist = make([]uint64, int(max)+1)
+		for _, z := range sizes {
+			bhist[z]++
+		}
+	}
+
+	seeds := make([]uint32, m)
+	occ := newBitVector(m)
+
+	var hs, keys []uint64
+	var maxseed uint32
+	var cur uint64
+	var prev runEntry
+
+	tries := 0
+	first := true
+
+	// displace the keys of the current bucket
+	doBucket := func() error {
+		if len(keys) > 255 {
+			return fmt.Errorf("chd: %s: pathological key set; bucket %d is too large", name, cur)
+		}
+
+		s, z, ok := displace(keys, m, salt, _MaxSeed, occ, &hs)
+		tries += z
+		if !ok {
+			return &SeedError{Bucket: cur, Keys: len(keys), MaxSeed: _MaxSeed}
+		}
+
+		seeds[cur] = s
+		if s > maxseed {
+			maxseed = s
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	err = ps.merge(func(e runEntry) error {
+		if !first && e == prev {
+			return fmt.Errorf("chd: %s: duplicate key %x", name, e.key)
+		}
+
+		if !first && e.bkt != cur {
+			if err := doBucket(); err != nil {
+				return err
+			}
+		}
+
+		first = false
+		prev = e
+		cur = e.bkt
+		keys = append(keys, e.key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) > 0 {
+		if err := doBucket(); err != nil {
+			return nil, err
+		}
+	}
+
+	// empty buckets get the same seed as they would in ChdBuilder.Freeze()
+	for i, z := range sizes {
+		if z == 0 {
+			seeds[i] = 1
+		}
+	}
+
+	chd := &Chd{
+		seed:  makeSeeds(seeds, maxseed),
+		salt:  salt,
+		tries: tries,
+		nkeys: n,
+		bhist: bhist,
+	}
+	return chd, nil
+}
+
+// call 'fp' for every key in file 'fn'
+func forEachKey(fn string, fp func(k uint64) error) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	rd := bufio.NewReaderSize(fd, 65536)
+	if strings.HasSuffix(fn, ".txt") {
+		sc := bufio.NewScanner(rd)
+		for line := 1; sc.Scan(); line++ {
+			s := strings.TrimSpace(sc.Text())
+			if len(s) == 0 || s[0] == '#' {
+				continue
+			}
+
+			k, err := strconv.ParseUint(s, 0, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %d: %s", fn, line, err)
+			}
+			if err := fp(k); err != nil {
+				return err
+			}
+		}
+		return sc.Err()
+	}
+
+	var b [8]byte
+	for {
+		_, err := io.ReadFull(rd, b[:])
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		case io.ErrUnexpectedEOF:
+			return fmt.Errorf("%s: partial key at end of file", fn)
+		default:
+			return err
+		}
+
+		if err := fp(binary.LittleEndian.Uint64(b[:])); err != nil {
+			return err
+		}
+	}
+}
+
+// a key and its bucket
+type runEntry struct {
+	bkt uint64
+	key uint64
+}
+
+// partitions holds the sorted runs of keys. Keys are ordered by decreasing
+// bucket size, then by bucket and then by key - so the merge yields all
+// keys of a bucket together, largest buckets first and duplicates adjacent.
+type partitions struct {
+	sizes []uint8
+	m     uint64
+	salt  uint64
+
+	buf  []runEntry
+	runs []*os.File
+}
+
+func (p *partitions) less(a, b runEntry) bool {
+	sa, sb := p.sizes[a.bkt], p.sizes[b.bkt]
+	if sa != sb {
+		return sa > sb
+	}
+	if a.bkt != b.bkt {
+		return a.bkt < b.bkt
+	}
+	return a.key < b.key
+}
+
+func (p *partitions) add(k uint64) error {
+	p.buf = append(p.buf, runEntry{rhash(0, k, p.m, p.salt), k})
+	if len(p.buf) >= freezeRunKeys {
+		return p.flush()
+	}
+	return nil
+}
+
+// sort the buffered keys and write them out as a new run
+func (p *partitions) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	sort.Slice(p.buf, func(i, j int) bool {
+		return p.less(p.buf[i], p.buf[j])
+	})
+
+	fd, err := ioutil.TempFile("", "chdrun")
+	if err != nil {
+		return err
+	}
+	p.runs = append(p.runs, fd)
+
+	var b [8]byte
+	wr := bufio.NewWriterSize(fd, 65536)
+	for _, e := range p.buf {
+		binary.LittleEndian.PutUint64(b[:], e.key)
+		if _, err := writeAll(wr, b[:]); err != nil {
+			return err
+		}
+	}
+	if err := wr.Flush(); err != nil {
+		return err
+	}
+
+	p.buf = p.buf[:0]
+	return nil
+}
+
+// k-way merge of all the runs
+func (p *partitions) merge(fp func(e runEntry) error) error {
+	h := &runHeap{p: p}
+	for _, fd := range p.runs {
+		if _, err := fd.Seek(0, 0); err != nil {
+			return err
+		}
+
+		r := &run{rd: bufio.NewReaderSize(fd, 65536)}
+		ok, err := r.next(p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.r = append(h.r, r)
+		}
+	}
+
+	heap.Init(h)
+	for len(h.r) > 0 {
+		r := h.r[0]
+		if err := fp(r.cur); err != nil {
+			return err
+		}
+
+		ok, err := r.next(p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func (p *partitions) cleanup() {
+	for _, fd := range p.runs {
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+	p.runs = nil
+}
+
+// a sorted run being merged
+type run struct {
+	rd  *bufio.Reader
+	cur runEntry
+}
+
+func (r *run) next(p *partitions) (bool, error) {
+	var b [8]byte
+
+	_, err := io.ReadFull(r.rd, b[:])
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	k := binary.LittleEndian.Uint64(b[:])
+	r.cur = runEntry{rhash(0, k, p.m, p.salt), k}
+	return true, nil
+}
+
+// min-heap of runs for the k-way merge
+type runHeap struct {
+	p *partitions
+	r []*run
+}
+
+func (h *runHeap) Len() int {
+	return len(h.r)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	return h.p.less(h.r[i].cur, h.r[j].cur)
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.r[i], h.r[j] = h.r[j], h.r[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.r = append(h.r, x.(*run))
+}
+
+func (h *runHeap) Pop() interface{} {
+	n := len(h.r)
+	x := h.r[n-1]
+	h.r = h.r[:n-1]
+	return x
+}
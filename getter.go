@@ -0,0 +1,104 @@
+// getter.go -- a read-only, map like interface to the lookup tables
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+// Getter is the read-only lookup interface common to all the lookup tables:
+// Map and MapGetter in this package and DBReader, DBSet (the stacked base
+// and delta DBs), Snapshot and ReaderPool in package chdb. Application code
+// that only needs lookups can depend on Getter and swap implementations -
+// e.g., a MapGetter in unit tests and a DBReader in production.
+type Getter interface {
+	// Lookup returns the value of 'key' and true if the key exists; nil
+	// and false otherwise.
+	Lookup(key uint64) ([]byte, bool)
+}
+
+var (
+	_ Getter = &Map{}
+	_ Getter = MapGetter(nil)
+)
+
+// MapGetter adapts a plain Go map to the Getter interface
+type MapGetter map[uint64][]byte
+
+// Lookup returns the value of 'key' in the map
+func (m MapGetter) Lookup(key uint64) ([]byte, bool) {
+	v, ok := m[key]
+	return v, ok
+}
+
+// Map is an immutable in-memory table of key, value pairs indexed by a CHD
+// minimal perfect hash. Lookups are a hash and a single comparison - with
+// no buckets or probing; it is the in-memory equivalent of a DB.
+type Map struct {
+	chd  *Chd
+	keys []uint64
+	vals [][]byte
+
+	// occupied slots of the table
+	used *bitVector
+	n    int
+}
+
+// NewMap builds a Map of the key, value pairs in 'kv' with the given load
+// factor (see ChdBuilder.Freeze()). The values are not copied.
+func NewMap(kv map[uint64][]byte, load float64) (*Map, error) {
+	b, err := New()
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range kv {
+		if err := b.Add(k); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := b.Freeze(load)
+	if err != nil {
+		return nil, err
+	}
+
+	n := uint64(c.Len())
+	m := &Map{
+		chd:  c,
+		keys: make([]uint64, n),
+		vals: make([][]byte, n),
+		used: newBitVector(n),
+		n:    len(kv),
+	}
+
+	for k, v := range kv {
+		i := c.Find(k)
+		m.keys[i] = k
+		m.vals[i] = v
+		m.used.Set(i)
+	}
+	return m, nil
+}
+
+// Len returns the number of keys in the map
+func (m *Map) Len() int {
+	return m.n
+}
+
+// Lookup returns the value of 'key' and true if it is in the map
+func (m *Map) Lookup(key uint64) ([]byte, bool) {
+	if m.n == 0 {
+		return nil, false
+	}
+
+	i := m.chd.Find(key)
+	if !m.used.IsSet(i) || m.keys[i] != key {
+		return nil, false
+	}
+	return m.vals[i], true
+}
@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/dchest/siphash v1.2.2
+	github.com/klauspost/compress v1.15.1
 	github.com/opencoff/go-fasthash v0.0.0-20180406145558-aed761496075
 	github.com/opencoff/golang-lru v0.6.0
 	github.com/opencoff/pflag v0.5.0
@@ -0,0 +1,101 @@
+// csv.go -- import CSV files into a CHD DBWriter
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"encoding/csv"
+	"io"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// AddCSVFile adds contents from CSV file 'fn'. The key and value are the
+// first two fields of each record unless configured otherwise (see
+// WithFields()); records without these fields are skipped. The delimiter and
+// comment characters are configured with WithComma() and WithComment().
+// gzip and zstd compressed files are decompressed on the fly.
+// Returns a summary of the import.
+func AddCSVFile(w *chdb.DBWriter, fn string, opts ...Option) (*Summary, error) {
+	fd, err := openInput(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	return addCSV(w, fd, fn, defaultOptions(w, opts))
+}
+
+// AddCSVStream adds contents from CSV stream 'rd'. See AddCSVFile().
+// Returns a summary of the import.
+func AddCSVStream(w *chdb.DBWriter, rd io.Reader, opts ...Option) (*Summary, error) {
+	return addCSV(w, rd, "", defaultOptions(w, opts))
+}
+
+func addCSV(w *chdb.DBWriter, rd io.Reader, fn string, o *options) (*Summary, error) {
+	return o.run(w, fn, func(out *sink) error {
+		return o.csvRecords(rd, fn, 0, out)
+	})
+}
+
+// parse CSV stream 'rd' from input 'fn' and send the records tagged
+// with 'src' to 'out'.
+func (o *options) csvRecords(rd io.Reader, fn string, src int, out *sink) error {
+	max := o.nfields()
+
+	cr := csv.NewReader(rd)
+	cr.Comma = o.comma
+	cr.Comment = o.comment
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	for line := 1; ; line++ {
+		v, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// the csv reader can carry on after a malformed record
+			if _, ok := err.(*csv.ParseError); !ok {
+				return err
+			}
+			if err := o.badLine(fn, src, line, err, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(v) < max {
+			if err := o.badLine(fn, src, line, ErrTooFewFields, out); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var val string
+		if !o.keysOnly {
+			val = v[o.valField]
+		}
+
+		r, err := o.record(v[o.keyField], val)
+		if err != nil {
+			if err := o.badLine(fn, src, line, err, out); err != nil {
+				return err
+			}
+			continue
+		}
+		r.src, r.line = src, line
+		if err := out.send(r); err != nil {
+			return err
+		}
+	}
+}
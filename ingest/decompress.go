@@ -0,0 +1,100 @@
+// decompress.go -- transparently decompress input files
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressed stream along with the underlying file
+type inFile struct {
+	io.Reader
+
+	fd *os.File
+	gz *gzip.Reader
+	zd *zstd.Decoder
+}
+
+// openInput opens file 'fn' for reading; gzip and zstd compressed files are
+// detected by their magic bytes and decompressed on the fly.
+func openInput(fn string) (*inFile, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	in := &inFile{fd: fd}
+	br := bufio.NewReaderSize(fd, 65536)
+
+	// a short file can't be compressed; Peek() returns what it can
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		if in.gz, err = gzip.NewReader(br); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		in.Reader = in.gz
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		// the importers already read several files concurrently
+		if in.zd, err = zstd.NewReader(br, zstd.WithDecoderConcurrency(1)); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %s", fn, err)
+		}
+		in.Reader = in.zd
+
+	default:
+		in.Reader = br
+	}
+	return in, nil
+}
+
+// Close releases the input; it returns the decompressor's error (if any).
+func (in *inFile) Close() error {
+	var err error
+
+	if in.gz != nil {
+		err = in.gz.Close()
+	}
+	if in.zd != nil {
+		in.zd.Close()
+	}
+
+	in.fd.Close()
+	return err
+}
+
+// inputType returns the type suffix (".txt", ".csv") of file 'fn' - ignoring
+// any compression suffix.
+func inputType(fn string) string {
+	for _, sfx := range []string{".gz", ".zst", ".zstd"} {
+		if strings.HasSuffix(fn, sfx) {
+			fn = strings.TrimSuffix(fn, sfx)
+			break
+		}
+	}
+	return filepath.Ext(fn)
+}
@@ -0,0 +1,96 @@
+// errors.go -- error handling policy and summary of an import
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"fmt"
+)
+
+// ErrorPolicy decides what happens to input lines that can't be imported
+type ErrorPolicy int
+
+const (
+	// SkipBadLines skips bad lines and duplicate keys, counts them and
+	// continues with the rest of the input. This is the default.
+	SkipBadLines ErrorPolicy = iota
+
+	// FailOnBadLine stops the import of an input at its first bad line or
+	// duplicate key.
+	FailOnBadLine
+)
+
+// max number of errors retained in a Summary
+const MaxErrors = 64
+
+// LineError describes a bad input line
+type LineError struct {
+	// file name (empty for streams)
+	File string
+
+	// line number (the record number for CSV files)
+	Line int
+
+	Err error
+}
+
+func (e *LineError) Error() string {
+	if len(e.File) > 0 {
+		return fmt.Sprintf("%s: %d: %s", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Summary is the outcome of an import
+type Summary struct {
+	// number of records added to the DB
+	Records uint64
+
+	// number of input lines that were skipped because they couldn't be
+	// parsed: too few fields, bad encoding, values that are too large etc.
+	Skipped uint64
+
+	// number of records rejected by the DB writer: duplicate keys
+	Rejected uint64
+
+	// the first MaxErrors skipped or rejected lines
+	Errors []*LineError
+}
+
+// add the counts of 's' to 'z'
+func (z *Summary) merge(s *Summary) {
+	z.Records += s.Records
+	z.Skipped += s.Skipped
+	z.Rejected += s.Rejected
+
+	for _, e := range s.Errors {
+		z.note(e)
+	}
+}
+
+func (z *Summary) note(e *LineError) {
+	if len(z.Errors) < MaxErrors {
+		z.Errors = append(z.Errors, e)
+	}
+}
+
+// WithErrorPolicy sets the handling of bad input lines; the default is
+// SkipBadLines. In either case, every bad line is reported to the handler
+// set by WithSkipHandler() and recorded in the Summary.
+func WithErrorPolicy(p ErrorPolicy) Option {
+	return func(o *options) {
+		o.policy = p
+	}
+}
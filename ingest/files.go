@@ -0,0 +1,171 @@
+// files.go -- concurrent ingestion of many input files into a DBWriter
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// per-input state
+type input struct {
+	fn  string
+	s   Summary
+	err error
+
+	// stops the parsing of just this input
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// AddFiles adds the contents of all the files in 'files' to 'w'. Files with
+// a ".txt" suffix are text files (see AddTextFile()) and those with a ".csv"
+// suffix are CSV files (see AddCSVFile()); the suffix may be followed by a
+// compression suffix (".gz", ".zst"). Up to WithWorkers() files are read and
+// parsed concurrently; a single goroutine feeds the parsed records to the
+// writer through a bounded queue (see WithBuffer()).
+//
+// A file that fails to parse or add doesn't affect the others; records added
+// before the failure are retained. The outcome of each file is reported via
+// WithProgress(). If the writer itself fails (or the context is cancelled),
+// all the files stop being read immediately. AddFiles returns the combined
+// summary of all the files and the error of the first file that failed.
+func AddFiles(w *chdb.DBWriter, files []string, opts ...Option) (*Summary, error) {
+	o := defaultOptions(w, opts)
+
+	ctx, cancel := context.WithCancel(o.ctx)
+	defer cancel()
+
+	ins := make([]input, len(files))
+	ch := make(chan *record, o.buffer)
+	work := make(chan int, len(files))
+
+	for i, fn := range files {
+		in := &ins[i]
+		in.fn = fn
+		in.ctx, in.cancel = context.WithCancel(ctx)
+		work <- i
+	}
+	close(work)
+
+	defer func() {
+		for i := range ins {
+			ins[i].cancel()
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	wg.Add(o.workers)
+	for i := 0; i < o.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				in := &ins[j]
+				if ctx.Err() != nil {
+					return
+				}
+
+				r := &record{src: j, eof: true}
+				r.err = o.readFile(in.fn, j, &sink{in.ctx, ch})
+				select {
+				case ch <- r:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var err, fatal error
+
+	tot := &Summary{}
+
+	// we drain the chan even after a fatal error - so all the parsers exit
+	// before we return.
+	for r := range ch {
+		in := &ins[r.src]
+		switch {
+		case fatal != nil:
+
+		case r.eof:
+			if in.err == nil {
+				in.err = r.err
+			}
+			if in.err != nil && err == nil {
+				err = in.err
+				if _, ok := err.(*LineError); !ok {
+					err = fmt.Errorf("%s: %s", in.fn, err)
+				}
+			}
+
+			tot.merge(&in.s)
+			if o.progress != nil {
+				o.progress(in.fn, &in.s, in.err)
+			}
+
+		case in.err != nil:
+			// drop the rest of a failed input
+
+		default:
+			if in.err = o.consume(w, in.fn, r, &in.s); in.err == nil {
+				continue
+			}
+
+			// stop reading this input; a writer failure stops all of them
+			in.cancel()
+			if _, ok := in.err.(*LineError); !ok {
+				fatal = fmt.Errorf("%s: %s", in.fn, in.err)
+				cancel()
+			}
+		}
+	}
+
+	switch {
+	case fatal != nil:
+		return tot, fatal
+	case o.ctx.Err() != nil:
+		return tot, o.ctx.Err()
+	}
+	return tot, err
+}
+
+// read and parse file 'fn' and send its records tagged with 'src' to 'out'
+func (o *options) readFile(fn string, src int, out *sink) error {
+	typ := inputType(fn)
+	if typ != ".txt" && typ != ".csv" {
+		return fmt.Errorf("don't know how to add %s", fn)
+	}
+
+	fd, err := openInput(fn)
+	if err != nil {
+		return err
+	}
+
+	if typ == ".txt" {
+		err = o.textRecords(fd, fn, src, out)
+	} else {
+		err = o.csvRecords(fd, fn, src, out)
+	}
+
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+// helpers_test.go - helper routines for tests
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+func newAsserter(t *testing.T) func(cond bool, msg string, args ...interface{}) {
+	return func(cond bool, msg string, args ...interface{}) {
+		if cond {
+			return
+		}
+
+		_, file, line, ok := runtime.Caller(1)
+		if !ok {
+			file = "???"
+			line = 0
+		}
+
+		s := fmt.Sprintf(msg, args...)
+		t.Fatalf("%s: %d: Assertion failed: %s\n", file, line, s)
+	}
+}
+
+// return a new DBWriter in a temp dir and a func to freeze it and open the DB
+func tempDB(t *testing.T) (*chdb.DBWriter, func() *chdb.DBReader) {
+	assert := newAsserter(t)
+
+	dir, err := ioutil.TempDir("", "ingest")
+	assert(err == nil, "tempdir: %s", err)
+
+	fn := filepath.Join(dir, "test.db")
+	w, err := chdb.NewDBWriter(fn)
+	assert(err == nil, "can't create db: %s", err)
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return w, func() *chdb.DBReader {
+		err := w.Freeze(0.9)
+		assert(err == nil, "freeze failed: %s", err)
+
+		rd, err := chdb.NewDBReader(fn, 10)
+		assert(err == nil, "can't read db: %s", err)
+		t.Cleanup(rd.Close)
+		return rd
+	}
+}
+
+// write 'data' to file 'nm' in a temp dir and return its name
+func tempFile(t *testing.T, nm string, data []byte) string {
+	dir, err := ioutil.TempDir("", "ingest")
+	if err != nil {
+		t.Fatalf("tempdir: %s", err)
+	}
+
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	fn := filepath.Join(dir, nm)
+	if err := ioutil.WriteFile(fn, data, 0600); err != nil {
+		t.Fatalf("can't write %s: %s", fn, err)
+	}
+	return fn
+}
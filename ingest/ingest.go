@@ -0,0 +1,368 @@
+// ingest.go -- populate a CHD DBWriter from text and CSV files
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+// Package ingest populates a chdb.DBWriter from text and CSV files.
+//
+// Every input line yields a key and a value; the key is hashed to a uint64
+// (see HashFunc) and the value is stored as is. The mapping of input fields
+// to keys and values, the hash function and any massaging of the data are
+// configured with functional options.
+package ingest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dchest/siphash"
+	"github.com/opencoff/go-chd/chdb"
+	"github.com/opencoff/go-fasthash"
+)
+
+// ErrTooFewFields is reported for input lines that don't have the key or
+// value field
+var ErrTooFewFields = errors.New("ingest: too few fields")
+
+// HashFunc maps a key of an input line to the uint64 key stored in the DB.
+// Readers of the DB must use the same function (and salt) to query it.
+type HashFunc func(key []byte) uint64
+
+// DBHash returns the default HashFunc for a DB with the given salt:
+// siphash-2-4 keyed with the 16 byte salt. The importers hash the keys
+// with DBHash(w.Salt()); readers query the DB with DBHash(rd.Salt()).
+// Since the salt is random, the keys of a DB can't be predicted before it
+// is built; so untrusted parties can't craft colliding keys offline.
+func DBHash(salt []byte) HashFunc {
+	var k [16]byte
+
+	copy(k[:], salt)
+	return SipHash(binary.LittleEndian.Uint64(k[:8]), binary.LittleEndian.Uint64(k[8:]))
+}
+
+// FastHash returns a HashFunc using fasthash with the given salt. It is
+// fast but not keyed; anyone can compute the keys of a string.
+func FastHash(salt uint64) HashFunc {
+	return func(key []byte) uint64 {
+		return fasthash.Hash64(salt, key)
+	}
+}
+
+// SipHash returns a HashFunc using siphash-2-4 keyed with 'k0' and 'k1';
+// see DBHash().
+func SipHash(k0, k1 uint64) HashFunc {
+	return func(key []byte) uint64 {
+		return siphash.Hash(k0, k1, key)
+	}
+}
+
+// XXHash returns a HashFunc using XXH64 with the given seed
+func XXHash(seed uint64) HashFunc {
+	return func(key []byte) uint64 {
+		return xxhash64(seed, key)
+	}
+}
+
+// Option configures the importers
+type Option func(o *options)
+
+type options struct {
+	// field# of the key and value in each input line
+	keyField, valField int
+
+	// field delimiters for text files
+	delim string
+
+	// CSV delimiter and comment character
+	comma, comment rune
+
+	lower  bool
+	trim   bool
+	base64 bool
+
+	// ignore the values; see WithKeysOnly()
+	keysOnly bool
+
+	hash HashFunc
+
+	// number of files read concurrently by AddFiles()
+	workers int
+
+	// max number of parsed records buffered ahead of the writer
+	buffer int
+
+	ctx context.Context
+
+	// what to do with bad lines
+	policy ErrorPolicy
+
+	// called for every input line that is skipped
+	skip func(src string, line int, err error)
+
+	// called when AddFiles() is done with a file
+	progress func(fn string, s *Summary, err error)
+}
+
+func defaultOptions(w *chdb.DBWriter, opts []Option) *options {
+	o := &options{
+		keyField: 0,
+		valField: 1,
+		delim:    " \t",
+		comma:    ',',
+		comment:  '#',
+		hash:     DBHash(w.Salt()),
+		workers:  1,
+		buffer:   256,
+		ctx:      context.Background(),
+	}
+
+	for _, fp := range opts {
+		fp(o)
+	}
+	return o
+}
+
+// WithFields uses field# 'key' and 'val' of each input line as the key and
+// value respectively; the default is 0 and 1. For text files, when neither
+// is set, the value is the rest of the line after the key.
+func WithFields(key, val int) Option {
+	return func(o *options) {
+		if key >= 0 && val >= 0 && key != val {
+			o.keyField, o.valField = key, val
+		}
+	}
+}
+
+// WithHash hashes the keys with 'h' instead of the default DBHash() of the
+// writer's salt
+func WithHash(h HashFunc) Option {
+	return func(o *options) {
+		if h != nil {
+			o.hash = h
+		}
+	}
+}
+
+// WithDelim splits the lines of text files on any of the characters in
+// 'delim'; the default is space and tab.
+func WithDelim(delim string) Option {
+	return func(o *options) {
+		if len(delim) > 0 {
+			o.delim = delim
+		}
+	}
+}
+
+// WithComma uses 'comma' as the field delimiter of CSV files (default ',')
+func WithComma(comma rune) Option {
+	return func(o *options) {
+		if comma != 0 {
+			o.comma = comma
+		}
+	}
+}
+
+// WithComment discards lines of CSV files that begin with 'comment'
+// (default '#'); a zero rune disables comments.
+func WithComment(comment rune) Option {
+	return func(o *options) {
+		o.comment = comment
+	}
+}
+
+// WithLower lower cases the keys before hashing them
+func WithLower() Option {
+	return func(o *options) {
+		o.lower = true
+	}
+}
+
+// WithTrim trims white space around keys and values
+func WithTrim() Option {
+	return func(o *options) {
+		o.trim = true
+	}
+}
+
+// WithBase64Values decodes base64 encoded values; lines with invalid base64
+// values are skipped.
+func WithBase64Values() Option {
+	return func(o *options) {
+		o.base64 = true
+	}
+}
+
+// WithKeysOnly treats the input as a list of keys: the value fields are
+// ignored and every key is added without a value; so the writer builds a
+// compact keys-only DB. Unless a key field is set with WithFields(), each
+// line of a text file is a key.
+func WithKeysOnly() Option {
+	return func(o *options) {
+		o.keysOnly = true
+	}
+}
+
+// WithWorkers makes AddFiles() read upto 'n' files concurrently
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// WithBuffer bounds the number of parsed records that are queued for the
+// writer to 'n' (default 256). Parsers block when the writer falls behind;
+// so memory use is bounded regardless of the size of the input.
+func WithBuffer(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.buffer = n
+		}
+	}
+}
+
+// WithContext makes the import stop - and return ctx.Err() - when 'ctx' is
+// cancelled.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		if ctx != nil {
+			o.ctx = ctx
+		}
+	}
+}
+
+// WithSkipHandler calls 'fp' for every bad input line: lines with too few
+// fields, values that are too large or can't be decoded and duplicate keys.
+// 'src' is the file name (empty for streams) and 'line' is the line number
+// (the record number for CSV files).
+func WithSkipHandler(fp func(src string, line int, err error)) Option {
+	return func(o *options) {
+		o.skip = fp
+	}
+}
+
+// WithProgress makes AddFiles() call 'fp' as soon as it is done with a file;
+// 's' summarizes the import of file 'fn' and 'err' is the error that stopped
+// its processing (if any).
+func WithProgress(fp func(fn string, s *Summary, err error)) Option {
+	return func(o *options) {
+		o.progress = fp
+	}
+}
+
+// a parsed record
+type record struct {
+	key uint64
+	val []byte
+
+	// index and line# of the input this record came from
+	src  int
+	line int
+
+	// a bad line that couldn't be parsed
+	bad *LineError
+
+	// marks the end of input 'src'; err is its read error if any
+	eof bool
+	err error
+}
+
+// true if the key and value aren't the first two fields
+func (o *options) hasFields() bool {
+	return o.keyField != 0 || o.valField != 1
+}
+
+// number of fields needed in an input line
+func (o *options) nfields() int {
+	if o.keysOnly {
+		return o.keyField + 1
+	}
+	if o.keyField > o.valField {
+		return o.keyField + 1
+	}
+	return o.valField + 1
+}
+
+// make a record out of 'key' and 'val'
+func (o *options) record(key, val string) (*record, error) {
+	if o.trim {
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+	}
+
+	if o.lower {
+		key = strings.ToLower(key)
+	}
+
+	if o.keysOnly {
+		return &record{key: o.hash([]byte(key))}, nil
+	}
+
+	v := []byte(val)
+	if o.base64 {
+		var err error
+		if v, err = base64.StdEncoding.DecodeString(val); err != nil {
+			return nil, fmt.Errorf("ingest: key %s: invalid base64 value: %s", key, err)
+		}
+	}
+
+	if uint64(len(v)) > uint64(1<<32)-1 {
+		return nil, chdb.ErrValueTooLarge
+	}
+
+	return &record{key: o.hash([]byte(key)), val: v}, nil
+}
+
+// report bad line 'line' of input 'fn' (index 'src') to the consumer. It
+// returns a non-nil error if the input must stop.
+func (o *options) badLine(fn string, src, line int, err error, out *sink) error {
+	e := &LineError{File: fn, Line: line, Err: err}
+	if err := out.send(&record{src: src, line: line, bad: e}); err != nil {
+		return err
+	}
+	if o.policy == FailOnBadLine {
+		return e
+	}
+	return nil
+}
+
+// add record 'r' of input 'fn' to the writer and account for it in 's'.
+// It returns a non-nil error if the input must stop.
+func (o *options) consume(w *chdb.DBWriter, fn string, r *record, s *Summary) error {
+	e := r.bad
+	if e == nil {
+		err := w.Add(r.key, r.val)
+		if err == nil {
+			s.Records++
+			return nil
+		}
+
+		if err != chdb.ErrExists {
+			return err
+		}
+
+		s.Rejected++
+		e = &LineError{File: fn, Line: r.line, Err: err}
+	} else {
+		s.Skipped++
+	}
+
+	s.note(e)
+	if o.skip != nil {
+		o.skip(e.File, e.Line, e.Err)
+	}
+	if o.policy == FailOnBadLine {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+// ingest_test.go -- test suite for the importers
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencoff/go-chd/chdb"
+)
+
+func TestText(t *testing.T) {
+	assert := newAsserter(t)
+
+	w, open := tempDB(t)
+
+	txt := `# comment
+apple  red
+banana	yellow
+
+cherry dark red
+`
+	s, err := AddTextStream(w, strings.NewReader(txt), WithTrim())
+	assert(err == nil, "add failed: %s", err)
+	assert(s.Records == 3, "exp 3 records, saw %d", s.Records)
+
+	rd := open()
+	h := DBHash(rd.Salt())
+	for k, v := range map[string]string{"apple": "red", "banana": "yellow", "cherry": "dark red"} {
+		val, err := rd.Find(h([]byte(k)))
+		assert(err == nil, "%s: not found: %s", k, err)
+		assert(string(val) == v, "%s: exp '%s', saw '%s'", k, v, string(val))
+	}
+}
+
+func TestCSV(t *testing.T) {
+	assert := newAsserter(t)
+
+	w, open := tempDB(t)
+
+	csv := `id,name,value
+# comment
+1,Apple,cmVk
+2,Banana,eWVsbG93
+3,Cherry
+4,Date,!!notbase64
+`
+	var skipped []int
+	skip := func(src string, line int, err error) {
+		skipped = append(skipped, line)
+	}
+
+	s, err := AddCSVStream(w, strings.NewReader(csv), WithFields(1, 2), WithLower(),
+		WithBase64Values(), WithHash(SipHash(1, 2)), WithSkipHandler(skip))
+	assert(err == nil, "add failed: %s", err)
+
+	// the header line is a valid record with an invalid base64 value
+	assert(s.Records == 2, "exp 2 records, saw %d", s.Records)
+	assert(s.Skipped == 3, "exp 3 skipped lines, saw %d", s.Skipped)
+	assert(len(skipped) == 3, "exp 3 skipped lines, saw %v", skipped)
+	assert(len(s.Errors) == 3 && s.Errors[1].Line == 4, "wrong errors %v", s.Errors)
+
+	rd := open()
+	h := SipHash(1, 2)
+	for k, v := range map[string]string{"apple": "red", "banana": "yellow"} {
+		val, err := rd.Find(h([]byte(k)))
+		assert(err == nil, "%s: not found: %s", k, err)
+		assert(string(val) == v, "%s: exp '%s', saw '%s'", k, v, string(val))
+	}
+}
+
+func TestKeysOnly(t *testing.T) {
+	assert := newAsserter(t)
+
+	w, open := tempDB(t)
+
+	txt := `# comment
+apple
+banana split
+
+cherry
+`
+	s, err := AddTextStream(w, strings.NewReader(txt), WithKeysOnly())
+	assert(err == nil, "add failed: %s", err)
+	assert(s.Records == 3, "exp 3 records, saw %d", s.Records)
+
+	w2, open2 := tempDB(t)
+
+	csv := `1,Apple,red
+2,Banana
+3
+`
+	s, err = AddCSVStream(w2, strings.NewReader(csv), WithFields(1, 2), WithKeysOnly())
+	assert(err == nil, "add failed: %s", err)
+	assert(s.Records == 2, "exp 2 records, saw %d", s.Records)
+	assert(s.Skipped == 1, "exp 1 skipped line, saw %d", s.Skipped)
+
+	for _, x := range []struct {
+		rd   *chdb.DBReader
+		keys []string
+	}{
+		{open(), []string{"apple", "banana split", "cherry"}},
+		{open2(), []string{"Apple", "Banana"}},
+	} {
+		in, err := x.rd.Info()
+		assert(err == nil, "info: %s", err)
+		assert(in.KeysOnly, "not a keys-only DB")
+
+		h := DBHash(x.rd.Salt())
+		for _, k := range x.keys {
+			_, err := x.rd.Find(h([]byte(k)))
+			assert(err == nil, "%s: not found: %s", k, err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	assert := newAsserter(t)
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("c 3\nd 4\n"))
+	zw.Close()
+
+	var zst bytes.Buffer
+	zsw, err := zstd.NewWriter(&zst)
+	assert(err == nil, "can't create zstd writer: %s", err)
+	zsw.Write([]byte("e,5\nf,6\n"))
+	zsw.Close()
+
+	files := []string{
+		tempFile(t, "a.csv", []byte("a,1\nb,2\n")),
+		tempFile(t, "b.txt.gz", gz.Bytes()),
+		tempFile(t, "c.json", []byte("{}")),
+		tempFile(t, "d.csv.zst", zst.Bytes()),
+	}
+
+	w, open := tempDB(t)
+
+	got := make(map[string]uint64)
+	progress := func(fn string, s *Summary, err error) {
+		n := s.Records
+		if err != nil {
+			n = 1000
+		}
+		got[fn] = n
+	}
+
+	s, err := AddFiles(w, files, WithWorkers(2), WithTrim(), WithProgress(progress))
+	assert(err != nil, "unknown file type accepted")
+	assert(s.Records == 6, "exp 6 records, saw %d", s.Records)
+	assert(got[files[0]] == 2, "%s: exp 2 records, saw %d", files[0], got[files[0]])
+	assert(got[files[1]] == 2, "%s: exp 2 records, saw %d", files[1], got[files[1]])
+	assert(got[files[2]] == 1000, "%s: exp error", files[2])
+	assert(got[files[3]] == 2, "%s: exp 2 records, saw %d", files[3], got[files[3]])
+
+	rd := open()
+	h := DBHash(rd.Salt())
+	for k, v := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4", "e": "5", "f": "6"} {
+		val, err := rd.Find(h([]byte(k)))
+		assert(err == nil, "%s: not found: %s", k, err)
+		assert(string(val) == v, "%s: exp '%s', saw '%s'", k, v, string(val))
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	assert := newAsserter(t)
+
+	txt := "a 1\nb 2\na 3\nc\"\"d 4\nc 5\n"
+	csv := "a,1\nb,2\na,3\nc\"\"d,4\nc,5\n"
+
+	// a bare quote is a bad CSV record; it's a valid text line
+	tests := []struct {
+		add     func(w *chdb.DBWriter, opts ...Option) (*Summary, error)
+		records uint64
+		skipped uint64
+	}{
+		{
+			func(w *chdb.DBWriter, opts ...Option) (*Summary, error) {
+				return AddTextStream(w, strings.NewReader(txt), opts...)
+			}, 4, 0,
+		},
+		{
+			func(w *chdb.DBWriter, opts ...Option) (*Summary, error) {
+				return AddCSVStream(w, strings.NewReader(csv), opts...)
+			}, 3, 1,
+		},
+	}
+
+	for _, tt := range tests {
+		add := tt.add
+		w, _ := tempDB(t)
+		s, err := add(w)
+		assert(err == nil, "add failed: %s", err)
+		assert(s.Records == tt.records, "exp %d records, saw %d", tt.records, s.Records)
+		assert(s.Skipped == tt.skipped, "exp %d bad lines, saw %d", tt.skipped, s.Skipped)
+		assert(s.Rejected == 1, "exp 1 duplicate, saw %d", s.Rejected)
+		assert(len(s.Errors) >= 1 && s.Errors[0].Line == 3, "wrong errors %v", s.Errors)
+		assert(errors.Is(s.Errors[0], chdb.ErrExists), "exp ErrExists, saw %s", s.Errors[0])
+
+		w, _ = tempDB(t)
+		s, err = add(w, WithErrorPolicy(FailOnBadLine))
+		assert(err != nil, "duplicate accepted")
+		assert(s.Records == 2, "exp 2 records, saw %d", s.Records)
+
+		le, ok := err.(*LineError)
+		assert(ok && le.Line == 3, "exp error at line 3, saw %s", err)
+	}
+}
+
+// endless produces an endless stream of distinct "key value" lines
+type endless struct {
+	n   int
+	buf []byte
+}
+
+func (e *endless) Read(b []byte) (int, error) {
+	for len(e.buf) < len(b) {
+		e.buf = append(e.buf, fmt.Sprintf("key%d %d\n", e.n, e.n)...)
+		e.n++
+	}
+
+	n := copy(b, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func TestShutdown(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a writer failure must stop the parser
+	w, open := tempDB(t)
+	open()
+
+	s, err := AddTextStream(w, &endless{}, WithBuffer(4))
+	assert(err == chdb.ErrFrozen, "exp ErrFrozen, saw %v", err)
+	assert(s.Records == 0, "exp 0 records, saw %d", s.Records)
+
+	// and so must cancelling the context
+	w, _ = tempDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &endless{}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	s, err = AddTextStream(w, e, WithContext(ctx))
+	assert(err == context.Canceled, "exp cancellation, saw %v", err)
+	assert(s.Records > 0, "no records added")
+
+	// a writer failure stops all the files
+	fn := tempFile(t, "a.txt", []byte("a 1\nb 2\n"))
+	w, open = tempDB(t)
+	open()
+
+	_, err = AddFiles(w, []string{fn, fn, fn}, WithWorkers(2), WithBuffer(1))
+	assert(err != nil && strings.Contains(err.Error(), chdb.ErrFrozen.Error()), "exp ErrFrozen, saw %v", err)
+}
+
+func TestDBHash(t *testing.T) {
+	assert := newAsserter(t)
+
+	txt := "apple red\nbanana yellow\n"
+
+	w1, open1 := tempDB(t)
+	w2, open2 := tempDB(t)
+	for _, w := range []*chdb.DBWriter{w1, w2} {
+		_, err := AddTextStream(w, strings.NewReader(txt), WithTrim())
+		assert(err == nil, "add failed: %s", err)
+	}
+
+	// the same key hashes differently in DBs with different salts
+	rd1, rd2 := open1(), open2()
+	h1, h2 := DBHash(rd1.Salt()), DBHash(rd2.Salt())
+	assert(h1([]byte("apple")) != h2([]byte("apple")), "salt doesn't key the hash")
+
+	_, err := rd1.Find(FastHash(0)([]byte("apple")))
+	assert(err == chdb.ErrNoKey, "unsalted key found: %v", err)
+
+	// a converted DB keeps the salt of the original
+	fn := rd1.Name() + ".new"
+	err = chdb.Convert(rd1.Name(), fn)
+	assert(err == nil, "convert failed: %s", err)
+
+	rd3, err := chdb.NewDBReader(fn, 10)
+	assert(err == nil, "can't read db: %s", err)
+	defer rd3.Close()
+
+	for _, rd := range []*chdb.DBReader{rd1, rd2, rd3} {
+		h := DBHash(rd.Salt())
+		for k, v := range map[string]string{"apple": "red", "banana": "yellow"} {
+			val, err := rd.Find(h([]byte(k)))
+			assert(err == nil, "%s: %s: not found: %s", rd.Name(), k, err)
+			assert(string(val) == v, "%s: exp '%s', saw '%s'", k, v, string(val))
+		}
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		in  string
+		exp uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+
+	for _, tt := range tests {
+		h := xxhash64(0, []byte(tt.in))
+		assert(h == tt.exp, "'%s': exp %#x, saw %#x", tt.in, tt.exp, h)
+	}
+}
@@ -0,0 +1,84 @@
+// pipe.go -- bounded pipeline between the input parsers and the DB writer
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"context"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// sink is the producer end of the pipeline: records sent to a sink block
+// when the consumer falls behind and fail once the import is cancelled.
+type sink struct {
+	ctx context.Context
+	ch  chan<- *record
+}
+
+// send 'r' to the consumer
+func (k *sink) send(r *record) error {
+	select {
+	case k.ch <- r:
+		return nil
+	case <-k.ctx.Done():
+		return k.ctx.Err()
+	}
+}
+
+// run parses a single input 'fn' with 'produce' in a separate goroutine
+// and adds its records to the writer. A writer failure (or a bad line with
+// FailOnBadLine) cancels the parser; run returns only after the parser has
+// stopped.
+func (o *options) run(w *chdb.DBWriter, fn string, produce func(out *sink) error) (*Summary, error) {
+	ctx, cancel := context.WithCancel(o.ctx)
+	defer cancel()
+
+	ch := make(chan *record, o.buffer)
+	done := make(chan error, 1)
+
+	// do I/O asynchronously
+	go func() {
+		done <- produce(&sink{ctx, ch})
+		close(ch)
+	}()
+
+	s, err := o.addFromChan(ctx, w, fn, ch)
+
+	// stop the producer and wait for it to finish
+	cancel()
+	for range ch {
+	}
+
+	rerr := <-done
+	if err == nil && rerr != context.Canceled {
+		err = rerr
+	}
+	return s, err
+}
+
+// read records of input 'fn' from the chan and add them to the writer
+func (o *options) addFromChan(ctx context.Context, w *chdb.DBWriter, fn string, ch <-chan *record) (*Summary, error) {
+	s := &Summary{}
+	for {
+		select {
+		case r, ok := <-ch:
+			if !ok {
+				return s, nil
+			}
+			if err := o.consume(w, fn, r, s); err != nil {
+				return s, err
+			}
+
+		case <-ctx.Done():
+			return s, ctx.Err()
+		}
+	}
+}
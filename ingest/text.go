@@ -0,0 +1,105 @@
+// text.go -- import text files into a CHD DBWriter
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package ingest
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/opencoff/go-chd/chdb"
+)
+
+// AddTextFile adds contents from text file 'fn' where key and value are
+// separated by one of the delimiter characters (see WithDelim()). Empty lines
+// and lines beginning with '#' are ignored; a line with just a key has an empty
+// value. gzip and zstd compressed files are decompressed on the fly.
+// This function just opens the file and calls AddTextStream().
+// Returns a summary of the import.
+func AddTextFile(w *chdb.DBWriter, fn string, opts ...Option) (*Summary, error) {
+	fd, err := openInput(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	return addText(w, fd, fn, defaultOptions(w, opts))
+}
+
+// AddTextStream adds contents from text stream 'rd'. See AddTextFile().
+// Returns a summary of the import.
+func AddTextStream(w *chdb.DBWriter, rd io.Reader, opts ...Option) (*Summary, error) {
+	return addText(w, rd, "", defaultOptions(w, opts))
+}
+
+func addText(w *chdb.DBWriter, rd io.Reader, fn string, o *options) (*Summary, error) {
+	return o.run(w, fn, func(out *sink) error {
+		return o.textRecords(rd, fn, 0, out)
+	})
+}
+
+// parse text stream 'rd' from input 'fn' and send the records tagged
+// with 'src' to 'out'.
+func (o *options) textRecords(rd io.Reader, fn string, src int, out *sink) error {
+	var empty string
+
+	sc := bufio.NewScanner(bufio.NewReader(rd))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+
+		var k, v string
+
+		if o.keysOnly && o.keyField == 0 {
+			k = s
+		} else if o.hasFields() {
+			fv := strings.FieldsFunc(s, func(r rune) bool {
+				return strings.ContainsRune(o.delim, r)
+			})
+			if len(fv) < o.nfields() {
+				if err := o.badLine(fn, src, line, ErrTooFewFields, out); err != nil {
+					return err
+				}
+				continue
+			}
+			k = fv[o.keyField]
+			if !o.keysOnly {
+				v = fv[o.valField]
+			}
+		} else {
+			// if we have no delimiters - we treat the value as "boolean"
+			i := strings.IndexAny(s, o.delim)
+			if i > 0 {
+				k = s[:i]
+				v = s[i:]
+			} else {
+				k = s
+				v = empty
+			}
+		}
+
+		r, err := o.record(k, v)
+		if err != nil {
+			if err := o.badLine(fn, src, line, err, out); err != nil {
+				return err
+			}
+			continue
+		}
+		r.src, r.line = src, line
+		if err := out.send(r); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,300 @@
+// multilevel.go -- two level CHD tables for very large key sets
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// A multi-level table splits the keys into shards with a top level hash
+// (the router) and builds an independent CHD table for each shard. The slots
+// of the shards are laid end to end - so the table is still a minimal
+// perfect hash over [0, Len()). Small shards fit in the CPU caches during
+// construction, can be built in parallel and rarely need large seeds.
+//
+// Marshaled multi-level tables use version 3 of the binary format - all
+// multibyte ints are little-endian:
+//   - 16 byte header:
+//      * version  byte    3
+//      * resv     byte
+//      * nkeys    [6]byte 48-bit number of keys (0 if unknown)
+//      * salt     uint64
+//   - nshards uint64
+//   - nshards pairs of uint64: offset and length of each shard; the
+//     offset is relative to the start of the header and a multiple of 8
+//   - the shards: each a marshaled single level table (version 1 or 2)
+//     followed by zero padding to the next multiple of 8 bytes
+
+// seed of the router; SetMaxSeed() keeps displacement seeds below it
+const _RouteSeed uint32 = 0xffffffff
+
+// DefaultShardSize is a good number of keys per shard for SetShardSize()
+const DefaultShardSize = 1 << 20
+
+// SetShardSize makes Freeze() build a multi-level table when there are more
+// than 'n' keys: the keys are split into shards of about 'n' keys each and
+// every shard is built independently (and in parallel). This bounds the
+// construction time and the seed sizes of very large key sets. 0 (the
+// default) always builds a single level table.
+func (c *ChdBuilder) SetShardSize(n int) error {
+	if n < 0 {
+		return fmt.Errorf("chd: invalid shard size %d", n)
+	}
+	c.shardsz = uint64(n)
+	return nil
+}
+
+// return the shard of key 'k' in a table of 'n' shards
+func route(k, n, salt uint64) uint64 {
+	return rhash(_RouteSeed, k, n, salt)
+}
+
+// build a multi-level table of all the keys in the builder
+func (c *ChdBuilder) freezeShards(load float64) (*Chd, error) {
+	n := uint64(len(c.data))
+	ns := nextpow2((n + c.shardsz - 1) / c.shardsz)
+
+	keys := make([][]uint64, ns)
+	for key := range c.data {
+		i := route(key, ns, c.salt)
+		keys[i] = append(keys[i], key)
+	}
+
+	shards := make([]*Chd, ns)
+	errs := make([]error, ns)
+
+	workers := runtime.GOMAXPROCS(0)
+	if uint64(workers) > ns {
+		workers = int(ns)
+	}
+
+	var wg sync.WaitGroup
+
+	ch := make(chan uint64, ns)
+	for i := uint64(0); i < ns; i++ {
+		ch <- i
+	}
+	close(ch)
+
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			var a freezeArena
+
+			defer wg.Done()
+			for i := range ch {
+				ks := keys[i]
+				shards[i], errs[i] = c.build(&a, uint64(len(ks)), load, func(fp func(k uint64)) {
+					for _, k := range ks {
+						fp(k)
+					}
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("chd: shard %d: %w", i, err)
+		}
+
+		// every shard needs a slot for the keys routed to it - even
+		// if none of them are in the key set.
+		if shards[i].Len() == 0 {
+			s := &Chd{
+				seed: newSeeder([]uint32{1}, 1),
+				salt: c.salt,
+			}
+			if c.fpbits > 0 {
+				s.fp = newFingerprints(c.fpbits, 1)
+			}
+			shards[i] = s
+		}
+	}
+
+	return newMultiLevel(shards, c.salt, n), nil
+}
+
+// make a multi-level table out of 'shards'
+func newMultiLevel(shards []*Chd, salt, nkeys uint64) *Chd {
+	base := make([]uint64, len(shards)+1)
+	for i, s := range shards {
+		base[i+1] = base[i] + uint64(s.Len())
+	}
+
+	return &Chd{
+		salt:   salt,
+		nkeys:  nkeys,
+		shards: shards,
+		base:   base,
+	}
+}
+
+// Shards returns the number of shards of a multi-level table; 0 for single
+// level tables.
+func (c *Chd) Shards() int {
+	return len(c.shards)
+}
+
+// find the slot of 'k' in a multi-level table
+func (c *Chd) findShard(k uint64) (*Chd, uint64) {
+	i := route(k, uint64(len(c.shards)), c.salt)
+	return c.shards[i], c.base[i]
+}
+
+// combine the stats of the shards into 'st'
+func (c *Chd) shardStats(st *ChdStats) {
+	st.Shards = len(c.shards)
+	st.FingerprintBits = c.FingerprintBits()
+	for _, s := range c.shards {
+		x := s.Stats()
+		if x.SeedSize > st.SeedSize {
+			st.SeedSize = x.SeedSize
+		}
+		if x.MaxSeed > st.MaxSeed {
+			st.MaxSeed = x.MaxSeed
+		}
+
+		st.Slots += x.Slots
+		st.Tries += x.Tries
+		st.SeedHist = addHist(st.SeedHist, x.SeedHist)
+		st.BucketHist = addHist(st.BucketHist, x.BucketHist)
+	}
+
+	st.Keys = c.nkeys
+	if c.nkeys > 0 && st.Slots > 0 {
+		st.Empty = st.Slots - c.nkeys
+		st.Load = float64(c.nkeys) / float64(st.Slots)
+	}
+}
+
+// add histogram 'b' to 'a'
+func addHist(a, b []uint64) []uint64 {
+	for len(a) < len(b) {
+		a = append(a, 0)
+	}
+	for i, v := range b {
+		a[i] += v
+	}
+	return a
+}
+
+// marshal a multi-level table; see the format above
+func (c *Chd) marshalShards(w io.Writer) (int, error) {
+	var bufs [][]byte
+
+	ns := len(c.shards)
+	off := uint64(_ChdHeaderSize + 8 + 16*ns)
+	dir := make([]byte, 8+16*ns)
+
+	le := binary.LittleEndian
+	le.PutUint64(dir, uint64(ns))
+	for i, s := range c.shards {
+		var b sliceWriter
+		if _, err := s.MarshalBinary(&b); err != nil {
+			return 0, err
+		}
+
+		le.PutUint64(dir[8+16*i:], off)
+		le.PutUint64(dir[16+16*i:], uint64(len(b)))
+		off += uint64(len(b))
+
+		// pad to the next 8 byte boundary
+		for off%8 != 0 {
+			b = append(b, 0)
+			off++
+		}
+		bufs = append(bufs, b)
+	}
+
+	var x [_ChdHeaderSize]byte
+
+	x[0] = 3
+	if c.nkeys < (1 << 48) {
+		putUint48(x[2:8], c.nkeys)
+	}
+	le.PutUint64(x[8:], c.salt)
+
+	nw, err := writeAll(w, x[:])
+	if err != nil {
+		return nw, err
+	}
+
+	m, err := writeAll(w, dir)
+	nw += m
+	if err != nil {
+		return nw, err
+	}
+
+	for _, b := range bufs {
+		m, err := writeAll(w, b)
+		nw += m
+		if err != nil {
+			return nw, err
+		}
+	}
+	return nw, nil
+}
+
+// unmarshal a multi-level table from mem-mapped byte slice 'buf'
+func (c *Chd) unmarshalShards(buf []byte) error {
+	le := binary.LittleEndian
+	hdr := buf[:_ChdHeaderSize]
+	nkeys := uint48(hdr[2:8])
+	salt := le.Uint64(hdr[8:])
+
+	rest := buf[_ChdHeaderSize:]
+	if len(rest) < 8 {
+		return fmt.Errorf("chd: multi-level table too small (%d bytes)", len(buf))
+	}
+
+	ns := le.Uint64(rest)
+	if ns == 0 || (ns&(ns-1)) != 0 || uint64(len(rest)-8)/16 < ns {
+		return fmt.Errorf("chd: bad number of shards %d", ns)
+	}
+
+	shards := make([]*Chd, ns)
+	for i := range shards {
+		off := le.Uint64(rest[8+16*i:])
+		sz := le.Uint64(rest[16+16*i:])
+		if off%8 != 0 || off > uint64(len(buf)) || sz > uint64(len(buf))-off {
+			return fmt.Errorf("chd: shard %d: bad extent %d+%d", i, off, sz)
+		}
+
+		s := &Chd{}
+		if err := s.UnmarshalBinaryMmap(buf[off : off+sz]); err != nil {
+			return fmt.Errorf("chd: shard %d: %w", i, err)
+		}
+		if s.shards != nil {
+			return fmt.Errorf("chd: shard %d: nested multi-level table", i)
+		}
+		if s.salt != salt {
+			return fmt.Errorf("chd: shard %d: salt mismatch", i)
+		}
+		shards[i] = s
+	}
+
+	*c = *newMultiLevel(shards, salt, nkeys)
+	return nil
+}
+
+// an io.Writer that appends to a byte slice
+type sliceWriter []byte
+
+func (b *sliceWriter) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
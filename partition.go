@@ -0,0 +1,282 @@
+// partition.go -- distributed builds from pre-bucketed key partitions
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bufio"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A distributed (map-reduce style) build splits the work of hashing and
+// de-duplicating a huge key set across many machines:
+//
+//   - map: every machine hashes its share of the input to uint64 keys and
+//     splits them with PartitionKeys() - using the same salt and number of
+//     partitions everywhere.
+//   - reduce: the keys of partition 'i' from all the machines are brought
+//     together, de-duplicated and written with WritePartition().
+//   - freeze: FreezePartitions() builds the table from all the partition
+//     files.
+//
+// A key always lands in the same partition; and the partitions hold
+// disjoint sets of buckets of the final table (when it has at least as many
+// slots as there are partitions). The salt of the partitions becomes the
+// salt of the table.
+//
+// Partition file format - all multibyte ints are little-endian:
+//   - 32 byte header:
+//      * magic    [4]byte "CHDP"
+//      * version  byte    currently 1
+//      * resv     [3]byte
+//      * salt     uint64
+//      * part     uint32  partition number
+//      * nparts   uint32  total number of partitions
+//      * nkeys    uint64
+//   - nkeys worth of uint64 keys
+//   - 32 bytes of strong checksum (SHA512_256) over the header and keys
+
+const _PartitionHeaderSize = 32
+
+// header of a partition file
+type partHeader struct {
+	salt   uint64
+	part   uint32
+	nparts uint32
+	nkeys  uint64
+}
+
+// PartitionKeys splits 'keys' into 'nparts' partitions by their CHD bucket
+// for the given salt; 'nparts' must be a power of 2. See WritePartition()
+// and FreezePartitions().
+func PartitionKeys(keys []uint64, nparts int, salt uint64) ([][]uint64, error) {
+	if !validParts(nparts) {
+		return nil, fmt.Errorf("chd: number of partitions %d is not a power of 2", nparts)
+	}
+
+	parts := make([][]uint64, nparts)
+	for _, k := range keys {
+		i := rhash(0, k, uint64(nparts), salt)
+		parts[i] = append(parts[i], k)
+	}
+	return parts, nil
+}
+
+func validParts(n int) bool {
+	return n > 0 && uint64(n) <= 1<<31 && (n&(n-1)) == 0
+}
+
+// WritePartition writes 'keys' as partition 'part' of 'nparts' partitions
+// made with 'salt' to 'w'. The keys must be free of duplicates and must all
+// belong to the partition (see PartitionKeys()). It implements the reduce
+// step of a distributed build; FreezePartitions() reads the files.
+func WritePartition(w io.Writer, part, nparts int, salt uint64, keys []uint64) (int64, error) {
+	if !validParts(nparts) {
+		return 0, fmt.Errorf("chd: number of partitions %d is not a power of 2", nparts)
+	}
+	if part < 0 || part >= nparts {
+		return 0, fmt.Errorf("chd: partition %d out of range [0, %d)", part, nparts)
+	}
+
+	var hdr [_PartitionHeaderSize]byte
+
+	le := binary.LittleEndian
+	copy(hdr[:4], []byte{'C', 'H', 'D', 'P'})
+	hdr[4] = 1
+	le.PutUint64(hdr[8:], salt)
+	le.PutUint32(hdr[16:], uint32(part))
+	le.PutUint32(hdr[20:], uint32(nparts))
+	le.PutUint64(hdr[24:], uint64(len(keys)))
+
+	h := sha512.New512_256()
+	bw := bufio.NewWriterSize(w, 65536)
+	tee := io.MultiWriter(bw, h)
+
+	n, err := writeAll(tee, hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+
+	nw := int64(n)
+
+	var b [8]byte
+	for _, k := range keys {
+		if i := rhash(0, k, uint64(nparts), salt); i != uint64(part) {
+			return nw, fmt.Errorf("chd: key %x belongs to partition %d, not %d", k, i, part)
+		}
+
+		le.PutUint64(b[:], k)
+		if n, err = writeAll(tee, b[:]); err != nil {
+			return nw + int64(n), err
+		}
+		nw += int64(n)
+	}
+
+	if n, err = writeAll(bw, h.Sum(nil)); err != nil {
+		return nw + int64(n), err
+	}
+	nw += int64(n)
+
+	return nw, bw.Flush()
+}
+
+// FreezePartitions builds a constant-time lookup table using the given load
+// factor (see ChdBuilder.Freeze()) from the partition files 'files' written
+// by WritePartition(). Every partition must be present exactly once and all
+// of them must use the same salt. Like FreezeFromFile(), the keys are never
+// held in memory at once; duplicate keys are an error.
+func FreezePartitions(files []string, load float64) (*Chd, error) {
+	if load <= 0 || load > 1 {
+		return nil, fmt.Errorf("chd: invalid load factor %f", load)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("chd: no partitions")
+	}
+
+	hdrs := make([]partHeader, len(files))
+	seen := make(map[uint32]string)
+
+	var n uint64
+	for i, fn := range files {
+		h, err := readPartHeader(fn)
+		if err != nil {
+			return nil, err
+		}
+
+		h0 := &hdrs[0]
+		if i > 0 && (h.salt != h0.salt || h.nparts != h0.nparts) {
+			return nil, fmt.Errorf("chd: %s: partition of a different build than %s", fn, files[0])
+		}
+		if x, ok := seen[h.part]; ok {
+			return nil, fmt.Errorf("chd: %s: duplicate partition %d (also in %s)", fn, h.part, x)
+		}
+
+		seen[h.part] = fn
+		hdrs[i] = h
+		n += h.nkeys
+	}
+
+	if np := hdrs[0].nparts; uint64(len(files)) != uint64(np) {
+		return nil, fmt.Errorf("chd: exp %d partitions, saw %d", np, len(files))
+	}
+
+	each := func(fp func(k uint64) error) error {
+		for i, fn := range files {
+			if err := forEachPartKey(fn, &hdrs[i], fp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return freezeKeys("partitions", n, load, hdrs[0].salt, each)
+}
+
+// read and validate the header of partition file 'fn'
+func readPartHeader(fn string) (partHeader, error) {
+	var h partHeader
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return h, err
+	}
+
+	defer fd.Close()
+
+	var hdr [_PartitionHeaderSize]byte
+	if _, err := io.ReadFull(fd, hdr[:]); err != nil {
+		return h, fmt.Errorf("chd: %s: can't read partition header: %w", fn, err)
+	}
+	return decodePartHeader(fn, hdr[:])
+}
+
+func decodePartHeader(fn string, hdr []byte) (partHeader, error) {
+	var h partHeader
+
+	if string(hdr[:4]) != "CHDP" {
+		return h, fmt.Errorf("chd: %s: bad partition magic", fn)
+	}
+	if hdr[4] != 1 {
+		return h, fmt.Errorf("chd: %s: no support to read partition version %d", fn, hdr[4])
+	}
+
+	le := binary.LittleEndian
+	h.salt = le.Uint64(hdr[8:])
+	h.part = le.Uint32(hdr[16:])
+	h.nparts = le.Uint32(hdr[20:])
+	h.nkeys = le.Uint64(hdr[24:])
+
+	if !validParts(int(h.nparts)) || h.part >= h.nparts {
+		return h, fmt.Errorf("chd: %s: bad partition %d of %d", fn, h.part, h.nparts)
+	}
+	return h, nil
+}
+
+// call 'fp' for every key of partition file 'fn' with header 'h'; the keys
+// must belong to the partition and the checksum must match.
+func forEachPartKey(fn string, h *partHeader, fp func(k uint64) error) error {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+
+	defer fd.Close()
+
+	sh := sha512.New512_256()
+	br := bufio.NewReaderSize(fd, 65536)
+	tee := io.TeeReader(br, sh)
+
+	var hdr [_PartitionHeaderSize]byte
+	if _, err := io.ReadFull(tee, hdr[:]); err != nil {
+		return fmt.Errorf("chd: %s: can't read partition header: %w", fn, err)
+	}
+
+	// the file may have changed since we first read the header
+	if x, err := decodePartHeader(fn, hdr[:]); err != nil {
+		return err
+	} else if x != *h {
+		return fmt.Errorf("chd: %s: partition header changed", fn)
+	}
+
+	var b [8]byte
+	for i := uint64(0); i < h.nkeys; i++ {
+		if _, err := io.ReadFull(tee, b[:]); err != nil {
+			return fmt.Errorf("chd: %s: can't read partition key %d: %w", fn, i, err)
+		}
+
+		k := binary.LittleEndian.Uint64(b[:])
+		if j := rhash(0, k, uint64(h.nparts), h.salt); j != uint64(h.part) {
+			return fmt.Errorf("chd: %s: key %x belongs to partition %d", fn, k, j)
+		}
+		if err := fp(k); err != nil {
+			return err
+		}
+	}
+
+	var exp [32]byte
+	if _, err := io.ReadFull(br, exp[:]); err != nil {
+		return fmt.Errorf("chd: %s: can't read partition checksum: %w", fn, err)
+	}
+
+	csum := sh.Sum(nil)
+	if subtle.ConstantTimeCompare(csum, exp[:]) != 1 {
+		return fmt.Errorf("chd: %s: partition checksum failure; exp %#x, saw %#x", fn, exp[:], csum)
+	}
+
+	if _, err := br.ReadByte(); err != io.EOF {
+		return fmt.Errorf("chd: %s: trailing data after partition checksum", fn)
+	}
+	return nil
+}
@@ -16,27 +16,6 @@ import (
 	"io"
 )
 
-func randbytes(n int) []byte {
-	b := make([]byte, n)
-
-	_, err := io.ReadFull(rand.Reader, b)
-	if err != nil {
-		panic("can't read crypto/rand")
-	}
-	return b
-}
-
-func rand32() uint32 {
-	var b [4]byte
-
-	_, err := io.ReadFull(rand.Reader, b[:])
-	if err != nil {
-		panic("can't read crypto/rand")
-	}
-
-	return binary.BigEndian.Uint32(b[:])
-}
-
 func rand64() uint64 {
 	var b [8]byte
 
@@ -0,0 +1,186 @@
+// rank.go -- rank/select over bitvectors (rank9)
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+// rankSelect answers rank and select queries over a bitvector using the
+// rank9 layout (S. Vigna, "Broadword Implementation of Rank/Select
+// Queries", 2008). The bitvector is divided into blocks of 8 words (512
+// bits); every block has two counter words:
+//
+//   - the number of set bits before the block
+//   - seven 9-bit fields: field k-1 (k = 1..7) is the number of set bits in
+//     words 0..k-1 of the block
+//
+// Rank is a constant number of operations; select is a binary search over
+// the blocks followed by a scan of at most 8 words. The counters take 25%
+// of the size of the bitvector.
+//
+// Serialized layout (all words little-endian):
+//
+//   - bitvector: uint64 word count 'n', followed by 'n' words
+//   - uint64 total number of set bits
+//   - uint64 number of counter words (2 per block)
+//   - the counter words
+type rankSelect struct {
+	bv     *bitVector
+	counts []uint64
+	ones   uint64
+}
+
+// newRankSelect builds the rank/select counters of 'bv'; 'bv' must not be
+// modified afterwards.
+func newRankSelect(bv *bitVector) *rankSelect {
+	words := bv.v
+	nb := (len(words) + 7) / 8
+	counts := make([]uint64, 2*nb)
+
+	var tot uint64
+	for b := 0; b < nb; b++ {
+		counts[2*b] = tot
+
+		var rel, sub uint64
+		for k := 0; k < 8; k++ {
+			if k > 0 {
+				sub |= rel << (9 * uint(k-1))
+			}
+			if w := 8*b + k; w < len(words) {
+				rel += uint64(bits.OnesCount64(words[w]))
+			}
+		}
+		counts[2*b+1] = sub
+		tot += rel
+	}
+
+	return &rankSelect{
+		bv:     bv,
+		counts: counts,
+		ones:   tot,
+	}
+}
+
+// Ones returns the number of set bits
+func (r *rankSelect) Ones() uint64 {
+	return r.ones
+}
+
+// Rank returns the number of set bits before bit 'i' - i.e., in [0, i)
+func (r *rankSelect) Rank(i uint64) uint64 {
+	w := i / 64
+	if w >= uint64(len(r.bv.v)) {
+		return r.ones
+	}
+
+	b, k := w/8, w%8
+	n := r.counts[2*b]
+	if k > 0 {
+		n += (r.counts[2*b+1] >> (9 * (k - 1))) & 0x1ff
+	}
+
+	mask := uint64(1)<<(i%64) - 1
+	return n + uint64(bits.OnesCount64(r.bv.v[w]&mask))
+}
+
+// Select returns the position of the set bit of rank 'k' (i.e., the k+1'th
+// set bit); it returns false if there are 'k' or fewer set bits.
+func (r *rankSelect) Select(k uint64) (uint64, bool) {
+	if k >= r.ones {
+		return 0, false
+	}
+
+	// the last block whose preceding count is <= k
+	nb := len(r.counts) / 2
+	b := sort.Search(nb, func(b int) bool {
+		return r.counts[2*b] > k
+	}) - 1
+
+	k -= r.counts[2*b]
+	sub := r.counts[2*b+1]
+
+	// the last word in the block whose relative count is <= k
+	j := 0
+	for j < 7 && (sub>>(9*uint(j)))&0x1ff <= k {
+		j++
+	}
+	if j > 0 {
+		k -= (sub >> (9 * uint(j-1))) & 0x1ff
+	}
+
+	w := 8*b + j
+	x := r.bv.v[w]
+	for ; k > 0; k-- {
+		x &= x - 1
+	}
+	return uint64(w)*64 + uint64(bits.TrailingZeros64(x)), true
+}
+
+// MarshalBinary writes the bitvector and its counters to 'w' and returns the
+// number of bytes written.
+func (r *rankSelect) MarshalBinary(w io.Writer) (int, error) {
+	n, err := r.bv.MarshalBinary(w)
+	if err != nil {
+		return n, err
+	}
+
+	le := binary.LittleEndian
+	buf := make([]byte, 16+8*len(r.counts))
+	le.PutUint64(buf, r.ones)
+	le.PutUint64(buf[8:], uint64(len(r.counts)))
+	for i, c := range r.counts {
+		le.PutUint64(buf[16+8*i:], c)
+	}
+
+	m, err := writeAll(w, buf)
+	return n + m, err
+}
+
+// UnmarshalBinary restores a rankSelect written by MarshalBinary() from
+// 'buf' and returns the number of bytes consumed.
+func (r *rankSelect) UnmarshalBinary(buf []byte) (int, error) {
+	var bv bitVector
+
+	n, err := bv.UnmarshalBinary(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	buf = buf[n:]
+	if len(buf) < 16 {
+		return 0, fmt.Errorf("rank: buffer too small")
+	}
+
+	le := binary.LittleEndian
+	ones := le.Uint64(buf)
+	nc := le.Uint64(buf[8:])
+	if nc != 2*((uint64(len(bv.v))+7)/8) {
+		return 0, fmt.Errorf("rank: %d counters for %d words", nc, len(bv.v))
+	}
+	if nc > uint64(len(buf)-16)/8 {
+		return 0, fmt.Errorf("rank: buffer too small for %d counters", nc)
+	}
+
+	counts := make([]uint64, nc)
+	for i := range counts {
+		counts[i] = le.Uint64(buf[16+8*i:])
+	}
+
+	r.bv = &bv
+	r.counts = counts
+	r.ones = ones
+	return n + 16 + int(8*nc), nil
+}
@@ -0,0 +1,102 @@
+// rank_test.go -- test suite for rank/select
+//
+// (c) Sudhi Herle 2018
+//
+// Author: Sudhi Herle <sudhi@herle.net>
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package chd
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRankSelect(t *testing.T) {
+	assert := newAsserter(t)
+
+	// sparse, dense and sizes that aren't a multiple of the block size
+	for _, tc := range []struct {
+		size uint64
+		prob float64
+	}{
+		{0, 0.5}, {1, 1}, {100, 0.5}, {4096, 0.01}, {10000, 0.5}, {33333, 0.99},
+	} {
+		bv := newBitVector(tc.size)
+		var pos []uint64
+		for i := uint64(0); i < bv.Size(); i++ {
+			if rand.Float64() < tc.prob {
+				bv.Set(i)
+				pos = append(pos, i)
+			}
+		}
+
+		rs := newRankSelect(bv)
+		assert(rs.Ones() == uint64(len(pos)), "%d: exp %d ones, saw %d", tc.size, len(pos), rs.Ones())
+
+		var n uint64
+		for i := uint64(0); i <= bv.Size(); i++ {
+			r := rs.Rank(i)
+			assert(r == n, "%d: rank(%d): exp %d, saw %d", tc.size, i, n, r)
+			if i < bv.Size() && bv.IsSet(i) {
+				n++
+			}
+		}
+
+		for k, p := range pos {
+			x, ok := rs.Select(uint64(k))
+			assert(ok && x == p, "%d: select(%d): exp %d, saw %d", tc.size, k, p, x)
+		}
+		_, ok := rs.Select(uint64(len(pos)))
+		assert(!ok, "%d: select past the last bit", tc.size)
+
+		var buf bytes.Buffer
+		sz, err := rs.MarshalBinary(&buf)
+		assert(err == nil, "%d: marshal failed: %s", tc.size, err)
+		assert(sz == buf.Len(), "%d: marshal: exp %d bytes, saw %d", tc.size, buf.Len(), sz)
+
+		var r2 rankSelect
+		m, err := r2.UnmarshalBinary(buf.Bytes())
+		assert(err == nil, "%d: unmarshal failed: %s", tc.size, err)
+		assert(m == sz, "%d: unmarshal consumed %d of %d bytes", tc.size, m, sz)
+		for i := uint64(0); i <= bv.Size(); i += 37 {
+			assert(r2.Rank(i) == rs.Rank(i), "%d: rank(%d) mismatch after unmarshal", tc.size, i)
+		}
+
+		_, err = r2.UnmarshalBinary(buf.Bytes()[:sz-1])
+		assert(err != nil, "%d: truncated buffer accepted", tc.size)
+	}
+}
+
+func benchRankSelect(b *testing.B) (*rankSelect, uint64) {
+	bv := newBitVector(1 << 24)
+	for i := uint64(0); i < bv.Size(); i++ {
+		if rand.Intn(2) == 0 {
+			bv.Set(i)
+		}
+	}
+	return newRankSelect(bv), bv.Size()
+}
+
+func BenchmarkRank(b *testing.B) {
+	rs, n := benchRankSelect(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.Rank(uint64(i*7919) % n)
+	}
+}
+
+func BenchmarkSelect(b *testing.B) {
+	rs, _ := benchRankSelect(b)
+	n := rs.Ones()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.Select(uint64(i*7919) % n)
+	}
+}